@@ -4,24 +4,42 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 
+	"simmgate-gateway/internal/async"
+	"simmgate-gateway/internal/audit"
+	"simmgate-gateway/internal/batch"
 	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/grpcserver"
 	"simmgate-gateway/internal/handlers"
+	"simmgate-gateway/internal/health"
 	"simmgate-gateway/internal/httpserver"
 	"simmgate-gateway/internal/llm"
 	"simmgate-gateway/internal/metrics"
+	"simmgate-gateway/internal/middleware"
+	"simmgate-gateway/internal/models"
+	"simmgate-gateway/internal/resume"
+	"simmgate-gateway/internal/tracing"
 	"simmgate-gateway/pkg/logging/logging"
 )
 
+// drainGrace is how long streams cut at the end of the drain period get to
+// write their terminal event before connections are closed.
+const drainGrace = 5 * time.Second
+
 type Config struct {
 	Port         string
 	CacheBackend string // "memory" or "redis"
@@ -29,6 +47,94 @@ type Config struct {
 	RedisAddr    string
 	LLMBaseURL   string
 	LLMAPIKey    string
+
+	// LLMEmulateResponseFormat is set when the upstream lacks native
+	// response_format support.
+	LLMEmulateResponseFormat bool
+	StructuredOutputRetries  int
+
+	LLMProviderName       string
+	ModelsConfigFile      string
+	ModelsRefreshInterval time.Duration
+
+	// Allow/deny lists for unmodeled request fields forwarded upstream.
+	LLMExtraFieldsAllow []string
+	LLMExtraFieldsDeny  []string
+
+	// ResponseStateTTL bounds how long /v1/responses can be continued.
+	ResponseStateTTL time.Duration
+
+	// Batch API limits.
+	BatchWorkers            int
+	BatchDefaultConcurrency int
+	BatchMaxRequests        int
+	BatchMaxBodyBytes       int64
+	BatchRetention          time.Duration
+
+	// Async ("Prefer: respond-async") limits and webhook delivery.
+	AsyncWorkers             int
+	AsyncMaxPending          int
+	AsyncJobTTL              time.Duration
+	AsyncWebhookSecret       string
+	AsyncWebhookMaxAttempts  int
+	AsyncWebhookAllowedHosts []string
+
+	// Request deadlines. Streams are exempt from RequestTimeout and bounded
+	// by the stream limits instead.
+	RequestTimeout         time.Duration
+	StreamFirstByteTimeout time.Duration
+	StreamIdleTimeout      time.Duration
+	StreamMaxDuration      time.Duration
+	// StreamHeartbeat is the keep-alive interval for quiet streams.
+	StreamHeartbeat time.Duration
+
+	// Resumable streams (Last-Event-ID) and how long their events are kept.
+	StreamResume          bool
+	StreamResumeRetention time.Duration
+
+	// Realtime WebSocket endpoint.
+	RealtimeEnabled        bool
+	RealtimeAllowedOrigins []string
+	RealtimeMaxInFlight    int
+
+	// PipelineStages orders the stages every completion goes through.
+	PipelineStages []string
+
+	// gRPC API, served on its own port.
+	GRPCEnabled bool
+	GRPCPort    string
+
+	// OpenTelemetry tracing. TracesExporter is "otlp", "stdout" or "none".
+	TracesExporter    string
+	OTLPEndpoint      string
+	ServiceName       string
+	TracesSampleRatio float64
+
+	// Readiness checks. Optional checks only degrade /readyz when they
+	// fail; the upstream is probed at most once per interval.
+	ReadinessOptionalChecks   []string
+	ReadinessCheckTimeout     time.Duration
+	ReadinessUpstreamInterval time.Duration
+
+	// DrainPeriod is how long in-flight requests and streams get to finish
+	// after SIGTERM; streams still running then end with an error event.
+	DrainPeriod time.Duration
+	// ShutdownDelay is how long /readyz reports draining after SIGTERM
+	// while requests are still served, so load balancers stop routing
+	// before the drain refuses new work.
+	ShutdownDelay time.Duration
+
+	// Audit log. AuditSinks lists "file", "stdout" and "webhook"; empty
+	// disables auditing. AuditBodies is "none", "redacted" or "full".
+	AuditSinks          []string
+	AuditFilePath       string
+	AuditFileMaxBytes   int
+	AuditFileMaxBackups int
+	AuditWebhookURL     string
+	AuditWebhookSecret  string
+	AuditBodies         string
+	AuditBufferSize     int
+	AuditBlockTimeout   time.Duration
 }
 
 func LoadConfig() Config {
@@ -39,6 +145,72 @@ func LoadConfig() Config {
 		RedisAddr:    getenv("REDIS_ADDR", "127.0.0.1:6379"),
 		LLMBaseURL:   getenv("LLM_BASE_URL", "https://api.openai.com"),
 		LLMAPIKey:    os.Getenv("LLM_API_KEY"),
+
+		LLMEmulateResponseFormat: getenvBool("LLM_EMULATE_RESPONSE_FORMAT", false),
+		StructuredOutputRetries:  getenvInt("STRUCTURED_OUTPUT_RETRIES", 1),
+
+		LLMProviderName:  getenv("LLM_PROVIDER_NAME", "openai"),
+		ModelsConfigFile: os.Getenv("MODELS_CONFIG_FILE"),
+
+		ModelsRefreshInterval: getenvDuration("MODELS_REFRESH_INTERVAL", 10*time.Minute),
+
+		LLMExtraFieldsAllow: getenvList("LLM_EXTRA_FIELDS_ALLOW"),
+		LLMExtraFieldsDeny:  getenvList("LLM_EXTRA_FIELDS_DENY"),
+
+		ResponseStateTTL: getenvDuration("RESPONSE_STATE_TTL", 24*time.Hour),
+
+		BatchWorkers:            getenvInt("BATCH_WORKERS", 16),
+		BatchDefaultConcurrency: getenvInt("BATCH_DEFAULT_CONCURRENCY", 4),
+		BatchMaxRequests:        getenvInt("BATCH_MAX_REQUESTS", 50000),
+		BatchMaxBodyBytes:       int64(getenvInt("BATCH_MAX_BODY_BYTES", 200<<20)),
+		BatchRetention:          getenvDuration("BATCH_RETENTION", 7*24*time.Hour),
+
+		AsyncWorkers:             getenvInt("ASYNC_WORKERS", 32),
+		AsyncMaxPending:          getenvInt("ASYNC_MAX_PENDING", 1000),
+		AsyncJobTTL:              getenvDuration("ASYNC_JOB_TTL", 24*time.Hour),
+		AsyncWebhookSecret:       os.Getenv("ASYNC_WEBHOOK_SECRET"),
+		AsyncWebhookMaxAttempts:  getenvInt("ASYNC_WEBHOOK_MAX_ATTEMPTS", 5),
+		AsyncWebhookAllowedHosts: getenvList("ASYNC_WEBHOOK_ALLOWED_HOSTS"),
+
+		RequestTimeout:         getenvDuration("REQUEST_TIMEOUT", 15*time.Second),
+		StreamFirstByteTimeout: getenvDuration("STREAM_FIRST_BYTE_TIMEOUT", 30*time.Second),
+		StreamIdleTimeout:      getenvDuration("STREAM_IDLE_TIMEOUT", 30*time.Second),
+		StreamMaxDuration:      getenvDuration("STREAM_MAX_DURATION", 10*time.Minute),
+		StreamHeartbeat:        getenvDuration("STREAM_HEARTBEAT_INTERVAL", 15*time.Second),
+
+		StreamResume:          getenvBool("STREAM_RESUME", false),
+		StreamResumeRetention: getenvDuration("STREAM_RESUME_RETENTION", 5*time.Minute),
+
+		RealtimeEnabled:        getenvBool("REALTIME_ENABLED", true),
+		RealtimeAllowedOrigins: getenvList("REALTIME_ALLOWED_ORIGINS"),
+		RealtimeMaxInFlight:    getenvInt("REALTIME_MAX_IN_FLIGHT", 16),
+
+		PipelineStages: getenvList("PIPELINE_STAGES"),
+
+		GRPCEnabled: getenvBool("GRPC_ENABLED", true),
+		GRPCPort:    getenv("GRPC_PORT", "9090"),
+
+		TracesExporter:    getenv("OTEL_TRACES_EXPORTER", "none"),
+		OTLPEndpoint:      os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		ServiceName:       getenv("OTEL_SERVICE_NAME", "simmgate-gateway"),
+		TracesSampleRatio: getenvFloat("TRACES_SAMPLE_RATIO", 1),
+
+		ReadinessOptionalChecks:   getenvListOr("READINESS_OPTIONAL_CHECKS", []string{"redis"}),
+		ReadinessCheckTimeout:     getenvDuration("READINESS_CHECK_TIMEOUT", 2*time.Second),
+		ReadinessUpstreamInterval: getenvDuration("READINESS_UPSTREAM_INTERVAL", 30*time.Second),
+
+		DrainPeriod:   getenvDuration("DRAIN_PERIOD", 20*time.Second),
+		ShutdownDelay: getenvDuration("SHUTDOWN_DELAY", 5*time.Second),
+
+		AuditSinks:          getenvList("AUDIT_SINKS"),
+		AuditFilePath:       getenv("AUDIT_FILE_PATH", "audit.ndjson"),
+		AuditFileMaxBytes:   getenvInt("AUDIT_FILE_MAX_BYTES", 100*1024*1024),
+		AuditFileMaxBackups: getenvInt("AUDIT_FILE_MAX_BACKUPS", 5),
+		AuditWebhookURL:     os.Getenv("AUDIT_WEBHOOK_URL"),
+		AuditWebhookSecret:  os.Getenv("AUDIT_WEBHOOK_SECRET"),
+		AuditBodies:         getenv("AUDIT_BODIES", audit.BodiesNone),
+		AuditBufferSize:     getenvInt("AUDIT_BUFFER_SIZE", 1024),
+		AuditBlockTimeout:   getenvDuration("AUDIT_BLOCK_TIMEOUT", 0),
 	}
 }
 
@@ -67,6 +239,25 @@ func run() error {
 		zap.String("llm_base_url", cfg.LLMBaseURL),
 	)
 
+	// ----- Tracing -----
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.TracesExporter,
+		Endpoint:    cfg.OTLPEndpoint,
+		ServiceName: cfg.ServiceName,
+		SampleRatio: cfg.TracesSampleRatio,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Flush buffered spans on the way out.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Warn("tracing shutdown error", zap.Error(err))
+		}
+	}()
+
 	// ----- Redis client (only if needed) -----
 	var redisClient *redis.Client
 	if cfg.CacheBackend == "redis" {
@@ -91,6 +282,14 @@ func run() error {
 		Prefix:  "simmgate",
 	}
 	exactCache := cache.NewExactCache(cacheCfg, redisClient)
+
+	// ----- Readiness checks -----
+	readiness := health.NewReadiness()
+	readiness.Timeout = cfg.ReadinessCheckTimeout
+	if pinger, ok := exactCache.(interface{ Ping(context.Context) error }); ok {
+		readiness.Register(health.Check{Name: "redis", Run: pinger.Ping})
+	}
+
 	exactCache = cache.NewLoggingExactCache(exactCache)
 
 	// ----- LLM client -----
@@ -98,9 +297,17 @@ func run() error {
 		return fmt.Errorf("LLM_API_KEY is required")
 	}
 
+	// The registry lists models through the client, so the client labels
+	// metrics through a registry built further down.
+	var modelRegistry *models.Registry
 	llmClient, err := llm.NewClient(llm.Config{
-		BaseURL: cfg.LLMBaseURL,
-		APIKey:  cfg.LLMAPIKey,
+		BaseURL:               cfg.LLMBaseURL,
+		APIKey:                cfg.LLMAPIKey,
+		ProviderName:          cfg.LLMProviderName,
+		EmulateResponseFormat: cfg.LLMEmulateResponseFormat,
+		ExtraFieldsAllow:      cfg.LLMExtraFieldsAllow,
+		ExtraFieldsDeny:       cfg.LLMExtraFieldsDeny,
+		ModelLabel:            func(model string) string { return modelRegistry.MetricLabel(model) },
 	}, logger)
 	if err != nil {
 		return err
@@ -109,17 +316,151 @@ func run() error {
 		defer closer.Close()
 	}
 
+	if pinger, ok := llmClient.(llm.Pinger); ok {
+		readiness.Register(health.Check{
+			Name: "upstream",
+			Run:  health.Cached(pinger.Ping, cfg.ReadinessUpstreamInterval, cfg.ReadinessCheckTimeout),
+		})
+	}
+	readiness.SetOptional(cfg.ReadinessOptionalChecks)
+
+	// ----- Model registry -----
+	modelsCfg, err := models.LoadConfig(cfg.ModelsConfigFile)
+	if err != nil {
+		return err
+	}
+	modelsCfg.RefreshInterval = cfg.ModelsRefreshInterval
+	provider := models.Provider{Name: cfg.LLMProviderName}
+	if lister, ok := llmClient.(llm.ModelLister); ok {
+		provider.Lister = lister
+	}
+	modelRegistry = models.NewRegistry(modelsCfg, []models.Provider{provider}, logger)
+
+	// ----- Audit log -----
+	// Closed after the servers and job managers have stopped, so queued
+	// records are written.
+	auditSinks, err := newAuditSinks(cfg)
+	if err != nil {
+		return err
+	}
+	var auditLog *audit.Log
+	if len(auditSinks) > 0 {
+		auditLog = audit.New(audit.Config{
+			Provider:     cfg.LLMProviderName,
+			Bodies:       cfg.AuditBodies,
+			BufferSize:   cfg.AuditBufferSize,
+			BlockTimeout: cfg.AuditBlockTimeout,
+		}, logger, auditSinks...)
+		defer auditLog.Close()
+	}
+
 	// ----- Handlers -----
+	drain := middleware.NewDrain()
 	chatHandler := handlers.NewChatHandler(
 		exactCache,
 		cacheCfg.TTL,
 		cfg.VersionID,
 		llmClient,
 	)
+	chatHandler.StructuredOutputRetries = cfg.StructuredOutputRetries
+	chatHandler.Models = modelRegistry
+	chatHandler.ResponseStateTTL = cfg.ResponseStateTTL
+	chatHandler.StreamHeartbeat = cfg.StreamHeartbeat
+	chatHandler.Drain = drain
+	chatHandler.Audit = auditLog
+
+	pipelineStages := cfg.PipelineStages
+	if len(pipelineStages) == 0 {
+		pipelineStages = handlers.DefaultStages
+	}
+	// Without the stage the configured sinks would never get a record.
+	if auditLog != nil && !slices.Contains(pipelineStages, handlers.StageAudit) {
+		return fmt.Errorf("AUDIT_SINKS is set but PIPELINE_STAGES has no %s stage", handlers.StageAudit)
+	}
+	chatHandler.Pipeline, err = chatHandler.Stages().Build(pipelineStages)
+	if err != nil {
+		return err
+	}
+
+	if cfg.StreamResume {
+		if redisClient != nil {
+			chatHandler.StreamBuffer = resume.NewRedisStore(redisClient, cacheCfg.Prefix, cfg.StreamResumeRetention)
+		} else {
+			streamBuffer := resume.NewMemoryStore(cfg.StreamResumeRetention)
+			defer streamBuffer.Close()
+			chatHandler.StreamBuffer = streamBuffer
+		}
+	}
+
+	embeddingsHandler := handlers.NewEmbeddingsHandler(
+		exactCache,
+		cacheCfg.TTL,
+		cfg.VersionID,
+		llmClient,
+	)
+	embeddingsHandler.Models = modelRegistry
+
+	modelsHandler := handlers.NewModelsHandler(modelRegistry)
+
+	// ----- Batches -----
+	var batchStore batch.Store
+	if redisClient != nil {
+		batchStore = batch.NewRedisStore(redisClient, cacheCfg.Prefix, cfg.BatchRetention)
+	} else {
+		memoryBatches := batch.NewMemoryStore(cfg.BatchRetention)
+		defer memoryBatches.Close()
+		batchStore = memoryBatches
+	}
+	batchManager := batch.NewManager(batchStore, chatHandler.CompleteJSON, batch.Config{
+		Workers:            cfg.BatchWorkers,
+		DefaultConcurrency: cfg.BatchDefaultConcurrency,
+	}, logger)
+	defer batchManager.Close()
+
+	batchHandler := handlers.NewBatchHandler(batchManager, cfg.BatchMaxRequests, cfg.BatchMaxBodyBytes)
+
+	// ----- Async requests -----
+	asyncManager := async.NewManager(exactCache, async.Config{
+		Workers:             cfg.AsyncWorkers,
+		MaxPending:          cfg.AsyncMaxPending,
+		TTL:                 cfg.AsyncJobTTL,
+		WebhookSecret:       cfg.AsyncWebhookSecret,
+		WebhookMaxAttempts:  cfg.AsyncWebhookMaxAttempts,
+		WebhookAllowedHosts: cfg.AsyncWebhookAllowedHosts,
+	}, logger)
+	defer asyncManager.Close()
+
+	asyncHandler := handlers.NewAsyncHandler(asyncManager)
+
+	timeouts := middleware.Timeouts{
+		Request:         cfg.RequestTimeout,
+		StreamFirstByte: cfg.StreamFirstByteTimeout,
+		StreamIdle:      cfg.StreamIdleTimeout,
+		StreamTotal:     cfg.StreamMaxDuration,
+	}
+
+	// ----- Realtime WebSocket -----
+	var realtimeHandler *handlers.RealtimeHandler
+	if cfg.RealtimeEnabled {
+		realtimeHandler = handlers.NewRealtimeHandler(chatHandler, timeouts)
+		realtimeHandler.OriginPatterns = cfg.RealtimeAllowedOrigins
+		if cfg.RealtimeMaxInFlight > 0 {
+			realtimeHandler.MaxInFlight = cfg.RealtimeMaxInFlight
+		}
+	}
 
 	// ----- Router + middleware -----
 	r := chi.NewRouter()
-	httpserver.SetupRouter(r, logger, chatHandler)
+	httpserver.SetupRouter(r, logger, httpserver.Handlers{
+		Chat:       chatHandler,
+		Embeddings: embeddingsHandler,
+		Models:     modelsHandler,
+		Batches:    batchHandler,
+		Async:      asyncHandler,
+		Realtime:   realtimeHandler,
+		Readiness:  readiness,
+		Drain:      drain,
+	}, timeouts)
 
 	// ----- HTTP server -----
 	srv := &http.Server{
@@ -127,8 +468,11 @@ func run() error {
 		Handler:           r,
 		ReadHeaderTimeout: 5 * time.Second,
 		ReadTimeout:       15 * time.Second,
-		WriteTimeout:      30 * time.Second,
-		IdleTimeout:       60 * time.Second,
+		// Leaves room to write a response that finished just before the
+		// request timeout. Streams move their own write deadline, see
+		// middleware.StartStream.
+		WriteTimeout: cfg.RequestTimeout + 15*time.Second,
+		IdleTimeout:  60 * time.Second,
 	}
 
 	logger.Info("starting gateway",
@@ -144,18 +488,89 @@ func run() error {
 		}
 	}()
 
+	// ----- gRPC server -----
+	var grpcSrv *grpc.Server
+	if cfg.GRPCEnabled {
+		lis, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			return err
+		}
+		grpcSrv = grpcserver.New(logger, handlers.NewGRPCChatService(chatHandler, timeouts))
+
+		logger.Info("starting grpc server", zap.String("addr", lis.Addr().String()))
+		go func() {
+			if err := grpcSrv.Serve(lis); err != nil {
+				logger.Error("grpc server error", zap.Error(err))
+			}
+		}()
+	}
+
 	// ----- Graceful shutdown -----
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
 	<-stop
-	logger.Info("shutdown signal received")
+	requests, streams := drain.InFlight()
+	logger.Info("shutdown signal received",
+		zap.Duration("shutdown_delay", cfg.ShutdownDelay),
+		zap.Duration("drain_period", cfg.DrainPeriod),
+		zap.Int64("in_flight_requests", requests),
+		zap.Int64("in_flight_streams", streams),
+	)
+
+	// Report not ready and keep serving until load balancers have seen it;
+	// a second signal skips the wait.
+	readiness.StartDrain()
+	select {
+	case <-time.After(cfg.ShutdownDelay):
+	case <-stop:
+	}
+
+	// Refuse new work; the servers stop accepting connections and wait for
+	// the ones in flight.
+	drain.Start()
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// shutdownCtx leaves streams cut at the end of the drain period time
+	// to write their terminal event.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainPeriod+drainGrace)
 	defer cancel()
 
-	if err := srv.Shutdown(shutdownCtx); err != nil {
+	httpStopped := make(chan error, 1)
+	go func() {
+		httpStopped <- srv.Shutdown(shutdownCtx)
+	}()
+
+	// GracefulStop waits for open streams; Stop cuts them at the deadline.
+	grpcStopped := make(chan struct{})
+	go func() {
+		if grpcSrv != nil {
+			grpcSrv.GracefulStop()
+		}
+		close(grpcStopped)
+	}()
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.DrainPeriod)
+	defer cancelDrain()
+	if err := drain.Wait(drainCtx); err != nil {
+		requests, streams := drain.InFlight()
+		logger.Warn("drain period expired, ending open streams",
+			zap.Int64("in_flight_requests", requests),
+			zap.Int64("in_flight_streams", streams),
+		)
+		drain.Expire()
+	}
+
+	select {
+	case <-grpcStopped:
+	case <-shutdownCtx.Done():
+		if grpcSrv != nil {
+			grpcSrv.Stop()
+		}
+	}
+
+	if err := <-httpStopped; err != nil {
 		logger.Error("server shutdown error", zap.Error(err))
+		srv.Close()
 		return err
 	}
 
@@ -163,6 +578,37 @@ func run() error {
 	return nil
 }
 
+// newAuditSinks opens the sinks named in cfg.AuditSinks.
+func newAuditSinks(cfg Config) ([]audit.Sink, error) {
+	switch cfg.AuditBodies {
+	case audit.BodiesNone, audit.BodiesRedacted, audit.BodiesFull:
+	default:
+		return nil, fmt.Errorf("invalid AUDIT_BODIES %q", cfg.AuditBodies)
+	}
+
+	var sinks []audit.Sink
+	for _, name := range cfg.AuditSinks {
+		switch name {
+		case "file":
+			s, err := audit.NewFileSink(cfg.AuditFilePath, int64(cfg.AuditFileMaxBytes), cfg.AuditFileMaxBackups)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		case "stdout":
+			sinks = append(sinks, audit.NewWriterSink("stdout", os.Stdout))
+		case "webhook":
+			if cfg.AuditWebhookURL == "" {
+				return nil, fmt.Errorf("AUDIT_WEBHOOK_URL is required for the webhook audit sink")
+			}
+			sinks = append(sinks, audit.NewWebhookSink(cfg.AuditWebhookURL, cfg.AuditWebhookSecret, 10*time.Second))
+		default:
+			return nil, fmt.Errorf("unknown audit sink %q", name)
+		}
+	}
+	return sinks, nil
+}
+
 // getenv returns the value of the environment variable key or def if not set.
 func getenv(key, def string) string {
 	if v := os.Getenv(key); v != "" {
@@ -170,3 +616,56 @@ func getenv(key, def string) string {
 	}
 	return def
 }
+
+// getenvBool parses key as a bool, returning def if unset or invalid.
+func getenvBool(key string, def bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// getenvInt parses key as an int, returning def if unset or invalid.
+func getenvInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// getenvFloat parses key as a float64, returning def if unset or invalid.
+func getenvFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+// getenvDuration parses key as a time.Duration, returning def if unset or
+// invalid.
+func getenvDuration(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// getenvListOr is getenvList with a default for when key is unset; set to
+// an empty value it gives an empty list.
+func getenvListOr(key string, def []string) []string {
+	if _, ok := os.LookupEnv(key); !ok {
+		return def
+	}
+	return getenvList(key)
+}
+
+// getenvList splits a comma-separated variable, dropping empty entries.
+func getenvList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
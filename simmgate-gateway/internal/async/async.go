@@ -0,0 +1,335 @@
+// Package async runs requests in the background for callers that sent
+// "Prefer: respond-async". Job state is kept in the cache store so it can
+// be polled, and the result is POSTed to an optional webhook with an HMAC
+// signature and retries.
+package async
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/cache"
+)
+
+const (
+	StatusQueued     = "queued"
+	StatusInProgress = "in_progress"
+	StatusCompleted  = "completed"
+	StatusFailed     = "failed"
+
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+const (
+	defaultWorkers        = 32
+	defaultMaxPending     = 1000
+	defaultTTL            = 24 * time.Hour
+	defaultMaxAttempts    = 5
+	defaultWebhookBackoff = time.Second
+	defaultWebhookTimeout = 10 * time.Second
+	maxWebhookBackoff     = time.Minute
+)
+
+var (
+	ErrNotFound = errors.New("async: job not found")
+	// ErrBusy is returned by Submit when MaxPending jobs are already queued
+	// or running.
+	ErrBusy = errors.New("async: too many pending jobs")
+	// ErrWebhooksDisabled is returned for a webhook URL when no signing
+	// secret is configured.
+	ErrWebhooksDisabled = errors.New("async: webhooks are not configured")
+)
+
+// Job is the polled and delivered state of one async request.
+// Timestamps are unix seconds.
+type Job struct {
+	ID          string    `json:"id"`
+	Object      string    `json:"object"`
+	Status      string    `json:"status"`
+	UserID      string    `json:"user_id"`
+	CreatedAt   int64     `json:"created_at"`
+	StartedAt   int64     `json:"started_at,omitempty"`
+	CompletedAt int64     `json:"completed_at,omitempty"`
+	Response    *Response `json:"response,omitempty"`
+	Webhook     *Webhook  `json:"webhook,omitempty"`
+}
+
+// Response is what the synchronous endpoint would have answered.
+type Response struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type Webhook struct {
+	URL         string `json:"url"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	DeliveredAt int64  `json:"delivered_at,omitempty"`
+}
+
+// RunFunc does the work of a job and returns an HTTP status and body.
+type RunFunc func(ctx context.Context) (int, []byte)
+
+type Config struct {
+	// Workers caps jobs running at once; MaxPending caps queued plus
+	// running jobs before Submit returns ErrBusy.
+	Workers    int
+	MaxPending int
+	// TTL is how long job state can be polled.
+	TTL time.Duration
+
+	// WebhookSecret signs deliveries; webhooks are refused without it.
+	WebhookSecret      string
+	WebhookMaxAttempts int
+	// WebhookBackoff is the delay before the first retry; it doubles per
+	// attempt up to one minute.
+	WebhookBackoff time.Duration
+	WebhookTimeout time.Duration
+	// WebhookAllowedHosts restricts webhook hosts. When empty, any host is
+	// accepted but only public addresses are connected to, see
+	// ErrWebhookAddressBlocked.
+	WebhookAllowedHosts []string
+
+	HTTPClient *http.Client
+}
+
+// Manager runs jobs and delivers their webhooks.
+type Manager struct {
+	store   cache.ExactCache
+	cfg     Config
+	client  *http.Client
+	workers chan struct{}
+	pending atomic.Int64
+	logger  *zap.Logger
+
+	baseCtx context.Context
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func NewManager(store cache.ExactCache, cfg Config, logger *zap.Logger) *Manager {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = defaultMaxPending
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultTTL
+	}
+	if cfg.WebhookMaxAttempts <= 0 {
+		cfg.WebhookMaxAttempts = defaultMaxAttempts
+	}
+	if cfg.WebhookBackoff <= 0 {
+		cfg.WebhookBackoff = defaultWebhookBackoff
+	}
+	if cfg.WebhookTimeout <= 0 {
+		cfg.WebhookTimeout = defaultWebhookTimeout
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = newWebhookClient(cfg.WebhookTimeout, len(cfg.WebhookAllowedHosts) == 0)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	return &Manager{
+		store:   store,
+		cfg:     cfg,
+		client:  client,
+		workers: make(chan struct{}, cfg.Workers),
+		logger:  logger.Named("async"),
+		baseCtx: ctx,
+		stop:    stop,
+	}
+}
+
+// ValidateWebhookURL checks that raw is an absolute http(s) URL on an
+// allowed host and that webhooks are enabled. Without an allow list, local
+// hosts and non-public IP literals are refused up front; hostnames are
+// checked again on each connection.
+func (m *Manager) ValidateWebhookURL(raw string) error {
+	if m.cfg.WebhookSecret == "" {
+		return ErrWebhooksDisabled
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL must be an absolute http(s) URL")
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(m.cfg.WebhookAllowedHosts) == 0 {
+		if !publicHost(host) {
+			return fmt.Errorf("webhook host %q is not a public address", host)
+		}
+		return nil
+	}
+	for _, allowed := range m.cfg.WebhookAllowedHosts {
+		if host == strings.ToLower(allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhook host %q is not allowed", host)
+}
+
+// Submit stores a queued job for userID and runs it in the background.
+// ctx only supplies values (logger, request ID); the job outlives it and
+// is cancelled only by Close. webhookURL may be empty.
+func (m *Manager) Submit(ctx context.Context, userID, webhookURL string, run RunFunc) (*Job, error) {
+	if webhookURL != "" {
+		if err := m.ValidateWebhookURL(webhookURL); err != nil {
+			return nil, err
+		}
+	}
+	if m.pending.Add(1) > int64(m.cfg.MaxPending) {
+		m.pending.Add(-1)
+		return nil, ErrBusy
+	}
+
+	job := &Job{
+		ID:        newID("async_"),
+		Object:    "async.job",
+		Status:    StatusQueued,
+		UserID:    userID,
+		CreatedAt: time.Now().Unix(),
+	}
+	if webhookURL != "" {
+		job.Webhook = &Webhook{URL: webhookURL, Status: WebhookPending}
+	}
+	if err := m.save(ctx, job); err != nil {
+		m.pending.Add(-1)
+		return nil, err
+	}
+
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stopAfter := context.AfterFunc(m.baseCtx, cancel)
+
+	snapshot := *job
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer m.pending.Add(-1)
+		defer cancel()
+		defer stopAfter()
+		m.process(runCtx, job, run)
+	}()
+
+	return &snapshot, nil
+}
+
+// Get returns userID's job.
+func (m *Manager) Get(ctx context.Context, userID, id string) (*Job, error) {
+	data, hit, err := m.store.Get(ctx, cache.AsyncJobKey(userID, id))
+	if err != nil {
+		return nil, err
+	}
+	if !hit {
+		return nil, ErrNotFound
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("decode async job %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// Close stops pending webhook retries, cancels running jobs and waits for
+// them.
+func (m *Manager) Close() {
+	m.stop()
+	m.wg.Wait()
+}
+
+func (m *Manager) process(ctx context.Context, job *Job, run RunFunc) {
+	select {
+	case m.workers <- struct{}{}:
+	case <-ctx.Done():
+		m.finish(ctx, job, http.StatusServiceUnavailable,
+			[]byte(`{"error":{"message":"gateway shutting down","type":"server_error","param":null,"code":"shutting_down"}}`))
+		return
+	}
+
+	job.Status = StatusInProgress
+	job.StartedAt = time.Now().Unix()
+	m.saveLogged(ctx, job)
+
+	status, body := m.runSafely(ctx, run)
+	<-m.workers
+
+	m.finish(ctx, job, status, body)
+}
+
+// runSafely turns a panic in run into a 500 result.
+func (m *Manager) runSafely(ctx context.Context, run RunFunc) (status int, body []byte) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			m.logger.Error("async_job_panic", zap.Any("panic", rec))
+			status = http.StatusInternalServerError
+			body = []byte(`{"error":{"message":"internal server error","type":"server_error","param":null,"code":"internal_error"}}`)
+		}
+	}()
+	return run(ctx)
+}
+
+func (m *Manager) finish(ctx context.Context, job *Job, status int, body []byte) {
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+
+	job.Status = StatusCompleted
+	if status >= 500 {
+		job.Status = StatusFailed
+	}
+	job.CompletedAt = time.Now().Unix()
+	job.Response = &Response{StatusCode: status, Body: body}
+	m.saveLogged(ctx, job)
+
+	m.logger.Info("async_job_finished",
+		zap.String("job_id", job.ID),
+		zap.String("user_id", job.UserID),
+		zap.String("status", job.Status),
+		zap.Int("status_code", status),
+	)
+
+	if job.Webhook != nil {
+		m.deliver(ctx, job)
+	}
+}
+
+func (m *Manager) save(ctx context.Context, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return m.store.Set(context.WithoutCancel(ctx), cache.AsyncJobKey(job.UserID, job.ID), data, m.cfg.TTL)
+}
+
+func (m *Manager) saveLogged(ctx context.Context, job *Job) {
+	if err := m.save(ctx, job); err != nil {
+		m.logger.Error("async_job_save_error", zap.String("job_id", job.ID), zap.Error(err))
+	}
+}
+
+func newID(prefix string) string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return prefix + hex.EncodeToString([]byte(time.Now().Format("150405.000000")))
+	}
+	return prefix + hex.EncodeToString(b[:])
+}
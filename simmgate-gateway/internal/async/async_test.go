@@ -0,0 +1,202 @@
+package async
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"simmgate-gateway/internal/cache"
+)
+
+func waitForJob(t *testing.T, m *Manager, userID, id string, done func(*Job) bool) *Job {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := m.Get(context.Background(), userID, id)
+		if err != nil {
+			t.Fatalf("get job: %v", err)
+		}
+		if done(job) {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not reach the expected state", id)
+	return nil
+}
+
+func TestWebhookSignedAndRetried(t *testing.T) {
+	const secret = "s3cret"
+
+	var attempts int32
+	received := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		var ts int64
+		var sig string
+		if _, err := fmt.Sscanf(strings.Replace(r.Header.Get(SignatureHeader), ",v1=", " ", 1), "t=%d %s", &ts, &sig); err != nil {
+			t.Errorf("parse signature header %q: %v", r.Header.Get(SignatureHeader), err)
+		}
+		if sig != Sign(secret, ts, body) {
+			t.Errorf("bad signature")
+		}
+
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		received <- body
+	}))
+	defer srv.Close()
+
+	store := cache.NewMemoryExactCache(time.Minute)
+	defer store.Close()
+
+	m := NewManager(store, Config{WebhookSecret: secret, WebhookBackoff: time.Millisecond, WebhookAllowedHosts: []string{"127.0.0.1"}}, nil)
+	defer m.Close()
+
+	job, err := m.Submit(context.Background(), "u1", srv.URL, func(ctx context.Context) (int, []byte) {
+		return http.StatusOK, []byte(`{"ok":true}`)
+	})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	select {
+	case body := <-received:
+		var delivered Job
+		if err := json.Unmarshal(body, &delivered); err != nil {
+			t.Fatalf("decode delivery: %v", err)
+		}
+		if delivered.ID != job.ID || delivered.Response.StatusCode != http.StatusOK || string(delivered.Response.Body) != `{"ok":true}` {
+			t.Fatalf("unexpected delivery: %s", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("webhook was not delivered")
+	}
+
+	final := waitForJob(t, m, "u1", job.ID, func(j *Job) bool { return j.Webhook.Status == WebhookDelivered })
+	if final.Webhook.Attempts != 2 || final.Status != StatusCompleted {
+		t.Fatalf("unexpected final job: %+v %+v", final, final.Webhook)
+	}
+
+	if _, err := m.Get(context.Background(), "u2", job.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected other users not to see the job, got %v", err)
+	}
+}
+
+func TestWebhookPermanentFailure(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer srv.Close()
+
+	store := cache.NewMemoryExactCache(time.Minute)
+	defer store.Close()
+
+	m := NewManager(store, Config{WebhookSecret: "k", WebhookBackoff: time.Millisecond, WebhookAllowedHosts: []string{"127.0.0.1"}}, nil)
+	defer m.Close()
+
+	job, err := m.Submit(context.Background(), "u1", srv.URL, func(ctx context.Context) (int, []byte) {
+		return http.StatusOK, []byte(`{}`)
+	})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	final := waitForJob(t, m, "u1", job.ID, func(j *Job) bool { return j.Webhook.Status == WebhookFailed })
+	if final.Webhook.Attempts != 1 || atomic.LoadInt32(&attempts) != 1 {
+		t.Fatalf("expected no retry on 410, got %d attempts", final.Webhook.Attempts)
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	m := NewManager(cache.NewMemoryExactCache(time.Minute), Config{}, nil)
+	if err := m.ValidateWebhookURL("https://example.com/hook"); !errors.Is(err, ErrWebhooksDisabled) {
+		t.Fatalf("expected webhooks to be disabled without a secret, got %v", err)
+	}
+
+	m = NewManager(cache.NewMemoryExactCache(time.Minute), Config{
+		WebhookSecret:       "k",
+		WebhookAllowedHosts: []string{"hooks.example.com"},
+	}, nil)
+	if err := m.ValidateWebhookURL("https://hooks.example.com/x"); err != nil {
+		t.Fatalf("expected allowed host, got %v", err)
+	}
+	for _, bad := range []string{"https://evil.example.com/x", "ftp://hooks.example.com/x", "/relative"} {
+		if err := m.ValidateWebhookURL(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestValidateWebhookURLWithoutAllowList(t *testing.T) {
+	m := NewManager(cache.NewMemoryExactCache(time.Minute), Config{WebhookSecret: "k"}, nil)
+	if err := m.ValidateWebhookURL("https://hooks.example.com/x"); err != nil {
+		t.Fatalf("expected public host to be accepted, got %v", err)
+	}
+	for _, bad := range []string{
+		"http://localhost:8080/x",
+		"http://api.localhost/x",
+		"http://127.0.0.1/x",
+		"http://[::1]/x",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.7/x",
+		"http://192.168.1.1/x",
+		"http://[::ffff:172.16.0.1]/x",
+		"http://0.0.0.0/x",
+		"http://100.64.0.1/x",
+		"http://198.18.0.1/x",
+		"http://192.0.0.8/x",
+		"http://192.0.2.10/x",
+		"http://198.51.100.10/x",
+		"http://203.0.113.10/x",
+		"http://[2001:db8::1]/x",
+		"http://[::ffff:100.100.100.200]/x",
+	} {
+		if err := m.ValidateWebhookURL(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestWebhookClientBlocksInternalAddresses(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+
+	// The check runs on the resolved address, so a hostname pointing at
+	// loopback is refused like the literal.
+	client := newWebhookClient(time.Second, true)
+	for _, u := range []string{srv.URL, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)} {
+		resp, err := client.Post(u, "application/json", strings.NewReader(`{}`))
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, ErrWebhookAddressBlocked) {
+			t.Fatalf("%s: expected ErrWebhookAddressBlocked, got %v", u, err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Fatalf("blocked client reached the server %d times", n)
+	}
+
+	resp, err := newWebhookClient(time.Second, false).Post(srv.URL, "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("allow-listed client: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,200 @@
+package async
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Webhook request headers. The signature header is
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">", so receivers can
+// reject replays by checking t.
+const (
+	SignatureHeader = "X-SimmGate-Signature"
+	JobIDHeader     = "X-SimmGate-Job-ID"
+	AttemptHeader   = "X-SimmGate-Delivery-Attempt"
+)
+
+// Sign returns the v1 signature of body at timestamp ts.
+func Sign(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrWebhookAddressBlocked fails a delivery to a loopback, private,
+// link-local or otherwise non-public address when no allow list is set.
+var ErrWebhookAddressBlocked = errors.New("async: webhook address is not public")
+
+// newWebhookClient returns the delivery client. Redirects are not followed,
+// so a receiver cannot bounce deliveries to another host. With publicOnly,
+// every connection is checked after DNS resolution, which also covers
+// hostnames that resolve, or later re-resolve, to internal addresses.
+func newWebhookClient(timeout time.Duration, publicOnly bool) *http.Client {
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if publicOnly {
+		dialer := &net.Dialer{
+			Timeout: timeout,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip, err := netip.ParseAddr(host); err != nil || !publicAddr(ip) {
+					return fmt.Errorf("%w: %s", ErrWebhookAddressBlocked, host)
+				}
+				return nil
+			},
+		}
+		// No proxy: the check must see the receiver's address.
+		client.Transport = &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        16,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+	return client
+}
+
+// deniedPrefixes are non-public ranges that IsGlobalUnicast and IsPrivate
+// let through.
+var deniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+}
+
+// publicAddr reports whether ip is a public unicast address.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range deniedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicHost rejects local names and non-public IP literals; other
+// hostnames are left to the dial-time check.
+func publicHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return publicAddr(ip)
+	}
+	return true
+}
+
+// deliver POSTs the finished job to its webhook. Network errors, 429 and
+// 5xx are retried with exponential backoff; other statuses are final.
+func (m *Manager) deliver(ctx context.Context, job *Job) {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		m.logger.Error("async_webhook_marshal_error", zap.String("job_id", job.ID), zap.Error(err))
+		return
+	}
+
+	backoff := m.cfg.WebhookBackoff
+attempts:
+	for attempt := 1; attempt <= m.cfg.WebhookMaxAttempts; attempt++ {
+		job.Webhook.Attempts = attempt
+
+		retry, err := m.post(ctx, job, payload, attempt)
+		if err == nil {
+			job.Webhook.Status = WebhookDelivered
+			job.Webhook.LastError = ""
+			job.Webhook.DeliveredAt = time.Now().Unix()
+			m.saveLogged(ctx, job)
+			return
+		}
+
+		job.Webhook.LastError = err.Error()
+		m.logger.Warn("async_webhook_attempt_failed",
+			zap.String("job_id", job.ID),
+			zap.Int("attempt", attempt),
+			zap.Bool("retry", retry),
+			zap.Error(err),
+		)
+		if !retry || attempt == m.cfg.WebhookMaxAttempts {
+			break attempts
+		}
+		m.saveLogged(ctx, job)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			job.Webhook.LastError = "delivery aborted: " + ctx.Err().Error()
+			break attempts
+		}
+		backoff *= 2
+		if backoff > maxWebhookBackoff {
+			backoff = maxWebhookBackoff
+		}
+	}
+
+	job.Webhook.Status = WebhookFailed
+	m.saveLogged(ctx, job)
+}
+
+// post makes one delivery attempt and reports whether a failure is
+// retryable.
+func (m *Manager) post(ctx context.Context, job *Job, payload []byte, attempt int) (bool, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, m.cfg.WebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, job.Webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(JobIDHeader, job.ID)
+	req.Header.Set(AttemptHeader, strconv.Itoa(attempt))
+	req.Header.Set(SignatureHeader, fmt.Sprintf("t=%d,v1=%s", ts, Sign(m.cfg.WebhookSecret, ts, payload)))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil && !errors.Is(err, ErrWebhookAddressBlocked), err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+}
@@ -0,0 +1,344 @@
+// Package audit keeps a durable record of every completion: who sent which
+// prompt to which model, and what came back. Records are queued per sink
+// and written in batches in the background, so a slow sink never holds up
+// requests; when a queue stays full, records are dropped and counted.
+package audit
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/metrics"
+)
+
+// Body capture modes for Config.Bodies.
+const (
+	BodiesNone     = "none"
+	BodiesRedacted = "redacted"
+	BodiesFull     = "full"
+)
+
+// Defaults for a zero Config.
+const (
+	defaultBufferSize    = 1024
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultMaxBodyBytes  = 16 * 1024
+	defaultWriteTimeout  = 10 * time.Second
+)
+
+// Record is one completion. Usage and cost are those of the upstream
+// call; a cache hit has a zero cost.
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	UserID    string    `json:"user_id"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+
+	Model         string `json:"model"`
+	ResponseModel string `json:"response_model,omitempty"`
+	Provider      string `json:"provider,omitempty"`
+	VersionID     string `json:"version_id,omitempty"`
+	Stream        bool   `json:"stream"`
+
+	// CacheResult is hit, miss or bypass (not eligible, such as streams).
+	CacheTier   string `json:"cache_tier,omitempty"`
+	CacheResult string `json:"cache_result"`
+
+	Usage   *Usage   `json:"usage,omitempty"`
+	CostUSD *float64 `json:"cost_usd,omitempty"`
+
+	LatencyMS         float64 `json:"latency_ms"`
+	UpstreamLatencyMS float64 `json:"upstream_latency_ms,omitempty"`
+
+	// Status is ok, error, or aborted for streams cut short.
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	AbortReason string `json:"abort_reason,omitempty"`
+
+	// Prompt and Response are only set when bodies are captured; Response
+	// holds the text of each choice.
+	Prompt   []Message `json:"prompt,omitempty"`
+	Response []string  `json:"response,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Sink stores batches of records.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, records []Record) error
+	Close() error
+}
+
+type Config struct {
+	// Provider is recorded on every record.
+	Provider string
+	// Bodies is "none", "redacted" or "full"; prompt and response text
+	// are captured for the last two.
+	Bodies string
+	// MaxBodyBytes truncates each captured text (default 16KiB).
+	MaxBodyBytes int
+
+	// BufferSize is the queue length per sink (default 1024), BatchSize
+	// the records per write (default 100) and FlushInterval the longest a
+	// record waits for its batch to fill (default 1s).
+	BufferSize    int
+	BatchSize     int
+	FlushInterval time.Duration
+	// BlockTimeout is how long Emit waits for room in a full queue before
+	// dropping the record; zero drops at once.
+	BlockTimeout time.Duration
+}
+
+// Stats are the record counts of one sink.
+type Stats struct {
+	Written int64
+	Dropped int64 // queue full
+	Failed  int64 // sink write errors
+}
+
+// Log fans records out to its sinks. A nil *Log records nothing.
+type Log struct {
+	cfg     Config
+	logger  *zap.Logger
+	writers []*writer
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New starts a writer for each sink.
+func New(cfg Config, logger *zap.Logger, sinks ...Sink) *Log {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if cfg.Bodies == "" {
+		cfg.Bodies = BodiesNone
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultBufferSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultFlushInterval
+	}
+
+	l := &Log{cfg: cfg, logger: logger.Named("audit")}
+	for _, s := range sinks {
+		w := &writer{
+			sink:  s,
+			queue: make(chan Record, cfg.BufferSize),
+			done:  make(chan struct{}),
+		}
+		l.writers = append(l.writers, w)
+		go l.run(w)
+	}
+	return l
+}
+
+// Provider is the provider recorded on every record.
+func (l *Log) Provider() string {
+	if l == nil {
+		return ""
+	}
+	return l.cfg.Provider
+}
+
+// CapturesBodies reports whether records carry prompt and response text.
+func (l *Log) CapturesBodies() bool {
+	return l != nil && (l.cfg.Bodies == BodiesRedacted || l.cfg.Bodies == BodiesFull)
+}
+
+// Body prepares captured text for a record: redacted unless bodies are
+// captured in full, and truncated to MaxBodyBytes.
+func (l *Log) Body(s string) string {
+	if l.cfg.Bodies != BodiesFull {
+		s = Redact(s)
+	}
+	if len(s) > l.cfg.MaxBodyBytes {
+		s = strings.ToValidUTF8(s[:l.cfg.MaxBodyBytes], "") + "...[truncated]"
+	}
+	return s
+}
+
+// Emit queues rec for every sink. A queue that stays full for BlockTimeout
+// drops the record for that sink.
+func (l *Log) Emit(rec Record) {
+	if l == nil {
+		return
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+
+	for _, w := range l.writers {
+		select {
+		case w.queue <- rec:
+			continue
+		default:
+		}
+		if l.cfg.BlockTimeout > 0 && l.enqueueWait(w, rec) {
+			continue
+		}
+		w.dropped.Add(1)
+		metrics.AuditRecordsTotal.WithLabelValues(w.sink.Name(), metrics.AuditDropped).Inc()
+	}
+}
+
+// enqueueWait waits up to BlockTimeout for room in w's queue.
+func (l *Log) enqueueWait(w *writer, rec Record) bool {
+	timer := time.NewTimer(l.cfg.BlockTimeout)
+	defer timer.Stop()
+	select {
+	case w.queue <- rec:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Stats returns the counts of each sink by name.
+func (l *Log) Stats() map[string]Stats {
+	out := make(map[string]Stats)
+	if l == nil {
+		return out
+	}
+	for _, w := range l.writers {
+		out[w.sink.Name()] = Stats{
+			Written: w.written.Load(),
+			Dropped: w.dropped.Load(),
+			Failed:  w.failed.Load(),
+		}
+	}
+	return out
+}
+
+// Close writes the queued records and closes the sinks.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	for _, w := range l.writers {
+		close(w.queue)
+	}
+	l.mu.Unlock()
+
+	var firstErr error
+	for _, w := range l.writers {
+		<-w.done
+		if err := w.sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// writer is the queue of one sink.
+type writer struct {
+	sink  Sink
+	queue chan Record
+	done  chan struct{}
+
+	written atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// run writes w's queue in batches until it is closed.
+func (l *Log) run(w *writer) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(l.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, l.cfg.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), defaultWriteTimeout)
+		err := w.sink.Write(ctx, batch)
+		cancel()
+
+		n := int64(len(batch))
+		if err != nil {
+			w.failed.Add(n)
+			metrics.AuditRecordsTotal.WithLabelValues(w.sink.Name(), metrics.AuditFailed).Add(float64(n))
+			l.logger.Warn("audit_sink_write_error",
+				zap.String("sink", w.sink.Name()),
+				zap.Int("records", len(batch)),
+				zap.Error(err),
+			)
+		} else {
+			w.written.Add(n)
+			metrics.AuditRecordsTotal.WithLabelValues(w.sink.Name(), metrics.AuditWritten).Add(float64(n))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case rec, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= l.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Redaction patterns, applied in order.
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)\bbearer\s+[a-z0-9._~+/=-]{16,}`), "[REDACTED_SECRET]"},
+	{regexp.MustCompile(`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}`), "[REDACTED_SECRET]"},
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[REDACTED_EMAIL]"},
+	{regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), "[REDACTED_NUMBER]"},
+}
+
+// Redact masks API keys and bearer tokens, email addresses and long digit
+// runs such as card and account numbers.
+func Redact(s string) string {
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+	return s
+}
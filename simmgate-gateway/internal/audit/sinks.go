@@ -0,0 +1,211 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"simmgate-gateway/internal/async"
+)
+
+// encodeNDJSON appends one JSON line per record to buf.
+func encodeNDJSON(buf *bytes.Buffer, records []Record) error {
+	enc := json.NewEncoder(buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return fmt.Errorf("audit: encode record: %w", err)
+		}
+	}
+	return nil
+}
+
+// WriterSink writes NDJSON to an io.Writer such as os.Stdout.
+type WriterSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+func NewWriterSink(name string, w io.Writer) *WriterSink {
+	return &WriterSink{name: name, w: w}
+}
+
+func (s *WriterSink) Name() string { return s.name }
+
+func (s *WriterSink) Write(_ context.Context, records []Record) error {
+	var buf bytes.Buffer
+	if err := encodeNDJSON(&buf, records); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+func (s *WriterSink) Close() error { return nil }
+
+// FileSink appends NDJSON to a local file, synced after every batch. Once
+// the file reaches MaxBytes it is renamed to <path>.1, older files shift to
+// <path>.2 and so on, and the oldest beyond MaxBackups is removed.
+type FileSink struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewFileSink opens path for appending. A maxBytes of zero never rotates;
+// otherwise maxBackups must be at least one, so a rotation never deletes
+// the only copy of the records.
+func NewFileSink(path string, maxBytes int64, maxBackups int) (*FileSink, error) {
+	if maxBytes > 0 && maxBackups < 1 {
+		return nil, fmt.Errorf("audit: %s rotates at %d bytes but keeps no backups", path, maxBytes)
+	}
+	s := &FileSink{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) Name() string { return "file" }
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("audit: open %s: %w", s.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("audit: stat %s: %w", s.path, err)
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(_ context.Context, records []Record) error {
+	var buf bytes.Buffer
+	if err := encodeNDJSON(&buf, records); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return fmt.Errorf("audit: %s is closed", s.path)
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(buf.Len()) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("audit: write %s: %w", s.path, err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("audit: sync %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// rotate shifts the backups and starts a new file; s.mu is held.
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return fmt.Errorf("audit: close %s: %w", s.path, err)
+	}
+	s.f = nil
+
+	_ = os.Remove(s.backup(s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(s.backup(i), s.backup(i+1))
+	}
+	err := os.Rename(s.path, s.backup(1))
+
+	// Reopen even if the rename failed, so later batches are not lost;
+	// the file then keeps growing until a rotation succeeds.
+	if openErr := s.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		return fmt.Errorf("audit: rotate %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *FileSink) backup(i int) string {
+	return s.path + "." + strconv.Itoa(i)
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// WebhookSink POSTs each batch as NDJSON. With a secret the body is signed
+// like async webhooks, see async.Sign. A non-2xx answer fails the batch.
+type WebhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func NewWebhookSink(url, secret string, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{url: url, secret: secret, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *WebhookSink) Name() string { return "webhook" }
+
+func (s *WebhookSink) Write(ctx context.Context, records []Record) error {
+	var buf bytes.Buffer
+	if err := encodeNDJSON(&buf, records); err != nil {
+		return err
+	}
+	payload := buf.Bytes()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("audit: build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.secret != "" {
+		ts := time.Now().Unix()
+		req.Header.Set(async.SignatureHeader, fmt.Sprintf("t=%d,v1=%s", ts, async.Sign(s.secret, ts, payload)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("audit: webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("audit: webhook status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
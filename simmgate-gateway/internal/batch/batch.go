@@ -0,0 +1,217 @@
+// Package batch runs asynchronous batches of chat requests submitted as
+// JSONL. Jobs are processed by a bounded worker pool through the same
+// cache and provider path as /v1/chat/completions, and their state and
+// results are kept in a Store (memory or Redis).
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"simmgate-gateway/internal/llm"
+)
+
+// Endpoint is the only endpoint a batch line may target.
+const Endpoint = "/v1/chat/completions"
+
+// Job statuses, following the OpenAI Batch API.
+const (
+	StatusInProgress = "in_progress"
+	StatusCompleted  = "completed"
+	StatusFailed     = "failed"
+	StatusCancelling = "cancelling"
+	StatusCancelled  = "cancelled"
+)
+
+var (
+	ErrNotFound = errors.New("batch: not found")
+	// ErrConflict is returned by Store.Update when the stored job has a
+	// status the update may not replace, see CanReplace.
+	ErrConflict = errors.New("batch: job changed concurrently")
+)
+
+// RequestCounts tracks per-request progress of a job.
+type RequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// Job is a batch's persisted state. Timestamps are unix seconds.
+type Job struct {
+	ID            string        `json:"id"`
+	Object        string        `json:"object"`
+	Endpoint      string        `json:"endpoint"`
+	Status        string        `json:"status"`
+	Concurrency   int           `json:"concurrency"`
+	RequestCounts RequestCounts `json:"request_counts"`
+	UserID        string        `json:"user_id"`
+
+	CreatedAt    int64 `json:"created_at"`
+	InProgressAt int64 `json:"in_progress_at,omitempty"`
+	CompletedAt  int64 `json:"completed_at,omitempty"`
+	FailedAt     int64 `json:"failed_at,omitempty"`
+	CancellingAt int64 `json:"cancelling_at,omitempty"`
+	CancelledAt  int64 `json:"cancelled_at,omitempty"`
+	// UpdatedAt is refreshed while an instance runs the job, so a job
+	// whose instance died can be told apart from a slow one.
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+}
+
+// Terminal reports whether the job will not change any more.
+func (j *Job) Terminal() bool {
+	switch j.Status {
+	case StatusCompleted, StatusFailed, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// CanReplace reports whether a stored job in status from may be
+// overwritten by one in status to. A terminal job keeps its status and a
+// cancelling one can only end, so an instance still running a job never
+// undoes a cancellation or failure recorded elsewhere.
+func CanReplace(from, to string) bool {
+	switch from {
+	case StatusInProgress:
+		return true
+	case StatusCancelling:
+		return to != StatusInProgress
+	}
+	return to == from
+}
+
+// Request is one input line: {"custom_id", "method", "url", "body"}.
+type Request struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method,omitempty"`
+	URL      string          `json:"url,omitempty"`
+	Body     llm.ChatRequest `json:"body"`
+}
+
+// Result is one output line. Response carries whatever the synchronous
+// endpoint would have returned, including upstream errors; Error is set
+// instead when the request could not be run at all, such as when the
+// gateway shut down first.
+type Result struct {
+	ID       string          `json:"id"`
+	CustomID string          `json:"custom_id"`
+	Response *ResultResponse `json:"response"`
+	Error    *ResultError    `json:"error"`
+}
+
+type ResultResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// ResultError codes.
+const ErrCodeInterrupted = "batch_interrupted"
+
+type ResultError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// CompleteFunc runs one chat request for userID and returns the HTTP status
+// and JSON body /v1/chat/completions would have answered with.
+type CompleteFunc func(ctx context.Context, req *llm.ChatRequest, userID string) (int, []byte)
+
+// LineError reports an invalid input line (1-based).
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error { return e.Err }
+
+// ParseRequests reads JSONL batch lines. A line is either a full batch
+// request object or a bare chat request; custom_id defaults to
+// "request-<line>" and must be unique. Streaming requests are rejected.
+func ParseRequests(r io.Reader, maxRequests int) ([]Request, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), llm.MaxPayloadBytes)
+
+	var (
+		out  []Request
+		seen = make(map[string]bool)
+		line int
+	)
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if maxRequests > 0 && len(out) == maxRequests {
+			return nil, &LineError{Line: line, Err: fmt.Errorf("batch exceeds %d requests", maxRequests)}
+		}
+
+		req, err := parseLine(raw)
+		if err != nil {
+			// A failed read still yields the partial line it cut off.
+			if readErr := scanner.Err(); readErr != nil {
+				err = readErr
+			}
+			return nil, &LineError{Line: line, Err: err}
+		}
+		if req.CustomID == "" {
+			req.CustomID = fmt.Sprintf("request-%d", line)
+		}
+		if seen[req.CustomID] {
+			return nil, &LineError{Line: line, Err: fmt.Errorf("duplicate custom_id %q", req.CustomID)}
+		}
+		seen[req.CustomID] = true
+		out = append(out, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &LineError{Line: line + 1, Err: err}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("batch has no requests")
+	}
+	return out, nil
+}
+
+func parseLine(raw []byte) (Request, error) {
+	var envelope struct {
+		CustomID string          `json:"custom_id"`
+		Method   string          `json:"method"`
+		URL      string          `json:"url"`
+		Body     json.RawMessage `json:"body"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return Request{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	req := Request{CustomID: envelope.CustomID, Method: envelope.Method, URL: envelope.URL}
+	body := envelope.Body
+	if len(body) == 0 {
+		// Bare chat request line.
+		body = raw
+		req.CustomID = ""
+	}
+	if req.Method != "" && req.Method != "POST" {
+		return Request{}, fmt.Errorf("unsupported method %q", req.Method)
+	}
+	if req.URL != "" && req.URL != Endpoint {
+		return Request{}, fmt.Errorf("unsupported url %q, only %s is supported", req.URL, Endpoint)
+	}
+
+	if err := json.Unmarshal(body, &req.Body); err != nil {
+		return Request{}, fmt.Errorf("invalid chat request: %w", err)
+	}
+	if req.Body.Stream {
+		return Request{}, errors.New("streaming requests are not supported in batches")
+	}
+	return req, nil
+}
@@ -0,0 +1,466 @@
+package batch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"simmgate-gateway/pkg/logging/logging"
+)
+
+const (
+	defaultWorkers     = 16
+	defaultConcurrency = 4
+
+	// heartbeatInterval is how often a running job's UpdatedAt is
+	// refreshed; a job not refreshed for orphanAfter is taken to have lost
+	// its instance.
+	heartbeatInterval = 30 * time.Second
+	orphanAfter       = 3 * heartbeatInterval
+
+	// storeTimeout bounds store calls made outside a request.
+	storeTimeout = 5 * time.Second
+)
+
+// Config bounds batch processing.
+type Config struct {
+	// Workers caps requests in flight across all batches.
+	Workers int
+	// DefaultConcurrency caps requests in flight for one batch when the
+	// submission does not ask for a limit. Never above Workers.
+	DefaultConcurrency int
+}
+
+// run is a job being processed by this instance.
+type run struct {
+	mu     sync.Mutex
+	job    Job
+	cancel context.CancelFunc
+}
+
+// Manager accepts batches and processes them in the background. A job runs
+// on the instance it was submitted to and is not resumed elsewhere; a job
+// whose instance died is reported failed once its heartbeat is stale.
+// Another instance sharing the store can cancel it: the running instance
+// sees the cancellation on its next heartbeat.
+type Manager struct {
+	store              Store
+	complete           CompleteFunc
+	workers            chan struct{}
+	defaultConcurrency int
+	heartbeatEvery     time.Duration
+	logger             *zap.Logger
+
+	baseCtx context.Context
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu   sync.Mutex
+	runs map[string]*run
+}
+
+func NewManager(store Store, complete CompleteFunc, cfg Config, logger *zap.Logger) *Manager {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.DefaultConcurrency <= 0 {
+		cfg.DefaultConcurrency = defaultConcurrency
+	}
+	if cfg.DefaultConcurrency > cfg.Workers {
+		cfg.DefaultConcurrency = cfg.Workers
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	return &Manager{
+		store:              store,
+		complete:           complete,
+		workers:            make(chan struct{}, cfg.Workers),
+		defaultConcurrency: cfg.DefaultConcurrency,
+		heartbeatEvery:     heartbeatInterval,
+		logger:             logger.Named("batch"),
+		baseCtx:            ctx,
+		stop:               stop,
+		runs:               make(map[string]*run),
+	}
+}
+
+// Submit stores a new job for userID and starts processing it. concurrency
+// <= 0 selects the default; it is capped at the worker pool size.
+func (m *Manager) Submit(ctx context.Context, userID string, reqs []Request, concurrency int) (*Job, error) {
+	if concurrency <= 0 {
+		concurrency = m.defaultConcurrency
+	}
+	if concurrency > cap(m.workers) {
+		concurrency = cap(m.workers)
+	}
+
+	now := time.Now().Unix()
+	job := Job{
+		ID:            newID("batch_"),
+		Object:        "batch",
+		Endpoint:      Endpoint,
+		Status:        StatusInProgress,
+		Concurrency:   concurrency,
+		RequestCounts: RequestCounts{Total: len(reqs)},
+		UserID:        userID,
+		CreatedAt:     now,
+		InProgressAt:  now,
+		UpdatedAt:     now,
+	}
+	if err := m.store.Create(ctx, &job); err != nil {
+		return nil, err
+	}
+
+	m.start(job, reqs)
+
+	m.logger.Info("batch_submitted",
+		zap.String("batch_id", job.ID),
+		zap.String("user_id", userID),
+		zap.Int("requests", len(reqs)),
+		zap.Int("concurrency", concurrency),
+	)
+	return &job, nil
+}
+
+// Get returns userID's job. Jobs of other users are reported as not found.
+// A job left unfinished by an instance that died is marked failed, or
+// cancelled if it was being cancelled.
+func (m *Manager) Get(ctx context.Context, userID, id string) (*Job, error) {
+	job, err := m.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.UserID != userID {
+		return nil, ErrNotFound
+	}
+	if m.orphaned(job) {
+		now := time.Now().Unix()
+		if job.Status == StatusCancelling {
+			job.Status, job.CancelledAt = StatusCancelled, now
+		} else {
+			job.Status, job.FailedAt = StatusFailed, now
+		}
+		switch err := m.store.Update(ctx, job); {
+		case errors.Is(err, ErrConflict):
+			// Another instance ended it first.
+			return m.store.Get(ctx, id)
+		case err != nil:
+			return nil, err
+		}
+		m.logger.Warn("batch_orphaned", zap.String("batch_id", job.ID), zap.String("status", job.Status))
+	}
+	return job, nil
+}
+
+// orphaned reports whether job is unfinished, not running here, and has
+// not been refreshed by the instance running it for orphanAfter.
+func (m *Manager) orphaned(job *Job) bool {
+	if job.Terminal() {
+		return false
+	}
+	m.mu.Lock()
+	_, running := m.runs[job.ID]
+	m.mu.Unlock()
+	if running {
+		return false
+	}
+	updated := max(job.UpdatedAt, job.InProgressAt, job.CancellingAt)
+	return time.Since(time.Unix(updated, 0)) > orphanAfter
+}
+
+// Output returns the result lines written so far, in completion order.
+func (m *Manager) Output(ctx context.Context, userID, id string) ([][]byte, error) {
+	if _, err := m.Get(ctx, userID, id); err != nil {
+		return nil, err
+	}
+	return m.store.Outputs(ctx, id)
+}
+
+// Cancel stops dispatching new requests for a job; requests already in
+// flight are aborted and not recorded. The job moves to cancelling and then
+// to cancelled once its workers have returned. A job running on another
+// instance is only marked cancelling here; that instance stops it on its
+// next heartbeat, or Get ends it once the heartbeat is stale.
+func (m *Manager) Cancel(ctx context.Context, userID, id string) (*Job, error) {
+	job, err := m.Get(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Terminal() {
+		return job, nil
+	}
+
+	m.mu.Lock()
+	rn := m.runs[id]
+	m.mu.Unlock()
+
+	now := time.Now().Unix()
+	if rn == nil {
+		if job.Status == StatusCancelling {
+			return job, nil
+		}
+		job.Status = StatusCancelling
+		job.CancellingAt = now
+		switch err := m.store.Update(ctx, job); {
+		case errors.Is(err, ErrConflict):
+			return m.store.Get(ctx, id)
+		case err != nil:
+			return nil, err
+		}
+		return job, nil
+	}
+
+	rn.mu.Lock()
+	if rn.job.Status == StatusInProgress {
+		rn.job.Status = StatusCancelling
+		rn.job.CancellingAt = now
+		m.persist(rn)
+	}
+	snapshot := rn.job
+	rn.mu.Unlock()
+
+	rn.cancel()
+	return &snapshot, nil
+}
+
+// Close aborts running jobs and waits for their workers. Interrupted jobs
+// are marked failed, since they are not resumed, and each of their
+// unfinished requests gets a batch_interrupted error line.
+func (m *Manager) Close() {
+	m.stop()
+	m.wg.Wait()
+}
+
+func (m *Manager) start(job Job, reqs []Request) {
+	ctx, cancel := context.WithCancel(m.baseCtx)
+	ctx = logging.WithLogger(ctx, m.logger.With(zap.String("batch_id", job.ID)))
+
+	rn := &run{job: job, cancel: cancel}
+
+	m.mu.Lock()
+	m.runs[job.ID] = rn
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go m.process(ctx, rn, reqs)
+}
+
+// process dispatches the job's requests, holding one slot of the job's own
+// semaphore and one of the shared worker pool per request in flight.
+func (m *Manager) process(ctx context.Context, rn *run, reqs []Request) {
+	defer m.wg.Done()
+	defer rn.cancel()
+
+	sem := make(chan struct{}, rn.job.Concurrency)
+	userID := rn.job.UserID
+	var inflight sync.WaitGroup
+
+	heartbeatDone := make(chan struct{})
+	defer close(heartbeatDone)
+	go m.heartbeat(rn, heartbeatDone)
+
+	dispatched := 0
+dispatch:
+	for _, req := range reqs {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case sem <- struct{}{}:
+		}
+		select {
+		case <-ctx.Done():
+			<-sem
+			break dispatch
+		case m.workers <- struct{}{}:
+		}
+		dispatched++
+
+		inflight.Add(1)
+		go func(req Request) {
+			defer func() {
+				<-m.workers
+				<-sem
+				inflight.Done()
+			}()
+			m.processOne(ctx, rn, userID, req)
+		}(req)
+	}
+	inflight.Wait()
+
+	if m.baseCtx.Err() != nil {
+		for _, req := range reqs[dispatched:] {
+			m.recordInterrupted(ctx, rn, req)
+		}
+	}
+
+	rn.mu.Lock()
+	now := time.Now().Unix()
+	switch {
+	case rn.job.Terminal():
+		// Ended by another instance, see adopt.
+	case rn.job.Status == StatusCancelling:
+		rn.job.Status = StatusCancelled
+		rn.job.CancelledAt = now
+	case m.baseCtx.Err() != nil:
+		rn.job.Status = StatusFailed
+		rn.job.FailedAt = now
+	default:
+		rn.job.Status = StatusCompleted
+		rn.job.CompletedAt = now
+	}
+	m.persist(rn)
+	job := rn.job
+	rn.mu.Unlock()
+
+	m.mu.Lock()
+	delete(m.runs, job.ID)
+	m.mu.Unlock()
+
+	m.logger.Info("batch_finished",
+		zap.String("batch_id", job.ID),
+		zap.String("status", job.Status),
+		zap.Int("completed", job.RequestCounts.Completed),
+		zap.Int("failed", job.RequestCounts.Failed),
+		zap.Int("total", job.RequestCounts.Total),
+	)
+}
+
+func (m *Manager) processOne(ctx context.Context, rn *run, userID string, req Request) {
+	status, body := m.complete(ctx, &req.Body, userID)
+	if ctx.Err() != nil && status != http.StatusOK {
+		// Aborted by cancellation, which is not a real result, or by
+		// shutdown, which is recorded as such.
+		if m.baseCtx.Err() != nil {
+			m.recordInterrupted(ctx, rn, req)
+		}
+		return
+	}
+
+	m.record(ctx, rn, Result{
+		ID:       newID("batch_req_"),
+		CustomID: req.CustomID,
+		Response: &ResultResponse{StatusCode: status, Body: body},
+	}, status == http.StatusOK)
+}
+
+// recordInterrupted records req as not run because the gateway shut down.
+func (m *Manager) recordInterrupted(ctx context.Context, rn *run, req Request) {
+	m.record(ctx, rn, Result{
+		ID:       newID("batch_req_"),
+		CustomID: req.CustomID,
+		Error: &ResultError{
+			Code:    ErrCodeInterrupted,
+			Message: "the gateway shut down before the request finished",
+		},
+	}, false)
+}
+
+// record appends res to the job's output and counts it.
+func (m *Manager) record(ctx context.Context, rn *run, res Result, ok bool) {
+	line, err := json.Marshal(res)
+	if err != nil {
+		m.logger.Error("batch_result_marshal_error", zap.Error(err))
+		return
+	}
+
+	// Results that finished must be stored even if the job is being
+	// cancelled.
+	storeCtx := context.WithoutCancel(ctx)
+	if err := m.store.AppendOutput(storeCtx, rn.job.ID, line); err != nil {
+		m.logger.Error("batch_output_append_error", zap.String("batch_id", rn.job.ID), zap.Error(err))
+	}
+
+	rn.mu.Lock()
+	if ok {
+		rn.job.RequestCounts.Completed++
+	} else {
+		rn.job.RequestCounts.Failed++
+	}
+	m.persist(rn)
+	rn.mu.Unlock()
+}
+
+// heartbeat refreshes rn's UpdatedAt until done is closed, so other
+// instances do not take a job with slow requests for an orphan. It also
+// picks up a cancellation made through another instance.
+func (m *Manager) heartbeat(rn *run, done <-chan struct{}) {
+	ticker := time.NewTicker(m.heartbeatEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+			stored, err := m.store.Get(ctx, rn.job.ID)
+			cancel()
+
+			rn.mu.Lock()
+			if err == nil {
+				m.adopt(rn, stored)
+			}
+			m.persist(rn)
+			rn.mu.Unlock()
+		}
+	}
+}
+
+// adopt applies a cancellation or failure stored for rn's job by another
+// instance and stops dispatching; the caller holds rn.mu.
+func (m *Manager) adopt(rn *run, stored *Job) {
+	switch {
+	case stored.Terminal():
+		if rn.job.Status == stored.Status {
+			return
+		}
+		rn.job.Status = stored.Status
+		rn.job.CompletedAt, rn.job.FailedAt, rn.job.CancelledAt = stored.CompletedAt, stored.FailedAt, stored.CancelledAt
+	case stored.Status == StatusCancelling && rn.job.Status == StatusInProgress:
+		rn.job.Status, rn.job.CancellingAt = StatusCancelling, stored.CancellingAt
+	default:
+		return
+	}
+	m.logger.Info("batch_changed_elsewhere", zap.String("batch_id", rn.job.ID), zap.String("status", stored.Status))
+	rn.cancel()
+}
+
+// persist saves rn.job; the caller holds rn.mu. If the stored job was
+// cancelled or failed elsewhere meanwhile, rn adopts that and the save is
+// retried, so a running instance never undoes it.
+func (m *Manager) persist(rn *run) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	rn.job.UpdatedAt = time.Now().Unix()
+	job := rn.job
+	err := m.store.Update(ctx, &job)
+	if errors.Is(err, ErrConflict) {
+		var stored *Job
+		if stored, err = m.store.Get(ctx, job.ID); err == nil {
+			m.adopt(rn, stored)
+			job = rn.job
+			err = m.store.Update(ctx, &job)
+		}
+	}
+	if err != nil {
+		m.logger.Error("batch_update_error", zap.String("batch_id", job.ID), zap.Error(err))
+	}
+}
+
+func newID(prefix string) string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return prefix + hex.EncodeToString([]byte(time.Now().Format("150405.000000")))
+	}
+	return prefix + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,325 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"simmgate-gateway/internal/llm"
+)
+
+func waitForStatus(t *testing.T, m *Manager, userID, id string, statuses ...string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := m.Get(context.Background(), userID, id)
+		if err != nil {
+			t.Fatalf("get job: %v", err)
+		}
+		for _, s := range statuses {
+			if job.Status == s {
+				return job
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not reach %v", id, statuses)
+	return nil
+}
+
+func TestParseRequests(t *testing.T) {
+	body := strings.Join([]string{
+		`{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"m","messages":[{"role":"user","content":"hi"}]}}`,
+		``,
+		`{"model":"m","messages":[{"role":"user","content":"bare"}]}`,
+	}, "\n")
+
+	reqs, err := ParseRequests(strings.NewReader(body), 0)
+	if err != nil {
+		t.Fatalf("ParseRequests: %v", err)
+	}
+	if len(reqs) != 2 || reqs[0].CustomID != "a" || reqs[1].CustomID != "request-3" {
+		t.Fatalf("unexpected requests: %+v", reqs)
+	}
+	if reqs[1].Body.Messages[0].Content != "bare" {
+		t.Fatalf("unexpected bare body: %+v", reqs[1].Body)
+	}
+
+	bad := []string{
+		`{"custom_id":"a","body":{"model":"m"}}` + "\n" + `{"custom_id":"a","body":{"model":"m"}}`,
+		`{"url":"/v1/embeddings","body":{"model":"m"}}`,
+		`{"model":"m","stream":true}`,
+		`not json`,
+	}
+	for _, b := range bad {
+		var lineErr *LineError
+		if _, err := ParseRequests(strings.NewReader(b), 0); !errors.As(err, &lineErr) {
+			t.Fatalf("expected line error for %q, got %v", b, err)
+		}
+	}
+
+	if _, err := ParseRequests(strings.NewReader(body), 1); err == nil {
+		t.Fatalf("expected max requests error")
+	}
+}
+
+func TestManagerProcessesWithinConcurrency(t *testing.T) {
+	var inflight, peak int32
+	complete := func(ctx context.Context, req *llm.ChatRequest, userID string) (int, []byte) {
+		n := atomic.AddInt32(&inflight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+
+		if req.Messages[0].Content == "fail" {
+			return http.StatusBadRequest, []byte(`{"error":{"message":"bad"}}`)
+		}
+		return http.StatusOK, []byte(`{"model":"` + req.Model + `"}`)
+	}
+
+	m := NewManager(NewMemoryStore(time.Hour), complete, Config{Workers: 8}, nil)
+	defer m.Close()
+
+	var reqs []Request
+	for i := 0; i < 9; i++ {
+		content := "ok"
+		if i == 0 {
+			content = "fail"
+		}
+		reqs = append(reqs, Request{
+			CustomID: string(rune('a' + i)),
+			Body:     llm.ChatRequest{Model: "m", Messages: []llm.ChatMessage{{Role: llm.RoleUser, Content: content}}},
+		})
+	}
+
+	job, err := m.Submit(context.Background(), "u1", reqs, 2)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	done := waitForStatus(t, m, "u1", job.ID, StatusCompleted)
+	if done.RequestCounts != (RequestCounts{Total: 9, Completed: 8, Failed: 1}) {
+		t.Fatalf("unexpected counts: %+v", done.RequestCounts)
+	}
+	if peak > 2 {
+		t.Fatalf("per-batch concurrency exceeded: %d", peak)
+	}
+
+	lines, err := m.Output(context.Background(), "u1", job.ID)
+	if err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	if len(lines) != 9 {
+		t.Fatalf("expected 9 result lines, got %d", len(lines))
+	}
+	var res Result
+	if err := json.Unmarshal(lines[0], &res); err != nil {
+		t.Fatalf("decode result: %v", err)
+	}
+	if res.CustomID == "" || res.Response == nil {
+		t.Fatalf("unexpected result: %s", lines[0])
+	}
+
+	if _, err := m.Get(context.Background(), "someone-else", job.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected other users not to see the job, got %v", err)
+	}
+}
+
+func TestManagerCancel(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	complete := func(ctx context.Context, req *llm.ChatRequest, userID string) (int, []byte) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-release:
+			return http.StatusOK, []byte(`{}`)
+		case <-ctx.Done():
+			return http.StatusGatewayTimeout, nil
+		}
+	}
+
+	m := NewManager(NewMemoryStore(time.Hour), complete, Config{Workers: 4}, nil)
+	defer m.Close()
+
+	reqs := make([]Request, 10)
+	for i := range reqs {
+		reqs[i] = Request{CustomID: string(rune('a' + i)), Body: llm.ChatRequest{Model: "m"}}
+	}
+	job, err := m.Submit(context.Background(), "u1", reqs, 1)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	cancelled, err := m.Cancel(context.Background(), "u1", job.ID)
+	if err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if cancelled.Status != StatusCancelling && cancelled.Status != StatusCancelled {
+		t.Fatalf("unexpected status after cancel: %s", cancelled.Status)
+	}
+
+	final := waitForStatus(t, m, "u1", job.ID, StatusCancelled)
+	if final.RequestCounts.Completed+final.RequestCounts.Failed != 0 {
+		t.Fatalf("aborted requests must not be recorded: %+v", final.RequestCounts)
+	}
+	if n := atomic.LoadInt32(&calls); n > 1 {
+		t.Fatalf("expected dispatch to stop after cancel, got %d calls", n)
+	}
+}
+
+func TestManagerCancelFromAnotherInstance(t *testing.T) {
+	aborted := make(chan struct{})
+	complete := func(ctx context.Context, req *llm.ChatRequest, userID string) (int, []byte) {
+		<-ctx.Done()
+		close(aborted)
+		return http.StatusGatewayTimeout, nil
+	}
+
+	// Both instances share the store; only the first one runs the job.
+	store := NewMemoryStore(time.Hour)
+	running := NewManager(store, complete, Config{}, nil)
+	running.heartbeatEvery = 10 * time.Millisecond
+	defer running.Close()
+	other := NewManager(store, nil, Config{}, nil)
+	defer other.Close()
+
+	job, err := running.Submit(context.Background(), "u1", []Request{{CustomID: "a", Body: llm.ChatRequest{Model: "m"}}}, 1)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	cancelled, err := other.Cancel(context.Background(), "u1", job.ID)
+	if err != nil || cancelled.Status != StatusCancelling {
+		t.Fatalf("Cancel = %+v, %v; want cancelling", cancelled, err)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the running instance did not stop the job")
+	}
+	waitForStatus(t, other, "u1", job.ID, StatusCancelled)
+
+	// A late save from the running side must not revive the job.
+	stale := *job
+	if err := store.Update(context.Background(), &stale); !errors.Is(err, ErrConflict) {
+		t.Fatalf("in_progress over cancelled: %v, want ErrConflict", err)
+	}
+	stale.Status = StatusCompleted
+	if err := store.Update(context.Background(), &stale); !errors.Is(err, ErrConflict) {
+		t.Fatalf("completed over cancelled: %v, want ErrConflict", err)
+	}
+}
+
+func TestManagerCloseRecordsInterrupted(t *testing.T) {
+	started := make(chan struct{}, 1)
+	complete := func(ctx context.Context, req *llm.ChatRequest, userID string) (int, []byte) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return http.StatusGatewayTimeout, nil
+	}
+
+	store := NewMemoryStore(time.Hour)
+	m := NewManager(store, complete, Config{Workers: 1}, nil)
+
+	reqs := make([]Request, 3)
+	for i := range reqs {
+		reqs[i] = Request{CustomID: string(rune('a' + i)), Body: llm.ChatRequest{Model: "m"}}
+	}
+	job, err := m.Submit(context.Background(), "u1", reqs, 1)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	<-started
+	m.Close()
+
+	final, err := store.Get(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if final.Status != StatusFailed || final.RequestCounts.Failed != 3 {
+		t.Fatalf("unexpected job after shutdown: %+v", final)
+	}
+	lines, _ := store.Outputs(context.Background(), job.ID)
+	if len(lines) != 3 {
+		t.Fatalf("expected a line per request, got %d", len(lines))
+	}
+	for _, line := range lines {
+		var res Result
+		if err := json.Unmarshal(line, &res); err != nil {
+			t.Fatalf("decode result: %v", err)
+		}
+		if res.Response != nil || res.Error == nil || res.Error.Code != ErrCodeInterrupted {
+			t.Fatalf("unexpected result: %s", line)
+		}
+	}
+}
+
+func TestManagerFailsOrphanedJob(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	m := NewManager(store, nil, Config{}, nil)
+	defer m.Close()
+
+	stale := time.Now().Add(-2 * orphanAfter).Unix()
+	fresh := time.Now().Unix()
+	for id, updated := range map[string]int64{"batch_stale": stale, "batch_fresh": fresh} {
+		job := &Job{ID: id, Status: StatusInProgress, UserID: "u1", InProgressAt: updated, UpdatedAt: updated}
+		if err := store.Create(context.Background(), job); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	if job, err := m.Get(context.Background(), "u1", "batch_stale"); err != nil || job.Status != StatusFailed || job.FailedAt == 0 {
+		t.Fatalf("expected orphaned job to fail, got %+v, %v", job, err)
+	}
+	if job, _ := store.Get(context.Background(), "batch_stale"); job.Status != StatusFailed {
+		t.Fatalf("failed status was not stored: %+v", job)
+	}
+	if job, err := m.Get(context.Background(), "u1", "batch_fresh"); err != nil || job.Status != StatusInProgress {
+		t.Fatalf("job with a live heartbeat must keep running, got %+v, %v", job, err)
+	}
+}
+
+func TestMemoryStoreDropsEndedJobs(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(20 * time.Millisecond)
+	defer store.Close()
+
+	for _, id := range []string{"batch_done", "batch_running"} {
+		if err := store.Create(ctx, &Job{ID: id, Status: StatusInProgress}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := store.AppendOutput(ctx, id, []byte(`{}`)); err != nil {
+			t.Fatalf("AppendOutput: %v", err)
+		}
+	}
+	if err := store.Update(ctx, &Job{ID: "batch_done", Status: StatusCompleted}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := store.Get(ctx, "batch_done"); errors.Is(err, ErrNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ended job was kept past its retention")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := store.Outputs(ctx, "batch_done"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("output of the dropped job: %v", err)
+	}
+	if _, err := store.Get(ctx, "batch_running"); err != nil {
+		t.Fatalf("running job must be kept: %v", err)
+	}
+}
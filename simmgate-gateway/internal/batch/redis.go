@@ -0,0 +1,142 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRetention = 7 * 24 * time.Hour
+	// maxUpdateAttempts bounds Update retries when the job changes between
+	// WATCH and EXEC.
+	maxUpdateAttempts = 5
+)
+
+// RedisStore keeps jobs in Redis so their state survives restarts and is
+// visible to every gateway instance. All keys expire after Retention.
+//
+// Keys: <prefix>:batch:<id> (job JSON) and <prefix>:batch:<id>:output
+// (list of JSONL lines).
+type RedisStore struct {
+	client    *redis.Client
+	prefix    string
+	retention time.Duration
+}
+
+func NewRedisStore(client *redis.Client, prefix string, retention time.Duration) *RedisStore {
+	if retention <= 0 {
+		retention = defaultRetention
+	}
+	return &RedisStore{client: client, prefix: prefix, retention: retention}
+}
+
+func (s *RedisStore) key(id string, suffix ...string) string {
+	k := "batch:" + id
+	if s.prefix != "" {
+		k = s.prefix + ":" + k
+	}
+	for _, part := range suffix {
+		k += ":" + part
+	}
+	return k
+}
+
+func (s *RedisStore) Create(ctx context.Context, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Set(ctx, s.key(job.ID), data, s.retention).Err(); err != nil {
+		return fmt.Errorf("redis batch create failed: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisStore) Get(ctx context.Context, id string) (*Job, error) {
+	data, err := s.client.Get(ctx, s.key(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis batch get failed: %w", err)
+	}
+
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("decode batch %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// Update overwrites the job, keeping its remaining TTL. The stored status
+// is checked under WATCH, so instances racing on one job cannot undo each
+// other's cancellation or failure.
+func (s *RedisStore) Update(ctx context.Context, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	key := s.key(job.ID)
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			current, err := tx.Get(ctx, key).Bytes()
+			if err == redis.Nil {
+				return ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			var stored Job
+			if err := json.Unmarshal(current, &stored); err != nil {
+				return fmt.Errorf("decode batch %s: %w", job.ID, err)
+			}
+			if !CanReplace(stored.Status, job.Status) {
+				return ErrConflict
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetArgs(ctx, key, data, redis.SetArgs{KeepTTL: true})
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	switch {
+	case err == nil, errors.Is(err, ErrNotFound), errors.Is(err, ErrConflict):
+		return err
+	}
+	return fmt.Errorf("redis batch update failed: %w", err)
+}
+
+func (s *RedisStore) AppendOutput(ctx context.Context, id string, line []byte) error {
+	pipe := s.client.TxPipeline()
+	pipe.RPush(ctx, s.key(id, "output"), line)
+	pipe.Expire(ctx, s.key(id, "output"), s.retention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis batch append failed: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisStore) Outputs(ctx context.Context, id string) ([][]byte, error) {
+	return s.lines(ctx, s.key(id, "output"))
+}
+
+func (s *RedisStore) lines(ctx context.Context, key string) ([][]byte, error) {
+	vals, err := s.client.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis batch read failed: %w", err)
+	}
+	out := make([][]byte, len(vals))
+	for i, v := range vals {
+		out[i] = []byte(v)
+	}
+	return out, nil
+}
@@ -0,0 +1,140 @@
+package batch
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store persists jobs and their output lines. Inputs are not stored: a job
+// runs on the instance it was submitted to and is not resumed elsewhere.
+type Store interface {
+	Create(ctx context.Context, job *Job) error
+	// Get returns ErrNotFound for unknown IDs.
+	Get(ctx context.Context, id string) (*Job, error)
+	// Update overwrites the job if CanReplace allows its status over the
+	// stored one, atomically, and returns ErrConflict otherwise.
+	Update(ctx context.Context, job *Job) error
+	AppendOutput(ctx context.Context, id string, line []byte) error
+	Outputs(ctx context.Context, id string) ([][]byte, error)
+}
+
+type memoryJob struct {
+	job     Job
+	outputs [][]byte
+	// ended is when the job reached a terminal status; zero while it runs.
+	ended time.Time
+}
+
+// MemoryStore keeps jobs in process memory; they are lost on restart. A
+// job and its output are dropped Retention after the job ended, like the
+// key expiry of RedisStore.
+type MemoryStore struct {
+	retention time.Duration
+
+	mu   sync.RWMutex
+	jobs map[string]*memoryJob
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewMemoryStore(retention time.Duration) *MemoryStore {
+	if retention <= 0 {
+		retention = defaultRetention
+	}
+	s := &MemoryStore{
+		retention: retention,
+		jobs:      make(map[string]*memoryJob),
+		stop:      make(chan struct{}),
+	}
+	go s.cleanup()
+	return s
+}
+
+func (s *MemoryStore) Create(_ context.Context, job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = &memoryJob{job: *job}
+	return nil
+}
+
+func (s *MemoryStore) Get(_ context.Context, id string) (*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	mj, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	job := mj.job
+	return &job, nil
+}
+
+func (s *MemoryStore) Update(_ context.Context, job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mj, ok := s.jobs[job.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if !CanReplace(mj.job.Status, job.Status) {
+		return ErrConflict
+	}
+	mj.job = *job
+	if mj.ended.IsZero() && job.Terminal() {
+		mj.ended = time.Now()
+	}
+	return nil
+}
+
+func (s *MemoryStore) AppendOutput(_ context.Context, id string, line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mj, ok := s.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	mj.outputs = append(mj.outputs, line)
+	return nil
+}
+
+func (s *MemoryStore) Outputs(_ context.Context, id string) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	mj, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([][]byte(nil), mj.outputs...), nil
+}
+
+// Close stops the cleanup goroutine.
+func (s *MemoryStore) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func (s *MemoryStore) cleanup() {
+	ticker := time.NewTicker(s.retention / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-s.retention)
+			s.mu.Lock()
+			for id, mj := range s.jobs {
+				if !mj.ended.IsZero() && mj.ended.Before(cutoff) {
+					delete(s.jobs, id)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
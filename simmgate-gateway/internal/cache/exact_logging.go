@@ -6,8 +6,12 @@ import (
 	"time"
 
 	"simmgate-gateway/internal/metrics"
+	"simmgate-gateway/internal/tracing"
 	"simmgate-gateway/pkg/logging/logging"
 
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -22,20 +26,23 @@ func NewLoggingExactCache(inner ExactCache) ExactCache {
 }
 
 func (c *LoggingExactCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "exact_cache get", trace.WithAttributes(spanAttributes(key)...))
+
 	start := time.Now()
 	value, ok, err := c.inner.Get(ctx, key)
 	latencyMs := float64(time.Since(start).Microseconds()) / 1000.0
 
 	logger := loggerFromContext(ctx)
 
-	result := "miss"
+	result := metrics.CacheMiss
 	if err != nil {
-		result = "error"
+		result = metrics.CacheError
 	} else if ok {
-		result = "hit"
+		result = metrics.CacheHit
 		// Prometheus: count exact cache hits
-		metrics.ExactHitsTotal.Inc()
+		metrics.Add(ctx, metrics.ExactHitsTotal, 1)
 	}
+	metrics.Add(ctx, metrics.CacheLookupsTotal.WithLabelValues("exact", result), 1)
 
 	fields := []zap.Field{
 		zap.String("cache_tier", "exact"),
@@ -59,10 +66,15 @@ func (c *LoggingExactCache) Get(ctx context.Context, key string) ([]byte, bool,
 		logger.Info("exact_cache_get", fields...)
 	}
 
+	span.SetAttributes(attribute.String("simmgate.cache.result", result))
+	tracing.EndSpan(span, err)
+
 	return value, ok, err
 }
 
 func (c *LoggingExactCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ctx, span := tracing.Tracer().Start(ctx, "exact_cache set", trace.WithAttributes(spanAttributes(key)...))
+
 	start := time.Now()
 	err := c.inner.Set(ctx, key, value, ttl)
 	latencyMs := float64(time.Since(start).Microseconds()) / 1000.0
@@ -90,9 +102,25 @@ func (c *LoggingExactCache) Set(ctx context.Context, key string, value []byte, t
 		logger.Info("exact_cache_set", fields...)
 	}
 
+	span.SetAttributes(attribute.Int("simmgate.cache.value_bytes", len(value)))
+	tracing.EndSpan(span, err)
+
 	return err
 }
 
+// spanAttributes describes a cache operation; the key itself is not
+// recorded since it carries the user ID.
+func spanAttributes(key string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("simmgate.cache.tier", "exact")}
+	if parts, ok := parseExactKey(key); ok {
+		attrs = append(attrs,
+			semconv.GenAIRequestModel(parts.modelID),
+			attribute.String("simmgate.cache.hash", parts.hash),
+		)
+	}
+	return attrs
+}
+
 func loggerFromContext(ctx context.Context) *zap.Logger {
 	if l := logging.FromContext(ctx); l != nil {
 		return l
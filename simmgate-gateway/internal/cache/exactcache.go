@@ -26,3 +26,18 @@ type ExactCache interface {
 	Get(ctx context.Context, key string) ([]byte, bool, error)
 	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
 }
+
+// ResponseStateKey is the key under which /v1/responses stores the
+// conversation behind a response ID, scoped to the caller so one tenant
+// cannot continue another's conversation.
+func ResponseStateKey(userID, versionID, responseID string) string {
+	// response:<USER_ID>:<VERSION_ID>:<RESPONSE_ID>
+	return fmt.Sprintf("response:%s:%s:%s", userID, versionID, responseID)
+}
+
+// AsyncJobKey is the key under which an async request's job state is
+// stored, scoped to the caller like ResponseStateKey.
+func AsyncJobKey(userID, jobID string) string {
+	// async:<USER_ID>:<JOB_ID>
+	return fmt.Sprintf("async:%s:%s", userID, jobID)
+}
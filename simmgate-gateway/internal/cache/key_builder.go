@@ -1,9 +1,11 @@
 package cache
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"strconv"
 	"strings"
 
 	"simmgate-gateway/internal/llm"
@@ -23,8 +25,10 @@ func BuildExactCacheKeyFromChatRequest(
 ) (ExactCacheKey, error) {
 	modelID := strings.TrimSpace(req.Model)
 
-	// Simple normalization for now: model + full JSON body of request.
-	body, err := json.Marshal(req)
+	// Normalization: model + JSON body of the request (including pass-through
+	// fields) with embedded JSON (tool schemas, tool_choice, tool-call
+	// arguments, extra values) in canonical form.
+	body, err := json.Marshal(normalizeChatRequest(req))
 	if err != nil {
 		return ExactCacheKey{}, err
 	}
@@ -41,3 +45,137 @@ func BuildExactCacheKeyFromChatRequest(
 		Hash:      hash,
 	}, nil
 }
+
+// BuildEmbeddingCacheKey builds the exact-cache key for a single embedding
+// input. Everything that changes the vector (model, encoding format,
+// dimensions) is part of the hash, so batched and single requests for the
+// same text share an entry.
+func BuildEmbeddingCacheKey(
+	model string,
+	input string,
+	encodingFormat string,
+	dimensions *int,
+	userID string,
+	versionID string,
+) ExactCacheKey {
+	modelID := strings.TrimSpace(model)
+
+	dims := ""
+	if dimensions != nil {
+		dims = strconv.Itoa(*dimensions)
+	}
+	if encodingFormat == "" {
+		encodingFormat = "float"
+	}
+
+	normalized := "embedding|model:" + modelID + "|format:" + encodingFormat +
+		"|dims:" + dims + "|input:" + input
+
+	sum := sha256.Sum256([]byte(normalized))
+
+	return ExactCacheKey{
+		UserID:    strings.TrimSpace(userID),
+		ModelID:   modelID,
+		VersionID: strings.TrimSpace(versionID),
+		Hash:      hex.EncodeToString(sum[:]),
+	}
+}
+
+// normalizeChatRequest returns a copy of req whose JSON-valued fields are
+// canonicalized (sorted keys, no insignificant whitespace), so requests that
+// differ only in how a client serialized a tool schema share a cache entry.
+// Tool order is preserved because it is visible to the model.
+func normalizeChatRequest(req llm.ChatRequest) llm.ChatRequest {
+	out := req
+
+	if len(req.Messages) > 0 {
+		out.Messages = make([]llm.ChatMessage, len(req.Messages))
+		for i, m := range req.Messages {
+			if m.Parts != nil {
+				m.Parts = normalizeContentParts(m.Parts)
+			}
+			if len(m.ToolCalls) > 0 {
+				calls := make([]llm.ToolCall, len(m.ToolCalls))
+				for j, tc := range m.ToolCalls {
+					tc.Function.Arguments = string(canonicalJSON([]byte(tc.Function.Arguments)))
+					calls[j] = tc
+				}
+				m.ToolCalls = calls
+			}
+			out.Messages[i] = m
+		}
+	}
+
+	if len(req.Tools) > 0 {
+		out.Tools = make([]llm.Tool, len(req.Tools))
+		for i, t := range req.Tools {
+			t.Function.Parameters = canonicalJSON(t.Function.Parameters)
+			out.Tools[i] = t
+		}
+	}
+
+	out.ToolChoice = canonicalJSON(req.ToolChoice)
+
+	if len(req.Extra) > 0 {
+		out.Extra = make(map[string]json.RawMessage, len(req.Extra))
+		for k, v := range req.Extra {
+			out.Extra[k] = canonicalJSON(v)
+		}
+	}
+
+	if rf := req.ResponseFormat; rf != nil && rf.JSONSchema != nil {
+		schema := *rf.JSONSchema
+		schema.Schema = canonicalJSON(schema.Schema)
+		out.ResponseFormat = &llm.ResponseFormat{Type: rf.Type, JSONSchema: &schema}
+	}
+
+	return out
+}
+
+// normalizeContentParts replaces inline image and audio payloads with their
+// SHA-256 digest so multi-megabyte data URLs are not copied into the
+// normalized key string. Remote image URLs are kept as-is.
+func normalizeContentParts(parts []llm.ContentPart) []llm.ContentPart {
+	out := make([]llm.ContentPart, len(parts))
+	for i, p := range parts {
+		if p.ImageURL != nil && strings.HasPrefix(p.ImageURL.URL, "data:") {
+			img := *p.ImageURL
+			img.URL = digest(img.URL)
+			p.ImageURL = &img
+		}
+		if p.InputAudio != nil {
+			audio := *p.InputAudio
+			audio.Data = digest(audio.Data)
+			p.InputAudio = &audio
+		}
+		out[i] = p
+	}
+	return out
+}
+
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// canonicalJSON re-encodes raw with sorted object keys. Input that is empty
+// or not valid JSON is returned unchanged.
+func canonicalJSON(raw []byte) []byte {
+	if len(raw) == 0 {
+		return raw
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return raw
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return raw
+	}
+	return out
+}
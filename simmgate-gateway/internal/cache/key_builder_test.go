@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"simmgate-gateway/internal/llm"
+)
+
+func TestBuildExactCacheKey_CanonicalToolJSON(t *testing.T) {
+	build := func(params, args string) string {
+		req := llm.ChatRequest{
+			Model: "gpt-4",
+			Messages: []llm.ChatMessage{
+				{Role: llm.RoleUser, Content: "weather?"},
+				{Role: llm.RoleAssistant, ToolCalls: []llm.ToolCall{{
+					ID:       "call_1",
+					Type:     llm.ToolTypeFunction,
+					Function: llm.FunctionCall{Name: "get_weather", Arguments: args},
+				}}},
+				{Role: llm.RoleTool, ToolCallID: "call_1", Content: "sunny"},
+			},
+			Tools: []llm.Tool{{
+				Type: llm.ToolTypeFunction,
+				Function: llm.FunctionDefinition{
+					Name:       "get_weather",
+					Parameters: json.RawMessage(params),
+				},
+			}},
+		}
+		key, err := BuildExactCacheKeyFromChatRequest(req, "u", "v1")
+		if err != nil {
+			t.Fatalf("build key: %v", err)
+		}
+		return key.Hash
+	}
+
+	a := build(`{"type":"object","properties":{"city":{"type":"string"}}}`, `{"city":"Oslo","unit":"c"}`)
+	b := build(`{ "properties": {"city": {"type":"string"}}, "type": "object" }`, `{"unit": "c", "city": "Oslo"}`)
+	if a != b {
+		t.Fatalf("expected equivalent tool JSON to share a key: %s != %s", a, b)
+	}
+
+	c := build(`{"type":"object"}`, `{"city":"Oslo","unit":"c"}`)
+	if a == c {
+		t.Fatalf("expected different tool schemas to produce different keys")
+	}
+}
+
+func TestBuildExactCacheKey_HashesInlineImages(t *testing.T) {
+	build := func(url string) llm.ChatRequest {
+		return llm.ChatRequest{
+			Model: "gpt-4o",
+			Messages: []llm.ChatMessage{{
+				Role: llm.RoleUser,
+				Parts: []llm.ContentPart{
+					{Type: llm.ContentPartText, Text: "describe"},
+					{Type: llm.ContentPartImageURL, ImageURL: &llm.ImageURL{URL: url}},
+				},
+			}},
+		}
+	}
+
+	req := build("data:image/png;base64," + strings.Repeat("A", 4096))
+	normalized := normalizeChatRequest(req)
+
+	got := normalized.Messages[0].Parts[1].ImageURL.URL
+	if !strings.HasPrefix(got, "sha256:") {
+		t.Fatalf("expected data URL to be replaced by digest, got %q", got)
+	}
+	if req.Messages[0].Parts[1].ImageURL.URL == got {
+		t.Fatalf("normalization must not mutate the original request")
+	}
+
+	a, _ := BuildExactCacheKeyFromChatRequest(req, "u", "v1")
+	b, _ := BuildExactCacheKeyFromChatRequest(build("data:image/png;base64,"+strings.Repeat("B", 4096)), "u", "v1")
+	if a.Hash == b.Hash {
+		t.Fatalf("different images must produce different keys")
+	}
+}
+
+func TestBuildExactCacheKey_IncludesExtraFields(t *testing.T) {
+	build := func(body string) string {
+		var req llm.ChatRequest
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		key, err := BuildExactCacheKeyFromChatRequest(req, "u", "v1")
+		if err != nil {
+			t.Fatalf("build key: %v", err)
+		}
+		return key.Hash
+	}
+
+	base := build(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`)
+	seeded := build(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"seed":1}`)
+	if base == seeded {
+		t.Fatalf("extra fields must be part of the key")
+	}
+
+	a := build(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"logit_bias":{"1":2,"3":4}}`)
+	b := build(`{"logit_bias":{"3":4, "1":2},"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`)
+	if a != b {
+		t.Fatalf("equivalent extra values must share a key")
+	}
+}
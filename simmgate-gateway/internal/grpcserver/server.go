@@ -0,0 +1,160 @@
+// Package grpcserver builds the gRPC server that exposes the chat API next
+// to the HTTP router, with the same request logging, panic recovery and
+// latency metrics.
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/metrics"
+	"simmgate-gateway/internal/tracing"
+	"simmgate-gateway/pkg/logging/logging"
+	pb "simmgate-gateway/proto/simmgate/v1"
+)
+
+// New returns a server with svc registered.
+func New(baseLogger *zap.Logger, svc pb.ChatServiceServer) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.MaxRecvMsgSize(llm.MaxPayloadBytes),
+		grpc.ChainUnaryInterceptor(unaryInterceptor(baseLogger)),
+		grpc.ChainStreamInterceptor(streamInterceptor(baseLogger)),
+	)
+	pb.RegisterChatServiceServer(srv, svc)
+	return srv
+}
+
+func unaryInterceptor(baseLogger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		ctx, span := startSpan(ctx, info.FullMethod)
+		ctx = withLogger(ctx, baseLogger, info.FullMethod)
+		start := time.Now()
+		inFlight := metrics.InFlightRequests.WithLabelValues("grpc")
+		inFlight.Inc()
+		defer func() {
+			inFlight.Dec()
+			if rec := recover(); rec != nil {
+				err = recovered(ctx, rec)
+			}
+			observe(ctx, info.FullMethod, start, err)
+			endSpan(span, err)
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func streamInterceptor(baseLogger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		ctx, span := startSpan(ss.Context(), info.FullMethod)
+		ctx = withLogger(ctx, baseLogger, info.FullMethod)
+		start := time.Now()
+		inFlight := metrics.InFlightRequests.WithLabelValues("grpc")
+		inFlight.Inc()
+		defer func() {
+			inFlight.Dec()
+			if rec := recover(); rec != nil {
+				err = recovered(ctx, rec)
+			}
+			observe(ctx, info.FullMethod, start, err)
+			endSpan(span, err)
+		}()
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// withLogger attaches a request-scoped logger and the request ID, like
+// chi's RequestID and middleware.LoggingContext. The request ID comes from
+// x-request-id metadata or is numbered from chi's request ID counter.
+func withLogger(ctx context.Context, baseLogger *zap.Logger, method string) context.Context {
+	reqID := fmt.Sprintf("grpc-%06d", chimw.NextRequestID())
+	if v := metadata.ValueFromIncomingContext(ctx, "x-request-id"); len(v) > 0 && v[0] != "" {
+		reqID = v[0]
+	}
+	ctx = context.WithValue(ctx, chimw.RequestIDKey, reqID)
+	fields := []zap.Field{
+		zap.String("method", "GRPC"),
+		zap.String("path", method),
+		zap.String("request_id", reqID),
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		fields = append(fields, zap.String("trace_id", sc.TraceID().String()))
+	}
+	return logging.WithLogger(ctx, baseLogger.With(fields...))
+}
+
+// startSpan continues the caller's trace from traceparent metadata and
+// starts the server span of the call.
+func startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	return tracing.Tracer().Start(ctx, strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCMethod(method)),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	span.SetAttributes(semconv.RPCResponseStatusCode(status.Code(err).String()))
+	tracing.EndSpan(span, err)
+}
+
+// metadataCarrier reads propagation fields from incoming metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func recovered(ctx context.Context, rec interface{}) error {
+	logging.L(ctx).Error("panic recovered",
+		zap.Any("error", rec),
+		zap.ByteString("stack", debug.Stack()),
+	)
+	return status.Error(codes.Internal, "internal server error")
+}
+
+// observe records the call in the gateway latency histogram, with the gRPC
+// status code in place of the HTTP one.
+func observe(ctx context.Context, method string, start time.Time, err error) {
+	metrics.Observe(ctx,
+		metrics.GatewayLatencySeconds.WithLabelValues(method, "GRPC", status.Code(err).String()),
+		time.Since(start).Seconds(),
+	)
+}
+
+// contextStream replaces the context of a ServerStream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
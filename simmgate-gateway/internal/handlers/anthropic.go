@@ -0,0 +1,646 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/pkg/logging/logging"
+
+	"go.uber.org/zap"
+)
+
+// Anthropic Messages API block and stop-reason values.
+const (
+	anthropicBlockText       = "text"
+	anthropicBlockImage      = "image"
+	anthropicBlockToolUse    = "tool_use"
+	anthropicBlockToolResult = "tool_result"
+
+	anthropicStopEndTurn   = "end_turn"
+	anthropicStopMaxTokens = "max_tokens"
+	anthropicStopToolUse   = "tool_use"
+)
+
+// anthropicRequest is the inbound /v1/messages request body.
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	MaxTokens     int                `json:"max_tokens"`
+	Messages      []anthropicMessage `json:"messages"`
+	System        json.RawMessage    `json:"system,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Temperature   float32            `json:"temperature,omitempty"`
+	TopP          float32            `json:"top_p,omitempty"`
+	TopK          json.RawMessage    `json:"top_k,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+
+	Metadata   *anthropicMetadata   `json:"metadata,omitempty"`
+	Tools      []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice *anthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+type anthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+// anthropicMessage content is a string or an array of blocks.
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// anthropicBlock is one inbound content block of any type.
+type anthropicBlock struct {
+	Type   string           `json:"type"`
+	Text   string           `json:"text,omitempty"`
+	Source *anthropicSource `json:"source,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result; Content is a string or an array of text blocks.
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+}
+
+// anthropicSource is an image source: base64 data or a URL.
+type anthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type                   string `json:"type"` // auto, any, tool, none
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// anthropicContent is one outbound content block.
+type anthropicContent struct {
+	Type  string          `json:"type"`
+	Text  *string         `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	ID           string             `json:"id"`
+	Type         string             `json:"type"`
+	Role         string             `json:"role"`
+	Model        string             `json:"model"`
+	Content      []anthropicContent `json:"content"`
+	StopReason   *string            `json:"stop_reason"`
+	StopSequence *string            `json:"stop_sequence"`
+	Usage        anthropicUsage     `json:"usage"`
+}
+
+type anthropicError struct {
+	Type  string             `json:"type"`
+	Error anthropicErrorBody `json:"error"`
+}
+
+type anthropicErrorBody struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// Messages handles POST /v1/messages (Anthropic Messages API). The request
+// is translated to a ChatRequest and served through the same cache and
+// provider path as ChatCompletion; the reply goes back in Anthropic's
+// message and named-event SSE formats regardless of the upstream provider.
+func (h *ChatHandler) Messages(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.L(ctx)
+	start := time.Now()
+
+	var areq anthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&areq); err != nil {
+		logger.Warn("invalid_request", zap.Error(err))
+		writeAnthropicError(ctx, w, requestBodyError(err))
+		return
+	}
+
+	req, err := areq.toChatRequest()
+	if err != nil {
+		writeAnthropicError(ctx, w, err)
+		return
+	}
+	req.Model = h.Models.Resolve(req.Model)
+
+	userID := userIDFromRequest(r)
+	versionID := versionOrDefault(h.VersionID)
+
+	if req.Stream {
+		// Output token counts are reported in message_delta.
+		req.StreamOptions = &llm.StreamOptions{IncludeUsage: true}
+		sw := newAnthropicStream(req.Model)
+		if err := h.streamChatCompletion(ctx, w, logger, req, userID, versionID, r.Header.Get(lastEventIDHeader), start, sw); err != nil {
+			writeAnthropicError(ctx, w, err)
+		}
+		return
+	}
+
+	resp, err := h.complete(ctx, req, userID, versionID, start)
+	if err != nil {
+		writeAnthropicError(ctx, w, err)
+		return
+	}
+
+	writeJSON(ctx, w, chatToAnthropic(resp))
+}
+
+func anthropicInvalid(param, msg string) error {
+	return &statusError{
+		status: http.StatusBadRequest,
+		body:   newAPIError(errTypeInvalidRequest, "invalid_request", param, msg),
+	}
+}
+
+// toChatRequest converts an Anthropic request into a ChatRequest. Content
+// maps one-to-one where possible (a string stays a string, a block array
+// becomes parts) so that equivalent chat requests share cache entries.
+func (a *anthropicRequest) toChatRequest() (*llm.ChatRequest, error) {
+	if a.MaxTokens <= 0 {
+		return nil, anthropicInvalid("max_tokens", "max_tokens is required and must be positive")
+	}
+
+	req := &llm.ChatRequest{
+		Model:       a.Model,
+		Temperature: a.Temperature,
+		TopP:        a.TopP,
+		MaxTokens:   a.MaxTokens,
+		Stop:        a.StopSequences,
+		Stream:      a.Stream,
+	}
+
+	if len(a.System) > 0 && string(a.System) != "null" {
+		system, err := anthropicText(a.System)
+		if err != nil {
+			return nil, anthropicInvalid("system", "system must be a string or an array of text blocks")
+		}
+		req.Messages = append(req.Messages, llm.ChatMessage{Role: llm.RoleSystem, Content: system})
+	}
+
+	for i, m := range a.Messages {
+		msgs, err := m.toChatMessages()
+		if err != nil {
+			return nil, anthropicInvalid(fmt.Sprintf("messages[%d]", i), err.Error())
+		}
+		req.Messages = append(req.Messages, msgs...)
+	}
+
+	for _, t := range a.Tools {
+		req.Tools = append(req.Tools, llm.Tool{
+			Type: llm.ToolTypeFunction,
+			Function: llm.FunctionDefinition{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.InputSchema,
+			},
+		})
+	}
+
+	if tc := a.ToolChoice; tc != nil {
+		var choice interface{}
+		switch tc.Type {
+		case "auto", "none":
+			choice = tc.Type
+		case "any":
+			choice = "required"
+		case "tool":
+			choice = map[string]interface{}{
+				"type":     llm.ToolTypeFunction,
+				"function": map[string]string{"name": tc.Name},
+			}
+		default:
+			return nil, anthropicInvalid("tool_choice", fmt.Sprintf("unsupported tool_choice type %q", tc.Type))
+		}
+		raw, err := json.Marshal(choice)
+		if err != nil {
+			return nil, err
+		}
+		req.ToolChoice = raw
+		if tc.DisableParallelToolUse {
+			parallel := false
+			req.ParallelToolCalls = &parallel
+		}
+	}
+
+	if len(a.TopK) > 0 {
+		req.Extra = map[string]json.RawMessage{"top_k": a.TopK}
+	}
+	if a.Metadata != nil && a.Metadata.UserID != "" {
+		user, err := json.Marshal(a.Metadata.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if req.Extra == nil {
+			req.Extra = make(map[string]json.RawMessage)
+		}
+		req.Extra["user"] = user
+	}
+
+	return req, nil
+}
+
+// toChatMessages converts one Anthropic message. tool_result blocks become
+// separate role "tool" messages placed before the rest of the user turn,
+// since chat providers expect them right after the assistant's tool calls.
+func (m anthropicMessage) toChatMessages() ([]llm.ChatMessage, error) {
+	if m.Role != llm.RoleUser && m.Role != llm.RoleAssistant {
+		return nil, fmt.Errorf("role must be user or assistant, got %q", m.Role)
+	}
+
+	if len(m.Content) > 0 && m.Content[0] == '"' {
+		var text string
+		if err := json.Unmarshal(m.Content, &text); err != nil {
+			return nil, err
+		}
+		return []llm.ChatMessage{{Role: m.Role, Content: text}}, nil
+	}
+
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(m.Content, &blocks); err != nil {
+		return nil, fmt.Errorf("content must be a string or an array of blocks")
+	}
+
+	if m.Role == llm.RoleAssistant {
+		msg := llm.ChatMessage{Role: llm.RoleAssistant}
+		var text strings.Builder
+		for _, b := range blocks {
+			switch b.Type {
+			case anthropicBlockText:
+				text.WriteString(b.Text)
+			case anthropicBlockToolUse:
+				args := "{}"
+				if len(b.Input) > 0 {
+					args = string(b.Input)
+				}
+				msg.ToolCalls = append(msg.ToolCalls, llm.ToolCall{
+					ID:       b.ID,
+					Type:     llm.ToolTypeFunction,
+					Function: llm.FunctionCall{Name: b.Name, Arguments: args},
+				})
+			default:
+				return nil, fmt.Errorf("unsupported assistant block type %q", b.Type)
+			}
+		}
+		msg.Content = text.String()
+		return []llm.ChatMessage{msg}, nil
+	}
+
+	var out []llm.ChatMessage
+	var parts []llm.ContentPart
+	for _, b := range blocks {
+		switch b.Type {
+		case anthropicBlockText:
+			parts = append(parts, llm.ContentPart{Type: llm.ContentPartText, Text: b.Text})
+		case anthropicBlockImage:
+			if b.Source == nil {
+				return nil, fmt.Errorf("image block has no source")
+			}
+			url := b.Source.URL
+			if b.Source.Type == "base64" {
+				url = "data:" + b.Source.MediaType + ";base64," + b.Source.Data
+			}
+			parts = append(parts, llm.ContentPart{
+				Type:     llm.ContentPartImageURL,
+				ImageURL: &llm.ImageURL{URL: url},
+			})
+		case anthropicBlockToolResult:
+			text, err := anthropicText(b.Content)
+			if err != nil {
+				return nil, fmt.Errorf("tool_result content must be a string or an array of text blocks")
+			}
+			out = append(out, llm.ChatMessage{Role: llm.RoleTool, ToolCallID: b.ToolUseID, Content: text})
+		default:
+			return nil, fmt.Errorf("unsupported user block type %q", b.Type)
+		}
+	}
+	if len(parts) > 0 {
+		out = append(out, llm.ChatMessage{Role: llm.RoleUser, Parts: parts})
+	}
+	return out, nil
+}
+
+// anthropicText flattens a string or an array of text blocks.
+func anthropicText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	if raw[0] == '"' {
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", err
+	}
+	var text strings.Builder
+	for _, b := range blocks {
+		if b.Type != anthropicBlockText {
+			return "", fmt.Errorf("unsupported block type %q", b.Type)
+		}
+		text.WriteString(b.Text)
+	}
+	return text.String(), nil
+}
+
+// chatToAnthropic converts the first choice of a chat response into an
+// Anthropic message.
+func chatToAnthropic(resp *llm.ChatResponse) anthropicResponse {
+	out := anthropicResponse{
+		ID:      anthropicMessageID(resp.ID),
+		Type:    "message",
+		Role:    llm.RoleAssistant,
+		Model:   resp.Model,
+		Content: []anthropicContent{},
+	}
+	if resp.Usage != nil {
+		out.Usage = anthropicUsage{
+			InputTokens:  resp.Usage.PromptTokens,
+			OutputTokens: resp.Usage.CompletionTokens,
+		}
+	}
+	if len(resp.Choices) == 0 {
+		return out
+	}
+
+	choice := resp.Choices[0]
+	if text := choice.Message.Text(); text != "" {
+		out.Content = append(out.Content, anthropicContent{Type: anthropicBlockText, Text: &text})
+	}
+	for _, tc := range choice.Message.ToolCalls {
+		out.Content = append(out.Content, anthropicContent{
+			Type:  anthropicBlockToolUse,
+			ID:    tc.ID,
+			Name:  tc.Function.Name,
+			Input: toolInput(tc.Function.Arguments),
+		})
+	}
+
+	reason := anthropicStopReason(choice.FinishReason)
+	out.StopReason = &reason
+	return out
+}
+
+func anthropicMessageID(id string) string {
+	if id == "" {
+		return newCompletionID("msg_")
+	}
+	return "msg_" + strings.TrimPrefix(id, "chatcmpl-")
+}
+
+// toolInput returns tool-call arguments as a JSON object; invalid or empty
+// arguments become {}.
+func toolInput(args string) json.RawMessage {
+	if args == "" || !json.Valid([]byte(args)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(args)
+}
+
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return anthropicStopMaxTokens
+	case "tool_calls", "function_call":
+		return anthropicStopToolUse
+	default:
+		return anthropicStopEndTurn
+	}
+}
+
+// anthropicErrorType maps an HTTP status to Anthropic's error type.
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+func newAnthropicError(err error) (int, anthropicError) {
+	status, body := errorFromLLM(err)
+	return status, anthropicError{
+		Type:  "error",
+		Error: anthropicErrorBody{Type: anthropicErrorType(status), Message: body.Message},
+	}
+}
+
+// writeAnthropicError writes err in Anthropic's error envelope.
+func writeAnthropicError(ctx context.Context, w http.ResponseWriter, err error) {
+	logger := logging.L(ctx)
+
+	status, body := newAnthropicError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Warn("write_error_json_failed", zap.Error(err))
+	}
+}
+
+// anthropicStream writes Anthropic's named SSE events: message_start, then
+// content_block_start/delta/stop per text or tool_use block, then
+// message_delta and message_stop. Only the first choice is streamed.
+type anthropicStream struct {
+	id      string
+	model   string
+	started bool
+
+	blockIndex int
+	blockOpen  bool
+	blockType  string
+
+	stopReason string
+	usage      *llm.Usage
+}
+
+func newAnthropicStream(model string) *anthropicStream {
+	return &anthropicStream{model: model, blockIndex: -1}
+}
+
+func (s *anthropicStream) start(w io.Writer, c *llm.StreamChunk) error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+
+	id := ""
+	if c != nil {
+		id = c.ID
+		if c.Model != "" {
+			s.model = c.Model
+		}
+	}
+	s.id = anthropicMessageID(id)
+
+	return writeSSEEvent(w, "message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": anthropicResponse{
+			ID:      s.id,
+			Type:    "message",
+			Role:    llm.RoleAssistant,
+			Model:   s.model,
+			Content: []anthropicContent{},
+		},
+	})
+}
+
+func (s *anthropicStream) openBlock(w io.Writer, block anthropicContent) error {
+	if err := s.closeBlock(w); err != nil {
+		return err
+	}
+	s.blockIndex++
+	s.blockOpen = true
+	s.blockType = block.Type
+	return writeSSEEvent(w, "content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         s.blockIndex,
+		"content_block": block,
+	})
+}
+
+func (s *anthropicStream) closeBlock(w io.Writer) error {
+	if !s.blockOpen {
+		return nil
+	}
+	s.blockOpen = false
+	return writeSSEEvent(w, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": s.blockIndex,
+	})
+}
+
+func (s *anthropicStream) delta(w io.Writer, delta map[string]string) error {
+	return writeSSEEvent(w, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": s.blockIndex,
+		"delta": delta,
+	})
+}
+
+func (s *anthropicStream) writeChunk(w io.Writer, c *llm.StreamChunk) error {
+	if err := s.start(w, c); err != nil {
+		return err
+	}
+	if c.Usage != nil {
+		s.usage = c.Usage
+		return nil
+	}
+	if c.Index != 0 {
+		return nil
+	}
+
+	if c.Delta != "" {
+		if !s.blockOpen || s.blockType != anthropicBlockText {
+			empty := ""
+			if err := s.openBlock(w, anthropicContent{Type: anthropicBlockText, Text: &empty}); err != nil {
+				return err
+			}
+		}
+		if err := s.delta(w, map[string]string{"type": "text_delta", "text": c.Delta}); err != nil {
+			return err
+		}
+	}
+
+	for _, tc := range c.ToolCalls {
+		if tc.ID != "" {
+			if err := s.openBlock(w, anthropicContent{
+				Type:  anthropicBlockToolUse,
+				ID:    tc.ID,
+				Name:  tc.Function.Name,
+				Input: json.RawMessage("{}"),
+			}); err != nil {
+				return err
+			}
+		}
+		if tc.Function.Arguments != "" && s.blockOpen && s.blockType == anthropicBlockToolUse {
+			if err := s.delta(w, map[string]string{"type": "input_json_delta", "partial_json": tc.Function.Arguments}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.FinishReason != "" {
+		s.stopReason = anthropicStopReason(c.FinishReason)
+		return s.closeBlock(w)
+	}
+	return nil
+}
+
+func (s *anthropicStream) writeDone(w io.Writer) error {
+	if err := s.start(w, nil); err != nil {
+		return err
+	}
+	if err := s.closeBlock(w); err != nil {
+		return err
+	}
+
+	reason := s.stopReason
+	if reason == "" {
+		reason = anthropicStopEndTurn
+	}
+	var usage anthropicUsage
+	if s.usage != nil {
+		usage = anthropicUsage{InputTokens: s.usage.PromptTokens, OutputTokens: s.usage.CompletionTokens}
+	}
+
+	if err := writeSSEEvent(w, "message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": reason, "stop_sequence": nil},
+		"usage": usage,
+	}); err != nil {
+		return err
+	}
+	return writeSSEEvent(w, "message_stop", map[string]string{"type": "message_stop"})
+}
+
+// writeHeartbeat sends Anthropic's ping event; before message_start it
+// falls back to an SSE comment so message_start stays the first event.
+func (s *anthropicStream) writeHeartbeat(w io.Writer) error {
+	if !s.started {
+		return writeSSEComment(w)
+	}
+	return writeSSEEvent(w, "ping", map[string]string{"type": "ping"})
+}
+
+func (s *anthropicStream) writeError(w io.Writer, err error) error {
+	_, body := newAnthropicError(err)
+	return writeSSEEvent(w, "error", body)
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+)
+
+func TestMessagesSharesChatCache(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		resp: &llm.ChatResponse{
+			ID:    "chatcmpl-1",
+			Model: "gpt-4",
+			Choices: []llm.ChatChoice{{
+				Message: llm.ChatMessage{
+					Role:    llm.RoleAssistant,
+					Content: "checking",
+					ToolCalls: []llm.ToolCall{{
+						ID:       "call_1",
+						Type:     llm.ToolTypeFunction,
+						Function: llm.FunctionCall{Name: "weather", Arguments: `{"city":"Oslo"}`},
+					}},
+				},
+				FinishReason: "tool_calls",
+			}},
+			Usage: &llm.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+		},
+	}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	payload := []byte(`{
+		"model": "gpt-4",
+		"max_tokens": 100,
+		"system": "be brief",
+		"tools": [{"name": "weather", "input_schema": {"type": "object"}}],
+		"messages": [{"role": "user", "content": "weather in Oslo?"}]
+	}`)
+	rr := httptest.NewRecorder()
+	h.Messages(rr, httptest.NewRequest(http.MethodPost, "/v1/messages", bytes.NewReader(payload)))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp anthropicResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Type != "message" || resp.ID != "msg_1" || *resp.StopReason != "tool_use" {
+		t.Fatalf("unexpected envelope: %+v", resp)
+	}
+	if len(resp.Content) != 2 || *resp.Content[0].Text != "checking" || resp.Content[1].Name != "weather" {
+		t.Fatalf("unexpected content: %+v", resp.Content)
+	}
+	if string(resp.Content[1].Input) != `{"city":"Oslo"}` {
+		t.Fatalf("unexpected tool input: %s", resp.Content[1].Input)
+	}
+	if resp.Usage.InputTokens != 10 || resp.Usage.OutputTokens != 5 {
+		t.Fatalf("unexpected usage: %+v", resp.Usage)
+	}
+
+	sent := fakeLLM.lastRequest
+	if len(sent.Messages) != 2 || sent.Messages[0].Role != llm.RoleSystem {
+		t.Fatalf("expected system message first: %+v", sent.Messages)
+	}
+
+	// The equivalent chat request is served from the same cache entry.
+	chatPayload := []byte(`{
+		"model": "gpt-4",
+		"max_tokens": 100,
+		"tools": [{"type": "function", "function": {"name": "weather", "parameters": {"type": "object"}}}],
+		"messages": [
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": "weather in Oslo?"}
+		]
+	}`)
+	rr = httptest.NewRecorder()
+	h.ChatCompletion(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(chatPayload)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	if fakeLLM.nonStreamCalls != 1 {
+		t.Fatalf("expected chat request to hit the shared cache entry, got %d upstream calls", fakeLLM.nonStreamCalls)
+	}
+}
+
+func TestMessagesToolResultTranslation(t *testing.T) {
+	areq := anthropicRequest{
+		Model:     "gpt-4",
+		MaxTokens: 10,
+		Messages: []anthropicMessage{
+			{Role: "assistant", Content: json.RawMessage(`[{"type":"tool_use","id":"t1","name":"f","input":{"a":1}}]`)},
+			{Role: "user", Content: json.RawMessage(`[{"type":"tool_result","tool_use_id":"t1","content":"42"},{"type":"text","text":"thanks"}]`)},
+		},
+	}
+
+	req, err := areq.toChatRequest()
+	if err != nil {
+		t.Fatalf("toChatRequest: %v", err)
+	}
+	if len(req.Messages) != 3 {
+		t.Fatalf("expected 3 messages, got %+v", req.Messages)
+	}
+	if call := req.Messages[0].ToolCalls[0]; call.ID != "t1" || call.Function.Arguments != `{"a":1}` {
+		t.Fatalf("unexpected tool call: %+v", call)
+	}
+	if m := req.Messages[1]; m.Role != llm.RoleTool || m.ToolCallID != "t1" || m.Content != "42" {
+		t.Fatalf("unexpected tool message: %+v", m)
+	}
+	if m := req.Messages[2]; m.Role != llm.RoleUser || m.Text() != "thanks" {
+		t.Fatalf("unexpected user message: %+v", m)
+	}
+}
+
+func TestMessagesStreamEvents(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	streamChan := make(chan llm.StreamResult, 4)
+	fakeLLM := &mockLLMClient{stream: streamChan}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{ID: "chatcmpl-s", Delta: "hel"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{ID: "chatcmpl-s", Delta: "lo"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{ID: "chatcmpl-s", FinishReason: "stop"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Usage: &llm.Usage{PromptTokens: 3, CompletionTokens: 2}}}
+	close(streamChan)
+
+	payload := []byte(`{"model":"gpt-4","max_tokens":10,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	rr := httptest.NewRecorder()
+	h.Messages(rr, httptest.NewRequest(http.MethodPost, "/v1/messages", bytes.NewReader(payload)))
+
+	if !fakeLLM.lastRequest.StreamOptions.IncludeUsage {
+		t.Fatalf("expected usage to be requested upstream")
+	}
+
+	var events []string
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, name)
+		}
+	}
+	want := []string{
+		"message_start",
+		"content_block_start",
+		"content_block_delta",
+		"content_block_delta",
+		"content_block_stop",
+		"message_delta",
+		"message_stop",
+	}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	body := rr.Body.String()
+	if !strings.Contains(body, `"stop_reason":"end_turn"`) || !strings.Contains(body, `"output_tokens":2`) {
+		t.Fatalf("expected stop reason and usage in message_delta: %s", body)
+	}
+	if strings.Contains(body, "[DONE]") {
+		t.Fatalf("unexpected OpenAI sentinel in Anthropic stream: %s", body)
+	}
+}
+
+func TestMessagesStreamPing(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	streamChan := make(chan llm.StreamResult)
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", &mockLLMClient{stream: streamChan})
+	h.StreamHeartbeat = 10 * time.Millisecond
+
+	go func() {
+		streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{ID: "chatcmpl-p", Delta: "a"}}
+		time.Sleep(50 * time.Millisecond)
+		streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{ID: "chatcmpl-p", FinishReason: "stop"}}
+		close(streamChan)
+	}()
+
+	payload := []byte(`{"model":"gpt-4","max_tokens":10,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	rr := httptest.NewRecorder()
+	h.Messages(rr, httptest.NewRequest(http.MethodPost, "/v1/messages", bytes.NewReader(payload)))
+
+	body := rr.Body.String()
+	if !strings.Contains(body, "event: ping\ndata: {\"type\":\"ping\"}") {
+		t.Fatalf("expected ping events after message_start: %s", body)
+	}
+	if strings.Index(body, "event: message_start") > strings.Index(body, "event: ping") {
+		t.Fatalf("ping must follow message_start: %s", body)
+	}
+}
+
+func TestMessagesErrorEnvelope(t *testing.T) {
+	fakeLLM := &mockLLMClient{}
+	h := NewChatHandler(cache.NewMemoryExactCache(time.Minute), time.Minute, "vtest", fakeLLM)
+
+	payload := []byte(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`)
+	rr := httptest.NewRecorder()
+	h.Messages(rr, httptest.NewRequest(http.MethodPost, "/v1/messages", bytes.NewReader(payload)))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rr.Code)
+	}
+	var body anthropicError
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if body.Type != "error" || body.Error.Type != "invalid_request_error" {
+		t.Fatalf("unexpected error body: %+v", body)
+	}
+}
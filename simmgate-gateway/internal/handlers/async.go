@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/async"
+	"simmgate-gateway/pkg/logging/logging"
+)
+
+// webhookURLHeader carries the optional callback URL of an async request.
+const webhookURLHeader = "X-Webhook-URL"
+
+// AsyncHandler adds "Prefer: respond-async" support to POST endpoints and
+// serves GET /v1/async/{id} for polling.
+type AsyncHandler struct {
+	Manager *async.Manager
+}
+
+func NewAsyncHandler(manager *async.Manager) *AsyncHandler {
+	return &AsyncHandler{Manager: manager}
+}
+
+// preferAsync reports whether the Prefer header asks for respond-async.
+func preferAsync(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wrap returns next unchanged for normal requests. With "Prefer:
+// respond-async" it answers 202 with the job right away and runs next in
+// the background on a copy of the request, outside the request timeout;
+// the buffered response becomes the job result. Streaming requests cannot
+// be made async.
+func (h *AsyncHandler) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h == nil || h.Manager == nil || !preferAsync(r) {
+			next(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		logger := logging.L(ctx)
+
+		webhookURL := r.Header.Get(webhookURLHeader)
+		if webhookURL != "" {
+			if err := h.Manager.ValidateWebhookURL(webhookURL); err != nil {
+				code := "invalid_webhook_url"
+				if errors.Is(err, async.ErrWebhooksDisabled) {
+					code = "webhooks_disabled"
+				}
+				writeErrorJSON(ctx, w, http.StatusBadRequest,
+					newAPIError(errTypeInvalidRequest, code, webhookURLHeader, err.Error()))
+				return
+			}
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Warn("async_body_read_error", zap.Error(err))
+			if errors.As(err, new(*http.MaxBytesError)) {
+				writeLLMError(ctx, w, requestBodyError(err))
+				return
+			}
+			writeErrorJSON(ctx, w, http.StatusBadRequest,
+				newAPIError(errTypeInvalidRequest, "invalid_request", "", "failed to read request body"))
+			return
+		}
+
+		var peek struct {
+			Stream bool `json:"stream"`
+		}
+		if json.Unmarshal(body, &peek) == nil && peek.Stream {
+			writeErrorJSON(ctx, w, http.StatusBadRequest,
+				newAPIError(errTypeInvalidRequest, "invalid_request", "stream", "streaming requests cannot be answered asynchronously"))
+			return
+		}
+
+		bg := r.Clone(context.WithoutCancel(ctx))
+		bg.Header.Del("Prefer")
+		run := func(ctx context.Context) (int, []byte) {
+			req := bg.WithContext(ctx)
+			req.Body = io.NopCloser(bytes.NewReader(body))
+
+			rec := newBufferedResponse()
+			next(rec, req)
+			return rec.status, rec.body.Bytes()
+		}
+
+		job, err := h.Manager.Submit(ctx, userIDFromRequest(r), webhookURL, run)
+		if errors.Is(err, async.ErrBusy) {
+			writeErrorJSON(ctx, w, http.StatusServiceUnavailable,
+				newAPIError(errTypeServer, "async_queue_full", "", "too many pending async requests"))
+			return
+		}
+		if err != nil {
+			logger.Error("async_submit_failed", zap.Error(err))
+			writeErrorJSON(ctx, w, http.StatusInternalServerError,
+				newAPIError(errTypeServer, "async_store_error", "", "failed to store async job"))
+			return
+		}
+
+		w.Header().Set("Location", "/v1/async/"+job.ID)
+		w.Header().Set("Preference-Applied", "respond-async")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(job); err != nil {
+			logger.Warn("write_json_failed", zap.Error(err))
+		}
+	}
+}
+
+// Get handles GET /v1/async/{id}.
+func (h *AsyncHandler) Get(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	job, err := h.Manager.Get(ctx, userIDFromRequest(r), chi.URLParam(r, "id"))
+	if errors.Is(err, async.ErrNotFound) {
+		writeErrorJSON(ctx, w, http.StatusNotFound,
+			newAPIError(errTypeInvalidRequest, "async_job_not_found", "id", "async job not found"))
+		return
+	}
+	if err != nil {
+		logging.L(ctx).Error("async_store_error", zap.Error(err))
+		writeErrorJSON(ctx, w, http.StatusInternalServerError,
+			newAPIError(errTypeServer, "async_store_error", "", "failed to read async job"))
+		return
+	}
+	writeJSON(ctx, w, job)
+}
+
+// bufferedResponse captures a handler's response for a background run.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.wroteHeader {
+		return
+	}
+	b.wroteHeader = true
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
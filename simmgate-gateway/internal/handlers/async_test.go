@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"simmgate-gateway/internal/async"
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+)
+
+func TestAsyncChatCompletion(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		resp: &llm.ChatResponse{
+			Model:   "gpt-4",
+			Choices: []llm.ChatChoice{{Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: "later"}}},
+		},
+	}
+	chat := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	manager := async.NewManager(cacheStore, async.Config{}, nil)
+	t.Cleanup(manager.Close)
+	h := NewAsyncHandler(manager)
+
+	r := chi.NewRouter()
+	r.Post("/v1/chat/completions", h.Wrap(chat.ChatCompletion))
+	r.Get("/v1/async/{id}", h.Get)
+
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Prefer", "respond-async")
+	req.Header.Set("X-User-ID", "u-async")
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var job async.Job
+	if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+		t.Fatalf("decode job: %v", err)
+	}
+	if rr.Header().Get("Location") != "/v1/async/"+job.ID {
+		t.Fatalf("unexpected Location %q", rr.Header().Get("Location"))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for job.Status != async.StatusCompleted {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not complete: %+v", job)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		rr = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/v1/async/"+job.ID, nil)
+		req.Header.Set("X-User-ID", "u-async")
+		r.ServeHTTP(rr, req)
+		if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+			t.Fatalf("decode job: %v", err)
+		}
+	}
+
+	if job.Response.StatusCode != http.StatusOK || !strings.Contains(string(job.Response.Body), "later") {
+		t.Fatalf("unexpected result: %+v", job.Response)
+	}
+}
+
+func TestAsyncRejectsStreamAndUnsignedWebhook(t *testing.T) {
+	manager := async.NewManager(cache.NewMemoryExactCache(time.Minute), async.Config{}, nil)
+	t.Cleanup(manager.Close)
+	h := NewAsyncHandler(manager)
+
+	called := false
+	next := func(w http.ResponseWriter, r *http.Request) { called = true }
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"stream":true}`))
+	req.Header.Set("Prefer", "respond-async")
+	h.Wrap(next)(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected stream to be rejected, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`))
+	req.Header.Set("Prefer", "respond-async")
+	req.Header.Set("X-Webhook-URL", "https://example.com/hook")
+	h.Wrap(next)(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "webhooks_disabled") {
+		t.Fatalf("expected webhook without secret to be rejected, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if called {
+		t.Fatalf("rejected requests must not reach the handler")
+	}
+}
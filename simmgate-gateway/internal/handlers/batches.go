@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/batch"
+	"simmgate-gateway/pkg/logging/logging"
+)
+
+// BatchHandler serves the /v1/batches endpoints.
+type BatchHandler struct {
+	Manager *batch.Manager
+
+	// MaxRequests caps the lines of one batch; 0 means unlimited.
+	MaxRequests int
+	// MaxBodyBytes caps the JSONL upload; 0 means unlimited.
+	MaxBodyBytes int64
+}
+
+func NewBatchHandler(manager *batch.Manager, maxRequests int, maxBodyBytes int64) *BatchHandler {
+	return &BatchHandler{Manager: manager, MaxRequests: maxRequests, MaxBodyBytes: maxBodyBytes}
+}
+
+// Create handles POST /v1/batches. The body is JSONL, one chat request per
+// line, either as {"custom_id","method","url","body"} or as a bare chat
+// request. The optional concurrency query parameter limits how many of the
+// batch's requests run at once. Uploads can be far larger than any chat
+// request, so the server's read and write deadlines are lifted and the
+// body is bounded by MaxBodyBytes instead.
+func (h *BatchHandler) Create(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.L(ctx)
+
+	rc := http.NewResponseController(w)
+	if err := errors.Join(rc.SetReadDeadline(time.Time{}), rc.SetWriteDeadline(time.Time{})); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Warn("batch_deadline_reset_failed", zap.Error(err))
+	}
+	if h.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxBodyBytes)
+	}
+
+	concurrency := 0
+	if v := r.URL.Query().Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeErrorJSON(ctx, w, http.StatusBadRequest,
+				newAPIError(errTypeInvalidRequest, "invalid_request", "concurrency", "concurrency must be a positive integer"))
+			return
+		}
+		concurrency = n
+	}
+
+	reqs, err := batch.ParseRequests(r.Body, h.MaxRequests)
+	if errors.As(err, new(*http.MaxBytesError)) {
+		logger.Warn("batch_too_large", zap.Error(err))
+		writeLLMError(ctx, w, requestBodyError(err))
+		return
+	}
+	if err != nil {
+		logger.Warn("invalid_batch", zap.Error(err))
+		writeErrorJSON(ctx, w, http.StatusBadRequest,
+			newAPIError(errTypeInvalidRequest, "invalid_batch", "", err.Error()))
+		return
+	}
+
+	job, err := h.Manager.Submit(ctx, userIDFromRequest(r), reqs, concurrency)
+	if err != nil {
+		logger.Error("batch_submit_failed", zap.Error(err))
+		writeErrorJSON(ctx, w, http.StatusInternalServerError,
+			newAPIError(errTypeServer, "batch_store_error", "", "failed to store batch"))
+		return
+	}
+
+	writeJSON(ctx, w, job)
+}
+
+// Get handles GET /v1/batches/{id}.
+func (h *BatchHandler) Get(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	job, err := h.Manager.Get(ctx, userIDFromRequest(r), chi.URLParam(r, "id"))
+	if err != nil {
+		writeBatchError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, job)
+}
+
+// Output handles GET /v1/batches/{id}/output: the JSONL results written so
+// far, in completion order. Match lines to inputs by custom_id.
+func (h *BatchHandler) Output(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	lines, err := h.Manager.Output(ctx, userIDFromRequest(r), chi.URLParam(r, "id"))
+	if err != nil {
+		writeBatchError(ctx, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	for _, line := range lines {
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			logging.L(ctx).Warn("batch_output_write_error", zap.Error(err))
+			return
+		}
+	}
+}
+
+// Cancel handles POST /v1/batches/{id}/cancel.
+func (h *BatchHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	job, err := h.Manager.Cancel(ctx, userIDFromRequest(r), chi.URLParam(r, "id"))
+	if err != nil {
+		writeBatchError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, job)
+}
+
+func writeBatchError(ctx context.Context, w http.ResponseWriter, err error) {
+	if errors.Is(err, batch.ErrNotFound) {
+		writeErrorJSON(ctx, w, http.StatusNotFound,
+			newAPIError(errTypeInvalidRequest, "batch_not_found", "id", "batch not found"))
+		return
+	}
+	logging.L(ctx).Error("batch_store_error", zap.Error(err))
+	writeErrorJSON(ctx, w, http.StatusInternalServerError,
+		newAPIError(errTypeServer, "batch_store_error", "", "failed to read batch"))
+}
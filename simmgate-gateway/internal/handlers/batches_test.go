@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"simmgate-gateway/internal/batch"
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+)
+
+func TestBatchThroughChatCache(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		resp: &llm.ChatResponse{
+			Model:   "gpt-4",
+			Choices: []llm.ChatChoice{{Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: "pong"}}},
+		},
+	}
+	chat := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	manager := batch.NewManager(batch.NewMemoryStore(time.Hour), chat.CompleteJSON, batch.Config{Workers: 2}, nil)
+	t.Cleanup(manager.Close)
+	h := NewBatchHandler(manager, 0, 0)
+
+	r := chi.NewRouter()
+	r.Post("/v1/batches", h.Create)
+	r.Get("/v1/batches/{id}", h.Get)
+	r.Get("/v1/batches/{id}/output", h.Output)
+
+	line := `{"model":"gpt-4","messages":[{"role":"user","content":"ping"}]}`
+	body := line + "\n" + line + "\n"
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/batches?concurrency=1", strings.NewReader(body))
+	req.Header.Set("X-User-ID", "u-batch")
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var job batch.Job
+	if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+		t.Fatalf("decode job: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for job.Status != batch.StatusCompleted {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch did not complete: %+v", job)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		rr = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/v1/batches/"+job.ID, nil)
+		req.Header.Set("X-User-ID", "u-batch")
+		r.ServeHTTP(rr, req)
+		if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+			t.Fatalf("decode job: %v", err)
+		}
+	}
+
+	if job.RequestCounts.Completed != 2 {
+		t.Fatalf("unexpected counts: %+v", job.RequestCounts)
+	}
+	if fakeLLM.nonStreamCalls != 1 {
+		t.Fatalf("expected the second line to be a cache hit, got %d upstream calls", fakeLLM.nonStreamCalls)
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/v1/batches/"+job.ID+"/output", nil)
+	req.Header.Set("X-User-ID", "u-batch")
+	r.ServeHTTP(rr, req)
+
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"status_code":200`) || !strings.Contains(lines[0], "pong") {
+		t.Fatalf("unexpected output: %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/batches/"+job.ID, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected other users to get 404, got %d", rr.Code)
+	}
+}
+
+func TestBatchCreateBodyOverLimit(t *testing.T) {
+	manager := batch.NewManager(batch.NewMemoryStore(time.Hour), func(context.Context, *llm.ChatRequest, string) (int, []byte) {
+		return http.StatusOK, []byte(`{}`)
+	}, batch.Config{Workers: 1}, nil)
+	t.Cleanup(manager.Close)
+	h := NewBatchHandler(manager, 0, 100)
+
+	line := `{"model":"gpt-4","messages":[{"role":"user","content":"ping"}]}`
+	rr := httptest.NewRecorder()
+	h.Create(rr, httptest.NewRequest(http.MethodPost, "/v1/batches", strings.NewReader(line+"\n"+line+"\n")))
+	if rr.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rr.Body.String(), "request_too_large") {
+		t.Fatalf("expected 413 request_too_large, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
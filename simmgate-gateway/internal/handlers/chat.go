@@ -1,15 +1,27 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"time"
 
+	"simmgate-gateway/internal/audit"
 	"simmgate-gateway/internal/cache"
 	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/metrics"
+	"simmgate-gateway/internal/middleware"
+	"simmgate-gateway/internal/models"
+	"simmgate-gateway/internal/pipeline"
+	"simmgate-gateway/internal/resume"
+	"simmgate-gateway/internal/tracing"
 	"simmgate-gateway/pkg/logging/logging"
 
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -19,6 +31,37 @@ type ChatHandler struct {
 	CacheTTL  time.Duration
 	VersionID string
 	LLM       llm.Client
+
+	// Models resolves model aliases; nil disables aliasing.
+	Models *models.Registry
+
+	// StructuredOutputRetries is how many times a choice that fails its
+	// response_format schema is re-prompted before the response is returned
+	// uncached.
+	StructuredOutputRetries int
+
+	// ResponseStateTTL is how long /v1/responses conversations stay
+	// available to previous_response_id (default 24h).
+	ResponseStateTTL time.Duration
+
+	// StreamHeartbeat is how long a stream may go without a write before a
+	// keep-alive is sent, so proxies do not drop it; zero disables them.
+	StreamHeartbeat time.Duration
+
+	// StreamBuffer makes streams resumable with Last-Event-ID; nil
+	// disables it.
+	StreamBuffer resume.Store
+
+	// Pipeline holds the stages every completion goes through, built from
+	// Stages(); nil uses DefaultStages.
+	Pipeline *pipeline.Pipeline
+
+	// Drain counts streams during shutdown and ends those still running
+	// when the drain period is over; nil disables it.
+	Drain *middleware.Drain
+
+	// Audit receives a record of every completion; nil disables it.
+	Audit *audit.Log
 }
 
 func NewChatHandler(c cache.ExactCache, ttl time.Duration, versionID string, client llm.Client) *ChatHandler {
@@ -41,209 +84,409 @@ func (h *ChatHandler) ChatCompletion(w http.ResponseWriter, r *http.Request) {
 	var req llm.ChatRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Warn("invalid_request", zap.Error(err))
-		writeErrorJSON(ctx, w, http.StatusBadRequest, "invalid_json")
+		writeLLMError(ctx, w, requestBodyError(err))
 		return
 	}
 
-	modelID := req.Model
-	if modelID == "" {
-		modelID = "unknown-model"
-	}
-
-	userID := r.Header.Get("X-User-ID")
-	if userID == "" {
-		userID = "anon"
-	}
+	req.Model = h.Models.Resolve(req.Model)
 
-	versionID := h.VersionID
-	if versionID == "" {
-		versionID = "v1"
-	}
+	userID := userIDFromRequest(r)
+	versionID := versionOrDefault(h.VersionID)
 
 	if req.Stream {
-		h.streamChatCompletion(ctx, w, logger, &req, userID, modelID, versionID, start)
+		sw := dataStream{enc: newStreamChunkBuilder(req.Model)}
+		if err := h.streamChatCompletion(ctx, w, logger, &req, userID, versionID, r.Header.Get(lastEventIDHeader), start, sw); err != nil {
+			writeLLMError(ctx, w, err)
+		}
 		return
 	}
 
-	var (
-		cacheKey           string
-		hashKey            string
-		cacheLookupLatency time.Duration
-		cacheHit           bool
-	)
-
-	key, err := cache.BuildExactCacheKeyFromChatRequest(req, userID, versionID)
+	resp, err := h.complete(ctx, &req, userID, versionID, start)
 	if err != nil {
-		logger.Warn("key_builder_error", zap.Error(err))
-	} else {
-		cacheKey = key.String()
-		hashKey = key.Hash
-
-		cacheLookupStart := time.Now()
-		cachedBytes, hit, cacheErr := h.Cache.Get(ctx, cacheKey)
-		cacheLookupLatency = time.Since(cacheLookupStart)
+		writeLLMError(ctx, w, err)
+		return
+	}
 
-		if cacheErr != nil {
-			logger.Warn("exact_cache_get_error", zap.Error(cacheErr))
-		}
+	writeJSON(ctx, w, resp)
+}
 
-		if hit {
-			var cachedResp llm.ChatResponse
-			if err := json.Unmarshal(cachedBytes, &cachedResp); err != nil {
-				logger.Warn("exact_cache_unmarshal_error", zap.Error(err))
-			} else {
-				cacheHit = true
-				totalLatency := time.Since(start)
-
-				logger.Info("cache_decision",
-					zap.String("cache_tier", "exact"),
-					zap.String("hash_key", hashKey),
-					zap.String("user_id", userID),
-					zap.String("model_id", modelID),
-					zap.String("version_id", versionID),
-					zap.Bool("cache_hit", true),
-					zap.Duration("cache_lookup_latency", cacheLookupLatency),
-					zap.Duration("total_latency", totalLatency),
-				)
+// complete serves a non-stream request through the stage pipeline and the
+// upstream LLM. It is shared by every endpoint that translates into a
+// ChatRequest, so they all hit the same cache entries.
+func (h *ChatHandler) complete(
+	ctx context.Context,
+	req *llm.ChatRequest,
+	userID, versionID string,
+	start time.Time,
+) (*llm.ChatResponse, error) {
+	logger := logging.L(ctx)
 
-				h.writeJSON(ctx, w, cachedResp)
-				return
-			}
+	validator, err := newStructuredValidator(req.ResponseFormat)
+	if err != nil {
+		logger.Warn("invalid_response_format_schema", zap.Error(err))
+		return nil, &statusError{
+			status: http.StatusBadRequest,
+			body:   newAPIError(errTypeInvalidRequest, "invalid_json_schema", "response_format", err.Error()),
 		}
 	}
 
-	llmStart := time.Now()
-	resp, err := h.LLM.ChatCompletion(ctx, &req)
-	llmLatency := time.Since(llmStart)
+	ex := pipeline.NewExchange(req, userID, versionID, start)
+	err = h.pipeline().Run(ctx, ex, func(ctx context.Context, ex *pipeline.Exchange) error {
+		llmStart := time.Now()
+		resp, valid, err := h.completeStructured(ctx, ex.Request, validator)
+		ex.UpstreamLatency = time.Since(llmStart)
+		if err != nil {
+			logger.Error("llm_request_failed", zap.Error(err))
+			return err
+		}
+		ex.Response, ex.Cacheable = resp, valid
+		return nil
+	})
 	if err != nil {
-		logger.Error("llm_request_failed", zap.Error(err))
-		writeErrorJSON(ctx, w, http.StatusBadGateway, "upstream_error")
-		return
+		return nil, err
 	}
+	return ex.Response, nil
+}
 
-	if cacheKey != "" {
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			logger.Warn("marshal_response_error", zap.Error(err))
-		} else if err := h.Cache.Set(ctx, cacheKey, respBytes, h.CacheTTL); err != nil {
-			logger.Warn("exact_cache_set_error", zap.Error(err))
-		}
+// CompleteJSON serves req as a non-stream /v1/chat/completions call for
+// userID and returns the status and JSON body that call would have
+// answered with. It is the entry point for work that runs outside an HTTP
+// request, such as batches.
+func (h *ChatHandler) CompleteJSON(ctx context.Context, req *llm.ChatRequest, userID string) (int, []byte) {
+	req.Model = h.Models.Resolve(req.Model)
+
+	resp, err := h.complete(ctx, req, userID, versionOrDefault(h.VersionID), time.Now())
+	if err != nil {
+		status, body := errorFromLLM(err)
+		data, _ := json.Marshal(apiError{Error: body})
+		return status, data
 	}
 
-	totalLatency := time.Since(start)
-
-	logger.Info("cache_decision",
-		zap.String("cache_tier", "exact"),
-		zap.String("hash_key", hashKey),
-		zap.String("user_id", userID),
-		zap.String("model_id", modelID),
-		zap.String("version_id", versionID),
-		zap.Bool("cache_hit", cacheHit),
-		zap.Duration("cache_lookup_latency", cacheLookupLatency),
-		zap.Duration("llm_latency", llmLatency),
-		zap.Duration("total_latency", totalLatency),
-	)
-
-	h.writeJSON(ctx, w, resp)
+	data, err := json.Marshal(resp)
+	if err != nil {
+		logging.L(ctx).Error("marshal_response_error", zap.Error(err))
+		data, _ = json.Marshal(apiError{Error: newAPIError(errTypeServer, "internal_error", "", "failed to encode response")})
+		return http.StatusInternalServerError, data
+	}
+	return http.StatusOK, data
 }
 
+// streamChatCompletion forwards a stream request to the upstream LLM and
+// writes it in sw's format. It returns an error only when nothing has been
+// written yet, so the caller can answer in its own error format.
+//
+// With a StreamBuffer every event carries an SSE id and is buffered, and
+// the generation continues into the buffer if the client disconnects; a
+// request with lastEventID set replays that buffer instead of calling the
+// upstream again.
 func (h *ChatHandler) streamChatCompletion(
 	ctx context.Context,
 	w http.ResponseWriter,
 	logger *zap.Logger,
 	req *llm.ChatRequest,
-	userID, modelID, versionID string,
+	userID, versionID, lastEventID string,
 	start time.Time,
-) {
+	sw streamWriter,
+) error {
+	modelID := req.Model
+	if modelID == "" {
+		modelID = "unknown-model"
+	}
+	modelLabel := h.Models.MetricLabel(req.Model)
+
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		writeErrorJSON(ctx, w, http.StatusInternalServerError, "streaming_not_supported")
-		return
+		return &statusError{
+			status: http.StatusInternalServerError,
+			body:   newAPIError(errTypeServer, "streaming_not_supported", "", "streaming is not supported by this connection"),
+		}
 	}
 
-	stream, err := h.LLM.ChatCompletionStream(ctx, req)
-	if err != nil {
-		logger.Error("llm_stream_connect_failed", zap.Error(err))
-		writeErrorJSON(ctx, w, http.StatusBadGateway, "upstream_error")
-		return
+	limits, ok := middleware.StartStream(ctx)
+	if !ok {
+		return context.Cause(ctx)
+	}
+
+	// Resumption relies on SSE ids, so message transports are not buffered,
+	// and they keep their connection alive themselves, so get no heartbeats.
+	buffer, heartbeatEvery := h.StreamBuffer, h.StreamHeartbeat
+	if _, ok := w.(messageWriter); ok {
+		buffer, heartbeatEvery = nil, 0
+	}
+
+	if lastEventID != "" && buffer != nil {
+		return h.resumeStream(ctx, w, flusher, logger, userID, lastEventID, start, sw)
 	}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	ex := pipeline.NewExchange(req, userID, versionID, start)
+	ex.Stream = true
+	return h.pipeline().Run(ctx, ex, func(ctx context.Context, ex *pipeline.Exchange) error {
+		req := ex.Request
+
+		// Returning stops the upstream stream, whether it ended or was aborted.
+		// A buffered generation is detached from the client so it can finish
+		// after a disconnect.
+		upstreamCtx := ctx
+		if buffer != nil {
+			upstreamCtx = context.WithoutCancel(ctx)
+		}
+		upstreamCtx, cancel := context.WithCancel(upstreamCtx)
+		defer cancel()
+
+		// ttft spans the wait for the first upstream chunk.
+		_, ttft := tracing.Tracer().Start(ctx, "time_to_first_token", trace.WithAttributes(semconv.GenAIRequestModel(modelID)))
+		defer ttft.End()
+		defer h.Drain.TrackStream()()
+		upstreamStart := time.Now()
+		var lastChunk time.Time
 
-	// Flush headers so the client can start receiving chunks immediately.
-	flusher.Flush()
+		stream, err := h.LLM.ChatCompletionStream(upstreamCtx, req)
+		if err != nil {
+			logger.Error("llm_stream_connect_failed", zap.Error(err))
+			return err
+		}
 
-	chunks := 0
+		var generationID string
+		var seq int64
+		if buffer != nil {
+			generationID = newCompletionID("gen_")
+			w.Header().Set(generationIDHeader, generationID)
+		}
 
-	for {
-		select {
-		case <-ctx.Done():
-			logger.Info("stream_cancelled",
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		// Flush headers so the client can start receiving chunks immediately.
+		flusher.Flush()
+
+		chunks, heartbeats := 0, 0
+		clientGone := false
+		clientDone := ctx.Done()
+
+		// silence fires when the upstream sends nothing for FirstByte before
+		// the first chunk or for Idle between later ones; heartbeat fires when
+		// nothing was written for StreamHeartbeat; total bounds a generation
+		// that outlived its client.
+		silence := newIdleTimer(limits.FirstByte)
+		defer silence.Stop()
+		heartbeat := newIdleTimer(heartbeatEvery)
+		defer heartbeat.Stop()
+		total := newIdleTimer(0)
+		defer total.Stop()
+
+		// finish logs stream_completed; abortReason is empty for streams that
+		// ran to the end.
+		finish := func(abortReason string) {
+			ex.AbortReason = abortReason
+			level, outcome := zap.InfoLevel, "completed"
+			if abortReason != "" {
+				level, outcome = zap.WarnLevel, abortReason
+			}
+			metrics.Observe(ctx, metrics.StreamDurationSeconds.WithLabelValues(modelLabel, outcome), time.Since(start).Seconds())
+			logger.Log(level, "stream_completed",
 				zap.String("user_id", userID),
 				zap.String("model_id", modelID),
 				zap.String("version_id", versionID),
+				zap.String("generation_id", generationID),
 				zap.Int("chunks", chunks),
+				zap.Int("heartbeats", heartbeats),
+				zap.String("abort_reason", abortReason),
+				zap.Bool("client_gone", clientGone),
 				zap.Duration("total_latency", time.Since(start)),
-				zap.Error(ctx.Err()),
 			)
-			return
+		}
 
-		case res, ok := <-stream:
-			if !ok {
-				if _, err := w.Write([]byte("data: [DONE]\n\n")); err != nil {
-					logger.Warn("stream_done_write_error", zap.Error(err))
-				} else {
-					flusher.Flush()
+		// detach switches a buffered generation to headless once the client is
+		// gone; without a buffer the stream simply ends.
+		detach := func() bool {
+			if buffer == nil {
+				return false
+			}
+			clientGone, clientDone = true, nil
+			heartbeat.Stop()
+			if limits.Total > 0 {
+				total.reset(max(limits.Total-time.Since(start), time.Millisecond))
+			}
+			return true
+		}
+
+		// emit writes one event to the client and, with a buffer, stores it
+		// under the next sequence number.
+		emit := func(write func(io.Writer) error) error {
+			var buf bytes.Buffer
+			if err := write(&buf); err != nil {
+				return err
+			}
+			data := buf.Bytes()
+
+			if buffer != nil {
+				seq++
+				data = withEventID(data, resume.EventID(generationID, seq))
+				if err := buffer.Append(upstreamCtx, resume.Key(userID, generationID), resume.Event{Seq: seq, Data: data}); err != nil {
+					logger.Warn("stream_buffer_append_error", zap.Error(err))
 				}
+			}
 
-				logger.Info("stream_completed",
+			if clientGone {
+				return nil
+			}
+			if _, err := w.Write(data); err != nil {
+				if detach() {
+					return nil
+				}
+				return err
+			}
+			flusher.Flush()
+			heartbeat.reset(heartbeatEvery)
+			return nil
+		}
+
+		// end closes the buffered stream so resumed readers stop waiting.
+		end := func() {
+			if buffer == nil {
+				return
+			}
+			if err := buffer.Finish(upstreamCtx, resume.Key(userID, generationID)); err != nil {
+				logger.Warn("stream_buffer_finish_error", zap.Error(err))
+			}
+		}
+
+		// abort ends the stream with an in-band error event.
+		abort := func(reason string, err error) error {
+			if err := emit(func(w io.Writer) error { return sw.writeError(w, err) }); err != nil {
+				logger.Warn("stream_error_write_error", zap.Error(err))
+			}
+			end()
+			finish(reason)
+			return nil
+		}
+
+		for {
+			select {
+			case <-clientDone:
+				if errors.Is(context.Cause(ctx), middleware.ErrStreamTimeout) {
+					return abort("max_duration", streamTimeoutError("stream_timeout", "stream exceeded its maximum duration"))
+				}
+				if detach() {
+					logger.Info("stream_client_gone",
+						zap.String("generation_id", generationID),
+						zap.Int("chunks", chunks),
+					)
+					continue
+				}
+				ex.AbortReason = "cancelled"
+				metrics.Observe(ctx, metrics.StreamDurationSeconds.WithLabelValues(modelLabel, "cancelled"), time.Since(start).Seconds())
+				logger.Info("stream_cancelled",
 					zap.String("user_id", userID),
 					zap.String("model_id", modelID),
 					zap.String("version_id", versionID),
 					zap.Int("chunks", chunks),
+					zap.Int("heartbeats", heartbeats),
 					zap.Duration("total_latency", time.Since(start)),
+					zap.Error(ctx.Err()),
 				)
-				return
-			}
+				return nil
 
-			if res.Err != nil {
-				logger.Error("llm_stream_error", zap.Error(res.Err))
-				_ = writeSSEJSON(w, map[string]string{"error": "upstream_error"})
-				if _, err := w.Write([]byte("data: [DONE]\n\n")); err != nil {
-					logger.Warn("stream_error_done_write_error", zap.Error(err))
+			case <-total.C:
+				return abort("max_duration", streamTimeoutError("stream_timeout", "stream exceeded its maximum duration"))
+
+			case <-h.Drain.Expired():
+				return abort("shutdown", shuttingDownError())
+
+			case <-silence.C:
+				if chunks == 0 {
+					return abort("first_byte_timeout", streamTimeoutError("stream_first_byte_timeout", "upstream sent no data before the first-byte timeout"))
+				}
+				return abort("idle_timeout", streamTimeoutError("stream_idle_timeout", "upstream sent no data within the idle timeout"))
+
+			case <-heartbeat.C:
+				if err := sw.writeHeartbeat(w); err != nil {
+					if detach() {
+						continue
+					}
+					logger.Warn("stream_write_error", zap.Error(err))
+					finish("write_error")
+					return nil
 				}
 				flusher.Flush()
-				return
-			}
+				heartbeats++
+				heartbeat.reset(heartbeatEvery)
+
+			case res, ok := <-stream:
+				if !ok {
+					if err := emit(sw.writeDone); err != nil {
+						logger.Warn("stream_done_write_error", zap.Error(err))
+					}
+					end()
+					finish("")
+					return nil
+				}
 
-			if res.Chunk == nil {
-				continue
-			}
+				if res.Err != nil {
+					logger.Error("llm_stream_error", zap.Error(res.Err))
+					return abort("upstream_error", res.Err)
+				}
 
-			payload := streamResponse{
-				Choices: []streamChoice{{
-					Index: res.Chunk.Index,
-					Delta: streamDelta{
-						Content: res.Chunk.Delta,
-					},
-					FinishReason: res.Chunk.FinishReason,
-				}},
-			}
+				if res.Chunk == nil {
+					continue
+				}
+				silence.reset(limits.Idle)
+				if res.Chunk.Usage != nil {
+					// Usage is always requested upstream but only passed on
+					// when the client asked; it carries no tokens to time.
+					ex.Usage = res.Chunk.Usage
+					if req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+						continue
+					}
+				} else {
+					ttft.End()
+					now := time.Now()
+					if lastChunk.IsZero() {
+						metrics.Observe(ctx, metrics.TimeToFirstTokenSeconds.WithLabelValues(modelLabel), now.Sub(upstreamStart).Seconds())
+					} else {
+						metrics.Observe(ctx, metrics.InterTokenLatencySeconds.WithLabelValues(modelLabel), now.Sub(lastChunk).Seconds())
+					}
+					lastChunk = now
+				}
 
-			if err := writeSSEJSON(w, payload); err != nil {
-				logger.Warn("stream_write_error", zap.Error(err))
-				return
+				chunk := res.Chunk
+				if ex.CollectOutput && chunk.Delta != "" {
+					ex.AppendOutput(chunk.Index, chunk.Delta)
+				}
+				if err := emit(func(w io.Writer) error { return sw.writeChunk(w, chunk) }); err != nil {
+					logger.Warn("stream_write_error", zap.Error(err))
+					finish("write_error")
+					return nil
+				}
+				chunks++
 			}
-
-			flusher.Flush()
-			chunks++
 		}
+	})
+}
+
+// idleTimer is a time.Timer that never fires when armed with a zero
+// duration.
+type idleTimer struct {
+	*time.Timer
+}
+
+func newIdleTimer(d time.Duration) *idleTimer {
+	t := time.NewTimer(d)
+	if d <= 0 {
+		t.Stop()
+	}
+	return &idleTimer{Timer: t}
+}
+
+func (t *idleTimer) reset(d time.Duration) {
+	t.Stop()
+	if d > 0 {
+		t.Timer.Reset(d)
 	}
 }
 
-func writeSSEJSON(w http.ResponseWriter, v interface{}) error {
+func writeSSEJSON(w io.Writer, v interface{}) error {
 	data, err := json.Marshal(v)
 	if err != nil {
 		return err
@@ -261,36 +504,26 @@ func writeSSEJSON(w http.ResponseWriter, v interface{}) error {
 	return nil
 }
 
-// writeJSON is a small helper to send JSON responses consistently.
-func (h *ChatHandler) writeJSON(ctx context.Context, w http.ResponseWriter, v interface{}) {
-	logger := logging.L(ctx)
+// writeSSEComment writes a keep-alive SSE comment, which clients ignore.
+func writeSSEComment(w io.Writer) error {
+	_, err := io.WriteString(w, ": keep-alive\n\n")
+	return err
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(v); err != nil {
-		logger.Warn("write_json_failed", zap.Error(err))
+// writeSSEEvent writes a named SSE event with a JSON payload.
+func writeSSEEvent(w io.Writer, event string, v interface{}) error {
+	if _, err := io.WriteString(w, "event: "+event+"\n"); err != nil {
+		return err
 	}
+	return writeSSEJSON(w, v)
 }
 
-func writeErrorJSON(ctx context.Context, w http.ResponseWriter, status int, msg string) {
+// writeJSON is a small helper to send JSON responses consistently.
+func writeJSON(ctx context.Context, w http.ResponseWriter, v interface{}) {
 	logger := logging.L(ctx)
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(map[string]string{"error": msg}); err != nil {
-		logger.Warn("write_error_json_failed", zap.Error(err))
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("write_json_failed", zap.Error(err))
 	}
 }
-
-type streamResponse struct {
-	Choices []streamChoice `json:"choices"`
-}
-
-type streamChoice struct {
-	Index        int         `json:"index"`
-	Delta        streamDelta `json:"delta"`
-	FinishReason string      `json:"finish_reason,omitempty"`
-}
-
-type streamDelta struct {
-	Content string `json:"content,omitempty"`
-}
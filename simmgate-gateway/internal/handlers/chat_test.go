@@ -4,24 +4,35 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"simmgate-gateway/internal/audit"
 	"simmgate-gateway/internal/cache"
 	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/middleware"
+	"simmgate-gateway/internal/models"
+	"simmgate-gateway/internal/pipeline"
 )
 
 type mockLLMClient struct {
 	resp           *llm.ChatResponse
+	responses      []*llm.ChatResponse // consumed in order before resp
 	stream         chan llm.StreamResult
 	err            error
 	streamErr      error
 	nonStreamCalls int
 	streamCalls    int
 	lastRequest    *llm.ChatRequest
+	streamCtx      context.Context
+
+	embedCalls       int
+	lastEmbedRequest *llm.EmbeddingRequest
 }
 
 func (m *mockLLMClient) ChatCompletion(ctx context.Context, req *llm.ChatRequest) (*llm.ChatResponse, error) {
@@ -30,12 +41,18 @@ func (m *mockLLMClient) ChatCompletion(ctx context.Context, req *llm.ChatRequest
 	if m.err != nil {
 		return nil, m.err
 	}
+	if len(m.responses) > 0 {
+		resp := m.responses[0]
+		m.responses = m.responses[1:]
+		return resp, nil
+	}
 	return m.resp, nil
 }
 
 func (m *mockLLMClient) ChatCompletionStream(ctx context.Context, req *llm.ChatRequest) (<-chan llm.StreamResult, error) {
 	m.streamCalls++
 	m.lastRequest = req
+	m.streamCtx = ctx
 	if m.streamErr != nil {
 		return nil, m.streamErr
 	}
@@ -45,6 +62,26 @@ func (m *mockLLMClient) ChatCompletionStream(ctx context.Context, req *llm.ChatR
 	return m.stream, nil
 }
 
+// Embeddings returns a one-element vector per input holding its length, so
+// tests can tell which input produced which embedding.
+func (m *mockLLMClient) Embeddings(ctx context.Context, req *llm.EmbeddingRequest) (*llm.EmbeddingResponse, error) {
+	m.embedCalls++
+	m.lastEmbedRequest = req
+	if m.err != nil {
+		return nil, m.err
+	}
+	resp := &llm.EmbeddingResponse{Object: "list", Model: req.Model}
+	for i, in := range req.Input {
+		resp.Data = append(resp.Data, llm.Embedding{
+			Object:    "embedding",
+			Index:     i,
+			Embedding: json.RawMessage(fmt.Sprintf("[%d]", len(in))),
+		})
+	}
+	resp.Usage = llm.EmbeddingUsage{PromptTokens: len(req.Input), TotalTokens: len(req.Input)}
+	return resp, nil
+}
+
 func TestChatHandlerNonStream(t *testing.T) {
 	cacheStore := cache.NewMemoryExactCache(time.Minute)
 	t.Cleanup(func() { cacheStore.Close() })
@@ -162,4 +199,683 @@ func TestChatHandlerStream(t *testing.T) {
 	if !strings.Contains(body, "data: [DONE]") {
 		t.Fatalf("expected DONE sentinel in body: %s", body)
 	}
+	if !strings.Contains(body, `"object":"chat.completion.chunk"`) {
+		t.Fatalf("expected chunk object in body: %s", body)
+	}
+	if strings.Count(body, `"role":"assistant"`) != 1 {
+		t.Fatalf("expected role only on first delta: %s", body)
+	}
+	if !strings.Contains(body, `"finish_reason":"stop"`) || !strings.Contains(body, `"finish_reason":null`) {
+		t.Fatalf("expected finish_reason null then stop: %s", body)
+	}
+}
+
+func TestChatHandlerUpstreamErrorMapping(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		err: &llm.UpstreamError{
+			StatusCode: http.StatusTooManyRequests,
+			Type:       "requests",
+			Code:       "rate_limit_exceeded",
+			Message:    "slow down",
+		},
+	}
+
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	payload := []byte(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(payload))
+	rr := httptest.NewRecorder()
+	h.ChatCompletion(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rr.Code)
+	}
+
+	var body struct {
+		Error struct {
+			Message string  `json:"message"`
+			Type    string  `json:"type"`
+			Param   *string `json:"param"`
+			Code    string  `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if body.Error.Type != "requests" || body.Error.Code != "rate_limit_exceeded" || body.Error.Message != "slow down" {
+		t.Fatalf("unexpected error body: %s", rr.Body.String())
+	}
+}
+
+func TestChatHandlerCachesToolCallResponse(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		resp: &llm.ChatResponse{
+			Model: "gpt-4",
+			Choices: []llm.ChatChoice{{
+				Index: 0,
+				Message: llm.ChatMessage{
+					Role: llm.RoleAssistant,
+					ToolCalls: []llm.ToolCall{{
+						ID:       "call_1",
+						Type:     llm.ToolTypeFunction,
+						Function: llm.FunctionCall{Name: "get_weather", Arguments: `{"city":"Oslo"}`},
+					}},
+				},
+				FinishReason: "tool_calls",
+			}},
+		},
+	}
+
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	payload := []byte(`{"model":"gpt-4","messages":[{"role":"user","content":"weather in Oslo?"}],` +
+		`"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}],` +
+		`"tool_choice":"auto"}`)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(payload))
+		rr := httptest.NewRecorder()
+		h.ChatCompletion(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i, rr.Code)
+		}
+
+		var resp llm.ChatResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		calls := resp.Choices[0].Message.ToolCalls
+		if len(calls) != 1 || calls[0].Function.Arguments != `{"city":"Oslo"}` {
+			t.Fatalf("request %d: unexpected tool calls: %#v", i, calls)
+		}
+	}
+
+	if fakeLLM.nonStreamCalls != 1 {
+		t.Fatalf("expected second request to be served from cache, got %d upstream calls", fakeLLM.nonStreamCalls)
+	}
+	if len(fakeLLM.lastRequest.Tools) != 1 || string(fakeLLM.lastRequest.ToolChoice) != `"auto"` {
+		t.Fatalf("tools not decoded: %#v", fakeLLM.lastRequest)
+	}
+}
+
+func TestChatHandlerStructuredOutputReprompt(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	reply := func(content string) *llm.ChatResponse {
+		return &llm.ChatResponse{
+			Model: "gpt-4",
+			Choices: []llm.ChatChoice{
+				{Index: 0, Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: content}},
+			},
+		}
+	}
+
+	fakeLLM := &mockLLMClient{
+		responses: []*llm.ChatResponse{
+			reply(`{"city":"Oslo"}`),
+			reply("```json\n{\"city\":\"Oslo\",\"temp\":4}\n```"),
+		},
+	}
+
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+	h.StructuredOutputRetries = 1
+
+	payload := []byte(`{"model":"gpt-4","messages":[{"role":"user","content":"weather?"}],` +
+		`"response_format":{"type":"json_schema","json_schema":{"name":"weather","schema":` +
+		`{"type":"object","properties":{"city":{"type":"string"},"temp":{"type":"number"}},"required":["city","temp"]}}}}`)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(payload))
+	rr := httptest.NewRecorder()
+	h.ChatCompletion(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if fakeLLM.nonStreamCalls != 2 {
+		t.Fatalf("expected one re-prompt, got %d calls", fakeLLM.nonStreamCalls)
+	}
+	if n := len(fakeLLM.lastRequest.Messages); n != 3 {
+		t.Fatalf("expected re-prompt to append the failed reply and a correction, got %d messages", n)
+	}
+
+	var resp llm.ChatResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Choices[0].Message.Content != `{"city":"Oslo","temp":4}` {
+		t.Fatalf("expected fence-stripped JSON, got %q", resp.Choices[0].Message.Content)
+	}
+	if cacheStore.Len() != 1 {
+		t.Fatalf("expected validated response to be cached")
+	}
+
+	// A response that never validates is returned but not cached.
+	cacheStore.Clear()
+	fakeLLM.responses = []*llm.ChatResponse{reply("nope"), reply("still nope")}
+	rr = httptest.NewRecorder()
+	h.ChatCompletion(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(payload)))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	if cacheStore.Len() != 0 {
+		t.Fatalf("invalid structured output must not be cached")
+	}
+}
+
+func TestChatHandlerStructuredOutputRepromptsFailingChoice(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		responses: []*llm.ChatResponse{
+			{Model: "gpt-4", Usage: &llm.Usage{PromptTokens: 10, CompletionTokens: 10, TotalTokens: 20}, Choices: []llm.ChatChoice{
+				{Index: 0, Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: `{"city":"Oslo"}`}},
+				{Index: 1, Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: `{"town":"Bergen"}`}},
+			}},
+			{Model: "gpt-4", Usage: &llm.Usage{PromptTokens: 30, CompletionTokens: 5, TotalTokens: 35}, Choices: []llm.ChatChoice{
+				{Index: 0, Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: `{"city":"Bergen"}`}},
+			}},
+		},
+	}
+
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+	h.StructuredOutputRetries = 1
+
+	payload := []byte(`{"model":"gpt-4","n":2,"messages":[{"role":"user","content":"city?"}],` +
+		`"response_format":{"type":"json_schema","json_schema":{"name":"city","schema":` +
+		`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}}}}`)
+
+	rr := httptest.NewRecorder()
+	h.ChatCompletion(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(payload)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if fakeLLM.nonStreamCalls != 2 {
+		t.Fatalf("expected one re-prompt, got %d calls", fakeLLM.nonStreamCalls)
+	}
+	last := fakeLLM.lastRequest
+	if last.N != 1 || len(last.Messages) != 3 || last.Messages[1].Content != `{"town":"Bergen"}` {
+		t.Fatalf("expected a single-choice re-prompt of the failing choice, got n=%d %+v", last.N, last.Messages)
+	}
+
+	var resp llm.ChatResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(resp.Choices) != 2 || resp.Choices[0].Message.Content != `{"city":"Oslo"}` ||
+		resp.Choices[1].Index != 1 || resp.Choices[1].Message.Content != `{"city":"Bergen"}` {
+		t.Fatalf("expected the passing choice kept and the failing one replaced, got %+v", resp.Choices)
+	}
+	if resp.Usage == nil || resp.Usage.TotalTokens != 55 {
+		t.Fatalf("expected usage of both calls, got %+v", resp.Usage)
+	}
+	if cacheStore.Len() != 1 {
+		t.Fatalf("expected the fully valid response to be cached")
+	}
+}
+
+func TestChatHandlerReplaysMultiChoiceFromCache(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		resp: &llm.ChatResponse{
+			ID:      "chatcmpl-n",
+			Created: time.Unix(1_700_000_000, 0),
+			Model:   "gpt-4",
+			Choices: []llm.ChatChoice{
+				{
+					Index:   0,
+					Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: "a"},
+					Logprobs: &llm.Logprobs{Content: []llm.TokenLogprob{{
+						Token: "a", Logprob: -0.1, Bytes: []int{97},
+						TopLogprobs: []llm.TopLogprob{{Token: "b", Logprob: -2.5, Bytes: []int{98}}},
+					}}},
+					FinishReason: "stop",
+				},
+				{Index: 1, Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: "b"}, FinishReason: "stop"},
+			},
+		},
+	}
+
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	payload := []byte(`{"model":"gpt-4","messages":[{"role":"user","content":"pick"}],"n":2,"logprobs":true,"top_logprobs":1}`)
+
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		h.ChatCompletion(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(payload)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i, rr.Code)
+		}
+		bodies = append(bodies, rr.Body.String())
+	}
+
+	if fakeLLM.nonStreamCalls != 1 {
+		t.Fatalf("expected second request to hit cache, got %d upstream calls", fakeLLM.nonStreamCalls)
+	}
+	if fakeLLM.lastRequest.N != 2 || !fakeLLM.lastRequest.Logprobs {
+		t.Fatalf("n/logprobs not decoded: %#v", fakeLLM.lastRequest)
+	}
+	if bodies[0] != bodies[1] {
+		t.Fatalf("cached replay differs from live response:\nlive:   %s\ncached: %s", bodies[0], bodies[1])
+	}
+	if !strings.Contains(bodies[1], `"created":1700000000`) || !strings.Contains(bodies[1], `"top_logprobs":[{"token":"b"`) {
+		t.Fatalf("unexpected replayed body: %s", bodies[1])
+	}
+}
+
+func TestChatHandlerStreamInterleavedChoices(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	streamChan := make(chan llm.StreamResult, 4)
+	fakeLLM := &mockLLMClient{stream: streamChan}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	lp := &llm.Logprobs{Content: []llm.TokenLogprob{{Token: "x", Logprob: -0.5}}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{ID: "chatcmpl-s", Index: 0, Delta: "x", Logprobs: lp}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{ID: "chatcmpl-s", Index: 1, Delta: "y"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{ID: "chatcmpl-s", Index: 0, FinishReason: "stop"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{ID: "chatcmpl-s", Index: 1, FinishReason: "stop"}}
+	close(streamChan)
+
+	payload := []byte(`{"model":"gpt-4","stream":true,"n":2,"logprobs":true,"messages":[{"role":"user","content":"go"}]}`)
+	rr := httptest.NewRecorder()
+	h.ChatCompletion(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(payload)))
+
+	var roles, logprobs int
+	indexes := map[int]int{}
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			ID      string `json:"id"`
+			Choices []struct {
+				Index int `json:"index"`
+				Delta struct {
+					Role string `json:"role"`
+				} `json:"delta"`
+				Logprobs *llm.Logprobs `json:"logprobs"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decode chunk %q: %v", data, err)
+		}
+		if chunk.ID != "chatcmpl-s" {
+			t.Fatalf("unexpected chunk id %q", chunk.ID)
+		}
+		for _, c := range chunk.Choices {
+			indexes[c.Index]++
+			if c.Delta.Role != "" {
+				roles++
+			}
+			if c.Logprobs != nil {
+				logprobs++
+			}
+		}
+	}
+
+	if indexes[0] != 2 || indexes[1] != 2 {
+		t.Fatalf("expected two chunks per choice, got %v", indexes)
+	}
+	if roles != 2 {
+		t.Fatalf("expected one role delta per choice, got %d", roles)
+	}
+	if logprobs != 1 {
+		t.Fatalf("expected logprobs on one chunk, got %d", logprobs)
+	}
+}
+
+func TestChatHandlerStreamTimeouts(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	timeouts := middleware.Timeouts{
+		Request:         20 * time.Millisecond,
+		StreamFirstByte: 200 * time.Millisecond,
+		StreamIdle:      100 * time.Millisecond,
+		StreamTotal:     time.Second,
+	}
+
+	run := func(t *testing.T, feed func(chan<- llm.StreamResult)) string {
+		t.Helper()
+		streamChan := make(chan llm.StreamResult, 4)
+		h := NewChatHandler(cacheStore, time.Minute, "vtest", &mockLLMClient{stream: streamChan})
+		feed(streamChan)
+
+		payload := `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"slow"}]}`
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(payload))
+		middleware.Timeout(timeouts)(http.HandlerFunc(h.ChatCompletion)).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected the stream to outlive the request timeout, got %d: %s", rr.Code, rr.Body.String())
+		}
+		return rr.Body.String()
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		body := run(t, func(c chan<- llm.StreamResult) {
+			c <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "partial"}}
+		})
+		if !strings.Contains(body, `"content":"partial"`) || !strings.Contains(body, `"code":"stream_idle_timeout"`) {
+			t.Fatalf("expected chunk then idle timeout event: %s", body)
+		}
+	})
+
+	t.Run("first byte", func(t *testing.T) {
+		body := run(t, func(chan<- llm.StreamResult) {})
+		if !strings.Contains(body, `"code":"stream_first_byte_timeout"`) {
+			t.Fatalf("expected first byte timeout event: %s", body)
+		}
+	})
+
+	t.Run("slow but steady", func(t *testing.T) {
+		body := run(t, func(c chan<- llm.StreamResult) {
+			go func() {
+				for i := 0; i < 3; i++ {
+					time.Sleep(40 * time.Millisecond)
+					c <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "tick"}}
+				}
+				close(c)
+			}()
+		})
+		if strings.Count(body, `"content":"tick"`) != 3 || !strings.Contains(body, "data: [DONE]") {
+			t.Fatalf("expected full stream past the request timeout: %s", body)
+		}
+	})
+}
+
+func TestChatHandlerStreamHeartbeat(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	streamChan := make(chan llm.StreamResult)
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", &mockLLMClient{stream: streamChan})
+	h.StreamHeartbeat = 10 * time.Millisecond
+
+	go func() {
+		time.Sleep(60 * time.Millisecond)
+		streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "thought", FinishReason: "stop"}}
+		close(streamChan)
+	}()
+
+	payload := `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"think"}]}`
+	rr := httptest.NewRecorder()
+	h.ChatCompletion(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(payload)))
+
+	body := rr.Body.String()
+	first := strings.Index(body, ": keep-alive\n\n")
+	if first < 0 || first > strings.Index(body, `"content":"thought"`) {
+		t.Fatalf("expected heartbeats while waiting for the first chunk: %q", body)
+	}
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Fatalf("expected the stream to finish normally: %q", body)
+	}
+}
+
+func TestChatHandlerPipelineStages(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		resp: &llm.ChatResponse{
+			Model:   "gpt-4",
+			Choices: []llm.ChatChoice{{Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: "hello!"}}},
+		},
+	}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	var seen []bool
+	stages := h.Stages()
+	stages["policy"] = pipeline.Funcs{BeforeFunc: func(_ context.Context, ex *pipeline.Exchange) error {
+		seen = append(seen, ex.Stream)
+		if ex.Request.Model == "blocked" {
+			return &pipeline.RejectError{Status: http.StatusForbidden, Code: "model_blocked", Param: "model", Message: "model is blocked"}
+		}
+		return nil
+	}}
+	p, err := stages.Build([]string{"policy", StageExactCache})
+	if err != nil {
+		t.Fatalf("build pipeline: %v", err)
+	}
+	h.Pipeline = p
+
+	do := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		h.ChatCompletion(rr, req)
+		return rr
+	}
+
+	rr := do(`{"model":"blocked","messages":[{"role":"user","content":"hi"}]}`)
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), `"code":"model_blocked"`) {
+		t.Fatalf("expected 403 model_blocked, got %d %s", rr.Code, rr.Body.String())
+	}
+	if fakeLLM.nonStreamCalls != 0 {
+		t.Fatalf("rejected request reached the upstream")
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := do(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`); rr.Code != http.StatusOK {
+			t.Fatalf("call %d: status %d", i, rr.Code)
+		}
+	}
+	if fakeLLM.nonStreamCalls != 1 {
+		t.Fatalf("expected the exact cache stage to answer the second call, upstream calls = %d", fakeLLM.nonStreamCalls)
+	}
+
+	streamChan := make(chan llm.StreamResult)
+	close(streamChan)
+	fakeLLM.stream = streamChan
+	if rr := do(`{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`); rr.Code != http.StatusOK {
+		t.Fatalf("stream: status %d", rr.Code)
+	}
+	if want := []bool{false, false, false, true}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("policy stage saw stream flags %v, want %v", seen, want)
+	}
+}
+
+func TestChatHandlerStreamDrainExpiry(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	streamChan := make(chan llm.StreamResult, 1)
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "partial"}}
+	drain := middleware.NewDrain()
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", &mockLLMClient{stream: streamChan})
+	h.Drain = drain
+
+	// The upstream never finishes; the drain period ends while it runs.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		for {
+			if _, streams := drain.InFlight(); streams == 1 || ctx.Err() != nil {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		drain.Start()
+		drain.Expire()
+	}()
+
+	payload := `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"long"}]}`
+	rr := httptest.NewRecorder()
+	h.ChatCompletion(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(payload)))
+
+	body := rr.Body.String()
+	if !strings.Contains(body, `"content":"partial"`) || !strings.Contains(body, `"code":"server_shutting_down"`) {
+		t.Fatalf("expected chunk then shutdown error event: %s", body)
+	}
+	if _, streams := drain.InFlight(); streams != 0 {
+		t.Fatalf("streams in flight after return = %d", streams)
+	}
+}
+
+func TestChatHandlerAuditRecords(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	streamChan := make(chan llm.StreamResult, 3)
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "mail "}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "bob@example.com", FinishReason: "stop"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Usage: &llm.Usage{PromptTokens: 10, CompletionTokens: 4, TotalTokens: 14}}}
+	close(streamChan)
+	fakeLLM := &mockLLMClient{
+		resp: &llm.ChatResponse{
+			Model:   "gpt-4o-2024-08-06",
+			Choices: []llm.ChatChoice{{Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: "hello!"}}},
+			Usage:   &llm.Usage{PromptTokens: 1000, CompletionTokens: 500, TotalTokens: 1500},
+		},
+		stream: streamChan,
+	}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+	h.Models = models.NewRegistry(models.Config{}, nil, nil)
+
+	var out bytes.Buffer
+	h.Audit = audit.New(audit.Config{Provider: "openai", Bodies: audit.BodiesRedacted}, nil, audit.NewWriterSink("test", &out))
+
+	do := func(body string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("X-User-ID", "user-42")
+		rr := httptest.NewRecorder()
+		h.ChatCompletion(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+	do(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)
+	do(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)
+	do(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"my key is sk-abcdefghijklmnopqrstuv"}]}`)
+
+	if err := h.Audit.Close(); err != nil {
+		t.Fatalf("close audit log: %v", err)
+	}
+	var records []audit.Record
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var rec audit.Record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("decode record: %v", err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d: %s", len(records), out.String())
+	}
+
+	miss, hit, stream := records[0], records[1], records[2]
+	if miss.CacheResult != "miss" || miss.UserID != "user-42" || miss.Provider != "openai" || miss.Status != "ok" {
+		t.Fatalf("unexpected miss record: %+v", miss)
+	}
+	if miss.Usage == nil || miss.Usage.TotalTokens != 1500 || miss.CostUSD == nil || *miss.CostUSD != 0.0075 {
+		t.Fatalf("expected usage and cost on miss record: %+v", miss)
+	}
+	if hit.CacheResult != "hit" || hit.CacheTier != StageExactCache || hit.CostUSD == nil || *hit.CostUSD != 0 {
+		t.Fatalf("unexpected hit record: %+v", hit)
+	}
+	if !reflect.DeepEqual(miss.Response, []string{"hello!"}) {
+		t.Fatalf("unexpected miss response body: %v", miss.Response)
+	}
+
+	if !stream.Stream || stream.CacheResult != "bypass" || stream.Usage == nil || stream.Usage.TotalTokens != 14 {
+		t.Fatalf("unexpected stream record: %+v", stream)
+	}
+	if want := []audit.Message{{Role: "user", Content: "my key is [REDACTED_SECRET]"}}; !reflect.DeepEqual(stream.Prompt, want) {
+		t.Fatalf("stream prompt = %+v, want %+v", stream.Prompt, want)
+	}
+	if want := []string{"mail [REDACTED_EMAIL]"}; !reflect.DeepEqual(stream.Response, want) {
+		t.Fatalf("stream response = %v, want %v", stream.Response, want)
+	}
+}
+
+func TestChatHandlerAuditRecordsCancelledStream(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	// The upstream sends one chunk and then nothing until the client leaves.
+	streamChan := make(chan llm.StreamResult, 1)
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "partial"}}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", &mockLLMClient{stream: streamChan})
+
+	var out bytes.Buffer
+	h.Audit = audit.New(audit.Config{}, nil, audit.NewWriterSink("test", &out))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	payload := `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"x"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(payload)).WithContext(ctx)
+	h.ChatCompletion(httptest.NewRecorder(), req)
+
+	if err := h.Audit.Close(); err != nil {
+		t.Fatalf("close audit log: %v", err)
+	}
+	var rec audit.Record
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatalf("decode record %q: %v", out.String(), err)
+	}
+	if rec.Status != "aborted" || rec.AbortReason != "cancelled" {
+		t.Fatalf("cancelled stream recorded as %q (%q)", rec.Status, rec.AbortReason)
+	}
+}
+
+func TestChatHandlerAuditsPlainStreamUsage(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	// Like OpenAI, the upstream only reports stream usage when asked to.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			StreamOptions *llm.StreamOptions `json:"stream_options"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":"stop"}]}`+"\n\n")
+		if body.StreamOptions != nil && body.StreamOptions.IncludeUsage {
+			fmt.Fprint(w, `data: {"id":"c1","choices":[],"usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500}}`+"\n\n")
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(upstream.Close)
+
+	client, err := llm.NewClient(llm.Config{BaseURL: upstream.URL, APIKey: "key"}, nil)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", client)
+	h.Models = models.NewRegistry(models.Config{}, nil, nil)
+	var out bytes.Buffer
+	h.Audit = audit.New(audit.Config{}, nil, audit.NewWriterSink("test", &out))
+
+	payload := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	rr := httptest.NewRecorder()
+	h.ChatCompletion(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(payload)))
+	if strings.Contains(rr.Body.String(), `"usage"`) {
+		t.Fatalf("usage sent to a client that did not ask for it: %s", rr.Body.String())
+	}
+
+	if err := h.Audit.Close(); err != nil {
+		t.Fatalf("close audit log: %v", err)
+	}
+	var rec audit.Record
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatalf("decode record %q: %v", out.String(), err)
+	}
+	if rec.Usage == nil || rec.Usage.TotalTokens != 1500 || rec.CostUSD == nil || *rec.CostUSD != 0.0075 {
+		t.Fatalf("stream record lacks usage or cost: %+v", rec)
+	}
 }
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/pkg/logging/logging"
+
+	"go.uber.org/zap"
+)
+
+const textCompletionObject = "text_completion"
+
+// legacyDefaultMaxTokens is the /v1/completions default for max_tokens.
+const legacyDefaultMaxTokens = 16
+
+// completionRequest is the legacy /v1/completions request body.
+type completionRequest struct {
+	Model       string          `json:"model"`
+	Prompt      json.RawMessage `json:"prompt"`
+	MaxTokens   *int            `json:"max_tokens,omitempty"`
+	Temperature float32         `json:"temperature,omitempty"`
+	TopP        float32         `json:"top_p,omitempty"`
+	N           int             `json:"n,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+	Stop        json.RawMessage `json:"stop,omitempty"`
+	Logprobs    *int            `json:"logprobs,omitempty"`
+	Echo        bool            `json:"echo,omitempty"`
+
+	StreamOptions *llm.StreamOptions `json:"stream_options,omitempty"`
+
+	// Forwarded unchanged as chat pass-through fields.
+	PresencePenalty  json.RawMessage `json:"presence_penalty,omitempty"`
+	FrequencyPenalty json.RawMessage `json:"frequency_penalty,omitempty"`
+	LogitBias        json.RawMessage `json:"logit_bias,omitempty"`
+	Seed             json.RawMessage `json:"seed,omitempty"`
+	User             json.RawMessage `json:"user,omitempty"`
+}
+
+type completionChoice struct {
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *completionLogprobs `json:"logprobs"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+// completionLogprobs is the legacy per-token logprobs shape.
+type completionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
+}
+
+type completionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []completionChoice `json:"choices"`
+	Usage   *llm.Usage         `json:"usage,omitempty"`
+}
+
+// Completion handles POST /v1/completions by translating the prompt into a
+// single user message and running it through the same cache and provider
+// path as ChatCompletion.
+func (h *ChatHandler) Completion(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.L(ctx)
+	start := time.Now()
+
+	var creq completionRequest
+	if err := json.NewDecoder(r.Body).Decode(&creq); err != nil {
+		logger.Warn("invalid_request", zap.Error(err))
+		writeLLMError(ctx, w, requestBodyError(err))
+		return
+	}
+
+	req, prompt, err := creq.toChatRequest()
+	if err != nil {
+		writeLLMError(ctx, w, err)
+		return
+	}
+	req.Model = h.Models.Resolve(req.Model)
+
+	userID := userIDFromRequest(r)
+	versionID := versionOrDefault(h.VersionID)
+
+	echo := ""
+	if creq.Echo {
+		echo = prompt
+	}
+
+	if req.Stream {
+		sw := dataStream{enc: newCompletionChunkEncoder(req.Model, echo)}
+		if err := h.streamChatCompletion(ctx, w, logger, req, userID, versionID, r.Header.Get(lastEventIDHeader), start, sw); err != nil {
+			writeLLMError(ctx, w, err)
+		}
+		return
+	}
+
+	resp, err := h.complete(ctx, req, userID, versionID, start)
+	if err != nil {
+		writeLLMError(ctx, w, err)
+		return
+	}
+
+	writeJSON(ctx, w, chatToCompletion(resp, echo))
+}
+
+// toChatRequest converts the legacy body into a ChatRequest and returns the
+// prompt text (for echo).
+func (c *completionRequest) toChatRequest() (*llm.ChatRequest, string, error) {
+	prompt, err := decodePrompt(c.Prompt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stop, err := decodeStringOrList(c.Stop)
+	if err != nil {
+		return nil, "", &statusError{
+			status: http.StatusBadRequest,
+			body:   newAPIError(errTypeInvalidRequest, "invalid_request", "stop", "stop must be a string or an array of strings"),
+		}
+	}
+
+	maxTokens := legacyDefaultMaxTokens
+	if c.MaxTokens != nil {
+		maxTokens = *c.MaxTokens
+	}
+
+	req := &llm.ChatRequest{
+		Model:         c.Model,
+		Messages:      []llm.ChatMessage{{Role: llm.RoleUser, Content: prompt}},
+		Temperature:   c.Temperature,
+		TopP:          c.TopP,
+		MaxTokens:     maxTokens,
+		Stop:          stop,
+		Stream:        c.Stream,
+		StreamOptions: c.StreamOptions,
+		N:             c.N,
+	}
+
+	if c.Logprobs != nil && *c.Logprobs > 0 {
+		top := *c.Logprobs
+		req.Logprobs = true
+		req.TopLogprobs = &top
+	}
+
+	extra := map[string]json.RawMessage{
+		"presence_penalty":  c.PresencePenalty,
+		"frequency_penalty": c.FrequencyPenalty,
+		"logit_bias":        c.LogitBias,
+		"seed":              c.Seed,
+		"user":              c.User,
+	}
+	for k, v := range extra {
+		if len(v) == 0 {
+			continue
+		}
+		if req.Extra == nil {
+			req.Extra = make(map[string]json.RawMessage)
+		}
+		req.Extra[k] = v
+	}
+
+	return req, prompt, nil
+}
+
+// decodePrompt accepts a string or a one-element array of strings. Batched
+// prompts are not supported by the shim.
+func decodePrompt(raw json.RawMessage) (string, error) {
+	prompts, err := decodeStringOrList(raw)
+	if err != nil || len(prompts) == 0 {
+		return "", &statusError{
+			status: http.StatusBadRequest,
+			body:   newAPIError(errTypeInvalidRequest, "invalid_request", "prompt", "prompt must be a non-empty string"),
+		}
+	}
+	if len(prompts) > 1 {
+		return "", &statusError{
+			status: http.StatusBadRequest,
+			body:   newAPIError(errTypeInvalidRequest, "unsupported_prompt", "prompt", "multiple prompts per request are not supported"),
+		}
+	}
+	return prompts[0], nil
+}
+
+func decodeStringOrList(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, errors.New("expected a string or an array of strings")
+	}
+	return list, nil
+}
+
+// chatToCompletion converts a chat response into the text_completion shape.
+func chatToCompletion(resp *llm.ChatResponse, echo string) completionResponse {
+	out := completionResponse{
+		ID:      "cmpl-" + strings.TrimPrefix(resp.ID, "chatcmpl-"),
+		Object:  textCompletionObject,
+		Created: resp.Created.Unix(),
+		Model:   resp.Model,
+		Choices: make([]completionChoice, 0, len(resp.Choices)),
+		Usage:   resp.Usage,
+	}
+	if resp.ID == "" {
+		out.ID = newCompletionID("cmpl-")
+	}
+	if resp.Created.IsZero() {
+		out.Created = time.Now().Unix()
+	}
+
+	for _, ch := range resp.Choices {
+		choice := completionChoice{
+			Text:     echo + ch.Message.Text(),
+			Index:    ch.Index,
+			Logprobs: legacyLogprobs(ch.Logprobs, len(echo)),
+		}
+		if ch.FinishReason != "" {
+			reason := ch.FinishReason
+			choice.FinishReason = &reason
+		}
+		out.Choices = append(out.Choices, choice)
+	}
+	return out
+}
+
+// legacyLogprobs converts chat logprobs to the legacy parallel-array shape.
+// offset is where the first token starts in the returned text.
+func legacyLogprobs(lp *llm.Logprobs, offset int) *completionLogprobs {
+	if lp == nil {
+		return nil
+	}
+
+	out := &completionLogprobs{
+		Tokens:        make([]string, 0, len(lp.Content)),
+		TokenLogprobs: make([]float64, 0, len(lp.Content)),
+		TopLogprobs:   make([]map[string]float64, 0, len(lp.Content)),
+		TextOffset:    make([]int, 0, len(lp.Content)),
+	}
+	for _, t := range lp.Content {
+		top := make(map[string]float64, len(t.TopLogprobs))
+		for _, alt := range t.TopLogprobs {
+			top[alt.Token] = alt.Logprob
+		}
+		out.Tokens = append(out.Tokens, t.Token)
+		out.TokenLogprobs = append(out.TokenLogprobs, t.Logprob)
+		out.TopLogprobs = append(out.TopLogprobs, top)
+		out.TextOffset = append(out.TextOffset, offset)
+		offset += len(t.Token)
+	}
+	return out
+}
+
+// completionChunkEncoder emits legacy text_completion stream chunks.
+type completionChunkEncoder struct {
+	id      string
+	created int64
+	model   string
+	echo    string
+	offsets map[int]int
+}
+
+func newCompletionChunkEncoder(model, echo string) *completionChunkEncoder {
+	return &completionChunkEncoder{
+		id:      newCompletionID("cmpl-"),
+		created: time.Now().Unix(),
+		model:   model,
+		echo:    echo,
+		offsets: make(map[int]int),
+	}
+}
+
+func (e *completionChunkEncoder) encode(c *llm.StreamChunk) interface{} {
+	if c.Model != "" {
+		e.model = c.Model
+	}
+
+	resp := completionResponse{
+		ID:      e.id,
+		Object:  textCompletionObject,
+		Created: e.created,
+		Model:   e.model,
+		Choices: []completionChoice{},
+	}
+	if c.Usage != nil {
+		resp.Usage = c.Usage
+		return resp
+	}
+
+	text := c.Delta
+	offset, started := e.offsets[c.Index]
+	if !started && e.echo != "" {
+		text = e.echo + text
+		offset = len(e.echo)
+	}
+
+	choice := completionChoice{
+		Text:     text,
+		Index:    c.Index,
+		Logprobs: legacyLogprobs(c.Logprobs, offset),
+	}
+	if c.FinishReason != "" {
+		reason := c.FinishReason
+		choice.FinishReason = &reason
+	}
+	e.offsets[c.Index] = offset + len(c.Delta)
+
+	resp.Choices = append(resp.Choices, choice)
+	return resp
+}
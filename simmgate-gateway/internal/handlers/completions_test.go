@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+)
+
+func TestCompletionSharesChatCache(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		resp: &llm.ChatResponse{
+			ID:    "chatcmpl-abc",
+			Model: "gpt-4",
+			Choices: []llm.ChatChoice{{
+				Index:        0,
+				Message:      llm.ChatMessage{Role: llm.RoleAssistant, Content: " world"},
+				FinishReason: "length",
+				Logprobs: &llm.Logprobs{Content: []llm.TokenLogprob{
+					{Token: " world", Logprob: -0.1, TopLogprobs: []llm.TopLogprob{{Token: " world", Logprob: -0.1}}},
+				}},
+			}},
+			Usage: &llm.Usage{PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2},
+		},
+	}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	payload := []byte(`{"model":"gpt-4","prompt":["hello"],"echo":true,"logprobs":1,"seed":7}`)
+	rr := httptest.NewRecorder()
+	h.Completion(rr, httptest.NewRequest(http.MethodPost, "/v1/completions", bytes.NewReader(payload)))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp completionResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Object != "text_completion" || resp.ID != "cmpl-abc" {
+		t.Fatalf("unexpected envelope: %+v", resp)
+	}
+	if got := resp.Choices[0].Text; got != "hello world" {
+		t.Fatalf("expected echoed text, got %q", got)
+	}
+	if lp := resp.Choices[0].Logprobs; lp == nil || lp.TextOffset[0] != len("hello") {
+		t.Fatalf("unexpected logprobs: %+v", lp)
+	}
+
+	sent := fakeLLM.lastRequest
+	if sent.MaxTokens != legacyDefaultMaxTokens || !sent.Logprobs || *sent.TopLogprobs != 1 {
+		t.Fatalf("unexpected translated request: %+v", sent)
+	}
+	if string(sent.Extra["seed"]) != "7" {
+		t.Fatalf("expected seed pass-through, got %s", sent.Extra["seed"])
+	}
+
+	// The same request through the chat endpoint is a cache hit.
+	chatPayload, err := json.Marshal(sent)
+	if err != nil {
+		t.Fatalf("marshal chat request: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	h.ChatCompletion(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(chatPayload)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	if fakeLLM.nonStreamCalls != 1 {
+		t.Fatalf("expected chat request to hit the completion cache entry, got %d upstream calls", fakeLLM.nonStreamCalls)
+	}
+}
+
+func TestCompletionStream(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	streamChan := make(chan llm.StreamResult, 3)
+	fakeLLM := &mockLLMClient{stream: streamChan}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "hel"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "lo", FinishReason: "stop"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Usage: &llm.Usage{TotalTokens: 3}}}
+	close(streamChan)
+
+	payload := []byte(`{"model":"gpt-4","prompt":"say","stream":true,"stream_options":{"include_usage":true}}`)
+	rr := httptest.NewRecorder()
+	h.Completion(rr, httptest.NewRequest(http.MethodPost, "/v1/completions", bytes.NewReader(payload)))
+
+	var text strings.Builder
+	var usage bool
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk completionResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decode chunk %q: %v", data, err)
+		}
+		if chunk.Object != "text_completion" {
+			t.Fatalf("unexpected chunk object %q", chunk.Object)
+		}
+		for _, c := range chunk.Choices {
+			text.WriteString(c.Text)
+		}
+		if chunk.Usage != nil {
+			usage = true
+		}
+	}
+
+	if text.String() != "hello" {
+		t.Fatalf("expected streamed text %q, got %q", "hello", text.String())
+	}
+	if !usage {
+		t.Fatalf("expected usage chunk: %s", rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "data: [DONE]") {
+		t.Fatalf("expected DONE sentinel: %s", rr.Body.String())
+	}
+}
+
+func TestCompletionRejectsBatchedPrompt(t *testing.T) {
+	fakeLLM := &mockLLMClient{}
+	h := NewChatHandler(cache.NewMemoryExactCache(time.Minute), time.Minute, "vtest", fakeLLM)
+
+	payload := []byte(`{"model":"gpt-4","prompt":["a","b"]}`)
+	rr := httptest.NewRecorder()
+	h.Completion(rr, httptest.NewRequest(http.MethodPost, "/v1/completions", bytes.NewReader(payload)))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `"param":"prompt"`) {
+		t.Fatalf("expected prompt param in error: %s", rr.Body.String())
+	}
+	if fakeLLM.nonStreamCalls != 0 {
+		t.Fatalf("expected no upstream call")
+	}
+}
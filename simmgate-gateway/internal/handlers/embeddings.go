@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/models"
+	"simmgate-gateway/pkg/logging/logging"
+
+	"go.uber.org/zap"
+)
+
+// EmbeddingsHandler holds dependencies for the /v1/embeddings endpoint.
+type EmbeddingsHandler struct {
+	Cache     cache.ExactCache
+	CacheTTL  time.Duration
+	VersionID string
+	LLM       llm.Client
+
+	// Models resolves model aliases; nil disables aliasing.
+	Models *models.Registry
+}
+
+func NewEmbeddingsHandler(c cache.ExactCache, ttl time.Duration, versionID string, client llm.Client) *EmbeddingsHandler {
+	return &EmbeddingsHandler{
+		Cache:     c,
+		CacheTTL:  ttl,
+		VersionID: versionID,
+		LLM:       client,
+	}
+}
+
+// Embeddings handles POST /v1/embeddings.
+// Each input is looked up in the exact cache on its own; only the misses
+// are sent upstream, as one batched call, and the response is reassembled
+// in the original input order.
+func (h *EmbeddingsHandler) Embeddings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.L(ctx)
+	start := time.Now()
+
+	var req llm.EmbeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Warn("invalid_request", zap.Error(err))
+		writeLLMError(ctx, w, requestBodyError(err))
+		return
+	}
+	req.Model = h.Models.Resolve(req.Model)
+	if err := req.Validate(); err != nil {
+		writeErrorJSON(ctx, w, http.StatusBadRequest,
+			newAPIError(errTypeInvalidRequest, "invalid_request", "input", err.Error()))
+		return
+	}
+
+	userID := userIDFromRequest(r)
+	versionID := versionOrDefault(h.VersionID)
+
+	data := make([]llm.Embedding, len(req.Input))
+	keys := make([]string, len(req.Input))
+
+	// missIdx maps each distinct uncached input to the positions that need it,
+	// so duplicates inside one batch are only embedded once.
+	var missInputs []string
+	missIdx := make(map[string][]int)
+
+	cacheLookupStart := time.Now()
+	for i, input := range req.Input {
+		keys[i] = cache.BuildEmbeddingCacheKey(req.Model, input, req.EncodingFormat, req.Dimensions, userID, versionID).String()
+
+		cached, hit, err := h.Cache.Get(ctx, keys[i])
+		if err != nil {
+			logger.Warn("exact_cache_get_error", zap.Error(err))
+		}
+		if hit {
+			data[i] = llm.Embedding{Object: "embedding", Index: i, Embedding: json.RawMessage(cached)}
+			continue
+		}
+
+		if _, seen := missIdx[input]; !seen {
+			missInputs = append(missInputs, input)
+		}
+		missIdx[input] = append(missIdx[input], i)
+	}
+	cacheLookupLatency := time.Since(cacheLookupStart)
+
+	resp := &llm.EmbeddingResponse{
+		Object: "list",
+		Model:  req.Model,
+	}
+
+	var llmLatency time.Duration
+	if len(missInputs) > 0 {
+		upstreamReq := req
+		upstreamReq.Input = missInputs
+
+		llmStart := time.Now()
+		upstream, err := h.LLM.Embeddings(ctx, &upstreamReq)
+		llmLatency = time.Since(llmStart)
+		if err != nil {
+			logger.Error("llm_embeddings_failed", zap.Error(err))
+			writeLLMError(ctx, w, err)
+			return
+		}
+
+		if upstream.Model != "" {
+			resp.Model = upstream.Model
+		}
+		resp.Usage = upstream.Usage
+
+		for _, emb := range upstream.Data {
+			if emb.Index < 0 || emb.Index >= len(missInputs) {
+				logger.Warn("embedding_index_out_of_range", zap.Int("index", emb.Index))
+				continue
+			}
+			input := missInputs[emb.Index]
+			for _, pos := range missIdx[input] {
+				data[pos] = llm.Embedding{Object: "embedding", Index: pos, Embedding: emb.Embedding}
+			}
+			h.storeEmbedding(ctx, keys[missIdx[input][0]], emb.Embedding)
+		}
+	}
+
+	for i := range data {
+		if data[i].Embedding == nil {
+			logger.Error("embedding_missing", zap.Int("index", i))
+			writeErrorJSON(ctx, w, http.StatusBadGateway,
+				newAPIError(errTypeUpstream, "upstream_error", "", "upstream returned incomplete embeddings"))
+			return
+		}
+	}
+	resp.Data = data
+
+	logger.Info("cache_decision",
+		zap.String("cache_tier", "exact"),
+		zap.String("endpoint", "embeddings"),
+		zap.String("user_id", userID),
+		zap.String("model_id", req.Model),
+		zap.String("version_id", versionID),
+		zap.Int("inputs", len(req.Input)),
+		zap.Int("cache_hits", len(req.Input)-countPositions(missIdx)),
+		zap.Int("upstream_inputs", len(missInputs)),
+		zap.Duration("cache_lookup_latency", cacheLookupLatency),
+		zap.Duration("llm_latency", llmLatency),
+		zap.Duration("total_latency", time.Since(start)),
+	)
+
+	writeJSON(ctx, w, resp)
+}
+
+func (h *EmbeddingsHandler) storeEmbedding(ctx context.Context, key string, vector json.RawMessage) {
+	if err := h.Cache.Set(ctx, key, vector, h.CacheTTL); err != nil {
+		logging.L(ctx).Warn("exact_cache_set_error", zap.Error(err))
+	}
+}
+
+func countPositions(m map[string][]int) int {
+	n := 0
+	for _, v := range m {
+		n += len(v)
+	}
+	return n
+}
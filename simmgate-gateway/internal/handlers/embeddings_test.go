@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/middleware"
+)
+
+func TestEmbeddingsHandlerPerInputCache(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{}
+	h := NewEmbeddingsHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	post := func(body string) llm.EmbeddingResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", bytes.NewReader([]byte(body)))
+		req.Header.Set("X-User-ID", "rag")
+		rr := httptest.NewRecorder()
+		h.Embeddings(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp llm.EmbeddingResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return resp
+	}
+
+	// Warm the cache with a single string input.
+	post(`{"model":"text-embedding-3-small","input":"bb"}`)
+	if fakeLLM.embedCalls != 1 {
+		t.Fatalf("expected one upstream call, got %d", fakeLLM.embedCalls)
+	}
+
+	resp := post(`{"model":"text-embedding-3-small","input":["a","bb","ccc","a"]}`)
+
+	if fakeLLM.embedCalls != 2 {
+		t.Fatalf("expected one batched upstream call for misses, got %d total", fakeLLM.embedCalls)
+	}
+	if got := fakeLLM.lastEmbedRequest.Input; !reflect.DeepEqual(got, []string{"a", "ccc"}) {
+		t.Fatalf("expected only distinct misses upstream, got %v", got)
+	}
+
+	want := []string{"[1]", "[2]", "[3]", "[1]"}
+	if len(resp.Data) != len(want) {
+		t.Fatalf("expected %d embeddings, got %d", len(want), len(resp.Data))
+	}
+	for i, emb := range resp.Data {
+		if emb.Index != i || string(emb.Embedding) != want[i] {
+			t.Fatalf("data[%d] = {index %d, %s}, want {index %d, %s}", i, emb.Index, emb.Embedding, i, want[i])
+		}
+	}
+
+	// Everything is cached now.
+	post(`{"model":"text-embedding-3-small","input":["ccc","a"]}`)
+	if fakeLLM.embedCalls != 2 {
+		t.Fatalf("expected full cache hit, got %d upstream calls", fakeLLM.embedCalls)
+	}
+}
+
+func TestEmbeddingsHandlerBodyOverLimit(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+	h := NewEmbeddingsHandler(cacheStore, time.Minute, "vtest", &mockLLMClient{})
+	handler := middleware.MaxBodySize(64)(http.HandlerFunc(h.Embeddings))
+
+	body := `{"model":"text-embedding-3-small","input":["` + strings.Repeat("x", 100) + `"]}`
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(body)))
+	if rr.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rr.Body.String(), "request_too_large") {
+		t.Fatalf("expected 413 request_too_large, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
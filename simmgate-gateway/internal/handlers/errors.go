@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/pipeline"
+	"simmgate-gateway/pkg/logging/logging"
+
+	"go.uber.org/zap"
+)
+
+// OpenAI error types used by the gateway itself.
+const (
+	errTypeInvalidRequest = "invalid_request_error"
+	errTypeUpstream       = "upstream_error"
+	errTypeTimeout        = "timeout_error"
+	errTypeServer         = "server_error"
+)
+
+// apiError is the OpenAI-compatible error envelope:
+// {"error":{"message":...,"type":...,"param":...,"code":...}}
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// newAPIError builds an error body; empty param/code are encoded as null.
+func newAPIError(errType, code, param, msg string) apiErrorBody {
+	body := apiErrorBody{
+		Message: msg,
+		Type:    errType,
+	}
+	if code != "" {
+		body.Code = &code
+	}
+	if param != "" {
+		body.Param = &param
+	}
+	return body
+}
+
+// statusError is an error that already knows its HTTP status and body,
+// used for failures detected by the handler itself.
+type statusError struct {
+	status int
+	body   apiErrorBody
+}
+
+func (e *statusError) Error() string {
+	return e.body.Message
+}
+
+// errorFromLLM maps an error returned by llm.Client to an HTTP status and an
+// OpenAI-style error body. Provider 4xx statuses are relayed as-is; provider
+// 5xx and transport failures become 502.
+func errorFromLLM(err error) (int, apiErrorBody) {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status, se.body
+	}
+
+	var re *pipeline.RejectError
+	if errors.As(err, &re) {
+		errType := re.Type
+		if errType == "" {
+			errType = errTypeInvalidRequest
+		}
+		return re.Status, newAPIError(errType, re.Code, re.Param, re.Message)
+	}
+
+	if ue, ok := llm.AsUpstreamError(err); ok {
+		status := ue.StatusCode
+		if status < 400 || status >= 500 {
+			status = http.StatusBadGateway
+		}
+		errType := ue.Type
+		if errType == "" {
+			errType = errTypeUpstream
+		}
+		return status, newAPIError(errType, ue.Code, ue.Param, ue.Message)
+	}
+
+	switch {
+	case errors.Is(err, llm.ErrInvalidRequest):
+		return http.StatusBadRequest, newAPIError(errTypeInvalidRequest, "invalid_request", "", err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, newAPIError(errTypeTimeout, "upstream_timeout", "", "upstream request timed out")
+	default:
+		return http.StatusBadGateway, newAPIError(errTypeUpstream, "upstream_error", "", "upstream request failed")
+	}
+}
+
+// streamTimeoutError is sent as the final event of a stream cut off by one
+// of the stream timeouts.
+// requestBodyError is the answer to a body that could not be decoded: 413
+// when it went over the route's size limit, 400 invalid_json otherwise.
+func requestBodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &statusError{
+			status: http.StatusRequestEntityTooLarge,
+			body:   newAPIError(errTypeInvalidRequest, "request_too_large", "", fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)),
+		}
+	}
+	return &statusError{
+		status: http.StatusBadRequest,
+		body:   newAPIError(errTypeInvalidRequest, "invalid_json", "", "request body is not valid JSON"),
+	}
+}
+
+func streamTimeoutError(code, msg string) error {
+	return &statusError{
+		status: http.StatusGatewayTimeout,
+		body:   newAPIError(errTypeTimeout, code, "", msg),
+	}
+}
+
+// shuttingDownError is sent as the final event of a stream still running
+// when the shutdown drain period is over; the request can be retried on
+// another instance.
+func shuttingDownError() error {
+	return &statusError{
+		status: http.StatusServiceUnavailable,
+		body:   newAPIError(errTypeServer, "server_shutting_down", "", "server is shutting down; retry the request"),
+	}
+}
+
+// writeErrorJSON sends an OpenAI-style error with the given status.
+func writeErrorJSON(ctx context.Context, w http.ResponseWriter, status int, body apiErrorBody) {
+	logger := logging.L(ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(apiError{Error: body}); err != nil {
+		logger.Warn("write_error_json_failed", zap.Error(err))
+	}
+}
+
+// writeLLMError maps an llm.Client error and writes it as JSON.
+func writeLLMError(ctx context.Context, w http.ResponseWriter, err error) {
+	status, body := errorFromLLM(err)
+	writeErrorJSON(ctx, w, status, body)
+}
+
+// writeSSEError sends an error as an SSE data event in the same envelope,
+// for failures that happen after the stream headers were committed.
+func writeSSEError(w io.Writer, err error) error {
+	_, body := errorFromLLM(err)
+	return writeSSEJSON(w, apiError{Error: body})
+}
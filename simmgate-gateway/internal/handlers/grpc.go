@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/middleware"
+	"simmgate-gateway/pkg/logging/logging"
+	pb "simmgate-gateway/proto/simmgate/v1"
+)
+
+// grpcErrorDomain is the ErrorInfo domain of gateway errors.
+const grpcErrorDomain = "simmgate"
+
+// GRPCChatService implements simmgate.v1.ChatService on top of ChatHandler,
+// so gRPC requests share the HTTP API's cache, model routing and provider
+// path.
+type GRPCChatService struct {
+	pb.UnimplementedChatServiceServer
+
+	Chat *ChatHandler
+	// Timeouts bounds each call the way Timeout bounds HTTP requests.
+	Timeouts middleware.Timeouts
+}
+
+func NewGRPCChatService(chat *ChatHandler, timeouts middleware.Timeouts) *GRPCChatService {
+	return &GRPCChatService{Chat: chat, Timeouts: timeouts}
+}
+
+// ChatCompletion serves a non-stream request.
+func (s *GRPCChatService) ChatCompletion(ctx context.Context, in *pb.ChatRequest) (*pb.ChatResponse, error) {
+	start := time.Now()
+
+	req, err := chatRequestFromProto(in)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	req.Model = s.Chat.Models.Resolve(req.Model)
+
+	ctx, cancel := requestContext(ctx, s.Timeouts)
+	defer cancel()
+
+	resp, err := s.Chat.complete(ctx, req, userIDFromMetadata(ctx), versionOrDefault(s.Chat.VersionID), start)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return chatResponseToProto(resp), nil
+}
+
+// ChatCompletionStream serves a stream request, sending one ChatChunk per
+// upstream delta.
+func (s *GRPCChatService) ChatCompletionStream(in *pb.ChatRequest, stream grpc.ServerStreamingServer[pb.ChatChunk]) error {
+	start := time.Now()
+	ctx := stream.Context()
+
+	req, err := chatRequestFromProto(in)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	req.Model = s.Chat.Models.Resolve(req.Model)
+	req.Stream = true
+
+	ctx, cancel := streamContext(ctx, s.Timeouts)
+	defer cancel()
+
+	sw := &grpcStream{stream: stream}
+	w := &grpcWriter{}
+	err = s.Chat.streamChatCompletion(ctx, w, logging.L(ctx), req, userIDFromMetadata(ctx), versionOrDefault(s.Chat.VersionID), "", start, sw)
+	if err == nil {
+		err = sw.err
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+// requestContext applies the non-stream deadline to a request that does
+// not go through the Timeout middleware.
+func requestContext(ctx context.Context, t middleware.Timeouts) (context.Context, context.CancelFunc) {
+	if t.Request <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, t.Request)
+}
+
+// streamContext applies the stream limits to a request that does not go
+// through the Timeout middleware.
+func streamContext(ctx context.Context, t middleware.Timeouts) (context.Context, context.CancelFunc) {
+	ctx = middleware.WithStreamLimits(ctx, middleware.StreamLimits{
+		FirstByte: t.StreamFirstByte,
+		Idle:      t.StreamIdle,
+		Total:     t.StreamTotal,
+	})
+	if t.StreamTotal <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, t.StreamTotal, middleware.ErrStreamTimeout)
+}
+
+// userIDFromMetadata is userIDFromRequest for gRPC calls.
+func userIDFromMetadata(ctx context.Context) string {
+	if v := metadata.ValueFromIncomingContext(ctx, "x-user-id"); len(v) > 0 && v[0] != "" {
+		return v[0]
+	}
+	return "anon"
+}
+
+// grpcError converts a handler or llm.Client error to a gRPC status. The
+// OpenAI error type, code and param travel in an ErrorInfo detail.
+func grpcError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, context.Canceled) {
+		return status.Error(codes.Canceled, "request cancelled")
+	}
+
+	httpStatus, body := errorFromLLM(err)
+	st := status.New(grpcCode(httpStatus), body.Message)
+
+	info := &errdetails.ErrorInfo{
+		Domain:   grpcErrorDomain,
+		Metadata: map[string]string{"type": body.Type},
+	}
+	if body.Code != nil {
+		info.Reason = *body.Code
+	}
+	if body.Param != nil {
+		info.Metadata["param"] = *body.Param
+	}
+	if withInfo, err := st.WithDetails(info); err == nil {
+		st = withInfo
+	}
+	return st.Err()
+}
+
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusRequestEntityTooLarge:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	}
+	if httpStatus >= 400 && httpStatus < 500 {
+		return codes.FailedPrecondition
+	}
+	return codes.Internal
+}
+
+// grpcWriter stands in for the ResponseWriter and Flusher that
+// streamChatCompletion expects. Chunks are sent by grpcStream, so nothing
+// is ever written through it.
+type grpcWriter struct {
+	header http.Header
+}
+
+func (w *grpcWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *grpcWriter) WriteHeader(int) {}
+
+func (w *grpcWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w *grpcWriter) Flush() {}
+
+func (w *grpcWriter) writesMessages() {}
+
+// grpcStream sends each chunk as a ChatChunk message. The end of the
+// stream is the end of the RPC, and an error after the first chunk is kept
+// for the RPC status.
+type grpcStream struct {
+	stream grpc.ServerStreamingServer[pb.ChatChunk]
+	err    error
+}
+
+func (s *grpcStream) writeChunk(_ io.Writer, c *llm.StreamChunk) error {
+	return s.stream.Send(chatChunkToProto(c))
+}
+
+func (s *grpcStream) writeDone(io.Writer) error { return nil }
+
+func (s *grpcStream) writeError(_ io.Writer, err error) error {
+	s.err = err
+	return nil
+}
+
+// writeHeartbeat is a no-op: HTTP/2 keep-alive is the transport's job.
+func (s *grpcStream) writeHeartbeat(io.Writer) error { return nil }
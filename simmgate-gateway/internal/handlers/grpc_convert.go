@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"simmgate-gateway/internal/llm"
+	pb "simmgate-gateway/proto/simmgate/v1"
+)
+
+// chatRequestFromProto converts a gRPC request to the chat schema. JSON
+// string fields must hold valid JSON.
+func chatRequestFromProto(in *pb.ChatRequest) (*llm.ChatRequest, error) {
+	req := &llm.ChatRequest{
+		Model:             in.GetModel(),
+		Temperature:       in.GetTemperature(),
+		TopP:              in.GetTopP(),
+		MaxTokens:         int(in.GetMaxTokens()),
+		Stop:              in.GetStop(),
+		N:                 int(in.GetN()),
+		Logprobs:          in.GetLogprobs(),
+		ParallelToolCalls: in.ParallelToolCalls,
+	}
+	if in.TopLogprobs != nil {
+		n := int(in.GetTopLogprobs())
+		req.TopLogprobs = &n
+	}
+	if o := in.GetStreamOptions(); o != nil {
+		req.StreamOptions = &llm.StreamOptions{IncludeUsage: o.GetIncludeUsage()}
+	}
+
+	for _, m := range in.GetMessages() {
+		req.Messages = append(req.Messages, chatMessageFromProto(m))
+	}
+
+	for i, t := range in.GetTools() {
+		params, err := rawJSON(t.GetFunction().GetParametersJson(), fmt.Sprintf("tools[%d].function.parameters_json", i))
+		if err != nil {
+			return nil, err
+		}
+		req.Tools = append(req.Tools, llm.Tool{
+			Type: t.GetType(),
+			Function: llm.FunctionDefinition{
+				Name:        t.GetFunction().GetName(),
+				Description: t.GetFunction().GetDescription(),
+				Parameters:  params,
+				Strict:      t.GetFunction().Strict,
+			},
+		})
+	}
+
+	toolChoice, err := rawJSON(in.GetToolChoiceJson(), "tool_choice_json")
+	if err != nil {
+		return nil, err
+	}
+	req.ToolChoice = toolChoice
+
+	if f := in.GetResponseFormat(); f != nil {
+		req.ResponseFormat = &llm.ResponseFormat{Type: f.GetType()}
+		if s := f.GetJsonSchema(); s != nil {
+			schema, err := rawJSON(s.GetSchemaJson(), "response_format.json_schema.schema_json")
+			if err != nil {
+				return nil, err
+			}
+			req.ResponseFormat.JSONSchema = &llm.JSONSchemaFormat{
+				Name:        s.GetName(),
+				Description: s.GetDescription(),
+				Schema:      schema,
+				Strict:      s.Strict,
+			}
+		}
+	}
+
+	for k, v := range in.GetExtraJson() {
+		raw, err := rawJSON(v, "extra_json."+k)
+		if err != nil {
+			return nil, err
+		}
+		if req.Extra == nil {
+			req.Extra = make(map[string]json.RawMessage)
+		}
+		req.Extra[k] = raw
+	}
+
+	return req, nil
+}
+
+func rawJSON(s, field string) (json.RawMessage, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !json.Valid([]byte(s)) {
+		return nil, fmt.Errorf("%s is not valid JSON", field)
+	}
+	return json.RawMessage(s), nil
+}
+
+func chatMessageFromProto(m *pb.ChatMessage) llm.ChatMessage {
+	out := llm.ChatMessage{
+		Role:       m.GetRole(),
+		Content:    m.GetContent(),
+		Name:       m.GetName(),
+		ToolCallID: m.GetToolCallId(),
+	}
+	for _, p := range m.GetParts() {
+		part := llm.ContentPart{Type: p.GetType(), Text: p.GetText()}
+		if u := p.GetImageUrl(); u != nil {
+			part.ImageURL = &llm.ImageURL{URL: u.GetUrl(), Detail: u.GetDetail()}
+		}
+		if a := p.GetInputAudio(); a != nil {
+			part.InputAudio = &llm.InputAudio{Data: a.GetData(), Format: a.GetFormat()}
+		}
+		out.Parts = append(out.Parts, part)
+	}
+	for _, tc := range m.GetToolCalls() {
+		out.ToolCalls = append(out.ToolCalls, llm.ToolCall{
+			ID:   tc.GetId(),
+			Type: tc.GetType(),
+			Function: llm.FunctionCall{
+				Name:      tc.GetFunction().GetName(),
+				Arguments: tc.GetFunction().GetArguments(),
+			},
+		})
+	}
+	return out
+}
+
+func chatMessageToProto(m llm.ChatMessage) *pb.ChatMessage {
+	out := &pb.ChatMessage{
+		Role:       m.Role,
+		Content:    m.Content,
+		Name:       m.Name,
+		ToolCallId: m.ToolCallID,
+	}
+	for _, p := range m.Parts {
+		part := &pb.ContentPart{Type: p.Type, Text: p.Text}
+		if p.ImageURL != nil {
+			part.ImageUrl = &pb.ImageURL{Url: p.ImageURL.URL, Detail: p.ImageURL.Detail}
+		}
+		if p.InputAudio != nil {
+			part.InputAudio = &pb.InputAudio{Data: p.InputAudio.Data, Format: p.InputAudio.Format}
+		}
+		out.Parts = append(out.Parts, part)
+	}
+	for _, tc := range m.ToolCalls {
+		out.ToolCalls = append(out.ToolCalls, &pb.ToolCall{
+			Id:       tc.ID,
+			Type:     tc.Type,
+			Function: &pb.FunctionCall{Name: tc.Function.Name, Arguments: tc.Function.Arguments},
+		})
+	}
+	return out
+}
+
+func chatResponseToProto(r *llm.ChatResponse) *pb.ChatResponse {
+	out := &pb.ChatResponse{
+		Id:      r.ID,
+		Created: unixSeconds(r.Created),
+		Model:   r.Model,
+		Usage:   usageToProto(r.Usage),
+	}
+	for _, c := range r.Choices {
+		out.Choices = append(out.Choices, &pb.ChatChoice{
+			Index:        int32(c.Index),
+			Message:      chatMessageToProto(c.Message),
+			FinishReason: c.FinishReason,
+			Logprobs:     logprobsToProto(c.Logprobs),
+		})
+	}
+	return out
+}
+
+func chatChunkToProto(c *llm.StreamChunk) *pb.ChatChunk {
+	out := &pb.ChatChunk{
+		Id:           c.ID,
+		Created:      unixSeconds(c.Created),
+		Model:        c.Model,
+		Index:        int32(c.Index),
+		Role:         c.Role,
+		Delta:        c.Delta,
+		FinishReason: c.FinishReason,
+		Usage:        usageToProto(c.Usage),
+		Logprobs:     logprobsToProto(c.Logprobs),
+	}
+	for _, tc := range c.ToolCalls {
+		out.ToolCalls = append(out.ToolCalls, &pb.ToolCallDelta{
+			Index:    int32(tc.Index),
+			Id:       tc.ID,
+			Type:     tc.Type,
+			Function: &pb.FunctionCall{Name: tc.Function.Name, Arguments: tc.Function.Arguments},
+		})
+	}
+	return out
+}
+
+func usageToProto(u *llm.Usage) *pb.Usage {
+	if u == nil {
+		return nil
+	}
+	return &pb.Usage{
+		PromptTokens:     int32(u.PromptTokens),
+		CompletionTokens: int32(u.CompletionTokens),
+		TotalTokens:      int32(u.TotalTokens),
+	}
+}
+
+func logprobsToProto(l *llm.Logprobs) *pb.Logprobs {
+	if l == nil {
+		return nil
+	}
+	return &pb.Logprobs{
+		Content: tokenLogprobsToProto(l.Content),
+		Refusal: tokenLogprobsToProto(l.Refusal),
+	}
+}
+
+func tokenLogprobsToProto(in []llm.TokenLogprob) []*pb.TokenLogprob {
+	var out []*pb.TokenLogprob
+	for _, t := range in {
+		tl := &pb.TokenLogprob{Token: t.Token, Logprob: t.Logprob, Bytes: int32s(t.Bytes)}
+		for _, top := range t.TopLogprobs {
+			tl.TopLogprobs = append(tl.TopLogprobs, &pb.TopLogprob{Token: top.Token, Logprob: top.Logprob, Bytes: int32s(top.Bytes)})
+		}
+		out = append(out, tl)
+	}
+	return out
+}
+
+func int32s(in []int) []int32 {
+	if in == nil {
+		return nil
+	}
+	out := make([]int32, len(in))
+	for i, v := range in {
+		out[i] = int32(v)
+	}
+	return out
+}
+
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
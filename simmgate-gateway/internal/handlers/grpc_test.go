@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/middleware"
+	pb "simmgate-gateway/proto/simmgate/v1"
+)
+
+func newGRPCTestClient(t *testing.T, fakeLLM *mockLLMClient) pb.ChatServiceClient {
+	t.Helper()
+
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+	chat := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterChatServiceServer(srv, NewGRPCChatService(chat, middleware.Timeouts{}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewChatServiceClient(conn)
+}
+
+func grpcTestRequest() *pb.ChatRequest {
+	return &pb.ChatRequest{
+		Model:    "gpt-4",
+		Messages: []*pb.ChatMessage{{Role: llm.RoleUser, Content: "hello"}},
+	}
+}
+
+func TestGRPCChatCompletionUsesCache(t *testing.T) {
+	fakeLLM := &mockLLMClient{
+		resp: &llm.ChatResponse{
+			ID:      "chatcmpl-1",
+			Model:   "gpt-4",
+			Choices: []llm.ChatChoice{{Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: "hi"}, FinishReason: "stop"}},
+			Usage:   &llm.Usage{PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2},
+		},
+	}
+	client := newGRPCTestClient(t, fakeLLM)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-id", "u1")
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.ChatCompletion(ctx, grpcTestRequest())
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if got := resp.GetChoices()[0].GetMessage().GetContent(); got != "hi" {
+			t.Fatalf("call %d: content = %q", i, got)
+		}
+		if resp.GetUsage().GetTotalTokens() != 2 {
+			t.Fatalf("call %d: usage = %v", i, resp.GetUsage())
+		}
+	}
+	if fakeLLM.nonStreamCalls != 1 {
+		t.Fatalf("expected the second call to be served from cache, upstream calls = %d", fakeLLM.nonStreamCalls)
+	}
+}
+
+func TestGRPCChatCompletionErrors(t *testing.T) {
+	fakeLLM := &mockLLMClient{
+		err: &llm.UpstreamError{StatusCode: http.StatusTooManyRequests, Type: "requests", Code: "rate_limit_exceeded", Message: "slow down"},
+	}
+	client := newGRPCTestClient(t, fakeLLM)
+
+	_, err := client.ChatCompletion(context.Background(), grpcTestRequest())
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted || st.Message() != "slow down" {
+		t.Fatalf("unexpected status: %v", st)
+	}
+	var info *errdetails.ErrorInfo
+	for _, d := range st.Details() {
+		if ei, ok := d.(*errdetails.ErrorInfo); ok {
+			info = ei
+		}
+	}
+	if info == nil || info.GetReason() != "rate_limit_exceeded" || info.GetMetadata()["type"] != "requests" {
+		t.Fatalf("unexpected error info: %v", info)
+	}
+
+	req := grpcTestRequest()
+	req.ToolChoiceJson = "{not json"
+	if _, err := client.ChatCompletion(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for bad tool_choice_json, got %v", err)
+	}
+}
+
+func TestGRPCChatCompletionStream(t *testing.T) {
+	streamChan := make(chan llm.StreamResult, 3)
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Role: llm.RoleAssistant, Delta: "Hel"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "lo", FinishReason: "stop"}}
+	close(streamChan)
+	client := newGRPCTestClient(t, &mockLLMClient{stream: streamChan})
+
+	stream, err := client.ChatCompletionStream(context.Background(), grpcTestRequest())
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	var text string
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("recv: %v", err)
+		}
+		text += chunk.GetDelta()
+	}
+	if text != "Hello" {
+		t.Fatalf("streamed text = %q", text)
+	}
+}
+
+func TestGRPCChatCompletionStreamUpstreamError(t *testing.T) {
+	streamChan := make(chan llm.StreamResult, 2)
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "Hel"}}
+	streamChan <- llm.StreamResult{Err: errors.New("connection reset")}
+	client := newGRPCTestClient(t, &mockLLMClient{stream: streamChan})
+
+	stream, err := client.ChatCompletionStream(context.Background(), grpcTestRequest())
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if chunk, err := stream.Recv(); err != nil || chunk.GetDelta() != "Hel" {
+		t.Fatalf("first chunk: %v, %v", chunk, err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable after the upstream error, got %v", err)
+	}
+}
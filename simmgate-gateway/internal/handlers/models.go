@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http"
+
+	"simmgate-gateway/internal/models"
+)
+
+// ModelsHandler serves GET /v1/models from the model registry.
+type ModelsHandler struct {
+	Registry *models.Registry
+}
+
+func NewModelsHandler(registry *models.Registry) *ModelsHandler {
+	return &ModelsHandler{Registry: registry}
+}
+
+type modelList struct {
+	Object string         `json:"object"`
+	Data   []models.Model `json:"data"`
+}
+
+// ListModels handles GET /v1/models in OpenAI list format. The caller's
+// X-User-ID selects the tenant allow list.
+func (h *ModelsHandler) ListModels(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	writeJSON(ctx, w, modelList{
+		Object: "list",
+		Data:   h.Registry.List(ctx, userIDFromRequest(r)),
+	})
+}
@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/middleware"
+	"simmgate-gateway/pkg/logging/logging"
+)
+
+const (
+	realtimeWriteTimeout = 10 * time.Second
+	defaultMaxInFlight   = 16
+)
+
+// Realtime frame types.
+const (
+	frameRequest   = "request"
+	frameCancel    = "cancel"
+	frameChunk     = "chunk"
+	frameResponse  = "response"
+	frameDone      = "done"
+	frameError     = "error"
+	frameCancelled = "cancelled"
+)
+
+// errCancelledByClient is the context cause of a request stopped by a
+// cancel frame.
+var errCancelledByClient = errors.New("request cancelled by client")
+
+// RealtimeHandler serves /v1/realtime/chat, a WebSocket that carries many
+// chat requests at once. Clients send
+//
+//	{"type":"request","id":"<client id>","request":{...chat request...}}
+//	{"type":"cancel","id":"<client id>"}
+//
+// and receive chunk, response, done, error and cancelled frames tagged
+// with the same id. Requests go through the same cache and provider path
+// as /v1/chat/completions, under the caller's X-User-ID.
+type RealtimeHandler struct {
+	Chat *ChatHandler
+	// Timeouts bounds each request the way Timeout bounds HTTP requests.
+	Timeouts middleware.Timeouts
+	// OriginPatterns lists cross-origin hosts allowed to connect, as in
+	// websocket.AcceptOptions; same-origin is always allowed.
+	OriginPatterns []string
+	// MaxInFlight caps concurrent requests per connection.
+	MaxInFlight int
+}
+
+func NewRealtimeHandler(chat *ChatHandler, timeouts middleware.Timeouts) *RealtimeHandler {
+	return &RealtimeHandler{Chat: chat, Timeouts: timeouts, MaxInFlight: defaultMaxInFlight}
+}
+
+type realtimeClientFrame struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+type realtimeServerFrame struct {
+	Type     string            `json:"type"`
+	ID       string            `json:"id,omitempty"`
+	Chunk    interface{}       `json:"chunk,omitempty"`
+	Response *llm.ChatResponse `json:"response,omitempty"`
+	Error    *apiErrorBody     `json:"error,omitempty"`
+}
+
+// Connect handles GET /v1/realtime/chat.
+func (h *RealtimeHandler) Connect(w http.ResponseWriter, r *http.Request) {
+	logger := logging.L(r.Context())
+
+	// The hijacked connection keeps the server's read and write deadlines.
+	rc := http.NewResponseController(w)
+	if err := errors.Join(rc.SetReadDeadline(time.Time{}), rc.SetWriteDeadline(time.Time{})); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Warn("realtime_deadline_reset_failed", zap.Error(err))
+	}
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: h.OriginPatterns})
+	if err != nil {
+		// Accept has already answered the handshake.
+		logger.Warn("realtime_accept_failed", zap.Error(err))
+		return
+	}
+	conn.SetReadLimit(llm.MaxPayloadBytes)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	s := &realtimeSession{
+		h:        h,
+		conn:     conn,
+		ctx:      ctx,
+		userID:   userIDFromRequest(r),
+		logger:   logger,
+		inflight: make(map[string]context.CancelCauseFunc),
+	}
+	s.run()
+}
+
+// realtimeSession is one WebSocket connection and its in-flight requests.
+type realtimeSession struct {
+	h      *RealtimeHandler
+	conn   *websocket.Conn
+	ctx    context.Context
+	userID string
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	inflight map[string]context.CancelCauseFunc
+	wg       sync.WaitGroup
+}
+
+func (s *realtimeSession) run() {
+	s.logger.Info("realtime_connected", zap.String("user_id", s.userID))
+	defer func() {
+		s.mu.Lock()
+		for _, cancel := range s.inflight {
+			cancel(context.Canceled)
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+		_ = s.conn.CloseNow()
+		s.logger.Info("realtime_disconnected", zap.String("user_id", s.userID))
+	}()
+
+	if every := s.h.Chat.StreamHeartbeat; every > 0 {
+		go s.keepAlive(every)
+	}
+
+	for {
+		typ, data, err := s.conn.Read(s.ctx)
+		if err != nil {
+			if status := websocket.CloseStatus(err); status != websocket.StatusNormalClosure && status != websocket.StatusGoingAway {
+				s.logger.Info("realtime_read_error", zap.Error(err))
+			}
+			return
+		}
+		if typ != websocket.MessageText {
+			s.sendError("", newAPIError(errTypeInvalidRequest, "invalid_frame", "", "frames must be JSON text messages"))
+			continue
+		}
+
+		var f realtimeClientFrame
+		if err := json.Unmarshal(data, &f); err != nil {
+			s.sendError("", newAPIError(errTypeInvalidRequest, "invalid_json", "", "frame is not valid JSON"))
+			continue
+		}
+
+		switch f.Type {
+		case frameRequest:
+			s.start(f)
+		case frameCancel:
+			s.cancel(f.ID)
+		default:
+			s.sendError(f.ID, newAPIError(errTypeInvalidRequest, "invalid_frame", "type", "unknown frame type "+f.Type))
+		}
+	}
+}
+
+// keepAlive pings the client every interval so proxies do not drop an idle
+// connection, and closes the connection when a ping goes unanswered. Pongs
+// are read by run.
+func (s *realtimeSession) keepAlive(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, realtimeWriteTimeout)
+		err := s.conn.Ping(ctx)
+		cancel()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.logger.Info("realtime_ping_failed", zap.Error(err))
+				_ = s.conn.CloseNow()
+			}
+			return
+		}
+	}
+}
+
+// start runs a request frame in its own goroutine.
+func (s *realtimeSession) start(f realtimeClientFrame) {
+	if f.ID == "" {
+		s.sendError("", newAPIError(errTypeInvalidRequest, "invalid_request", "id", "request frames need an id"))
+		return
+	}
+	// The connection outlives the drain middleware, so new requests on it
+	// are refused here; the client should reconnect elsewhere.
+	if s.h.Chat.Drain.Draining() {
+		_, body := errorFromLLM(shuttingDownError())
+		s.sendError(f.ID, body)
+		return
+	}
+
+	var req llm.ChatRequest
+	if err := json.Unmarshal(f.Request, &req); err != nil {
+		s.sendError(f.ID, newAPIError(errTypeInvalidRequest, "invalid_json", "request", "request is not a valid chat request"))
+		return
+	}
+
+	s.mu.Lock()
+	if _, dup := s.inflight[f.ID]; dup {
+		s.mu.Unlock()
+		s.sendError(f.ID, newAPIError(errTypeInvalidRequest, "duplicate_request_id", "id", "a request with this id is already running"))
+		return
+	}
+	if len(s.inflight) >= s.h.MaxInFlight {
+		s.mu.Unlock()
+		s.sendError(f.ID, newAPIError(errTypeInvalidRequest, "too_many_requests", "", "too many requests in flight on this connection"))
+		return
+	}
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	s.inflight[f.ID] = cancel
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.inflight, f.ID)
+			s.mu.Unlock()
+			cancel(nil)
+		}()
+		s.serve(ctx, f.ID, &req)
+	}()
+}
+
+func (s *realtimeSession) cancel(id string) {
+	s.mu.Lock()
+	cancel, ok := s.inflight[id]
+	s.mu.Unlock()
+	if ok {
+		cancel(errCancelledByClient)
+	}
+}
+
+// serve runs one request through the chat pipeline and answers with
+// frames tagged by id.
+func (s *realtimeSession) serve(ctx context.Context, id string, req *llm.ChatRequest) {
+	chat := s.h.Chat
+	logger := s.logger.With(zap.String("client_request_id", id))
+	ctx = logging.WithLogger(ctx, logger)
+	start := time.Now()
+
+	req.Model = chat.Models.Resolve(req.Model)
+	versionID := versionOrDefault(chat.VersionID)
+
+	var err error
+	if req.Stream {
+		var cancel context.CancelFunc
+		ctx, cancel = streamContext(ctx, s.h.Timeouts)
+		defer cancel()
+
+		w := &realtimeWriter{s: s}
+		sw := realtimeStream{id: id, enc: newStreamChunkBuilder(req.Model)}
+		err = chat.streamChatCompletion(ctx, w, logger, req, s.userID, versionID, "", start, sw)
+	} else {
+		// Frames bypass the drain middleware, so the request is counted
+		// here and gives up when the drain period ends.
+		defer chat.Drain.TrackRequest()()
+		var unbind, cancel context.CancelFunc
+		ctx, unbind = chat.Drain.Bind(ctx)
+		defer unbind()
+		ctx, cancel = requestContext(ctx, s.h.Timeouts)
+		defer cancel()
+
+		var resp *llm.ChatResponse
+		resp, err = chat.complete(ctx, req, s.userID, versionID, start)
+		if err == nil {
+			s.send(realtimeServerFrame{Type: frameResponse, ID: id, Response: resp})
+		} else if errors.Is(context.Cause(ctx), middleware.ErrDrainExpired) {
+			err = shuttingDownError()
+		}
+	}
+
+	if errors.Is(context.Cause(ctx), errCancelledByClient) {
+		s.send(realtimeServerFrame{Type: frameCancelled, ID: id})
+		return
+	}
+	if err != nil {
+		_, body := errorFromLLM(err)
+		s.sendError(id, body)
+	}
+}
+
+func (s *realtimeSession) sendError(id string, body apiErrorBody) {
+	s.send(realtimeServerFrame{Type: frameError, ID: id, Error: &body})
+}
+
+func (s *realtimeSession) send(f realtimeServerFrame) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		s.logger.Error("realtime_marshal_error", zap.Error(err))
+		return
+	}
+	if err := s.write(data); err != nil {
+		s.logger.Info("realtime_write_error", zap.Error(err))
+	}
+}
+
+// write sends one message; the connection allows concurrent writers.
+func (s *realtimeSession) write(data []byte) error {
+	ctx, cancel := context.WithTimeout(s.ctx, realtimeWriteTimeout)
+	defer cancel()
+	return s.conn.Write(ctx, websocket.MessageText, data)
+}
+
+// messageWriter is a ResponseWriter of a message-based transport: every
+// Write is one frame and headers are never sent.
+type messageWriter interface {
+	http.ResponseWriter
+	writesMessages()
+}
+
+// realtimeWriter lets streamChatCompletion write frames to the socket.
+type realtimeWriter struct {
+	s      *realtimeSession
+	header http.Header
+}
+
+func (w *realtimeWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *realtimeWriter) WriteHeader(int) {}
+
+func (w *realtimeWriter) Write(p []byte) (int, error) {
+	if err := w.s.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *realtimeWriter) Flush() {}
+
+func (w *realtimeWriter) writesMessages() {}
+
+// realtimeStream writes chat completion chunks as realtime frames.
+type realtimeStream struct {
+	id  string
+	enc chunkEncoder
+}
+
+func (s realtimeStream) writeChunk(w io.Writer, c *llm.StreamChunk) error {
+	return writeFrame(w, realtimeServerFrame{Type: frameChunk, ID: s.id, Chunk: s.enc.encode(c)})
+}
+
+func (s realtimeStream) writeDone(w io.Writer) error {
+	return writeFrame(w, realtimeServerFrame{Type: frameDone, ID: s.id})
+}
+
+func (s realtimeStream) writeError(w io.Writer, err error) error {
+	_, body := errorFromLLM(err)
+	return writeFrame(w, realtimeServerFrame{Type: frameError, ID: s.id, Error: &body})
+}
+
+// writeHeartbeat is never called: streams on a message transport get no
+// heartbeats, the session pings the connection instead.
+func (s realtimeStream) writeHeartbeat(io.Writer) error { return nil }
+
+func writeFrame(w io.Writer, f realtimeServerFrame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/middleware"
+)
+
+func dialRealtime(t *testing.T, h *RealtimeHandler) (*websocket.Conn, context.Context) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(h.Connect))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	return conn, ctx
+}
+
+func sendFrame(t *testing.T, ctx context.Context, conn *websocket.Conn, frame string) {
+	t.Helper()
+	if err := conn.Write(ctx, websocket.MessageText, []byte(frame)); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+func readFrame(t *testing.T, ctx context.Context, conn *websocket.Conn) map[string]json.RawMessage {
+	t.Helper()
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	var f map[string]json.RawMessage
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatalf("decode frame %s: %v", data, err)
+	}
+	return f
+}
+
+func frameString(f map[string]json.RawMessage, key string) string {
+	var s string
+	_ = json.Unmarshal(f[key], &s)
+	return s
+}
+
+func TestRealtimeStreamAndCompletion(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	streamChan := make(chan llm.StreamResult, 2)
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "hi", FinishReason: "stop"}}
+	close(streamChan)
+	fakeLLM := &mockLLMClient{
+		stream: streamChan,
+		resp: &llm.ChatResponse{
+			Model:   "gpt-4",
+			Choices: []llm.ChatChoice{{Message: llm.ChatMessage{Role: llm.RoleAssistant, Content: "whole"}}},
+		},
+	}
+	chat := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+	conn, ctx := dialRealtime(t, NewRealtimeHandler(chat, middleware.Timeouts{}))
+
+	sendFrame(t, ctx, conn, `{"type":"request","id":"s1","request":{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"x"}]}}`)
+
+	f := readFrame(t, ctx, conn)
+	if frameString(f, "type") != "chunk" || frameString(f, "id") != "s1" || !strings.Contains(string(f["chunk"]), `"content":"hi"`) {
+		t.Fatalf("unexpected chunk frame: %v", f)
+	}
+	if f = readFrame(t, ctx, conn); frameString(f, "type") != "done" || frameString(f, "id") != "s1" {
+		t.Fatalf("expected done frame, got %v", f)
+	}
+
+	sendFrame(t, ctx, conn, `{"type":"request","id":"n1","request":{"model":"gpt-4","messages":[{"role":"user","content":"x"}]}}`)
+	f = readFrame(t, ctx, conn)
+	if frameString(f, "type") != "response" || frameString(f, "id") != "n1" || !strings.Contains(string(f["response"]), "whole") {
+		t.Fatalf("unexpected response frame: %v", f)
+	}
+
+	sendFrame(t, ctx, conn, `{"type":"request","request":{}}`)
+	if f = readFrame(t, ctx, conn); frameString(f, "type") != "error" {
+		t.Fatalf("expected error frame for a request without id, got %v", f)
+	}
+}
+
+func TestRealtimeRefusesRequestsWhileDraining(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{resp: &llm.ChatResponse{Model: "gpt-4"}}
+	chat := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+	chat.Drain = middleware.NewDrain()
+	conn, ctx := dialRealtime(t, NewRealtimeHandler(chat, middleware.Timeouts{}))
+
+	chat.Drain.Start()
+	sendFrame(t, ctx, conn, `{"type":"request","id":"d1","request":{"model":"gpt-4","messages":[{"role":"user","content":"x"}]}}`)
+
+	f := readFrame(t, ctx, conn)
+	if frameString(f, "type") != "error" || frameString(f, "id") != "d1" || !strings.Contains(string(f["error"]), "server_shutting_down") {
+		t.Fatalf("expected server_shutting_down error frame, got %v", f)
+	}
+	if fakeLLM.nonStreamCalls != 0 {
+		t.Fatalf("refused request reached the LLM")
+	}
+}
+
+// blockingLLMClient holds non-stream requests until their context ends.
+type blockingLLMClient struct {
+	*mockLLMClient
+	started chan struct{}
+}
+
+func (b *blockingLLMClient) ChatCompletion(ctx context.Context, _ *llm.ChatRequest) (*llm.ChatResponse, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRealtimeCompletionDrainExpiry(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &blockingLLMClient{mockLLMClient: &mockLLMClient{}, started: make(chan struct{})}
+	chat := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+	chat.Drain = middleware.NewDrain()
+	conn, ctx := dialRealtime(t, NewRealtimeHandler(chat, middleware.Timeouts{}))
+
+	sendFrame(t, ctx, conn, `{"type":"request","id":"n1","request":{"model":"gpt-4","messages":[{"role":"user","content":"x"}]}}`)
+	<-fakeLLM.started
+	if requests, _ := chat.Drain.InFlight(); requests != 1 {
+		t.Fatalf("expected the request to be counted, got %d", requests)
+	}
+
+	chat.Drain.Start()
+	chat.Drain.Expire()
+	f := readFrame(t, ctx, conn)
+	if frameString(f, "type") != "error" || frameString(f, "id") != "n1" || !strings.Contains(string(f["error"]), "server_shutting_down") {
+		t.Fatalf("expected server_shutting_down error frame, got %v", f)
+	}
+	deadline := time.Now().Add(time.Second)
+	for requests, _ := chat.Drain.InFlight(); requests != 0; requests, _ = chat.Drain.InFlight() {
+		if time.Now().After(deadline) {
+			t.Fatalf("request still counted after it ended")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRealtimeCancel(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{stream: make(chan llm.StreamResult)}
+	chat := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+	conn, ctx := dialRealtime(t, NewRealtimeHandler(chat, middleware.Timeouts{}))
+
+	sendFrame(t, ctx, conn, `{"type":"request","id":"c1","request":{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"x"}]}}`)
+	time.Sleep(20 * time.Millisecond)
+	sendFrame(t, ctx, conn, `{"type":"cancel","id":"c1"}`)
+
+	f := readFrame(t, ctx, conn)
+	if frameString(f, "type") != "cancelled" || frameString(f, "id") != "c1" {
+		t.Fatalf("expected cancelled frame, got %v", f)
+	}
+	if fakeLLM.streamCtx == nil || fakeLLM.streamCtx.Err() == nil {
+		t.Fatalf("expected the upstream context to be cancelled")
+	}
+}
+
+func TestRealtimePingsIdleConnection(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	chat := NewChatHandler(cacheStore, time.Minute, "vtest", &mockLLMClient{})
+	chat.StreamHeartbeat = 10 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(NewRealtimeHandler(chat, middleware.Timeouts{}).Connect))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	pings := make(chan struct{}, 8)
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), &websocket.DialOptions{
+		OnPingReceived: func(context.Context, []byte) bool {
+			select {
+			case pings <- struct{}{}:
+			default:
+			}
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	// Control frames are handled while reading.
+	go func() { _, _, _ = conn.Read(ctx) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-pings:
+		case <-ctx.Done():
+			t.Fatalf("expected pings on an idle connection, got %d", i)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package handlers
+
+import "net/http"
+
+// userIDFromRequest returns the caller identity used for cache scoping.
+func userIDFromRequest(r *http.Request) string {
+	if userID := r.Header.Get("X-User-ID"); userID != "" {
+		return userID
+	}
+	return "anon"
+}
+
+// versionOrDefault returns the cache namespace version, defaulting to v1.
+func versionOrDefault(versionID string) string {
+	if versionID == "" {
+		return "v1"
+	}
+	return versionID
+}
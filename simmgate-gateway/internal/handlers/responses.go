@@ -0,0 +1,832 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/pkg/logging/logging"
+
+	"go.uber.org/zap"
+)
+
+// defaultResponseStateTTL is how long /v1/responses conversations can be
+// continued with previous_response_id when ResponseStateTTL is unset.
+const defaultResponseStateTTL = 24 * time.Hour
+
+const (
+	responseStatusInProgress = "in_progress"
+	responseStatusCompleted  = "completed"
+	responseStatusIncomplete = "incomplete"
+)
+
+// Responses API input item and output types.
+const (
+	responsesItemMessage            = "message"
+	responsesItemFunctionCall       = "function_call"
+	responsesItemFunctionCallOutput = "function_call_output"
+
+	responsesPartInputText  = "input_text"
+	responsesPartInputImage = "input_image"
+	responsesPartOutputText = "output_text"
+)
+
+// responsesRequest is the inbound /v1/responses request body.
+type responsesRequest struct {
+	Model              string            `json:"model"`
+	Input              json.RawMessage   `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	MaxOutputTokens    int               `json:"max_output_tokens,omitempty"`
+	Temperature        float32           `json:"temperature,omitempty"`
+	TopP               float32           `json:"top_p,omitempty"`
+	Stream             bool              `json:"stream,omitempty"`
+	Store              *bool             `json:"store,omitempty"`
+	Tools              []responsesTool   `json:"tools,omitempty"`
+	ToolChoice         json.RawMessage   `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool             `json:"parallel_tool_calls,omitempty"`
+	Text               *responsesText    `json:"text,omitempty"`
+	User               json.RawMessage   `json:"user,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// responsesTool is a flat function tool; other tool types are hosted by
+// OpenAI and not supported by the gateway.
+type responsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type responsesText struct {
+	Format *responsesFormat `json:"format,omitempty"`
+}
+
+type responsesFormat struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// responsesItem is one input item of any type.
+type responsesItem struct {
+	Type    string          `json:"type"`
+	Role    string          `json:"role,omitempty"`
+	Content json.RawMessage `json:"content,omitempty"`
+
+	// function_call / function_call_output
+	CallID    string          `json:"call_id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	Output    json.RawMessage `json:"output,omitempty"`
+}
+
+type responsesPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// responseObject is the Responses API response object.
+type responseObject struct {
+	ID                 string              `json:"id"`
+	Object             string              `json:"object"`
+	CreatedAt          int64               `json:"created_at"`
+	Status             string              `json:"status"`
+	Model              string              `json:"model"`
+	Output             []interface{}       `json:"output"`
+	Usage              *responseUsage      `json:"usage"`
+	Instructions       *string             `json:"instructions"`
+	PreviousResponseID *string             `json:"previous_response_id"`
+	IncompleteDetails  *responseIncomplete `json:"incomplete_details"`
+	Error              *apiErrorBody       `json:"error"`
+	Metadata           map[string]string   `json:"metadata"`
+}
+
+type responseIncomplete struct {
+	Reason string `json:"reason"`
+}
+
+type responseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type responseMessageItem struct {
+	Type    string               `json:"type"`
+	ID      string               `json:"id"`
+	Status  string               `json:"status"`
+	Role    string               `json:"role"`
+	Content []responseOutputText `json:"content"`
+}
+
+type responseOutputText struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+type responseFunctionCallItem struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Status    string `json:"status"`
+}
+
+// responseState is the conversation stored under a response ID: every
+// message so far (without instructions, which are not carried over),
+// ending with the assistant reply.
+type responseState struct {
+	Messages []llm.ChatMessage `json:"messages"`
+}
+
+// Responses handles POST /v1/responses (OpenAI Responses API). Input items
+// and instructions are mapped to a ChatRequest and served through the
+// normal cache and provider path. Unless store is false, the conversation
+// is saved in the cache store so a later request can continue it with
+// previous_response_id.
+func (h *ChatHandler) Responses(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.L(ctx)
+	start := time.Now()
+
+	var rreq responsesRequest
+	if err := json.NewDecoder(r.Body).Decode(&rreq); err != nil {
+		logger.Warn("invalid_request", zap.Error(err))
+		writeLLMError(ctx, w, requestBodyError(err))
+		return
+	}
+
+	userID := userIDFromRequest(r)
+	versionID := versionOrDefault(h.VersionID)
+
+	var history []llm.ChatMessage
+	if rreq.PreviousResponseID != "" {
+		state, err := h.loadResponseState(ctx, userID, versionID, rreq.PreviousResponseID)
+		if err != nil {
+			writeLLMError(ctx, w, err)
+			return
+		}
+		history = state.Messages
+	}
+
+	req, input, err := rreq.toChatRequest(history)
+	if err != nil {
+		writeLLMError(ctx, w, err)
+		return
+	}
+	req.Model = h.Models.Resolve(req.Model)
+
+	base := rreq.newResponseObject(req.Model)
+	conversation := append(append([]llm.ChatMessage{}, history...), input...)
+
+	save := func(reply llm.ChatMessage) {
+		if rreq.Store != nil && !*rreq.Store {
+			return
+		}
+		h.saveResponseState(ctx, userID, versionID, base.ID, append(conversation, reply))
+	}
+
+	if req.Stream {
+		req.StreamOptions = &llm.StreamOptions{IncludeUsage: true}
+		sw := newResponsesStream(base, save)
+		if err := h.streamChatCompletion(ctx, w, logger, req, userID, versionID, r.Header.Get(lastEventIDHeader), start, sw); err != nil {
+			writeLLMError(ctx, w, err)
+		}
+		return
+	}
+
+	resp, err := h.complete(ctx, req, userID, versionID, start)
+	if err != nil {
+		writeLLMError(ctx, w, err)
+		return
+	}
+
+	out := base
+	reply := llm.ChatMessage{Role: llm.RoleAssistant}
+	finishReason := ""
+	if len(resp.Choices) > 0 {
+		reply = resp.Choices[0].Message
+		reply.Role = llm.RoleAssistant
+		finishReason = resp.Choices[0].FinishReason
+	}
+	out.Output = responseOutput(reply)
+	out.Usage = newResponseUsage(resp.Usage)
+	out.finish(finishReason)
+	if resp.Model != "" {
+		out.Model = resp.Model
+	}
+
+	save(reply)
+	writeJSON(ctx, w, out)
+}
+
+func responsesInvalid(param, msg string) error {
+	return &statusError{
+		status: http.StatusBadRequest,
+		body:   newAPIError(errTypeInvalidRequest, "invalid_request", param, msg),
+	}
+}
+
+func (h *ChatHandler) stateTTL() time.Duration {
+	if h.ResponseStateTTL > 0 {
+		return h.ResponseStateTTL
+	}
+	return defaultResponseStateTTL
+}
+
+func (h *ChatHandler) loadResponseState(ctx context.Context, userID, versionID, id string) (*responseState, error) {
+	notFound := &statusError{
+		status: http.StatusNotFound,
+		body: newAPIError(errTypeInvalidRequest, "previous_response_not_found", "previous_response_id",
+			fmt.Sprintf("previous response with id %q not found", id)),
+	}
+
+	data, hit, err := h.Cache.Get(ctx, cache.ResponseStateKey(userID, versionID, id))
+	if err != nil {
+		// The state may well exist; a 404 would make the client start over.
+		logging.L(ctx).Error("response_state_get_error", zap.Error(err))
+		return nil, &statusError{
+			status: http.StatusServiceUnavailable,
+			body:   newAPIError(errTypeServer, "response_state_unavailable", "", "previous response state could not be read; retry the request"),
+		}
+	}
+	if !hit {
+		return nil, notFound
+	}
+
+	var state responseState
+	if err := json.Unmarshal(data, &state); err != nil {
+		logging.L(ctx).Warn("response_state_unmarshal_error", zap.Error(err))
+		return nil, notFound
+	}
+	return &state, nil
+}
+
+func (h *ChatHandler) saveResponseState(ctx context.Context, userID, versionID, id string, messages []llm.ChatMessage) {
+	data, err := json.Marshal(responseState{Messages: messages})
+	if err != nil {
+		logging.L(ctx).Warn("response_state_marshal_error", zap.Error(err))
+		return
+	}
+	if err := h.Cache.Set(ctx, cache.ResponseStateKey(userID, versionID, id), data, h.stateTTL()); err != nil {
+		logging.L(ctx).Warn("response_state_set_error", zap.Error(err))
+	}
+}
+
+// toChatRequest builds the ChatRequest for r on top of history and also
+// returns the messages that came from r.Input, for the stored state.
+func (r *responsesRequest) toChatRequest(history []llm.ChatMessage) (*llm.ChatRequest, []llm.ChatMessage, error) {
+	input, err := decodeResponsesInput(r.Input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := &llm.ChatRequest{
+		Model:             r.Model,
+		Temperature:       r.Temperature,
+		TopP:              r.TopP,
+		MaxTokens:         r.MaxOutputTokens,
+		Stream:            r.Stream,
+		ParallelToolCalls: r.ParallelToolCalls,
+	}
+
+	if r.Instructions != "" {
+		req.Messages = append(req.Messages, llm.ChatMessage{Role: llm.RoleSystem, Content: r.Instructions})
+	}
+	req.Messages = append(req.Messages, history...)
+	req.Messages = append(req.Messages, input...)
+
+	for _, t := range r.Tools {
+		if t.Type != llm.ToolTypeFunction {
+			return nil, nil, responsesInvalid("tools", fmt.Sprintf("unsupported tool type %q", t.Type))
+		}
+		req.Tools = append(req.Tools, llm.Tool{
+			Type: llm.ToolTypeFunction,
+			Function: llm.FunctionDefinition{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Parameters,
+				Strict:      t.Strict,
+			},
+		})
+	}
+
+	if len(r.ToolChoice) > 0 && string(r.ToolChoice) != "null" {
+		choice, err := responsesToolChoice(r.ToolChoice)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.ToolChoice = choice
+	}
+
+	if r.Text != nil && r.Text.Format != nil {
+		f := r.Text.Format
+		req.ResponseFormat = &llm.ResponseFormat{Type: f.Type}
+		if f.Type == llm.ResponseFormatJSONSchema {
+			req.ResponseFormat.JSONSchema = &llm.JSONSchemaFormat{
+				Name:        f.Name,
+				Description: f.Description,
+				Schema:      f.Schema,
+				Strict:      f.Strict,
+			}
+		}
+	}
+
+	if len(r.User) > 0 {
+		req.Extra = map[string]json.RawMessage{"user": r.User}
+	}
+
+	return req, input, nil
+}
+
+// responsesToolChoice converts a Responses tool_choice ("auto", "none",
+// "required" or {"type":"function","name":...}) to the chat form.
+func responsesToolChoice(raw json.RawMessage) (json.RawMessage, error) {
+	if raw[0] == '"' {
+		return raw, nil
+	}
+	var choice struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(raw, &choice); err != nil || choice.Type != llm.ToolTypeFunction {
+		return nil, responsesInvalid("tool_choice", "tool_choice must be a string or a function choice")
+	}
+	return json.Marshal(map[string]interface{}{
+		"type":     llm.ToolTypeFunction,
+		"function": map[string]string{"name": choice.Name},
+	})
+}
+
+// decodeResponsesInput maps input (a string or an array of items) to chat
+// messages.
+func decodeResponsesInput(raw json.RawMessage) ([]llm.ChatMessage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, responsesInvalid("input", "input is required")
+	}
+	if raw[0] == '"' {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, responsesInvalid("input", "input must be a string or an array of items")
+		}
+		return []llm.ChatMessage{{Role: llm.RoleUser, Content: text}}, nil
+	}
+
+	var items []responsesItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, responsesInvalid("input", "input must be a string or an array of items")
+	}
+
+	var out []llm.ChatMessage
+	for i, item := range items {
+		param := fmt.Sprintf("input[%d]", i)
+		switch item.Type {
+		case "", responsesItemMessage:
+			msg, err := responsesMessage(item)
+			if err != nil {
+				return nil, responsesInvalid(param, err.Error())
+			}
+			out = append(out, msg)
+
+		case responsesItemFunctionCall:
+			call := llm.ToolCall{
+				ID:       item.CallID,
+				Type:     llm.ToolTypeFunction,
+				Function: llm.FunctionCall{Name: item.Name, Arguments: item.Arguments},
+			}
+			// Consecutive calls belong to one assistant turn.
+			if n := len(out); n > 0 && out[n-1].Role == llm.RoleAssistant {
+				out[n-1].ToolCalls = append(out[n-1].ToolCalls, call)
+			} else {
+				out = append(out, llm.ChatMessage{Role: llm.RoleAssistant, ToolCalls: []llm.ToolCall{call}})
+			}
+
+		case responsesItemFunctionCallOutput:
+			output, err := decodeStringOrRaw(item.Output)
+			if err != nil {
+				return nil, responsesInvalid(param, err.Error())
+			}
+			out = append(out, llm.ChatMessage{Role: llm.RoleTool, ToolCallID: item.CallID, Content: output})
+
+		default:
+			return nil, responsesInvalid(param, fmt.Sprintf("unsupported input item type %q", item.Type))
+		}
+	}
+	return out, nil
+}
+
+// responsesMessage converts a message item. Developer messages become
+// system messages; assistant content is flattened to text.
+func responsesMessage(item responsesItem) (llm.ChatMessage, error) {
+	msg := llm.ChatMessage{Role: item.Role}
+	switch item.Role {
+	case "developer":
+		msg.Role = llm.RoleSystem
+	case llm.RoleSystem, llm.RoleUser, llm.RoleAssistant:
+	default:
+		return msg, fmt.Errorf("unsupported role %q", item.Role)
+	}
+
+	if len(item.Content) > 0 && item.Content[0] == '"' {
+		err := json.Unmarshal(item.Content, &msg.Content)
+		return msg, err
+	}
+
+	var parts []responsesPart
+	if err := json.Unmarshal(item.Content, &parts); err != nil {
+		return msg, fmt.Errorf("content must be a string or an array of parts")
+	}
+
+	var text strings.Builder
+	for _, p := range parts {
+		switch p.Type {
+		case responsesPartInputText, responsesPartOutputText:
+			if msg.Role != llm.RoleUser {
+				text.WriteString(p.Text)
+				continue
+			}
+			msg.Parts = append(msg.Parts, llm.ContentPart{Type: llm.ContentPartText, Text: p.Text})
+		case responsesPartInputImage:
+			if p.ImageURL == "" {
+				return msg, fmt.Errorf("input_image requires image_url")
+			}
+			if msg.Role != llm.RoleUser {
+				return msg, fmt.Errorf("input_image is only allowed in user messages")
+			}
+			msg.Parts = append(msg.Parts, llm.ContentPart{
+				Type:     llm.ContentPartImageURL,
+				ImageURL: &llm.ImageURL{URL: p.ImageURL, Detail: p.Detail},
+			})
+		default:
+			return msg, fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	if msg.Role != llm.RoleUser {
+		msg.Content = text.String()
+	}
+	return msg, nil
+}
+
+// decodeStringOrRaw returns a JSON string's value, or any other JSON value
+// as its raw text.
+func decodeStringOrRaw(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	if raw[0] == '"' {
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	}
+	return string(raw), nil
+}
+
+func (r *responsesRequest) newResponseObject(model string) responseObject {
+	out := responseObject{
+		ID:        newCompletionID("resp_"),
+		Object:    "response",
+		CreatedAt: time.Now().Unix(),
+		Status:    responseStatusInProgress,
+		Model:     model,
+		Output:    []interface{}{},
+		Metadata:  r.Metadata,
+	}
+	if out.Metadata == nil {
+		out.Metadata = map[string]string{}
+	}
+	if r.Instructions != "" {
+		instructions := r.Instructions
+		out.Instructions = &instructions
+	}
+	if r.PreviousResponseID != "" {
+		prev := r.PreviousResponseID
+		out.PreviousResponseID = &prev
+	}
+	return out
+}
+
+// finish sets the terminal status from the chat finish reason.
+func (o *responseObject) finish(finishReason string) {
+	switch finishReason {
+	case "length":
+		o.Status = responseStatusIncomplete
+		o.IncompleteDetails = &responseIncomplete{Reason: "max_output_tokens"}
+	case "content_filter":
+		o.Status = responseStatusIncomplete
+		o.IncompleteDetails = &responseIncomplete{Reason: "content_filter"}
+	default:
+		o.Status = responseStatusCompleted
+	}
+}
+
+func newResponseUsage(u *llm.Usage) *responseUsage {
+	if u == nil {
+		return nil
+	}
+	return &responseUsage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+		TotalTokens:  u.TotalTokens,
+	}
+}
+
+func newOutputText(text string) responseOutputText {
+	return responseOutputText{Type: responsesPartOutputText, Text: text, Annotations: []interface{}{}}
+}
+
+// responseOutput converts an assistant message into output items: a
+// message item for its text and one function_call item per tool call.
+func responseOutput(msg llm.ChatMessage) []interface{} {
+	out := []interface{}{}
+	if text := msg.Text(); text != "" {
+		out = append(out, responseMessageItem{
+			Type:    responsesItemMessage,
+			ID:      newCompletionID("msg_"),
+			Status:  responseStatusCompleted,
+			Role:    llm.RoleAssistant,
+			Content: []responseOutputText{newOutputText(text)},
+		})
+	}
+	for _, tc := range msg.ToolCalls {
+		out = append(out, responseFunctionCallItem{
+			Type:      responsesItemFunctionCall,
+			ID:        newCompletionID("fc_"),
+			CallID:    tc.ID,
+			Name:      tc.Function.Name,
+			Arguments: tc.Function.Arguments,
+			Status:    responseStatusCompleted,
+		})
+	}
+	return out
+}
+
+// responsesStream writes the Responses API typed SSE events. Every event is
+// named after its "type" and carries a sequence_number. Only the first
+// choice is streamed; onDone receives the assembled assistant message.
+type responsesStream struct {
+	resp    responseObject
+	seq     int
+	started bool
+	onDone  func(reply llm.ChatMessage)
+
+	nextIndex int
+
+	msgOpen  bool
+	msgID    string
+	msgIndex int
+	text     strings.Builder
+
+	calls   []*responsesStreamCall
+	byIndex map[int]*responsesStreamCall
+
+	finishReason string
+	usage        *llm.Usage
+}
+
+type responsesStreamCall struct {
+	itemID      string
+	callID      string
+	name        string
+	args        strings.Builder
+	outputIndex int
+}
+
+func newResponsesStream(base responseObject, onDone func(reply llm.ChatMessage)) *responsesStream {
+	return &responsesStream{
+		resp:    base,
+		onDone:  onDone,
+		byIndex: make(map[int]*responsesStreamCall),
+	}
+}
+
+func (s *responsesStream) emit(w io.Writer, eventType string, fields map[string]interface{}) error {
+	fields["type"] = eventType
+	fields["sequence_number"] = s.seq
+	s.seq++
+	return writeSSEEvent(w, eventType, fields)
+}
+
+func (s *responsesStream) start(w io.Writer) error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	return s.emit(w, "response.created", map[string]interface{}{"response": s.resp})
+}
+
+func (s *responsesStream) writeChunk(w io.Writer, c *llm.StreamChunk) error {
+	if c.Model != "" {
+		s.resp.Model = c.Model
+	}
+	if err := s.start(w); err != nil {
+		return err
+	}
+	if c.Usage != nil {
+		s.usage = c.Usage
+		return nil
+	}
+	if c.Index != 0 {
+		return nil
+	}
+
+	if c.Delta != "" {
+		if !s.msgOpen {
+			s.msgOpen = true
+			s.msgID = newCompletionID("msg_")
+			s.msgIndex = s.nextIndex
+			s.nextIndex++
+			if err := s.emit(w, "response.output_item.added", map[string]interface{}{
+				"output_index": s.msgIndex,
+				"item": responseMessageItem{
+					Type:    responsesItemMessage,
+					ID:      s.msgID,
+					Status:  responseStatusInProgress,
+					Role:    llm.RoleAssistant,
+					Content: []responseOutputText{},
+				},
+			}); err != nil {
+				return err
+			}
+			if err := s.emit(w, "response.content_part.added", map[string]interface{}{
+				"item_id":       s.msgID,
+				"output_index":  s.msgIndex,
+				"content_index": 0,
+				"part":          newOutputText(""),
+			}); err != nil {
+				return err
+			}
+		}
+		s.text.WriteString(c.Delta)
+		if err := s.emit(w, "response.output_text.delta", map[string]interface{}{
+			"item_id":       s.msgID,
+			"output_index":  s.msgIndex,
+			"content_index": 0,
+			"delta":         c.Delta,
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, td := range c.ToolCalls {
+		call := s.byIndex[td.Index]
+		if call == nil {
+			call = &responsesStreamCall{
+				itemID:      newCompletionID("fc_"),
+				callID:      td.ID,
+				name:        td.Function.Name,
+				outputIndex: s.nextIndex,
+			}
+			s.nextIndex++
+			s.byIndex[td.Index] = call
+			s.calls = append(s.calls, call)
+			if err := s.emit(w, "response.output_item.added", map[string]interface{}{
+				"output_index": call.outputIndex,
+				"item":         call.item(responseStatusInProgress),
+			}); err != nil {
+				return err
+			}
+		}
+		if td.Function.Arguments == "" {
+			continue
+		}
+		call.args.WriteString(td.Function.Arguments)
+		if err := s.emit(w, "response.function_call_arguments.delta", map[string]interface{}{
+			"item_id":      call.itemID,
+			"output_index": call.outputIndex,
+			"delta":        td.Function.Arguments,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if c.FinishReason != "" {
+		s.finishReason = c.FinishReason
+	}
+	return nil
+}
+
+func (c *responsesStreamCall) item(status string) responseFunctionCallItem {
+	return responseFunctionCallItem{
+		Type:      responsesItemFunctionCall,
+		ID:        c.itemID,
+		CallID:    c.callID,
+		Name:      c.name,
+		Arguments: c.args.String(),
+		Status:    status,
+	}
+}
+
+// writeDone closes every open output item in output order, then sends
+// response.completed (or response.incomplete) with the full response.
+func (s *responsesStream) writeDone(w io.Writer) error {
+	if err := s.start(w); err != nil {
+		return err
+	}
+
+	output := make([]interface{}, s.nextIndex)
+	reply := llm.ChatMessage{Role: llm.RoleAssistant}
+
+	if s.msgOpen {
+		text := s.text.String()
+		item := responseMessageItem{
+			Type:    responsesItemMessage,
+			ID:      s.msgID,
+			Status:  responseStatusCompleted,
+			Role:    llm.RoleAssistant,
+			Content: []responseOutputText{newOutputText(text)},
+		}
+		output[s.msgIndex] = item
+		reply.Content = text
+
+		if err := s.emit(w, "response.output_text.done", map[string]interface{}{
+			"item_id":       s.msgID,
+			"output_index":  s.msgIndex,
+			"content_index": 0,
+			"text":          text,
+		}); err != nil {
+			return err
+		}
+		if err := s.emit(w, "response.content_part.done", map[string]interface{}{
+			"item_id":       s.msgID,
+			"output_index":  s.msgIndex,
+			"content_index": 0,
+			"part":          newOutputText(text),
+		}); err != nil {
+			return err
+		}
+		if err := s.emit(w, "response.output_item.done", map[string]interface{}{
+			"output_index": s.msgIndex,
+			"item":         item,
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, call := range s.calls {
+		item := call.item(responseStatusCompleted)
+		output[call.outputIndex] = item
+		reply.ToolCalls = append(reply.ToolCalls, llm.ToolCall{
+			ID:       call.callID,
+			Type:     llm.ToolTypeFunction,
+			Function: llm.FunctionCall{Name: call.name, Arguments: item.Arguments},
+		})
+
+		if err := s.emit(w, "response.function_call_arguments.done", map[string]interface{}{
+			"item_id":      call.itemID,
+			"output_index": call.outputIndex,
+			"arguments":    item.Arguments,
+		}); err != nil {
+			return err
+		}
+		if err := s.emit(w, "response.output_item.done", map[string]interface{}{
+			"output_index": call.outputIndex,
+			"item":         item,
+		}); err != nil {
+			return err
+		}
+	}
+
+	s.resp.Output = output
+	s.resp.Usage = newResponseUsage(s.usage)
+	s.resp.finish(s.finishReason)
+
+	if s.onDone != nil {
+		s.onDone(reply)
+	}
+
+	eventType := "response.completed"
+	if s.resp.Status == responseStatusIncomplete {
+		eventType = "response.incomplete"
+	}
+	return s.emit(w, eventType, map[string]interface{}{"response": s.resp})
+}
+
+// writeHeartbeat uses an SSE comment: the Responses API has no ping event
+// and a typed event would consume a sequence number.
+func (s *responsesStream) writeHeartbeat(w io.Writer) error {
+	return writeSSEComment(w)
+}
+
+func (s *responsesStream) writeError(w io.Writer, err error) error {
+	_, body := errorFromLLM(err)
+	return s.emit(w, "error", map[string]interface{}{
+		"code":    body.Code,
+		"message": body.Message,
+		"param":   body.Param,
+	})
+}
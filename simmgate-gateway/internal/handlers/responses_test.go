@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+)
+
+func postResponses(h *ChatHandler, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-User-ID", "user-r")
+	h.Responses(rr, req)
+	return rr
+}
+
+func TestResponsesPreviousResponseID(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	fakeLLM := &mockLLMClient{
+		responses: []*llm.ChatResponse{
+			{Model: "gpt-4", Choices: []llm.ChatChoice{{
+				Message:      llm.ChatMessage{Role: llm.RoleAssistant, Content: "Hi Ada"},
+				FinishReason: "stop",
+			}}},
+			{Model: "gpt-4", Choices: []llm.ChatChoice{{
+				Message:      llm.ChatMessage{Role: llm.RoleAssistant, Content: "Ada"},
+				FinishReason: "stop",
+			}}},
+		},
+	}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	rr := postResponses(h, `{"model":"gpt-4","instructions":"be nice","input":"I am Ada"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var first responseObject
+	if err := json.Unmarshal(rr.Body.Bytes(), &first); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if first.Object != "response" || first.Status != "completed" || !strings.HasPrefix(first.ID, "resp_") {
+		t.Fatalf("unexpected response: %+v", first)
+	}
+	item, _ := first.Output[0].(map[string]interface{})
+	if item["type"] != "message" {
+		t.Fatalf("expected message output item, got %+v", first.Output)
+	}
+
+	rr = postResponses(h, `{"model":"gpt-4","previous_response_id":"`+first.ID+`",
+		"input":[{"role":"user","content":[{"type":"input_text","text":"Who am I?"}]}]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	msgs := fakeLLM.lastRequest.Messages
+	if len(msgs) != 3 {
+		t.Fatalf("expected history plus new input, got %+v", msgs)
+	}
+	if msgs[0].Content != "I am Ada" || msgs[1].Content != "Hi Ada" || msgs[2].Text() != "Who am I?" {
+		t.Fatalf("unexpected conversation: %+v", msgs)
+	}
+}
+
+func TestResponsesUnknownPreviousResponse(t *testing.T) {
+	fakeLLM := &mockLLMClient{}
+	h := NewChatHandler(cache.NewMemoryExactCache(time.Minute), time.Minute, "vtest", fakeLLM)
+
+	rr := postResponses(h, `{"model":"gpt-4","previous_response_id":"resp_missing","input":"hi"}`)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "previous_response_not_found") {
+		t.Fatalf("unexpected error body: %s", rr.Body.String())
+	}
+	if fakeLLM.nonStreamCalls != 0 {
+		t.Fatalf("expected no upstream call")
+	}
+}
+
+// failingCache fails every read, like an unreachable Redis.
+type failingCache struct{}
+
+func (failingCache) Get(context.Context, string) ([]byte, bool, error) {
+	return nil, false, errors.New("connection refused")
+}
+
+func (failingCache) Set(context.Context, string, []byte, time.Duration) error { return nil }
+
+func TestResponsesPreviousResponseStateUnavailable(t *testing.T) {
+	fakeLLM := &mockLLMClient{}
+	h := NewChatHandler(failingCache{}, time.Minute, "vtest", fakeLLM)
+
+	rr := postResponses(h, `{"model":"gpt-4","previous_response_id":"resp_1","input":"hi"}`)
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "response_state_unavailable") {
+		t.Fatalf("expected 503 response_state_unavailable, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if fakeLLM.nonStreamCalls != 0 {
+		t.Fatalf("expected no upstream call")
+	}
+}
+
+func TestResponsesFunctionCallItems(t *testing.T) {
+	r := responsesRequest{
+		Model: "gpt-4",
+		Input: json.RawMessage(`[
+			{"role":"user","content":"weather?"},
+			{"type":"function_call","call_id":"c1","name":"weather","arguments":"{}"},
+			{"type":"function_call","call_id":"c2","name":"time","arguments":"{}"},
+			{"type":"function_call_output","call_id":"c1","output":"sunny"}
+		]`),
+		Tools: []responsesTool{{Type: "function", Name: "weather"}},
+	}
+
+	req, _, err := r.toChatRequest(nil)
+	if err != nil {
+		t.Fatalf("toChatRequest: %v", err)
+	}
+	if len(req.Messages) != 3 || len(req.Messages[1].ToolCalls) != 2 {
+		t.Fatalf("expected calls merged into one assistant turn: %+v", req.Messages)
+	}
+	if m := req.Messages[2]; m.Role != llm.RoleTool || m.ToolCallID != "c1" || m.Content != "sunny" {
+		t.Fatalf("unexpected tool output message: %+v", m)
+	}
+	if req.Tools[0].Function.Name != "weather" {
+		t.Fatalf("unexpected tools: %+v", req.Tools)
+	}
+}
+
+func TestResponsesStreamEvents(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+
+	streamChan := make(chan llm.StreamResult, 4)
+	fakeLLM := &mockLLMClient{stream: streamChan}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Delta: "hel"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Delta: "lo"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{FinishReason: "stop"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Usage: &llm.Usage{PromptTokens: 1, CompletionTokens: 2, TotalTokens: 3}}}
+	close(streamChan)
+
+	rr := postResponses(h, `{"model":"gpt-4","stream":true,"input":"hi"}`)
+
+	var (
+		events    []string
+		deltas    strings.Builder
+		completed responseObject
+	)
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, name)
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var ev struct {
+			Type     string          `json:"type"`
+			Seq      int             `json:"sequence_number"`
+			Delta    string          `json:"delta"`
+			Response json.RawMessage `json:"response"`
+		}
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatalf("decode event %q: %v", data, err)
+		}
+		if ev.Seq != len(events)-1 {
+			t.Fatalf("expected sequence number %d, got %d", len(events)-1, ev.Seq)
+		}
+		switch ev.Type {
+		case "response.output_text.delta":
+			deltas.WriteString(ev.Delta)
+		case "response.completed":
+			if err := json.Unmarshal(ev.Response, &completed); err != nil {
+				t.Fatalf("decode completed response: %v", err)
+			}
+		}
+	}
+
+	if events[0] != "response.created" || events[len(events)-1] != "response.completed" {
+		t.Fatalf("unexpected events %v", events)
+	}
+	if deltas.String() != "hello" {
+		t.Fatalf("expected deltas to spell hello, got %q", deltas.String())
+	}
+	if completed.Status != "completed" || completed.Usage == nil || completed.Usage.OutputTokens != 2 {
+		t.Fatalf("unexpected completed response: %+v", completed)
+	}
+
+	// The streamed conversation is stored for previous_response_id.
+	if _, err := h.loadResponseState(context.Background(), "user-r", "vtest", completed.ID); err != nil {
+		t.Fatalf("expected stored state for %s: %v", completed.ID, err)
+	}
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/middleware"
+	"simmgate-gateway/internal/resume"
+)
+
+const (
+	// generationIDHeader names the buffered generation of a stream; its
+	// event IDs are "<generation>:<seq>".
+	generationIDHeader = "X-Generation-ID"
+	lastEventIDHeader  = "Last-Event-ID"
+
+	// resumeWait is how long a resumed stream waits for new events before
+	// sending a heartbeat, when StreamHeartbeat is off.
+	resumeWait = 15 * time.Second
+)
+
+// resumeStream replays a buffered generation after the event named by
+// lastEventID and follows it until it ends. Like streamChatCompletion it
+// returns an error only before anything is written.
+func (h *ChatHandler) resumeStream(
+	ctx context.Context,
+	w http.ResponseWriter,
+	flusher http.Flusher,
+	logger *zap.Logger,
+	userID, lastEventID string,
+	start time.Time,
+	sw streamWriter,
+) error {
+	generationID, after, err := resume.ParseEventID(lastEventID)
+	if err != nil {
+		return &statusError{
+			status: http.StatusBadRequest,
+			body:   newAPIError(errTypeInvalidRequest, "invalid_last_event_id", lastEventIDHeader, err.Error()),
+		}
+	}
+	key := resume.Key(userID, generationID)
+
+	events, done, err := h.StreamBuffer.Read(ctx, key, after, 0)
+	if errors.Is(err, resume.ErrNotFound) {
+		return &statusError{
+			status: http.StatusNotFound,
+			body:   newAPIError(errTypeInvalidRequest, "stream_not_found", lastEventIDHeader, "stream not found or no longer buffered"),
+		}
+	}
+	if err != nil {
+		logger.Error("stream_buffer_read_error", zap.Error(err))
+		return &statusError{
+			status: http.StatusInternalServerError,
+			body:   newAPIError(errTypeServer, "stream_buffer_error", "", "failed to read buffered stream"),
+		}
+	}
+
+	w.Header().Set(generationIDHeader, generationID)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	wait := h.StreamHeartbeat
+	if wait <= 0 {
+		wait = resumeWait
+	}
+
+	// A reader still following the generation at the end of the shutdown
+	// drain gets a terminal error, like the stream it follows.
+	defer h.Drain.TrackStream()()
+	ctx, cancel := h.Drain.Bind(ctx)
+	defer cancel()
+
+	replayed, heartbeats := 0, 0
+	for {
+		for _, ev := range events {
+			if _, err := w.Write(ev.Data); err != nil {
+				logger.Info("stream_resume_client_gone", zap.String("generation_id", generationID), zap.Error(err))
+				return nil
+			}
+			after = ev.Seq
+			replayed++
+		}
+		flusher.Flush()
+
+		if done {
+			break
+		}
+
+		events, done, err = h.StreamBuffer.Read(ctx, key, after, wait)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("stream_buffer_read_error", zap.Error(err))
+			}
+			break
+		}
+		if len(events) == 0 && !done && h.StreamHeartbeat > 0 {
+			if err := writeSSEComment(w); err != nil {
+				break
+			}
+			heartbeats++
+		}
+	}
+
+	if !done && errors.Is(context.Cause(ctx), middleware.ErrDrainExpired) {
+		if err := sw.writeError(w, shuttingDownError()); err == nil {
+			flusher.Flush()
+		}
+	}
+
+	logger.Info("stream_resumed",
+		zap.String("user_id", userID),
+		zap.String("generation_id", generationID),
+		zap.String("last_event_id", lastEventID),
+		zap.Int("events", replayed),
+		zap.Int("heartbeats", heartbeats),
+		zap.Bool("completed", done),
+		zap.Duration("total_latency", time.Since(start)),
+	)
+	return nil
+}
+
+// withEventID adds an SSE id line to the last event in data, so a client
+// only advances its Last-Event-ID once every event of the entry arrived.
+func withEventID(data []byte, id string) []byte {
+	body := bytes.TrimSuffix(data, []byte("\n\n"))
+	last := 0
+	if i := bytes.LastIndex(body, []byte("\n\n")); i >= 0 {
+		last = i + 2
+	}
+
+	out := make([]byte, 0, len(data)+len(id)+5)
+	out = append(out, data[:last]...)
+	out = append(out, "id: "...)
+	out = append(out, id...)
+	out = append(out, '\n')
+	return append(out, data[last:]...)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/resume"
+)
+
+func TestWithEventID(t *testing.T) {
+	got := string(withEventID([]byte("event: a\ndata: 1\n\nevent: b\ndata: 2\n\n"), "g:7"))
+	if got != "event: a\ndata: 1\n\nid: g:7\nevent: b\ndata: 2\n\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+	if got := string(withEventID([]byte("data: x\n\n"), "g:1")); got != "id: g:1\ndata: x\n\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+}
+
+func TestChatHandlerStreamResume(t *testing.T) {
+	cacheStore := cache.NewMemoryExactCache(time.Minute)
+	t.Cleanup(func() { cacheStore.Close() })
+	buffer := resume.NewMemoryStore(time.Minute)
+	t.Cleanup(buffer.Close)
+
+	streamChan := make(chan llm.StreamResult)
+	fakeLLM := &mockLLMClient{stream: streamChan}
+	h := NewChatHandler(cacheStore, time.Minute, "vtest", fakeLLM)
+	h.StreamBuffer = buffer
+
+	payload := `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"long answer"}]}`
+	newRequest := func(ctx context.Context, user string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(payload)).WithContext(ctx)
+		req.Header.Set("X-User-ID", user)
+		return req
+	}
+
+	// The client disconnects after the first chunk; generation goes on.
+	ctx, disconnect := context.WithCancel(context.Background())
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ChatCompletion(rr, newRequest(ctx, "u-resume"))
+		close(done)
+	}()
+
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "first"}}
+	disconnect()
+	time.Sleep(20 * time.Millisecond)
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "second"}}
+	streamChan <- llm.StreamResult{Chunk: &llm.StreamChunk{Index: 0, Delta: "third", FinishReason: "stop"}}
+	close(streamChan)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("generation did not finish after the client left")
+	}
+
+	gen := rr.Header().Get(generationIDHeader)
+	first := rr.Body.String()
+	if gen == "" || !strings.Contains(first, "id: "+gen+":1\ndata: ") || strings.Contains(first, "second") {
+		t.Fatalf("expected only the first event, with an id, before the disconnect: %q", first)
+	}
+
+	// Reconnect after the generation finished.
+	rr = httptest.NewRecorder()
+	req := newRequest(context.Background(), "u-resume")
+	req.Header.Set("Last-Event-ID", gen+":1")
+	h.ChatCompletion(rr, req)
+
+	body := rr.Body.String()
+	if strings.Contains(body, "first") || !strings.Contains(body, `"content":"second"`) || !strings.Contains(body, `"content":"third"`) {
+		t.Fatalf("expected the remaining chunks only: %q", body)
+	}
+	if !strings.HasSuffix(body, "id: "+gen+":4\ndata: [DONE]\n\n") {
+		t.Fatalf("expected the stream to end with [DONE]: %q", body)
+	}
+	if fakeLLM.streamCalls != 1 {
+		t.Fatalf("resuming must not call the upstream again, got %d calls", fakeLLM.streamCalls)
+	}
+
+	// Another caller cannot resume the stream.
+	rr = httptest.NewRecorder()
+	req = newRequest(context.Background(), "u-other")
+	req.Header.Set("Last-Event-ID", gen+":1")
+	h.ChatCompletion(rr, req)
+	if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), "stream_not_found") {
+		t.Fatalf("expected 404 for another user, got %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"simmgate-gateway/internal/audit"
+	"simmgate-gateway/internal/cache"
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/metrics"
+	"simmgate-gateway/internal/pipeline"
+	"simmgate-gateway/pkg/logging/logging"
+
+	"github.com/go-chi/chi/v5"
+	chimw "github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// Built-in stage names.
+const (
+	StageAudit      = "audit"
+	StageExactCache = "exact_cache"
+)
+
+// DefaultStages is the pipeline used when none is configured. Audit runs
+// first so its After hook sees the outcome of every other stage.
+var DefaultStages = []string{StageAudit, StageExactCache}
+
+// Stages returns the built-in stages by name. Callers may add their own
+// before building a pipeline from it.
+func (h *ChatHandler) Stages() pipeline.Registry {
+	return pipeline.Registry{
+		StageAudit:      auditStage{h: h},
+		StageExactCache: exactCacheStage{h: h},
+	}
+}
+
+// pipeline returns the configured pipeline or the default one.
+func (h *ChatHandler) pipeline() *pipeline.Pipeline {
+	if h.Pipeline != nil {
+		return h.Pipeline
+	}
+	p, _ := h.Stages().Build(DefaultStages)
+	return p
+}
+
+// exactCacheStage answers non-stream requests from the exact cache and
+// stores cacheable upstream responses. It logs the cache_decision line.
+type exactCacheStage struct {
+	h *ChatHandler
+}
+
+// exactCacheState is what the stage keeps on the Exchange between hooks.
+type exactCacheState struct {
+	key     string
+	hash    string
+	latency time.Duration
+}
+
+const exactCacheStateKey = StageExactCache
+
+func (s exactCacheStage) Before(ctx context.Context, ex *pipeline.Exchange) error {
+	if ex.Stream {
+		return nil
+	}
+	logger := logging.L(ctx)
+
+	key, err := cache.BuildExactCacheKeyFromChatRequest(*ex.Request, ex.UserID, ex.VersionID)
+	if err != nil {
+		logger.Warn("key_builder_error", zap.Error(err))
+		return nil
+	}
+	state := &exactCacheState{key: key.String(), hash: key.Hash}
+	ex.Set(exactCacheStateKey, state)
+
+	lookupStart := time.Now()
+	cachedBytes, hit, cacheErr := s.h.Cache.Get(ctx, state.key)
+	state.latency = time.Since(lookupStart)
+
+	if cacheErr != nil {
+		logger.Warn("exact_cache_get_error", zap.Error(cacheErr))
+	}
+	if !hit {
+		return nil
+	}
+
+	var cachedResp llm.ChatResponse
+	if err := json.Unmarshal(cachedBytes, &cachedResp); err != nil {
+		logger.Warn("exact_cache_unmarshal_error", zap.Error(err))
+		return nil
+	}
+	ex.Response = &cachedResp
+	ex.CacheTier = StageExactCache
+	return nil
+}
+
+func (s exactCacheStage) After(ctx context.Context, ex *pipeline.Exchange) error {
+	if ex.Stream || ex.Err != nil {
+		return nil
+	}
+	logger := logging.L(ctx)
+
+	var state exactCacheState
+	if v, ok := ex.Get(exactCacheStateKey); ok {
+		state = *v.(*exactCacheState)
+	}
+	hit := ex.CacheTier == StageExactCache
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("simmgate.cache.exact_hit", hit))
+
+	// Responses that failed structured-output validation are never cached.
+	if state.key != "" && ex.CacheTier == "" && ex.Cacheable {
+		respBytes, err := json.Marshal(ex.Response)
+		if err != nil {
+			logger.Warn("marshal_response_error", zap.Error(err))
+		} else if err := s.h.Cache.Set(ctx, state.key, respBytes, s.h.CacheTTL); err != nil {
+			logger.Warn("exact_cache_set_error", zap.Error(err))
+		}
+	}
+
+	modelID := ex.Request.Model
+	if modelID == "" {
+		modelID = "unknown-model"
+	}
+	fields := []zap.Field{
+		zap.String("cache_tier", "exact"),
+		zap.String("hash_key", state.hash),
+		zap.String("user_id", ex.UserID),
+		zap.String("model_id", modelID),
+		zap.String("version_id", ex.VersionID),
+		zap.Bool("cache_hit", hit),
+		zap.Duration("cache_lookup_latency", state.latency),
+	}
+	if !hit {
+		fields = append(fields, zap.Duration("llm_latency", ex.UpstreamLatency))
+	}
+	fields = append(fields, zap.Duration("total_latency", time.Since(ex.Start)))
+	logger.Info("cache_decision", fields...)
+	return nil
+}
+
+// auditStage emits an audit record for every completion to h.Audit.
+type auditStage struct {
+	h *ChatHandler
+}
+
+func (s auditStage) Before(_ context.Context, ex *pipeline.Exchange) error {
+	if ex.Stream && s.h.Audit.CapturesBodies() {
+		ex.CollectOutput = true
+	}
+	return nil
+}
+
+func (s auditStage) After(ctx context.Context, ex *pipeline.Exchange) error {
+	log := s.h.Audit
+	if log == nil {
+		return nil
+	}
+
+	rec := audit.Record{
+		Time:              ex.Start.UTC(),
+		RequestID:         chimw.GetReqID(ctx),
+		UserID:            ex.UserID,
+		Model:             ex.Request.Model,
+		Provider:          log.Provider(),
+		VersionID:         ex.VersionID,
+		Stream:            ex.Stream,
+		CacheTier:         ex.CacheTier,
+		CacheResult:       metrics.CacheMiss,
+		LatencyMS:         durationMS(time.Since(ex.Start)),
+		UpstreamLatencyMS: durationMS(ex.UpstreamLatency),
+		Status:            "ok",
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		rec.TraceID = sc.TraceID().String()
+	}
+	if rctx := chi.RouteContext(ctx); rctx != nil {
+		rec.Endpoint = rctx.RoutePattern()
+	} else if method, ok := grpc.Method(ctx); ok {
+		rec.Endpoint = method
+	}
+	switch {
+	case ex.CacheTier != "":
+		rec.CacheResult = metrics.CacheHit
+	case ex.Stream:
+		rec.CacheResult = "bypass"
+	}
+
+	switch {
+	case ex.Err != nil:
+		rec.Status, rec.Error = "error", ex.Err.Error()
+	case ex.AbortReason != "":
+		rec.Status, rec.AbortReason = "aborted", ex.AbortReason
+	}
+
+	usage := ex.Usage
+	if ex.Response != nil {
+		rec.ResponseModel = ex.Response.Model
+		if ex.Response.Usage != nil {
+			usage = ex.Response.Usage
+		}
+	}
+	if usage != nil {
+		rec.Usage = &audit.Usage{
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+			TotalTokens:      usage.TotalTokens,
+		}
+		// A cache hit costs nothing upstream.
+		if pricing := s.h.Models.Pricing(ex.Request.Model); pricing != nil {
+			cost := 0.0
+			if ex.CacheTier == "" {
+				cost = pricing.Cost(usage.PromptTokens, usage.CompletionTokens)
+			}
+			rec.CostUSD = &cost
+		}
+	}
+
+	if log.CapturesBodies() {
+		for _, m := range ex.Request.Messages {
+			rec.Prompt = append(rec.Prompt, audit.Message{Role: m.Role, Content: log.Body(m.Text())})
+		}
+		if ex.Response != nil {
+			for _, c := range ex.Response.Choices {
+				rec.Response = append(rec.Response, log.Body(c.Message.Text()))
+			}
+		} else {
+			for _, text := range ex.Output() {
+				rec.Response = append(rec.Response, log.Body(text))
+			}
+		}
+	}
+
+	log.Emit(rec)
+	return nil
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000.0
+}
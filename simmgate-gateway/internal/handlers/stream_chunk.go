@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"simmgate-gateway/internal/llm"
+)
+
+const chatCompletionChunkObject = "chat.completion.chunk"
+
+// streamResponse is one OpenAI chat.completion.chunk SSE payload.
+type streamResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []streamChoice `json:"choices"`
+	Usage   *llm.Usage     `json:"usage,omitempty"`
+}
+
+type streamChoice struct {
+	Index        int           `json:"index"`
+	Delta        streamDelta   `json:"delta"`
+	Logprobs     *llm.Logprobs `json:"logprobs,omitempty"`
+	FinishReason *string       `json:"finish_reason"`
+}
+
+type streamDelta struct {
+	Role      string              `json:"role,omitempty"`
+	Content   string              `json:"content,omitempty"`
+	ToolCalls []llm.ToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+// streamWriter writes one endpoint's SSE format: the events for each
+// chunk, the terminal event(s), an in-band error once the stream headers
+// are committed, and a heartbeat that keeps idle connections open.
+type streamWriter interface {
+	writeChunk(w io.Writer, c *llm.StreamChunk) error
+	writeDone(w io.Writer) error
+	writeError(w io.Writer, err error) error
+	writeHeartbeat(w io.Writer) error
+}
+
+// chunkEncoder turns an llm.StreamChunk into the SSE payload of one
+// OpenAI-style streaming format.
+type chunkEncoder interface {
+	encode(c *llm.StreamChunk) interface{}
+}
+
+// dataStream is the OpenAI SSE format: unnamed data events terminated by
+// "data: [DONE]".
+type dataStream struct {
+	enc chunkEncoder
+}
+
+func (s dataStream) writeChunk(w io.Writer, c *llm.StreamChunk) error {
+	return writeSSEJSON(w, s.enc.encode(c))
+}
+
+func (s dataStream) writeDone(w io.Writer) error {
+	_, err := io.WriteString(w, "data: [DONE]\n\n")
+	return err
+}
+
+func (s dataStream) writeHeartbeat(w io.Writer) error {
+	return writeSSEComment(w)
+}
+
+func (s dataStream) writeError(w io.Writer, err error) error {
+	if werr := writeSSEError(w, err); werr != nil {
+		return werr
+	}
+	return s.writeDone(w)
+}
+
+// streamChunkBuilder turns llm.StreamChunks into spec-complete chunks.
+// It keeps id/created/model stable for the whole stream (falling back to
+// generated values when the provider omits them) and makes sure the first
+// delta of every choice carries role: assistant. With n > 1 the provider
+// interleaves chunks of different choices; each is emitted as it arrives
+// with its own index.
+type streamChunkBuilder struct {
+	id      string
+	created int64
+	model   string
+	roleSet map[int]bool
+}
+
+func newStreamChunkBuilder(model string) *streamChunkBuilder {
+	return &streamChunkBuilder{
+		model:   model,
+		roleSet: make(map[int]bool),
+	}
+}
+
+func (b *streamChunkBuilder) encode(c *llm.StreamChunk) interface{} {
+	return b.build(c)
+}
+
+func (b *streamChunkBuilder) build(c *llm.StreamChunk) streamResponse {
+	if b.id == "" {
+		b.id = c.ID
+		if b.id == "" {
+			b.id = newCompletionID("chatcmpl-")
+		}
+	}
+	if b.created == 0 {
+		if !c.Created.IsZero() {
+			b.created = c.Created.Unix()
+		} else {
+			b.created = time.Now().Unix()
+		}
+	}
+	if c.Model != "" {
+		b.model = c.Model
+	}
+
+	resp := streamResponse{
+		ID:      b.id,
+		Object:  chatCompletionChunkObject,
+		Created: b.created,
+		Model:   b.model,
+		Choices: []streamChoice{},
+	}
+
+	if c.Usage != nil {
+		resp.Usage = c.Usage
+		return resp
+	}
+
+	delta := streamDelta{
+		Role:      c.Role,
+		Content:   c.Delta,
+		ToolCalls: c.ToolCalls,
+	}
+	if !b.roleSet[c.Index] {
+		if delta.Role == "" {
+			delta.Role = llm.RoleAssistant
+		}
+		b.roleSet[c.Index] = true
+	}
+
+	choice := streamChoice{
+		Index:    c.Index,
+		Delta:    delta,
+		Logprobs: c.Logprobs,
+	}
+	if c.FinishReason != "" {
+		reason := c.FinishReason
+		choice.FinishReason = &reason
+	}
+	resp.Choices = append(resp.Choices, choice)
+
+	return resp
+}
+
+// newCompletionID returns a random OpenAI-style object ID with prefix.
+func newCompletionID(prefix string) string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return prefix + hex.EncodeToString([]byte(time.Now().Format("150405.000000")))
+	}
+	return prefix + hex.EncodeToString(b[:])
+}
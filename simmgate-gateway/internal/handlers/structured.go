@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"simmgate-gateway/internal/jsonschema"
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/pkg/logging/logging"
+
+	"go.uber.org/zap"
+)
+
+// jsonObjectSchema is what response_format json_object promises.
+const jsonObjectSchema = `{"type":"object"}`
+
+// structuredValidator checks completions against a request's response_format.
+type structuredValidator struct {
+	schema *jsonschema.Schema
+}
+
+// newStructuredValidator returns nil when the request does not ask for JSON.
+func newStructuredValidator(rf *llm.ResponseFormat) (*structuredValidator, error) {
+	if !rf.WantsJSON() {
+		return nil, nil
+	}
+
+	raw := []byte(jsonObjectSchema)
+	if rf.Type == llm.ResponseFormatJSONSchema && rf.JSONSchema != nil {
+		raw = rf.JSONSchema.Schema
+	}
+
+	schema, err := jsonschema.Compile(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &structuredValidator{schema: schema}, nil
+}
+
+// check validates every text choice in resp and returns the position in
+// resp.Choices of the first one that fails. Markdown code fences around the
+// JSON are stripped in place, since emulating providers often add them.
+// Choices that only carry tool calls are not checked.
+func (v *structuredValidator) check(resp *llm.ChatResponse) (int, error) {
+	for i := range resp.Choices {
+		msg := &resp.Choices[i].Message
+		if !msg.HasContent() && len(msg.ToolCalls) > 0 {
+			continue
+		}
+
+		text := stripCodeFence(msg.Text())
+		if err := v.schema.ValidateJSON([]byte(text)); err != nil {
+			return i, fmt.Errorf("choice %d: %w", resp.Choices[i].Index, err)
+		}
+		if msg.Parts == nil {
+			msg.Content = text
+		}
+	}
+	return 0, nil
+}
+
+// completeStructured calls the LLM and, if a choice fails validation,
+// re-prompts with that choice and the validation error up to
+// h.StructuredOutputRetries times per choice. With n > 1 only the failing
+// choice is generated again, so the ones that passed are kept. valid
+// reports whether every choice of the returned response passed.
+func (h *ChatHandler) completeStructured(
+	ctx context.Context,
+	req *llm.ChatRequest,
+	v *structuredValidator,
+) (resp *llm.ChatResponse, valid bool, err error) {
+	logger := logging.L(ctx)
+
+	resp, err = h.LLM.ChatCompletion(ctx, req)
+	if err != nil || v == nil {
+		return resp, err == nil, err
+	}
+
+	// The re-prompt conversation of each failing choice, by position.
+	history := make(map[int][]llm.ChatMessage)
+	for {
+		bad, verr := v.check(resp)
+		if verr == nil {
+			return resp, true, nil
+		}
+
+		messages, ok := history[bad]
+		if !ok {
+			messages = req.Messages
+		}
+		attempt := (len(messages) - len(req.Messages)) / 2
+		if attempt >= h.StructuredOutputRetries {
+			logger.Warn("structured_output_invalid",
+				zap.Int("attempts", attempt+1),
+				zap.Error(verr),
+			)
+			return resp, false, nil
+		}
+
+		logger.Info("structured_output_reprompt",
+			zap.Int("attempt", attempt+1),
+			zap.Error(verr),
+		)
+
+		messages = append(messages[:len(messages):len(messages)],
+			llm.ChatMessage{Role: llm.RoleAssistant, Content: resp.Choices[bad].Message.Text()},
+			llm.ChatMessage{Role: llm.RoleUser, Content: "Your previous reply was not valid for the required JSON format: " +
+				verr.Error() + ". Reply again with only the corrected JSON."},
+		)
+		history[bad] = messages
+
+		retryReq := *req
+		retryReq.Messages = messages
+		if len(resp.Choices) == 1 {
+			resp, err = h.LLM.ChatCompletion(ctx, &retryReq)
+			if err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+
+		retryReq.N = 1
+		var retry *llm.ChatResponse
+		retry, err = h.LLM.ChatCompletion(ctx, &retryReq)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(retry.Choices) == 0 {
+			return resp, false, nil
+		}
+		choice := retry.Choices[0]
+		choice.Index = resp.Choices[bad].Index
+		resp.Choices[bad] = choice
+		resp.Usage = addUsage(resp.Usage, retry.Usage)
+	}
+}
+
+// addUsage sums the usage of a response and of a re-prompt merged into it.
+func addUsage(a, b *llm.Usage) *llm.Usage {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return &llm.Usage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+		TotalTokens:      a.TotalTokens + b.TotalTokens,
+	}
+}
+
+// stripCodeFence removes a surrounding ```json ... ``` fence, if present.
+func stripCodeFence(s string) string {
+	t := strings.TrimSpace(s)
+	if !strings.HasPrefix(t, "```") || !strings.HasSuffix(t, "```") || len(t) < 6 {
+		return s
+	}
+	t = strings.TrimSuffix(t[3:], "```")
+	if nl := strings.IndexByte(t, '\n'); nl >= 0 && !strings.ContainsAny(t[:nl], "{[\"") {
+		t = t[nl+1:]
+	}
+	return strings.TrimSpace(t)
+}
@@ -0,0 +1,228 @@
+// Package health serves the readiness probe: registered dependency checks
+// (Redis, upstream reachability, ...) reported as per-check JSON, and a
+// draining flag that takes the gateway out of rotation during shutdown.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overall readiness, the "status" of the /readyz body.
+const (
+	StatusReady    = "ready"
+	StatusDegraded = "degraded"
+	StatusNotReady = "not_ready"
+	StatusDraining = "draining"
+)
+
+// Per-check results.
+const (
+	CheckOK    = "ok"
+	CheckError = "error"
+)
+
+// defaultTimeout bounds each check when Readiness has no timeout set.
+const defaultTimeout = 2 * time.Second
+
+// Check is one dependency check.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Optional checks only degrade readiness when they fail: the gateway
+	// keeps serving, for example without its cache.
+	Optional bool
+}
+
+// CheckResult is the JSON detail of one check.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	Optional  bool    `json:"optional,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Report is the /readyz body.
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Readiness runs the registered checks for each probe.
+type Readiness struct {
+	// Timeout bounds each check; zero uses two seconds.
+	Timeout time.Duration
+
+	mu       sync.RWMutex
+	checks   []Check
+	draining atomic.Bool
+}
+
+func NewReadiness() *Readiness {
+	return &Readiness{}
+}
+
+// Register adds a check. A check with a name already registered replaces
+// it.
+func (r *Readiness) Register(c Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.checks {
+		if r.checks[i].Name == c.Name {
+			r.checks[i] = c
+			return
+		}
+	}
+	r.checks = append(r.checks, c)
+}
+
+// SetOptional marks the named checks optional, so their failure degrades
+// readiness instead of failing it.
+func (r *Readiness) SetOptional(names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		for i := range r.checks {
+			if r.checks[i].Name == name {
+				r.checks[i].Optional = true
+			}
+		}
+	}
+}
+
+// StartDrain reports not ready from now on, so load balancers stop sending
+// traffic while open requests finish.
+func (r *Readiness) StartDrain() {
+	r.draining.Store(true)
+}
+
+// Draining reports whether StartDrain was called.
+func (r *Readiness) Draining() bool {
+	return r.draining.Load()
+}
+
+// Evaluate runs every check concurrently and combines the results.
+func (r *Readiness) Evaluate(ctx context.Context) Report {
+	if r.Draining() {
+		return Report{Status: StatusDraining}
+	}
+
+	r.mu.RLock()
+	checks := append([]Check(nil), r.checks...)
+	r.mu.RUnlock()
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c Check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := c.Run(ctx)
+			res := CheckResult{
+				Status:    CheckOK,
+				Optional:  c.Optional,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000.0,
+			}
+			if err != nil {
+				res.Status, res.Error = CheckError, err.Error()
+			}
+			results[i] = res
+		}(i, c)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusReady, Checks: make(map[string]CheckResult, len(checks))}
+	for i, c := range checks {
+		res := results[i]
+		report.Checks[c.Name] = res
+		if res.Status == CheckOK {
+			continue
+		}
+		if !c.Optional {
+			report.Status = StatusNotReady
+		} else if report.Status == StatusReady {
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+// Handler serves /readyz: 200 when ready or degraded, 503 otherwise.
+func (r *Readiness) Handler(w http.ResponseWriter, req *http.Request) {
+	report := r.Evaluate(req.Context())
+
+	status := http.StatusOK
+	if report.Status == StatusNotReady || report.Status == StatusDraining {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// Cached wraps run so it runs at most once per ttl; probes in between get
+// the last result. It is for checks too costly to run on every probe, such
+// as calls to the upstream provider. A stale result is refreshed in the
+// background under timeout while probes keep getting it; only the first
+// probe waits, for the result or its own ctx.
+func Cached(run func(ctx context.Context) error, ttl, timeout time.Duration) func(ctx context.Context) error {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	var (
+		mu      sync.Mutex
+		checked time.Time
+		last    error
+		// refreshing is closed when the running refresh ends.
+		refreshing chan struct{}
+	)
+	refresh := func(done chan struct{}) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := run(ctx)
+
+		mu.Lock()
+		last, checked, refreshing = err, time.Now(), nil
+		mu.Unlock()
+		close(done)
+	}
+	return func(ctx context.Context) error {
+		mu.Lock()
+		if !checked.IsZero() && time.Since(checked) < ttl {
+			defer mu.Unlock()
+			return last
+		}
+		if refreshing == nil {
+			refreshing = make(chan struct{})
+			go refresh(refreshing)
+		}
+		done, stale, err := refreshing, !checked.IsZero(), last
+		mu.Unlock()
+
+		if stale {
+			return err
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+}
@@ -0,0 +1,177 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func ok(context.Context) error { return nil }
+
+func failing(context.Context) error { return errors.New("connection refused") }
+
+func probe(t *testing.T, r *Readiness) (int, Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.Handler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	return rec.Code, report
+}
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name       string
+		checks     []Check
+		optional   []string
+		wantCode   int
+		wantStatus string
+	}{
+		{
+			name:       "all ok",
+			checks:     []Check{{Name: "redis", Run: ok}, {Name: "upstream", Run: ok}},
+			wantCode:   http.StatusOK,
+			wantStatus: StatusReady,
+		},
+		{
+			name:       "optional check failing",
+			checks:     []Check{{Name: "redis", Run: failing}, {Name: "upstream", Run: ok}},
+			optional:   []string{"redis"},
+			wantCode:   http.StatusOK,
+			wantStatus: StatusDegraded,
+		},
+		{
+			name:       "required check failing",
+			checks:     []Check{{Name: "redis", Run: failing}, {Name: "upstream", Run: failing}},
+			optional:   []string{"redis"},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: StatusNotReady,
+		},
+		{
+			name:       "no checks",
+			wantCode:   http.StatusOK,
+			wantStatus: StatusReady,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReadiness()
+			for _, c := range tt.checks {
+				r.Register(c)
+			}
+			r.SetOptional(tt.optional)
+
+			code, report := probe(t, r)
+			if code != tt.wantCode || report.Status != tt.wantStatus {
+				t.Fatalf("got %d %q, want %d %q", code, report.Status, tt.wantCode, tt.wantStatus)
+			}
+			if len(report.Checks) != len(tt.checks) {
+				t.Fatalf("checks = %v", report.Checks)
+			}
+			for _, c := range tt.checks {
+				res := report.Checks[c.Name]
+				if (c.Run(context.Background()) == nil) != (res.Status == CheckOK) {
+					t.Errorf("%s: %+v", c.Name, res)
+				}
+				if res.Status == CheckError && res.Error == "" {
+					t.Errorf("%s: failed check has no error detail", c.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestReadinessCheckTimeout(t *testing.T) {
+	r := NewReadiness()
+	r.Timeout = 10 * time.Millisecond
+	r.Register(Check{Name: "slow", Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+
+	code, report := probe(t, r)
+	if code != http.StatusServiceUnavailable || report.Checks["slow"].Status != CheckError {
+		t.Fatalf("got %d %+v", code, report)
+	}
+}
+
+func TestReadinessDraining(t *testing.T) {
+	r := NewReadiness()
+	r.Register(Check{Name: "redis", Run: ok})
+	r.StartDrain()
+
+	code, report := probe(t, r)
+	if code != http.StatusServiceUnavailable || report.Status != StatusDraining {
+		t.Fatalf("got %d %q, want 503 %q", code, report.Status, StatusDraining)
+	}
+}
+
+func TestCached(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	check := Cached(func(ctx context.Context) error {
+		switch calls.Add(1) {
+		case 1:
+			return errors.New("down")
+		case 2:
+			<-release
+		}
+		return ctx.Err()
+	}, 50*time.Millisecond, time.Second)
+
+	for i := 0; i < 3; i++ {
+		if err := check(context.Background()); err == nil {
+			t.Fatalf("probe %d: want the cached error", i)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("calls = %d, want 1", n)
+	}
+
+	// Past the ttl, probes get the stale result while one refresh runs.
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := check(context.Background()); err == nil {
+			t.Fatalf("stale probe %d: want the cached error", i)
+		}
+	}
+	close(release)
+
+	deadline := time.Now().Add(time.Second)
+	for check(context.Background()) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("refreshed result was never served")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("calls = %d, want 2", n)
+	}
+}
+
+func TestCachedFirstProbeGivesUpAlone(t *testing.T) {
+	release := make(chan struct{})
+	check := Cached(func(ctx context.Context) error {
+		<-release
+		return ctx.Err()
+	}, time.Minute, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := check(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("first probe = %v, want its deadline", err)
+	}
+	close(release)
+
+	// The refresh has its own timeout, so the probe giving up did not fail it.
+	if err := check(context.Background()); err != nil {
+		t.Fatalf("refresh failed with the probe: %v", err)
+	}
+}
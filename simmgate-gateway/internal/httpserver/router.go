@@ -3,44 +3,115 @@ package httpserver
 import (
 	"net/http"
 	"net/http/pprof"
-	"time"
 
 	"github.com/go-chi/chi/v5"
 	chimw "github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
 
 	"simmgate-gateway/internal/handlers"
+	"simmgate-gateway/internal/health"
+	"simmgate-gateway/internal/llm"
 	"simmgate-gateway/internal/metrics"
 	"simmgate-gateway/internal/middleware"
+	"simmgate-gateway/internal/tracing"
 )
 
-func SetupRouter(r *chi.Mux, baseLogger *zap.Logger, chatHandler *handlers.ChatHandler) {
+// defaultBodyBytes caps request bodies outside the chat-shaped endpoints,
+// which accept up to llm.MaxPayloadBytes.
+const defaultBodyBytes = 512 * 1024
 
-	r.Use(metrics.Middleware)
+// Handlers groups the endpoint handlers mounted by SetupRouter.
+type Handlers struct {
+	Chat       *handlers.ChatHandler
+	Embeddings *handlers.EmbeddingsHandler
+	Models     *handlers.ModelsHandler
+	Batches    *handlers.BatchHandler
+	// Async enables "Prefer: respond-async"; nil disables it.
+	Async *handlers.AsyncHandler
+	// Realtime serves the WebSocket endpoint; nil disables it.
+	Realtime *handlers.RealtimeHandler
+	// Readiness serves /readyz; nil disables it.
+	Readiness *health.Readiness
+	// Drain counts API requests and refuses new ones during shutdown; nil
+	// disables it.
+	Drain *middleware.Drain
+}
+
+func SetupRouter(r *chi.Mux, baseLogger *zap.Logger, h Handlers, timeouts middleware.Timeouts) {
 
 	// base middleware
 	r.Use(chimw.RequestID)
 	r.Use(chimw.RealIP)
+	r.Use(tracing.Middleware) // server span; continues inbound traceparent
+	r.Use(metrics.Middleware) // after both, so exemplars carry request and trace IDs
 
 	r.Use(middleware.LoggingContext(baseLogger))
-	r.Use(middleware.Recoverer())               // panic recovery
-	r.Use(middleware.Timeout(15 * time.Second)) // request timeout
-	r.Use(middleware.MaxBodySize(512 * 1024))   // 512 KB max body
+	r.Use(middleware.Recoverer()) // panic recovery
+
+	// The WebSocket outlives any request timeout and bounds each request
+	// it carries itself.
+	if h.Realtime != nil {
+		r.Get("/v1/realtime/chat", h.Realtime.Connect)
+	}
 
 	// routes
 	r.Route("/v1", func(r chi.Router) {
-		r.Post("/chat/completions", chatHandler.ChatCompletion)
-	})
+		if h.Drain != nil {
+			r.Use(h.Drain.Middleware) // 503 once shutdown starts; probes stay reachable
+		}
+
+		// Batch uploads may take longer than any request deadline; the
+		// handler lifts the server deadlines and applies its own body limit.
+		r.Post("/batches", h.Batches.Create)
+
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.Timeout(timeouts)) // non-stream deadline; streams switch to their own limits
+
+			r.Group(func(r chi.Router) {
+				// Room for base64 image/audio parts, and for embedding
+				// requests batching many inputs.
+				r.Use(middleware.MaxBodySize(llm.MaxPayloadBytes))
 
-	// health check
-	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
+				r.Post("/chat/completions", h.Async.Wrap(h.Chat.ChatCompletion))
+				r.Post("/completions", h.Async.Wrap(h.Chat.Completion))
+				r.Post("/messages", h.Async.Wrap(h.Chat.Messages))
+				r.Post("/responses", h.Async.Wrap(h.Chat.Responses))
+				r.Post("/embeddings", h.Async.Wrap(h.Embeddings.Embeddings))
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.MaxBodySize(defaultBodyBytes))
+
+				r.Get("/models", h.Models.ListModels)
+
+				r.Get("/batches/{id}", h.Batches.Get)
+				r.Get("/batches/{id}/output", h.Batches.Output)
+				r.Post("/batches/{id}/cancel", h.Batches.Cancel)
+
+				if h.Async != nil {
+					r.Get("/async/{id}", h.Async.Get)
+				}
+			})
+		})
 	})
 
-	r.Handle("/metrics", metrics.Handler())
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(timeouts))
+		r.Use(middleware.MaxBodySize(defaultBodyBytes))
 
-	registerPprof(r)
+		// health check
+		r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("ok"))
+		})
+		if h.Readiness != nil {
+			r.Get("/readyz", h.Readiness.Handler)
+		}
+
+		r.Handle("/metrics", metrics.Handler())
+
+		registerPprof(r)
+	})
 }
 
 func registerPprof(r chi.Router) {
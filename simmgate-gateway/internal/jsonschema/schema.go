@@ -0,0 +1,281 @@
+// Package jsonschema validates JSON documents against the subset of JSON
+// Schema used by OpenAI structured outputs: type, properties, required,
+// additionalProperties, items, enum, const, string/number/array bounds,
+// pattern, allOf/anyOf/oneOf/not and local $ref into $defs/definitions.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is a compiled JSON Schema node.
+type Schema struct {
+	types []string
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema // nil = allowed
+	noAdditional         bool    // additionalProperties: false
+
+	items *Schema
+
+	enum     []interface{}
+	constVal *interface{}
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+
+	minItems, maxItems *int
+	uniqueItems        bool
+
+	allOf, anyOf, oneOf []*Schema
+	not                 *Schema
+
+	ref  string
+	root *Schema
+	// Only populated on the root: defs is keyed by the JSON pointer of each
+	// definition ("#/$defs/name", "#/properties/a/$defs/name"), refs maps
+	// every $ref used to where it was first seen.
+	defs map[string]*Schema
+	refs map[string]string
+
+	alwaysFalse bool
+}
+
+// Compile parses raw into a Schema.
+func Compile(raw []byte) (*Schema, error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("jsonschema: parse: %w", err)
+	}
+
+	root := &Schema{}
+	if err := root.compile(doc, root, "#"); err != nil {
+		return nil, err
+	}
+
+	// Definitions may follow the $ref that uses them, so refs are resolved
+	// once the whole document is compiled.
+	refs := make([]string, 0, len(root.refs))
+	for ref := range root.refs {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		if ref != "#" && root.defs[ref] == nil {
+			return nil, fmt.Errorf("jsonschema: %s: unresolved $ref %q", root.refs[ref], ref)
+		}
+	}
+	return root, nil
+}
+
+func (s *Schema) compile(doc interface{}, root *Schema, path string) error {
+	s.root = root
+
+	switch v := doc.(type) {
+	case bool:
+		s.alwaysFalse = !v
+		return nil
+	case map[string]interface{}:
+		return s.compileObject(v, root, path)
+	default:
+		return fmt.Errorf("jsonschema: %s: schema must be an object or boolean", path)
+	}
+}
+
+func (s *Schema) compileObject(m map[string]interface{}, root *Schema, path string) error {
+	sub := func(key string, v interface{}) (*Schema, error) {
+		child := &Schema{}
+		if err := child.compile(v, root, path+"/"+key); err != nil {
+			return nil, err
+		}
+		return child, nil
+	}
+	subList := func(key string, v interface{}) ([]*Schema, error) {
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("jsonschema: %s/%s must be an array", path, key)
+		}
+		out := make([]*Schema, 0, len(arr))
+		for i, item := range arr {
+			child, err := sub(fmt.Sprintf("%s/%d", key, i), item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, child)
+		}
+		return out, nil
+	}
+
+	for _, defsKey := range []string{"$defs", "definitions"} {
+		defs, ok := m[defsKey].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if root.defs == nil {
+			root.defs = make(map[string]*Schema)
+		}
+		for _, name := range sortedKeys(defs) {
+			key := defsKey + "/" + escapePointer(name)
+			child, err := sub(key, defs[name])
+			if err != nil {
+				return err
+			}
+			root.defs[path+"/"+key] = child
+		}
+	}
+
+	var err error
+	for _, key := range sortedKeys(m) {
+		v := m[key]
+		switch key {
+		case "type":
+			switch t := v.(type) {
+			case string:
+				s.types = []string{t}
+			case []interface{}:
+				for _, x := range t {
+					if str, ok := x.(string); ok {
+						s.types = append(s.types, str)
+					}
+				}
+			}
+		case "properties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("jsonschema: %s/properties must be an object", path)
+			}
+			s.properties = make(map[string]*Schema, len(props))
+			for _, name := range sortedKeys(props) {
+				if s.properties[name], err = sub("properties/"+escapePointer(name), props[name]); err != nil {
+					return err
+				}
+			}
+		case "required":
+			arr, _ := v.([]interface{})
+			for _, x := range arr {
+				if str, ok := x.(string); ok {
+					s.required = append(s.required, str)
+				}
+			}
+		case "additionalProperties":
+			if b, ok := v.(bool); ok {
+				s.noAdditional = !b
+			} else if s.additionalProperties, err = sub(key, v); err != nil {
+				return err
+			}
+		case "items":
+			if s.items, err = sub(key, v); err != nil {
+				return err
+			}
+		case "enum":
+			arr, ok := v.([]interface{})
+			if !ok {
+				return fmt.Errorf("jsonschema: %s/enum must be an array", path)
+			}
+			s.enum = arr
+		case "const":
+			c := v
+			s.constVal = &c
+		case "minLength":
+			s.minLength = intPtr(v)
+		case "maxLength":
+			s.maxLength = intPtr(v)
+		case "pattern":
+			str, _ := v.(string)
+			if s.pattern, err = regexp.Compile(str); err != nil {
+				return fmt.Errorf("jsonschema: %s/pattern: %w", path, err)
+			}
+		case "minimum":
+			s.minimum = floatPtr(v)
+		case "maximum":
+			s.maximum = floatPtr(v)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum = floatPtr(v)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum = floatPtr(v)
+		case "minItems":
+			s.minItems = intPtr(v)
+		case "maxItems":
+			s.maxItems = intPtr(v)
+		case "uniqueItems":
+			s.uniqueItems, _ = v.(bool)
+		case "allOf":
+			if s.allOf, err = subList(key, v); err != nil {
+				return err
+			}
+		case "anyOf":
+			if s.anyOf, err = subList(key, v); err != nil {
+				return err
+			}
+		case "oneOf":
+			if s.oneOf, err = subList(key, v); err != nil {
+				return err
+			}
+		case "not":
+			if s.not, err = sub(key, v); err != nil {
+				return err
+			}
+		case "$ref":
+			str, _ := v.(string)
+			if str != "#" && !strings.HasPrefix(str, "#/") {
+				return fmt.Errorf("jsonschema: %s: only local $ref is supported, got %q", path, str)
+			}
+			s.ref = str
+			if root.refs == nil {
+				root.refs = make(map[string]string)
+			}
+			if _, seen := root.refs[str]; !seen {
+				root.refs[str] = path
+			}
+		}
+	}
+
+	return nil
+}
+
+// sortedKeys returns the keys of m in order, so compile and validation
+// errors do not depend on map iteration.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func intPtr(v interface{}) *int {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil
+	}
+	i, err := n.Int64()
+	if err != nil {
+		return nil
+	}
+	out := int(i)
+	return &out
+}
+
+func floatPtr(v interface{}) *float64 {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil
+	}
+	return &f
+}
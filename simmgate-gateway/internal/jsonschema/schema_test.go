@@ -0,0 +1,115 @@
+package jsonschema
+
+import "testing"
+
+func TestValidateJSON(t *testing.T) {
+	schema, err := Compile([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "uniqueItems": true},
+			"kind": {"enum": ["a", "b"]},
+			"extra": {"anyOf": [{"type": "null"}, {"type": "number"}]}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"$defs": {"tag": {"type": "string", "pattern": "^[a-z]+$"}}
+	}`))
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	cases := []struct {
+		doc   string
+		valid bool
+	}{
+		{`{"name":"ann","age":3}`, true},
+		{`{"name":"ann","age":3,"tags":["x","y"],"kind":"a","extra":null}`, true},
+		{`{"name":"ann","age":3,"extra":1.5}`, true},
+		{`{"name":"ann"}`, false},
+		{`{"name":"","age":3}`, false},
+		{`{"name":"ann","age":3.5}`, false},
+		{`{"name":"ann","age":-1}`, false},
+		{`{"name":"ann","age":3,"tags":["x","x"]}`, false},
+		{`{"name":"ann","age":3,"tags":["X"]}`, false},
+		{`{"name":"ann","age":3,"kind":"c"}`, false},
+		{`{"name":"ann","age":3,"extra":"s"}`, false},
+		{`{"name":"ann","age":3,"other":1}`, false},
+		{`[1,2]`, false},
+		{`not json`, false},
+	}
+
+	for _, tc := range cases {
+		err := schema.ValidateJSON([]byte(tc.doc))
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.doc, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected validation error", tc.doc)
+		}
+	}
+}
+
+func TestValidationErrorPath(t *testing.T) {
+	schema, err := Compile([]byte(`{"type":"object","properties":{"items":{"type":"array","items":{"type":"string"}}}}`))
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	err = schema.ValidateJSON([]byte(`{"items":["a",2]}`))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected *ValidationError, got %T: %v", err, err)
+	}
+	if verr.Path != "/items/1" {
+		t.Fatalf("unexpected path: %s", verr.Path)
+	}
+}
+
+func TestCompileRefs(t *testing.T) {
+	// Definitions with the same name in different places stay apart.
+	schema, err := Compile([]byte(`{
+		"type": "object",
+		"properties": {
+			"a": {"$ref": "#/properties/a/$defs/item", "$defs": {"item": {"type": "string"}}},
+			"b": {"$ref": "#/properties/b/$defs/item", "$defs": {"item": {"type": "integer"}}},
+			"c": {"$ref": "#/$defs/item"}
+		},
+		"$defs": {"item": {"type": "boolean"}}
+	}`))
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	if err := schema.ValidateJSON([]byte(`{"a":"x","b":1,"c":true}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, doc := range []string{`{"a":1}`, `{"b":"x"}`, `{"c":"x"}`} {
+		if schema.ValidateJSON([]byte(doc)) == nil {
+			t.Errorf("%s: expected validation error", doc)
+		}
+	}
+
+	for _, raw := range []string{
+		`{"$ref": "#/$defs/missing"}`,
+		`{"$ref": "#/properties/a"}`,
+		`{"$ref": "other.json#/$defs/a"}`,
+	} {
+		if _, err := Compile([]byte(raw)); err == nil {
+			t.Errorf("%s: expected compile error", raw)
+		}
+	}
+}
+
+func TestValidationErrorsAreStable(t *testing.T) {
+	schema, err := Compile([]byte(`{"type":"object","additionalProperties":false}`))
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		err := schema.ValidateJSON([]byte(`{"d":1,"c":2,"b":3,"a":4}`))
+		if err == nil || err.Error() != `/: additional property "a" is not allowed` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
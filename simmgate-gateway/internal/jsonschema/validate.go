@@ -0,0 +1,318 @@
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxRefDepth bounds $ref chains so a self-referencing schema cannot loop.
+const maxRefDepth = 64
+
+// ValidationError describes the first violation found, with a JSON pointer
+// to the offending value.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidateJSON parses data and validates it against s.
+func (s *Schema) ValidateJSON(data []byte) error {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return &ValidationError{Path: "/", Message: "invalid JSON: " + err.Error()}
+	}
+	if dec.More() {
+		return &ValidationError{Path: "/", Message: "invalid JSON: trailing data"}
+	}
+	return s.Validate(v)
+}
+
+// Validate checks a value decoded with json.Decoder.UseNumber.
+func (s *Schema) Validate(v interface{}) error {
+	return s.validate(v, "", 0)
+}
+
+func (s *Schema) validate(v interface{}, path string, depth int) error {
+	fail := func(format string, args ...interface{}) error {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		return &ValidationError{Path: p, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if s.alwaysFalse {
+		return fail("no value is allowed here")
+	}
+
+	if s.ref != "" {
+		if depth >= maxRefDepth {
+			return fail("$ref nesting too deep")
+		}
+		target := s.root
+		if s.ref != "#" {
+			target = s.root.defs[s.ref]
+		}
+		if target == nil {
+			return fail("unresolved $ref %q", s.ref)
+		}
+		if err := target.validate(v, path, depth+1); err != nil {
+			return err
+		}
+	}
+
+	if len(s.types) > 0 && !matchesAnyType(v, s.types) {
+		return fail("expected type %s, got %s", strings.Join(s.types, " or "), typeName(v))
+	}
+
+	if len(s.enum) > 0 {
+		found := false
+		for _, e := range s.enum {
+			if jsonEqual(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("value is not one of the allowed enum values")
+		}
+	}
+	if s.constVal != nil && !jsonEqual(v, *s.constVal) {
+		return fail("value does not match const")
+	}
+
+	switch val := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(val)
+		if s.minLength != nil && n < *s.minLength {
+			return fail("string shorter than minLength %d", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fail("string longer than maxLength %d", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			return fail("string does not match pattern %q", s.pattern.String())
+		}
+
+	case json.Number:
+		f, _ := val.Float64()
+		if s.minimum != nil && f < *s.minimum {
+			return fail("number below minimum %v", *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			return fail("number above maximum %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+			return fail("number not above exclusiveMinimum %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+			return fail("number not below exclusiveMaximum %v", *s.exclusiveMaximum)
+		}
+
+	case []interface{}:
+		if s.minItems != nil && len(val) < *s.minItems {
+			return fail("array has fewer than minItems %d", *s.minItems)
+		}
+		if s.maxItems != nil && len(val) > *s.maxItems {
+			return fail("array has more than maxItems %d", *s.maxItems)
+		}
+		if s.uniqueItems {
+			for i := range val {
+				for j := i + 1; j < len(val); j++ {
+					if jsonEqual(val[i], val[j]) {
+						return fail("array items %d and %d are not unique", i, j)
+					}
+				}
+			}
+		}
+		if s.items != nil {
+			for i, item := range val {
+				if err := s.items.validate(item, fmt.Sprintf("%s/%d", path, i), depth); err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := val[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		for _, name := range sortedKeys(val) {
+			item := val[name]
+			childPath := path + "/" + escapePointer(name)
+			if ps, ok := s.properties[name]; ok {
+				if err := ps.validate(item, childPath, depth); err != nil {
+					return err
+				}
+				continue
+			}
+			if s.noAdditional {
+				return fail("additional property %q is not allowed", name)
+			}
+			if s.additionalProperties != nil {
+				if err := s.additionalProperties.validate(item, childPath, depth); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, path, depth); err != nil {
+			return err
+		}
+	}
+	if len(s.anyOf) > 0 {
+		var firstErr error
+		ok := false
+		for _, sub := range s.anyOf {
+			err := sub.validate(v, path, depth)
+			if err == nil {
+				ok = true
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if !ok {
+			return fail("value does not match any anyOf schema (first error: %v)", firstErr)
+		}
+	}
+	if len(s.oneOf) > 0 {
+		matches := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, path, depth) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("value matches %d oneOf schemas, expected exactly 1", matches)
+		}
+	}
+	if s.not != nil && s.not.validate(v, path, depth) == nil {
+		return fail("value must not match the \"not\" schema")
+	}
+
+	return nil
+}
+
+func matchesAnyType(v interface{}, types []string) bool {
+	for _, t := range types {
+		if matchesType(v, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(v interface{}, t string) bool {
+	switch t {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	default:
+		return false
+	}
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// jsonEqual compares decoded JSON values, treating numbers numerically.
+func jsonEqual(a, b interface{}) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, err1 := an.Float64()
+		bf, err2 := bn.Float64()
+		return err1 == nil && err2 == nil && af == bf
+	}
+	if aok != bok {
+		return false
+	}
+
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, x := range av {
+			y, ok := bv[k]
+			if !ok || !jsonEqual(x, y) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// escapePointer escapes a property name for use in a JSON pointer.
+func escapePointer(s string) string {
+	s = strings.ReplaceAll(s, "~", "~0")
+	return strings.ReplaceAll(s, "/", "~1")
+}
@@ -11,7 +11,17 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
 	"go.uber.org/zap/zaptest"
+
+	"simmgate-gateway/internal/metrics"
 )
 
 func TestNewClientValidation(t *testing.T) {
@@ -146,6 +156,42 @@ func TestChatCompletionValidationError(t *testing.T) {
 	}
 }
 
+func TestChatCompletionUpstreamError(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"message":"bad key","type":"invalid_request_error","param":null,"code":"invalid_api_key"}}`)
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(Config{
+		BaseURL: srv.URL,
+		APIKey:  "key",
+	}, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer closeClient(client)
+
+	_, err = client.ChatCompletion(context.Background(), &ChatRequest{
+		Model:    "gpt-4",
+		Messages: []ChatMessage{{Role: RoleUser, Content: "ping"}},
+	})
+
+	ue, ok := AsUpstreamError(err)
+	if !ok {
+		t.Fatalf("expected *UpstreamError, got %T: %v", err, err)
+	}
+	if ue.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", ue.StatusCode)
+	}
+	if ue.Type != "invalid_request_error" || ue.Code != "invalid_api_key" || ue.Message != "bad key" {
+		t.Fatalf("unexpected error fields: %#v", ue)
+	}
+}
+
 func TestChatCompletionStream(t *testing.T) {
 	t.Parallel()
 
@@ -167,8 +213,10 @@ func TestChatCompletionStream(t *testing.T) {
 		}
 
 		chunks := []string{
-			`{"choices":[{"index":0,"delta":{"content":"hel"}}]}`,
-			`{"choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+			`{"id":"chatcmpl-9","model":"gpt-4o","created":1700000000,"choices":[{"index":0,"delta":{"role":"assistant"}}]}`,
+			`{"id":"chatcmpl-9","choices":[{"index":0,"delta":{"content":"hel"}}]}`,
+			`{"id":"chatcmpl-9","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+			`{"id":"chatcmpl-9","choices":[],"usage":{"prompt_tokens":4,"completion_tokens":2,"total_tokens":6}}`,
 		}
 
 		for _, chunk := range chunks {
@@ -205,7 +253,8 @@ func TestChatCompletionStream(t *testing.T) {
 	}
 
 	var deltas strings.Builder
-	var finishReason string
+	var finishReason, role, id string
+	var usage *Usage
 
 	for res := range stream {
 		if res.Err != nil {
@@ -215,6 +264,14 @@ func TestChatCompletionStream(t *testing.T) {
 			continue
 		}
 
+		if res.Chunk.Usage != nil {
+			usage = res.Chunk.Usage
+			continue
+		}
+		if res.Chunk.Role != "" {
+			role = res.Chunk.Role
+			id = res.Chunk.ID
+		}
 		deltas.WriteString(res.Chunk.Delta)
 		if res.Chunk.FinishReason != "" {
 			finishReason = res.Chunk.FinishReason
@@ -224,6 +281,12 @@ func TestChatCompletionStream(t *testing.T) {
 	if !gotReq.Stream {
 		t.Fatalf("stream requests must set stream=true")
 	}
+	if gotReq.StreamOptions == nil || !gotReq.StreamOptions.IncludeUsage {
+		t.Fatalf("stream requests must ask for usage, got %+v", gotReq.StreamOptions)
+	}
+	if req.StreamOptions != nil {
+		t.Fatalf("the caller's request was modified: %+v", req.StreamOptions)
+	}
 	if gotReq.Model != req.Model {
 		t.Fatalf("expected model %s, got %s", req.Model, gotReq.Model)
 	}
@@ -237,6 +300,90 @@ func TestChatCompletionStream(t *testing.T) {
 	if finishReason != "stop" {
 		t.Fatalf("unexpected finish reason: %s", finishReason)
 	}
+	if role != RoleAssistant || id != "chatcmpl-9" {
+		t.Fatalf("unexpected role chunk: role=%q id=%q", role, id)
+	}
+	if usage == nil || usage.TotalTokens != 6 {
+		t.Fatalf("usage chunk not mapped: %#v", usage)
+	}
+}
+
+func TestChatMessageContentRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		`{"role":"user","content":"hello"}`,
+		`{"role":"user","content":[{"type":"text","text":"what is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA","detail":"low"}}]}`,
+		`{"role":"user","content":[{"type":"input_audio","input_audio":{"data":"UklGR","format":"wav"}}]}`,
+		`{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]}`,
+	}
+
+	for _, in := range cases {
+		var m ChatMessage
+		if err := json.Unmarshal([]byte(in), &m); err != nil {
+			t.Fatalf("unmarshal %s: %v", in, err)
+		}
+		out, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("marshal %s: %v", in, err)
+		}
+		if string(out) != in {
+			t.Fatalf("round trip mismatch:\n got: %s\nwant: %s", out, in)
+		}
+	}
+
+	var bad ChatMessage
+	if err := json.Unmarshal([]byte(`{"role":"user","content":42}`), &bad); err == nil {
+		t.Fatalf("expected error for numeric content")
+	}
+}
+
+func TestChatRequestExtraFieldsPassThrough(t *testing.T) {
+	t.Parallel()
+
+	var got map[string]json.RawMessage
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("decode body: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"x","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(Config{
+		BaseURL:         srv.URL,
+		APIKey:          "key",
+		ExtraFieldsDeny: []string{"user"},
+	}, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer closeClient(client)
+
+	var req ChatRequest
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"seed":7,"logit_bias":{"50256":-100},"user":"u-1"}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("unmarshal request: %v", err)
+	}
+	if len(req.Extra) != 3 {
+		t.Fatalf("expected 3 extra fields, got %v", req.Extra)
+	}
+
+	if _, err := client.ChatCompletion(context.Background(), &req); err != nil {
+		t.Fatalf("ChatCompletion: %v", err)
+	}
+
+	if string(got["seed"]) != "7" || string(got["logit_bias"]) != `{"50256":-100}` {
+		t.Fatalf("extra fields not forwarded: %v", got)
+	}
+	if _, ok := got["user"]; ok {
+		t.Fatalf("denied field was forwarded: %v", got)
+	}
+	if string(got["model"]) != `"gpt-4"` {
+		t.Fatalf("typed fields missing: %v", got)
+	}
 }
 
 func closeClient(c Client) {
@@ -244,3 +391,281 @@ func closeClient(c Client) {
 		_ = closer.Close()
 	}
 }
+
+func TestChatCompletionStreamOutlivesUpstreamTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: {\"id\":\"c\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"x\"}}]}\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(Config{
+		BaseURL:         srv.URL,
+		APIKey:          "k",
+		UpstreamTimeout: 50 * time.Millisecond,
+	}, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer closeClient(client)
+
+	stream, err := client.ChatCompletionStream(context.Background(), &ChatRequest{
+		Model:    "gpt-4o",
+		Messages: []ChatMessage{{Role: RoleUser, Content: "hello"}},
+	})
+	if err != nil {
+		t.Fatalf("ChatCompletionStream: %v", err)
+	}
+
+	var got string
+	for res := range stream {
+		if res.Err != nil {
+			t.Fatalf("stream error: %v", res.Err)
+		}
+		got += res.Chunk.Delta
+	}
+	if got != "xxx" {
+		t.Fatalf("expected the whole stream past UpstreamTimeout, got %q", got)
+	}
+}
+
+func TestChatCompletionTracing(t *testing.T) {
+	// Not parallel: it swaps the global tracer provider.
+	sr := tracetest.NewSpanRecorder()
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+
+	var traceparents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		if len(traceparents) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4-0613",`+
+			`"choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],`+
+			`"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`)
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(Config{
+		BaseURL:     srv.URL,
+		APIKey:      "key",
+		BaseBackoff: time.Millisecond,
+	}, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer closeClient(client)
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	_, err = client.ChatCompletion(ctx, &ChatRequest{
+		Model:    "gpt-4",
+		Messages: []ChatMessage{{Role: RoleUser, Content: "ping"}},
+	})
+	parent.End()
+	if err != nil {
+		t.Fatalf("ChatCompletion: %v", err)
+	}
+
+	traceID := parent.SpanContext().TraceID().String()
+	if len(traceparents) != 2 {
+		t.Fatalf("upstream calls = %d, want 2", len(traceparents))
+	}
+	for i, tp := range traceparents {
+		if !strings.Contains(tp, traceID) {
+			t.Errorf("attempt %d traceparent = %q, want trace %s", i, tp, traceID)
+		}
+	}
+
+	var chat sdktrace.ReadOnlySpan
+	var attempts []sdktrace.ReadOnlySpan
+	for _, s := range sr.Ended() {
+		switch s.Name() {
+		case "chat gpt-4":
+			chat = s
+		case http.MethodPost:
+			attempts = append(attempts, s)
+		}
+	}
+	if chat == nil {
+		t.Fatalf("no chat span among %d spans", len(sr.Ended()))
+	}
+	if chat.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("chat span is not a child of the request span")
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range chat.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if got := attrs[semconv.GenAIResponseModelKey].AsString(); got != "gpt-4-0613" {
+		t.Errorf("gen_ai.response.model = %q", got)
+	}
+	if got := attrs[semconv.GenAIUsageOutputTokensKey].AsInt64(); got != 2 {
+		t.Errorf("gen_ai.usage.output_tokens = %d", got)
+	}
+
+	if len(attempts) != 2 {
+		t.Fatalf("attempt spans = %d, want 2", len(attempts))
+	}
+	for _, a := range attempts {
+		if a.Parent().SpanID() != chat.SpanContext().SpanID() {
+			t.Errorf("attempt span is not a child of the chat span")
+		}
+	}
+}
+
+func TestChatCompletionMetrics(t *testing.T) {
+	t.Parallel()
+
+	// A model name of its own keeps the series apart from other tests.
+	const model = "metrics-test-model"
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"id":"chatcmpl-1","object":"chat.completion","model":"`+model+`",`+
+				`"choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],`+
+				`"usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}`)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"message":"bad","type":"invalid_request_error"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(Config{
+		BaseURL:      srv.URL,
+		APIKey:       "key",
+		ProviderName: "metrics-test",
+		BaseBackoff:  time.Millisecond,
+		ModelLabel:   func(m string) string { return m },
+	}, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer closeClient(client)
+
+	req := &ChatRequest{Model: model, Messages: []ChatMessage{{Role: RoleUser, Content: "ping"}}}
+	if _, err := client.ChatCompletion(context.Background(), req); err != nil {
+		t.Fatalf("ChatCompletion: %v", err)
+	}
+	if _, err := client.ChatCompletion(context.Background(), req); err == nil {
+		t.Fatal("expected the second call to fail")
+	}
+
+	for _, tc := range []struct {
+		name string
+		c    prometheus.Collector
+		want float64
+	}{
+		{"ok", metrics.UpstreamRequestsTotal.WithLabelValues("metrics-test", model, "ok"), 1},
+		{"400", metrics.UpstreamRequestsTotal.WithLabelValues("metrics-test", model, "400"), 1},
+		{"retries", metrics.UpstreamRetriesTotal.WithLabelValues("metrics-test", "429"), 1},
+		{"input tokens", metrics.TokensTotal.WithLabelValues("metrics-test", model, metrics.TokensInput), 7},
+		{"output tokens", metrics.TokensTotal.WithLabelValues("metrics-test", model, metrics.TokensOutput), 3},
+	} {
+		if got := testutil.ToFloat64(tc.c); got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestChatCompletionStreamMetrics(t *testing.T) {
+	t.Parallel()
+
+	const model = "stream-metrics-test-model"
+
+	// Like OpenAI, the upstream only reports usage when asked to.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body providerChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"id":"c1","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":"stop"}]}`+"\n\n")
+		if body.StreamOptions != nil && body.StreamOptions.IncludeUsage {
+			fmt.Fprint(w, `data: {"id":"c1","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":1,"total_tokens":6}}`+"\n\n")
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(Config{
+		BaseURL:      srv.URL,
+		APIKey:       "key",
+		ProviderName: "stream-metrics-test",
+		ModelLabel:   func(m string) string { return m },
+	}, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer closeClient(client)
+
+	stream, err := client.ChatCompletionStream(context.Background(), &ChatRequest{
+		Model:    model,
+		Messages: []ChatMessage{{Role: RoleUser, Content: "ping"}},
+	})
+	if err != nil {
+		t.Fatalf("ChatCompletionStream: %v", err)
+	}
+	for res := range stream {
+		if res.Err != nil {
+			t.Fatalf("stream error: %v", res.Err)
+		}
+	}
+
+	if got := testutil.ToFloat64(metrics.TokensTotal.WithLabelValues("stream-metrics-test", model, metrics.TokensInput)); got != 5 {
+		t.Errorf("input tokens = %v, want 5", got)
+	}
+	if got := testutil.ToFloat64(metrics.TokensTotal.WithLabelValues("stream-metrics-test", model, metrics.TokensOutput)); got != 1 {
+		t.Errorf("output tokens = %v, want 1", got)
+	}
+}
+
+func TestPing(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		status  int
+		wantErr bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotFound, false}, // no model list, but reachable
+		{http.StatusUnauthorized, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusBadGateway, true},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+		}))
+		client, err := NewClient(Config{BaseURL: srv.URL, APIKey: "key"}, zaptest.NewLogger(t))
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+
+		err = client.(Pinger).Ping(context.Background())
+		if (err != nil) != tc.wantErr {
+			t.Errorf("status %d: err = %v, want error %v", tc.status, err, tc.wantErr)
+		}
+		closeClient(client)
+		srv.Close()
+	}
+}
@@ -24,6 +24,25 @@ type Config struct {
 	MaxIdleConns        int // default: 100
 	MaxIdleConnsPerHost int // default: 100
 
+	// EmulateResponseFormat is set for providers without native
+	// response_format support: the format is sent as a system instruction
+	// instead and the gateway validates the output.
+	EmulateResponseFormat bool
+
+	// Pass-through of request fields the gateway does not model. If
+	// ExtraFieldsAllow is non-empty only those fields are forwarded;
+	// ExtraFieldsDeny is always removed.
+	ExtraFieldsAllow []string
+	ExtraFieldsDeny  []string
+
+	// ProviderName is reported as gen_ai.provider.name (default: openai).
+	ProviderName string
+
+	// ModelLabel maps a requested model to its metrics label, keeping
+	// client-chosen names out of the series. Nil labels every model as
+	// metrics.ModelOther.
+	ModelLabel func(model string) string
+
 	// Custom HTTP client (for testing or special configs)
 	HTTPClient *http.Client
 }
@@ -61,6 +80,9 @@ func (c *Config) WithDefaults() Config {
 	if cfg.MaxIdleConnsPerHost <= 0 {
 		cfg.MaxIdleConnsPerHost = 100
 	}
+	if cfg.ProviderName == "" {
+		cfg.ProviderName = "openai"
+	}
 
 	return cfg
 }
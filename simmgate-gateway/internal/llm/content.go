@@ -0,0 +1,169 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	ContentPartText       = "text"
+	ContentPartImageURL   = "image_url"
+	ContentPartInputAudio = "input_audio"
+)
+
+// ContentPart is one element of an array-form message content.
+type ContentPart struct {
+	Type       string      `json:"type"`
+	Text       string      `json:"text,omitempty"`
+	ImageURL   *ImageURL   `json:"image_url,omitempty"`
+	InputAudio *InputAudio `json:"input_audio,omitempty"`
+}
+
+// ImageURL is either a remote URL or a base64 data URL.
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// InputAudio is base64-encoded audio with its format ("wav", "mp3").
+type InputAudio struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+}
+
+// chatMessageJSON is the wire shape of ChatMessage; content is decoded
+// lazily because it may be a string, an array of parts or null.
+type chatMessageJSON struct {
+	Role       string          `json:"role"`
+	Content    json.RawMessage `json:"content"`
+	Name       string          `json:"name,omitempty"`
+	ToolCalls  []ToolCall      `json:"tool_calls,omitempty"`
+	ToolCallID string          `json:"tool_call_id,omitempty"`
+}
+
+// UnmarshalJSON accepts string, part-array and null content.
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+	var raw chatMessageJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*m = ChatMessage{
+		Role:       raw.Role,
+		Name:       raw.Name,
+		ToolCalls:  raw.ToolCalls,
+		ToolCallID: raw.ToolCallID,
+	}
+
+	if len(raw.Content) == 0 || string(raw.Content) == "null" {
+		return nil
+	}
+
+	switch raw.Content[0] {
+	case '"':
+		return json.Unmarshal(raw.Content, &m.Content)
+	case '[':
+		var parts []ContentPart
+		if err := json.Unmarshal(raw.Content, &parts); err != nil {
+			return fmt.Errorf("content parts: %w", err)
+		}
+		if parts == nil {
+			parts = []ContentPart{}
+		}
+		m.Parts = parts
+		return nil
+	default:
+		return fmt.Errorf("content must be a string, an array of parts or null")
+	}
+}
+
+// MarshalJSON writes Parts as an array when set, otherwise Content as a
+// string. Assistant tool-call messages without text get content: null.
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+	out := chatMessageJSON{
+		Role:       m.Role,
+		Name:       m.Name,
+		ToolCalls:  m.ToolCalls,
+		ToolCallID: m.ToolCallID,
+	}
+
+	var err error
+	switch {
+	case m.Parts != nil:
+		out.Content, err = json.Marshal(m.Parts)
+	case m.Content == "" && len(m.ToolCalls) > 0:
+		out.Content = json.RawMessage("null")
+	default:
+		out.Content, err = json.Marshal(m.Content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(out)
+}
+
+// HasContent reports whether the message carries any text or parts.
+func (m ChatMessage) HasContent() bool {
+	return m.Content != "" || len(m.Parts) > 0
+}
+
+// Text returns the message text, joining the text parts of array content.
+func (m ChatMessage) Text() string {
+	if m.Parts == nil {
+		return m.Content
+	}
+	var text string
+	for _, p := range m.Parts {
+		if p.Type == ContentPartText {
+			text += p.Text
+		}
+	}
+	return text
+}
+
+// textSize is the number of bytes of text in the message.
+func (m ChatMessage) textSize() int {
+	n := len(m.Content)
+	for _, p := range m.Parts {
+		n += len(p.Text)
+	}
+	return n
+}
+
+// mediaSize is the number of bytes of inline media (base64 data URLs and
+// audio) in the message. Remote image URLs are not counted.
+func (m ChatMessage) mediaSize() int {
+	n := 0
+	for _, p := range m.Parts {
+		if p.ImageURL != nil && isDataURL(p.ImageURL.URL) {
+			n += len(p.ImageURL.URL)
+		}
+		if p.InputAudio != nil {
+			n += len(p.InputAudio.Data)
+		}
+	}
+	return n
+}
+
+func (p ContentPart) validate() error {
+	switch p.Type {
+	case ContentPartText:
+		return nil
+	case ContentPartImageURL:
+		if p.ImageURL == nil || p.ImageURL.URL == "" {
+			return fmt.Errorf("image_url.url is required")
+		}
+	case ContentPartInputAudio:
+		if p.InputAudio == nil || p.InputAudio.Data == "" || p.InputAudio.Format == "" {
+			return fmt.Errorf("input_audio.data and input_audio.format are required")
+		}
+	default:
+		return fmt.Errorf("unsupported content part type %q", p.Type)
+	}
+	return nil
+}
+
+func isDataURL(u string) bool {
+	return len(u) > 5 && u[:5] == "data:"
+}
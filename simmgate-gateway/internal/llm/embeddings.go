@@ -0,0 +1,201 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/tracing"
+)
+
+const (
+	maxEmbeddingInputs    = 2048       // OpenAI per-request input limit
+	maxEmbeddingInputSize = 512 * 1024 // 512KB per input string
+)
+
+// EmbeddingRequest mirrors OpenAI's /v1/embeddings request. Input accepts a
+// single string or an array of strings on the wire; it is always a slice
+// here.
+type EmbeddingRequest struct {
+	Model          string   `json:"model"`
+	Input          []string `json:"input"`
+	EncodingFormat string   `json:"encoding_format,omitempty"` // "float" or "base64"
+	Dimensions     *int     `json:"dimensions,omitempty"`
+	User           string   `json:"user,omitempty"`
+}
+
+func (r *EmbeddingRequest) Validate() error {
+	if r.Model == "" {
+		return errors.New("model is required")
+	}
+	if len(r.Input) == 0 {
+		return errors.New("input is required")
+	}
+	if len(r.Input) > maxEmbeddingInputs {
+		return fmt.Errorf("too many inputs (%d, max %d)", len(r.Input), maxEmbeddingInputs)
+	}
+	for i, in := range r.Input {
+		if in == "" {
+			return fmt.Errorf("input[%d] is empty", i)
+		}
+		if len(in) > maxEmbeddingInputSize {
+			return fmt.Errorf("input[%d] too large (%d bytes, max %d)", i, len(in), maxEmbeddingInputSize)
+		}
+	}
+	switch r.EncodingFormat {
+	case "", "float", "base64":
+	default:
+		return fmt.Errorf("unsupported encoding_format %q", r.EncodingFormat)
+	}
+	return nil
+}
+
+// UnmarshalJSON accepts input as a string or an array of strings.
+func (r *EmbeddingRequest) UnmarshalJSON(data []byte) error {
+	type alias EmbeddingRequest
+	var raw struct {
+		alias
+		Input json.RawMessage `json:"input"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*r = EmbeddingRequest(raw.alias)
+	r.Input = nil
+
+	if len(raw.Input) == 0 || string(raw.Input) == "null" {
+		return nil
+	}
+	if raw.Input[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw.Input, &s); err != nil {
+			return err
+		}
+		r.Input = []string{s}
+		return nil
+	}
+	if err := json.Unmarshal(raw.Input, &r.Input); err != nil {
+		return fmt.Errorf("input must be a string or an array of strings: %w", err)
+	}
+	return nil
+}
+
+// Embedding is one vector. The vector is kept as raw JSON so float arrays
+// and base64 strings pass through (and into the cache) untouched.
+type Embedding struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type EmbeddingResponse struct {
+	Object string         `json:"object"`
+	Data   []Embedding    `json:"data"`
+	Model  string         `json:"model"`
+	Usage  EmbeddingUsage `json:"usage"`
+}
+
+// Embeddings runs embeddings under a GenAI client span.
+func (c *client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
+	if req == nil {
+		return nil, fmt.Errorf("llmclient: request is nil")
+	}
+
+	ctx, span := c.startSpan(ctx, "embeddings", req.Model)
+	resp, err := c.embeddings(ctx, req)
+	var usage *Usage
+	if resp != nil {
+		usage = &Usage{PromptTokens: resp.Usage.PromptTokens}
+		span.SetAttributes(responseAttributes("", resp.Model, nil, usage)...)
+	}
+	c.observeRequest(ctx, req.Model, err, usage)
+	tracing.EndSpan(span, err)
+	return resp, err
+}
+
+func (c *client) embeddings(parentCtx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
+	start := time.Now()
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if c.cfg.UpstreamTimeout > 0 {
+		ctx, cancel = context.WithTimeout(parentCtx, c.cfg.UpstreamTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(parentCtx)
+	}
+	defer cancel()
+
+	bodyBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("llmclient: marshal embeddings request: %w", err)
+	}
+
+	url := c.cfg.BaseURL + "/v1/embeddings"
+
+	doOnce := func(ctx context.Context, body []byte) (*http.Response, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("llmclient: build HTTP request: %w", err)
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+c.cfg.APIKey)
+		tracing.Inject(ctx, httpReq.Header)
+		httpReq.Header.Set("Content-Type", "application/json")
+		return c.httpClient.Do(httpReq)
+	}
+
+	resp, err := c.doWithRetry(ctx, bodyBytes, doOnce)
+	if err != nil {
+		c.logger.Error("llm embeddings request failed",
+			zap.Error(err),
+			zap.Duration("duration", time.Since(start)),
+		)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		uerr := newUpstreamError(resp.StatusCode, body, false)
+
+		c.logger.Error("llm embeddings provider error",
+			zap.Int("status", uerr.StatusCode),
+			zap.String("error_type", uerr.Type),
+			zap.String("error_message", uerr.Message),
+		)
+		return nil, uerr
+	}
+
+	var out EmbeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("llmclient: decode embeddings response: %w", err)
+	}
+	if len(out.Data) != len(req.Input) {
+		return nil, fmt.Errorf("llmclient: provider returned %d embeddings for %d inputs",
+			len(out.Data), len(req.Input))
+	}
+
+	c.logger.Info("llm embeddings request completed",
+		zap.String("model", out.Model),
+		zap.Int("inputs", len(req.Input)),
+		zap.Int("prompt_tokens", out.Usage.PromptTokens),
+		zap.Duration("duration", time.Since(start)),
+	)
+
+	return &out, nil
+}
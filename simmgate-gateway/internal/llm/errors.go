@@ -0,0 +1,93 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ErrInvalidRequest is wrapped by every error caused by a request that
+// failed client-side validation (bad fields, oversized payloads).
+// Callers can map it to a 400 without inspecting the message.
+var ErrInvalidRequest = errors.New("llmclient: invalid request")
+
+// UpstreamError is returned when the provider answers with a non-2xx status.
+// It carries the status and the OpenAI-style error fields so the handler can
+// relay them to the caller instead of collapsing everything into a 502.
+type UpstreamError struct {
+	StatusCode int
+	Type       string
+	Code       string
+	Param      string
+	Message    string
+
+	// Stream is true when the error was returned for a streaming request.
+	Stream bool
+}
+
+func (e *UpstreamError) Error() string {
+	kind := "upstream"
+	if e.Stream {
+		kind = "upstream stream"
+	}
+	if e.Type != "" {
+		return fmt.Sprintf("llmclient: %s %d: %s (%s)", kind, e.StatusCode, e.Message, e.Type)
+	}
+	return fmt.Sprintf("llmclient: %s %d: %s", kind, e.StatusCode, e.Message)
+}
+
+// AsUpstreamError unwraps err into an *UpstreamError if it is one.
+func AsUpstreamError(err error) (*UpstreamError, bool) {
+	var ue *UpstreamError
+	if errors.As(err, &ue) {
+		return ue, true
+	}
+	return nil, false
+}
+
+// invalidRequest wraps a validation failure with ErrInvalidRequest.
+func invalidRequest(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidRequest, fmt.Sprintf(format, args...))
+}
+
+// newUpstreamError builds an *UpstreamError from a non-2xx provider body.
+// Structured OpenAI-style bodies are parsed; anything else is kept as a
+// truncated raw message.
+func newUpstreamError(status int, body []byte, stream bool) *UpstreamError {
+	ue := &UpstreamError{
+		StatusCode: status,
+		Stream:     stream,
+	}
+
+	var perr providerErrorResponse
+	if err := json.Unmarshal(body, &perr); err == nil && perr.Error.Message != "" {
+		ue.Type = perr.Error.Type
+		ue.Code = stringifyCode(perr.Error.Code)
+		ue.Param = stringifyCode(perr.Error.Param)
+		ue.Message = perr.Error.Message
+		return ue
+	}
+
+	ue.Message = truncate(string(body), 200)
+	if ue.Message == "" {
+		ue.Message = http.StatusText(status)
+	}
+	return ue
+}
+
+// stringifyCode normalizes the provider "code"/"param" fields, which may be
+// strings, numbers or null depending on the provider.
+func stringifyCode(v interface{}) string {
+	switch c := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return c
+	case float64:
+		return strconv.FormatFloat(c, 'f', -1, 64)
+	default:
+		return fmt.Sprint(c)
+	}
+}
@@ -0,0 +1,124 @@
+package llm
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// knownRequestFields is the set of top-level JSON keys ChatRequest decodes
+// into typed fields. Everything else is kept in ChatRequest.Extra.
+var knownRequestFields = jsonFieldNames(reflect.TypeOf(ChatRequest{}))
+
+// chatRequestAlias has ChatRequest's fields but none of its methods, so it
+// can be (un)marshaled without recursing into the custom codecs below.
+type chatRequestAlias ChatRequest
+
+// UnmarshalJSON decodes the typed fields and keeps any unknown top-level
+// fields (seed, logit_bias, user, ...) verbatim in Extra.
+func (r *ChatRequest) UnmarshalJSON(data []byte) error {
+	var alias chatRequestAlias
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for k := range all {
+		if knownRequestFields[k] {
+			delete(all, k)
+		}
+	}
+
+	*r = ChatRequest(alias)
+	if len(all) > 0 {
+		r.Extra = all
+	}
+	return nil
+}
+
+// MarshalJSON writes the typed fields followed by Extra. Typed fields win
+// if a key appears in both.
+func (r ChatRequest) MarshalJSON() ([]byte, error) {
+	base, err := json.Marshal(chatRequestAlias(r))
+	if err != nil {
+		return nil, err
+	}
+	return mergeExtra(base, r.Extra)
+}
+
+// MarshalJSON adds the allowed extra fields to the provider request body.
+func (p providerChatRequest) MarshalJSON() ([]byte, error) {
+	type alias providerChatRequest
+	base, err := json.Marshal(alias(p))
+	if err != nil {
+		return nil, err
+	}
+	return mergeExtra(base, p.Extra)
+}
+
+// filterExtra applies the provider allow/deny lists to extra fields. An
+// empty allow list allows everything not denied.
+func filterExtra(extra map[string]json.RawMessage, allow, deny []string) map[string]json.RawMessage {
+	if len(extra) == 0 {
+		return nil
+	}
+
+	out := make(map[string]json.RawMessage, len(extra))
+	for k, v := range extra {
+		if len(allow) > 0 && !contains(allow, k) {
+			continue
+		}
+		if contains(deny, k) {
+			continue
+		}
+		out[k] = v
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// mergeExtra adds extra keys to the JSON object base without overwriting
+// existing keys.
+func mergeExtra(base []byte, extra map[string]json.RawMessage) ([]byte, error) {
+	if len(extra) == 0 {
+		return base, nil
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(base, &obj); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		if _, exists := obj[k]; !exists {
+			obj[k] = v
+		}
+	}
+	return json.Marshal(obj)
+}
+
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		names[name] = true
+	}
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
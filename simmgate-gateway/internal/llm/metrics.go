@@ -0,0 +1,59 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"simmgate-gateway/internal/metrics"
+)
+
+// observeRequest counts a finished provider call and the tokens it used.
+// Requests refused before reaching the provider are not counted.
+func (c *client) observeRequest(ctx context.Context, model string, err error, usage *Usage) {
+	if errors.Is(err, ErrInvalidRequest) {
+		return
+	}
+	metrics.Add(ctx, metrics.UpstreamRequestsTotal.WithLabelValues(c.cfg.ProviderName, c.modelLabel(model), upstreamStatus(err)), 1)
+	c.observeTokens(ctx, model, usage)
+}
+
+// observeTokens counts the tokens of usage, if the provider reported any.
+func (c *client) observeTokens(ctx context.Context, model string, usage *Usage) {
+	if usage == nil {
+		return
+	}
+	model = c.modelLabel(model)
+	if usage.PromptTokens > 0 {
+		metrics.Add(ctx, metrics.TokensTotal.WithLabelValues(c.cfg.ProviderName, model, metrics.TokensInput), float64(usage.PromptTokens))
+	}
+	if usage.CompletionTokens > 0 {
+		metrics.Add(ctx, metrics.TokensTotal.WithLabelValues(c.cfg.ProviderName, model, metrics.TokensOutput), float64(usage.CompletionTokens))
+	}
+}
+
+// modelLabel is the model label of provider metrics, see Config.ModelLabel.
+func (c *client) modelLabel(model string) string {
+	if c.cfg.ModelLabel == nil {
+		return metrics.ModelOther
+	}
+	return c.cfg.ModelLabel(model)
+}
+
+// upstreamStatus is the status label of a provider call: ok, the
+// provider's HTTP status, timeout, canceled or error.
+func upstreamStatus(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if ue, ok := AsUpstreamError(err); ok {
+		return strconv.Itoa(ue.StatusCode)
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "error"
+}
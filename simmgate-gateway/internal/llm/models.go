@@ -0,0 +1,105 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"simmgate-gateway/internal/tracing"
+)
+
+// ModelInfo is one entry of a provider's /v1/models list.
+type ModelInfo struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// ModelLister is implemented by clients whose provider exposes a model list
+// endpoint. It is optional: callers type-assert a Client to it.
+type ModelLister interface {
+	ListModels(ctx context.Context) ([]ModelInfo, error)
+}
+
+type providerModelList struct {
+	Object string      `json:"object"`
+	Data   []ModelInfo `json:"data"`
+}
+
+// ListModels fetches the provider's model list.
+func (c *client) ListModels(parentCtx context.Context) ([]ModelInfo, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if c.cfg.UpstreamTimeout > 0 {
+		ctx, cancel = context.WithTimeout(parentCtx, c.cfg.UpstreamTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(parentCtx)
+	}
+	defer cancel()
+
+	url := c.cfg.BaseURL + "/v1/models"
+
+	doOnce := func(ctx context.Context, _ []byte) (*http.Response, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("llmclient: build HTTP request: %w", err)
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+c.cfg.APIKey)
+		tracing.Inject(ctx, httpReq.Header)
+		return c.httpClient.Do(httpReq)
+	}
+
+	resp, err := c.doWithRetry(ctx, nil, doOnce)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, newUpstreamError(resp.StatusCode, body, false)
+	}
+
+	var list providerModelList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("llmclient: decode model list: %w", err)
+	}
+	return list.Data, nil
+}
+
+// Pinger is implemented by clients that can check the provider is
+// reachable. Like ModelLister, it is optional.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping requests the provider's model list once, without retries. Any answer
+// counts as reachable except a 5xx, a rate limit or a rejected API key,
+// which would fail real requests too.
+func (c *client) Ping(ctx context.Context) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.BaseURL+"/v1/models", nil)
+	if err != nil {
+		return fmt.Errorf("llmclient: build HTTP request: %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+c.cfg.APIKey)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("llmclient: ping: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusUnauthorized,
+		resp.StatusCode == http.StatusForbidden:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return newUpstreamError(resp.StatusCode, body, false)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -7,36 +7,58 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"time"
 
 	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/tracing"
 )
 
 const (
-	maxRequestSize = 2 * 1024 * 1024 // 2MB total JSON payload
-	maxMessageSize = 512 * 1024      // 512KB per message content
+	maxRequestSize = 2 * 1024 * 1024  // 2MB total JSON payload, excluding inline media
+	maxMessageSize = 512 * 1024       // 512KB per message text content
+	maxMediaSize   = 20 * 1024 * 1024 // 20MB of base64 image/audio data per request
 )
 
-func (c *client) ChatCompletion(parentCtx context.Context, req *ChatRequest) (*ChatResponse, error) {
-	start := time.Now()
-
+// ChatCompletion runs chatCompletion under a GenAI client span.
+func (c *client) ChatCompletion(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
 	if req == nil {
 		return nil, fmt.Errorf("llmclient: request is nil")
 	}
 
+	ctx, span := c.startSpan(ctx, "chat", req.Model, chatRequestAttributes(req)...)
+	resp, err := c.chatCompletion(ctx, req)
+	var usage *Usage
+	if resp != nil {
+		usage = resp.Usage
+	}
+	c.observeRequest(ctx, req.Model, err, usage)
+	if resp != nil {
+		var finishReasons []string
+		for _, ch := range resp.Choices {
+			if ch.FinishReason != "" {
+				finishReasons = append(finishReasons, ch.FinishReason)
+			}
+		}
+		span.SetAttributes(responseAttributes(resp.ID, resp.Model, finishReasons, resp.Usage)...)
+	}
+	tracing.EndSpan(span, err)
+	return resp, err
+}
+
+func (c *client) chatCompletion(parentCtx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	start := time.Now()
+
 	// Validate request
 	if err := req.Validate(); err != nil {
-		return nil, fmt.Errorf("llmclient: invalid request: %w", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
 	}
 
-	// Per-message size guard
-	for i, m := range req.Messages {
-		if len(m.Content) > maxMessageSize {
-			return nil, fmt.Errorf(
-				"llmclient: message[%d] content too large (%d bytes, max %d)",
-				i, len(m.Content), maxMessageSize,
-			)
-		}
+	// Per-message and media size guards
+	mediaBytes, err := checkRequestSize(req)
+	if err != nil {
+		return nil, err
 	}
 
 	c.logger.Debug("llm request starting",
@@ -55,26 +77,18 @@ func (c *client) ChatCompletion(parentCtx context.Context, req *ChatRequest) (*C
 	defer cancel()
 
 	// Build provider request
-	pReq := providerChatRequest{
-		Model:       req.Model,
-		Messages:    req.Messages,
-		Temperature: req.Temperature,
-		TopP:        req.TopP,
-		MaxTokens:   req.MaxTokens,
-		Stop:        req.Stop,
-		Stream:      false,
-	}
+	pReq := newProviderChatRequest(req, false, &c.cfg)
 
 	bodyBytes, err := json.Marshal(pReq)
 	if err != nil {
 		return nil, fmt.Errorf("llmclient: marshal request: %w", err)
 	}
 
-	// Sanity check total request size
-	if len(bodyBytes) > maxRequestSize {
-		return nil, fmt.Errorf(
-			"llmclient: request too large (%d bytes, max %d)",
-			len(bodyBytes), maxRequestSize,
+	// Sanity check total request size (inline media is budgeted separately)
+	if len(bodyBytes)-mediaBytes > maxRequestSize {
+		return nil, invalidRequest(
+			"request too large (%d bytes, max %d)",
+			len(bodyBytes)-mediaBytes, maxRequestSize,
 		)
 	}
 
@@ -87,6 +101,7 @@ func (c *client) ChatCompletion(parentCtx context.Context, req *ChatRequest) (*C
 			return nil, fmt.Errorf("llmclient: build HTTP request: %w", err)
 		}
 		httpReq.Header.Set("Authorization", "Bearer "+c.cfg.APIKey)
+		tracing.Inject(ctx, httpReq.Header)
 		httpReq.Header.Set("Content-Type", "application/json")
 		return c.httpClient.Do(httpReq)
 	}
@@ -104,26 +119,15 @@ func (c *client) ChatCompletion(parentCtx context.Context, req *ChatRequest) (*C
 	// Handle non-2xx responses
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(resp.Body)
+		uerr := newUpstreamError(resp.StatusCode, body, false)
 
-		// Try to parse structured error
-		var perr providerErrorResponse
-		if err := json.Unmarshal(body, &perr); err == nil && perr.Error.Message != "" {
-			c.logger.Error("llm provider error",
-				zap.Int("status", resp.StatusCode),
-				zap.String("error_type", perr.Error.Type),
-				zap.String("error_message", perr.Error.Message),
-			)
-			return nil, fmt.Errorf("llmclient: upstream %d: %s (%s)",
-				resp.StatusCode, perr.Error.Message, perr.Error.Type)
-		}
-
-		// Fallback to raw body
-		c.logger.Error("llm upstream error",
-			zap.Int("status", resp.StatusCode),
-			zap.String("body", truncate(string(body), 200)),
+		c.logger.Error("llm provider error",
+			zap.Int("status", uerr.StatusCode),
+			zap.String("error_type", uerr.Type),
+			zap.String("error_code", uerr.Code),
+			zap.String("error_message", uerr.Message),
 		)
-		return nil, fmt.Errorf("llmclient: upstream %d: %s",
-			resp.StatusCode, truncate(string(body), 200))
+		return nil, uerr
 	}
 
 	// Decode success response
@@ -153,9 +157,16 @@ func (c *client) ChatCompletion(parentCtx context.Context, req *ChatRequest) (*C
 			Index:        ch.Index,
 			Message:      ch.Message,
 			FinishReason: ch.FinishReason,
+			Logprobs:     ch.Logprobs,
 		})
 	}
 
+	// Providers usually return choices in index order already; make it a
+	// guarantee so n>1 responses replay identically from cache.
+	sort.SliceStable(out.Choices, func(i, j int) bool {
+		return out.Choices[i].Index < out.Choices[j].Index
+	})
+
 	// Always include usage (even if zero)
 	out.Usage = &Usage{}
 	if pResp.Usage != nil {
@@ -174,6 +185,29 @@ func (c *client) ChatCompletion(parentCtx context.Context, req *ChatRequest) (*C
 	return out, nil
 }
 
+// checkRequestSize enforces the per-message text limit and the per-request
+// inline media limit. It returns the number of inline media bytes so the
+// caller can exclude them from the total payload check.
+func checkRequestSize(req *ChatRequest) (int, error) {
+	mediaBytes := 0
+	for i, m := range req.Messages {
+		if n := m.textSize(); n > maxMessageSize {
+			return 0, invalidRequest(
+				"message[%d] content too large (%d bytes, max %d)",
+				i, n, maxMessageSize,
+			)
+		}
+		mediaBytes += m.mediaSize()
+	}
+	if mediaBytes > maxMediaSize {
+		return 0, invalidRequest(
+			"inline media too large (%d bytes, max %d)",
+			mediaBytes, maxMediaSize,
+		)
+	}
+	return mediaBytes, nil
+}
+
 // truncate limits string length for logging
 func truncate(s string, maxLen int) string {
 	if len(s) <= maxLen {
@@ -1,5 +1,7 @@
 package llm
 
+import "encoding/json"
+
 // Request shape we send to upstream (OpenAI-style).
 type providerChatRequest struct {
 	Model       string        `json:"model"`
@@ -9,6 +11,73 @@ type providerChatRequest struct {
 	MaxTokens   int           `json:"max_tokens,omitempty"`
 	Stop        []string      `json:"stop,omitempty"`
 	Stream      bool          `json:"stream,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	Tools             []Tool          `json:"tools,omitempty"`
+	ToolChoice        json.RawMessage `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+
+	N           int  `json:"n,omitempty"`
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs *int `json:"top_logprobs,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// newProviderChatRequest translates the internal request into the upstream
+// request body. stream_options is only meaningful (and only sent) when
+// streaming; usage is then always requested so tokens are counted and
+// audited, and the handler hides it from clients that did not ask. When cfg.EmulateResponseFormat is set the provider does not
+// understand response_format, so it is replaced by a system instruction.
+// Extra fields are filtered through the provider's allow/deny lists.
+func newProviderChatRequest(req *ChatRequest, stream bool, cfg *Config) providerChatRequest {
+	pReq := providerChatRequest{
+		Model:             req.Model,
+		Messages:          req.Messages,
+		Temperature:       req.Temperature,
+		TopP:              req.TopP,
+		MaxTokens:         req.MaxTokens,
+		Stop:              req.Stop,
+		Stream:            stream,
+		Tools:             req.Tools,
+		ToolChoice:        req.ToolChoice,
+		ParallelToolCalls: req.ParallelToolCalls,
+		N:                 req.N,
+		Logprobs:          req.Logprobs,
+		TopLogprobs:       req.TopLogprobs,
+		Extra:             filterExtra(req.Extra, cfg.ExtraFieldsAllow, cfg.ExtraFieldsDeny),
+	}
+	if stream {
+		opts := StreamOptions{}
+		if req.StreamOptions != nil {
+			opts = *req.StreamOptions
+		}
+		opts.IncludeUsage = true
+		pReq.StreamOptions = &opts
+	}
+
+	if req.ResponseFormat.WantsJSON() {
+		if cfg.EmulateResponseFormat {
+			instruction := ChatMessage{Role: RoleSystem, Content: responseFormatInstruction(req.ResponseFormat)}
+			pReq.Messages = append([]ChatMessage{instruction}, req.Messages...)
+		} else {
+			pReq.ResponseFormat = req.ResponseFormat
+		}
+	}
+	return pReq
+}
+
+// responseFormatInstruction describes a JSON response format in prose for
+// providers without native structured output.
+func responseFormatInstruction(rf *ResponseFormat) string {
+	if rf.Type == ResponseFormatJSONSchema && rf.JSONSchema != nil {
+		return "Respond only with a single JSON document, without code fences or commentary, " +
+			"that validates against this JSON Schema:\n" + string(rf.JSONSchema.Schema)
+	}
+	return "Respond only with a single valid JSON object, without code fences or commentary."
 }
 
 // Choice for non-streaming responses.
@@ -16,6 +85,7 @@ type providerChatChoice struct {
 	Index        int         `json:"index"`
 	Message      ChatMessage `json:"message"`                 // non-stream
 	FinishReason string      `json:"finish_reason,omitempty"` // last choice
+	Logprobs     *Logprobs   `json:"logprobs,omitempty"`
 }
 
 type providerUsage struct {
@@ -37,6 +107,7 @@ type providerErrorResponse struct {
 	Error struct {
 		Message string      `json:"message"`
 		Type    string      `json:"type"`
+		Param   interface{} `json:"param"`
 		Code    interface{} `json:"code"`
 	} `json:"error"`
 }
@@ -50,9 +121,12 @@ type providerStreamChunk struct {
 	Choices []struct {
 		Index int `json:"index"`
 		Delta struct {
-			Role    string `json:"role,omitempty"`
-			Content string `json:"content,omitempty"`
+			Role      string          `json:"role,omitempty"`
+			Content   string          `json:"content,omitempty"`
+			ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
 		} `json:"delta"`
-		FinishReason string `json:"finish_reason,omitempty"`
+		FinishReason string    `json:"finish_reason,omitempty"`
+		Logprobs     *Logprobs `json:"logprobs,omitempty"`
 	} `json:"choices"`
+	Usage *providerUsage `json:"usage,omitempty"`
 }
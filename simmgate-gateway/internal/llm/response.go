@@ -0,0 +1,70 @@
+package llm
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const chatCompletionObject = "chat.completion"
+
+// chatResponseJSON is the OpenAI wire shape of ChatResponse.
+type chatResponseJSON struct {
+	ID      string          `json:"id,omitempty"`
+	Object  string          `json:"object"`
+	Created json.RawMessage `json:"created,omitempty"`
+	Model   string          `json:"model,omitempty"`
+	Choices []ChatChoice    `json:"choices"`
+	Usage   *Usage          `json:"usage,omitempty"`
+}
+
+// MarshalJSON writes object: chat.completion and created as unix seconds,
+// so live and cache-replayed responses are byte-for-byte OpenAI shaped.
+func (r ChatResponse) MarshalJSON() ([]byte, error) {
+	out := chatResponseJSON{
+		ID:      r.ID,
+		Object:  chatCompletionObject,
+		Model:   r.Model,
+		Choices: r.Choices,
+		Usage:   r.Usage,
+	}
+	if out.Choices == nil {
+		out.Choices = []ChatChoice{}
+	}
+	if !r.Created.IsZero() {
+		created, err := json.Marshal(r.Created.Unix())
+		if err != nil {
+			return nil, err
+		}
+		out.Created = created
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON accepts created as unix seconds or, for entries cached by
+// older gateway versions, as an RFC 3339 string.
+func (r *ChatResponse) UnmarshalJSON(data []byte) error {
+	var in chatResponseJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	*r = ChatResponse{
+		ID:      in.ID,
+		Model:   in.Model,
+		Choices: in.Choices,
+		Usage:   in.Usage,
+	}
+
+	if len(in.Created) == 0 || string(in.Created) == "null" {
+		return nil
+	}
+
+	var unix int64
+	if err := json.Unmarshal(in.Created, &unix); err == nil {
+		if unix > 0 {
+			r.Created = time.Unix(unix, 0)
+		}
+		return nil
+	}
+	return json.Unmarshal(in.Created, &r.Created)
+}
@@ -13,6 +13,8 @@ import (
 	"time"
 
 	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/metrics"
 )
 
 func init() {
@@ -28,12 +30,14 @@ func init() {
 // - Respects Retry-After headers from rate limiting responses.
 // - Uses exponential backoff with full jitter to prevent thundering herd.
 // - Respects the provided ctx (deadline / cancellation).
+// - Hands back the final attempt's response so callers can parse the error.
 func (c *client) doWithRetry(
 	ctx context.Context,
 	body []byte,
 	do func(ctx context.Context, body []byte) (*http.Response, error),
 ) (*http.Response, error) {
 	var lastErr error
+	var retryReason string // why the previous attempt is being retried
 	maxAttempts := c.cfg.MaxRetries + 1
 	if maxAttempts < 1 {
 		maxAttempts = 1
@@ -45,9 +49,15 @@ func (c *client) doWithRetry(
 			return nil, err
 		}
 
+		if attempt > 0 {
+			metrics.Add(ctx, metrics.UpstreamRetriesTotal.WithLabelValues(c.cfg.ProviderName, retryReason), 1)
+		}
+
+		attemptCtx, span := startAttemptSpan(ctx, attempt)
 		start := time.Now()
-		resp, err := do(ctx, body)
+		resp, err := do(attemptCtx, body)
 		duration := time.Since(start)
+		endAttemptSpan(span, resp, err)
 
 		status := 0
 		if resp != nil {
@@ -82,6 +92,7 @@ func (c *client) doWithRetry(
 
 			// Transient error - will retry
 			lastErr = err
+			retryReason = "network"
 			c.logger.Debug("transient network error, will retry",
 				zap.Error(err),
 			)
@@ -91,9 +102,18 @@ func (c *client) doWithRetry(
 				zap.Int("status", status),
 			)
 			return resp, nil
+		} else if attempt == maxAttempts-1 {
+			// Retryable status on the final attempt: hand the response back
+			// so the caller can surface the provider's structured error.
+			c.logger.Warn("llm request exhausted all retries",
+				zap.Int("attempts", maxAttempts),
+				zap.Int("status", status),
+			)
+			return resp, nil
 		} else {
 			// Retryable HTTP status (429, 5xx)
 			lastErr = fmt.Errorf("upstream status %d", status)
+			retryReason = strconv.Itoa(status)
 			c.logger.Debug("retryable status code",
 				zap.Int("status", status),
 			)
@@ -8,8 +8,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/tracing"
 )
 
 func (c *client) ChatCompletionStream(parentCtx context.Context, req *ChatRequest) (<-chan StreamResult, error) {
@@ -19,17 +22,13 @@ func (c *client) ChatCompletionStream(parentCtx context.Context, req *ChatReques
 
 	// Validate request
 	if err := req.Validate(); err != nil {
-		return nil, fmt.Errorf("llmclient: invalid request: %w", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
 	}
 
-	// Per-message size guard (same as non-streaming)
-	for i, m := range req.Messages {
-		if len(m.Content) > maxMessageSize {
-			return nil, fmt.Errorf(
-				"llmclient: message[%d] content too large (%d bytes, max %d)",
-				i, len(m.Content), maxMessageSize,
-			)
-		}
+	// Per-message and media size guards (same as non-streaming)
+	mediaBytes, err := checkRequestSize(req)
+	if err != nil {
+		return nil, err
 	}
 
 	c.logger.Debug("llm stream request starting",
@@ -37,45 +36,62 @@ func (c *client) ChatCompletionStream(parentCtx context.Context, req *ChatReques
 		zap.Int("message_count", len(req.Messages)),
 	)
 
-	// Per-request timeout (0 = only use parentCtx)
-	var ctx context.Context
-	var cancel context.CancelFunc
+	// UpstreamTimeout bounds connecting, up to the response headers. The
+	// body can run much longer; its duration and idle gaps are bounded by
+	// the caller through parentCtx.
+	parentCtx, span := c.startSpan(parentCtx, "chat", req.Model, chatRequestAttributes(req)...)
+	ctx, cancel := context.WithCancelCause(parentCtx)
+	var connectTimer *time.Timer
 	if c.cfg.UpstreamTimeout > 0 {
-		ctx, cancel = context.WithTimeout(parentCtx, c.cfg.UpstreamTimeout)
-	} else {
-		ctx, cancel = context.WithCancel(parentCtx)
+		connectTimer = time.AfterFunc(c.cfg.UpstreamTimeout, func() {
+			cancel(context.DeadlineExceeded)
+		})
 	}
 
 	results := make(chan StreamResult, 16)
 
 	go func() {
+		// The span covers the whole stream and ends with its outcome.
+		var (
+			streamErr     error
+			responseID    string
+			responseModel string
+			finishReasons []string
+			usage         *Usage
+		)
+		defer func() {
+			span.SetAttributes(responseAttributes(responseID, responseModel, finishReasons, usage)...)
+			tracing.EndSpan(span, streamErr)
+			c.observeTokens(parentCtx, req.Model, usage)
+		}()
+		connected := false
+		fail := func(err error) {
+			streamErr = err
+			if !connected {
+				c.observeRequest(parentCtx, req.Model, err, nil)
+			}
+			results <- StreamResult{Err: err}
+		}
+
 		defer close(results)
-		defer cancel()
+		defer cancel(nil)
 
 		// ---------- Build provider request ----------
 
-		pReq := providerChatRequest{
-			Model:       req.Model,
-			Messages:    req.Messages,
-			Temperature: req.Temperature,
-			TopP:        req.TopP,
-			MaxTokens:   req.MaxTokens,
-			Stop:        req.Stop,
-			Stream:      true,
-		}
+		pReq := newProviderChatRequest(req, true, &c.cfg)
 
 		bodyBytes, err := json.Marshal(pReq)
 		if err != nil {
-			results <- StreamResult{Err: fmt.Errorf("llmclient: marshal stream request: %w", err)}
+			fail(fmt.Errorf("llmclient: marshal stream request: %w", err))
 			return
 		}
 
 		// Total request size guard
-		if len(bodyBytes) > maxRequestSize {
-			results <- StreamResult{Err: fmt.Errorf(
-				"llmclient: request too large (%d bytes, max %d)",
-				len(bodyBytes), maxRequestSize,
-			)}
+		if len(bodyBytes)-mediaBytes > maxRequestSize {
+			fail(invalidRequest(
+				"request too large (%d bytes, max %d)",
+				len(bodyBytes)-mediaBytes, maxRequestSize,
+			))
 			return
 		}
 
@@ -87,6 +103,7 @@ func (c *client) ChatCompletionStream(parentCtx context.Context, req *ChatReques
 				return nil, fmt.Errorf("llmclient: build HTTP stream request: %w", err)
 			}
 			httpReq.Header.Set("Authorization", "Bearer "+c.cfg.APIKey)
+			tracing.Inject(ctx, httpReq.Header)
 			httpReq.Header.Set("Content-Type", "application/json")
 			return c.httpClient.Do(httpReq)
 		}
@@ -94,42 +111,44 @@ func (c *client) ChatCompletionStream(parentCtx context.Context, req *ChatReques
 		// ---------- Connect with retries (no mid-stream retries) ----------
 
 		resp, err := c.doWithRetry(ctx, bodyBytes, doOnce)
+		if connectTimer != nil && !connectTimer.Stop() && parentCtx.Err() == nil {
+			// The connect deadline passed; a response that raced it is
+			// already cancelled.
+			if resp != nil {
+				resp.Body.Close()
+			}
+			resp, err = nil, fmt.Errorf("llmclient: stream connect: %w", context.DeadlineExceeded)
+		}
 		if err != nil {
 			c.logger.Error("llm stream connect failed",
 				zap.String("model", req.Model),
 				zap.Error(err),
 			)
-			results <- StreamResult{Err: err}
+			fail(err)
 			return
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			body, _ := io.ReadAll(resp.Body)
+			uerr := newUpstreamError(resp.StatusCode, body, true)
 
-			var perr providerErrorResponse
-			if err := json.Unmarshal(body, &perr); err == nil && perr.Error.Message != "" {
-				c.logger.Error("llm stream provider error",
-					zap.String("model", req.Model),
-					zap.Int("status", resp.StatusCode),
-					zap.String("error_type", perr.Error.Type),
-					zap.String("error_message", perr.Error.Message),
-				)
-				results <- StreamResult{Err: fmt.Errorf("llmclient: upstream stream %d: %s (%s)",
-					resp.StatusCode, perr.Error.Message, perr.Error.Type)}
-				return
-			}
-
-			c.logger.Error("llm stream upstream error",
+			c.logger.Error("llm stream provider error",
 				zap.String("model", req.Model),
-				zap.Int("status", resp.StatusCode),
-				zap.String("body", truncate(string(body), 200)),
+				zap.Int("status", uerr.StatusCode),
+				zap.String("error_type", uerr.Type),
+				zap.String("error_code", uerr.Code),
+				zap.String("error_message", uerr.Message),
 			)
-			results <- StreamResult{Err: fmt.Errorf("llmclient: upstream stream %d: %s",
-				resp.StatusCode, truncate(string(body), 200))}
+			fail(uerr)
 			return
 		}
 
+		// The request is counted once connected; mid-stream errors are not
+		// upstream request failures.
+		connected = true
+		c.observeRequest(parentCtx, req.Model, nil, nil)
+
 		// ---------- Read SSE stream ----------
 
 		reader := bufio.NewReader(resp.Body)
@@ -157,7 +176,7 @@ func (c *client) ChatCompletionStream(parentCtx context.Context, req *ChatReques
 					)
 					return
 				}
-				results <- StreamResult{Err: fmt.Errorf("llmclient: read stream line: %w", err)}
+				fail(fmt.Errorf("llmclient: read stream line: %w", err))
 				return
 			}
 
@@ -185,22 +204,60 @@ func (c *client) ChatCompletionStream(parentCtx context.Context, req *ChatReques
 
 			var chunk providerStreamChunk
 			if err := json.Unmarshal(payload, &chunk); err != nil {
-				results <- StreamResult{Err: fmt.Errorf("llmclient: unmarshal stream chunk: %w", err)}
+				fail(fmt.Errorf("llmclient: unmarshal stream chunk: %w", err))
 				return
 			}
 
+			created := time.Time{}
+			if chunk.Created > 0 {
+				created = time.Unix(chunk.Created, 0)
+			}
+
+			out := make([]*StreamChunk, 0, len(chunk.Choices)+1)
 			for _, choice := range chunk.Choices {
 				deltaText := choice.Delta.Content
-				if deltaText == "" && choice.FinishReason == "" {
+				if deltaText == "" && choice.FinishReason == "" && choice.Delta.Role == "" &&
+					len(choice.Delta.ToolCalls) == 0 && choice.Logprobs == nil {
 					continue
 				}
 
-				sc := &StreamChunk{
+				out = append(out, &StreamChunk{
+					ID:           chunk.ID,
+					Created:      created,
+					Model:        chunk.Model,
 					Index:        choice.Index,
+					Role:         choice.Delta.Role,
 					Delta:        deltaText,
 					FinishReason: choice.FinishReason,
-				}
+					ToolCalls:    choice.Delta.ToolCalls,
+					Logprobs:     choice.Logprobs,
+				})
+			}
+
+			// Usage arrives on its own trailing chunk (choices: []) when the
+			// request set stream_options.include_usage.
+			if chunk.Usage != nil {
+				out = append(out, &StreamChunk{
+					ID:      chunk.ID,
+					Created: created,
+					Model:   chunk.Model,
+					Usage: &Usage{
+						PromptTokens:     chunk.Usage.PromptTokens,
+						CompletionTokens: chunk.Usage.CompletionTokens,
+						TotalTokens:      chunk.Usage.TotalTokens,
+					},
+				})
+			}
+
+			for _, sc := range out {
 				chunkCount++
+				responseID, responseModel = sc.ID, sc.Model
+				if sc.FinishReason != "" {
+					finishReasons = append(finishReasons, sc.FinishReason)
+				}
+				if sc.Usage != nil {
+					usage = sc.Usage
+				}
 
 				select {
 				case <-ctx.Done():
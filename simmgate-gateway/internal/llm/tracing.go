@@ -0,0 +1,105 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"simmgate-gateway/internal/tracing"
+)
+
+// startSpan starts a GenAI client span for one provider call; operation is
+// a gen_ai.operation.name value such as "chat" or "embeddings".
+func (c *client) startSpan(ctx context.Context, operation, model string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		semconv.GenAIOperationNameKey.String(operation),
+		semconv.GenAIProviderNameKey.String(c.cfg.ProviderName),
+		semconv.GenAIRequestModel(model),
+	)
+	if u, err := url.Parse(c.cfg.BaseURL); err == nil && u.Hostname() != "" {
+		attrs = append(attrs, semconv.ServerAddress(u.Hostname()))
+	}
+	return tracing.Tracer().Start(ctx, operation+" "+model,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// chatRequestAttributes are the gen_ai.request.* attributes of req.
+func chatRequestAttributes(req *ChatRequest) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if req.Temperature != 0 {
+		attrs = append(attrs, semconv.GenAIRequestTemperature(float64(req.Temperature)))
+	}
+	if req.TopP != 0 {
+		attrs = append(attrs, semconv.GenAIRequestTopP(float64(req.TopP)))
+	}
+	if req.MaxTokens != 0 {
+		attrs = append(attrs, semconv.GenAIRequestMaxTokens(req.MaxTokens))
+	}
+	if req.N > 1 {
+		attrs = append(attrs, semconv.GenAIRequestChoiceCount(req.N))
+	}
+	if len(req.Stop) > 0 {
+		attrs = append(attrs, semconv.GenAIRequestStopSequences(req.Stop...))
+	}
+	return attrs
+}
+
+// responseAttributes are the gen_ai.response.* and gen_ai.usage.*
+// attributes of a completion.
+func responseAttributes(id, model string, finishReasons []string, usage *Usage) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if id != "" {
+		attrs = append(attrs, semconv.GenAIResponseID(id))
+	}
+	if model != "" {
+		attrs = append(attrs, semconv.GenAIResponseModel(model))
+	}
+	if len(finishReasons) > 0 {
+		attrs = append(attrs, semconv.GenAIResponseFinishReasons(finishReasons...))
+	}
+	if usage != nil {
+		attrs = append(attrs,
+			semconv.GenAIUsageInputTokens(usage.PromptTokens),
+			semconv.GenAIUsageOutputTokens(usage.CompletionTokens),
+		)
+	}
+	return attrs
+}
+
+// startAttemptSpan starts the span of one doWithRetry attempt; attempt
+// counts from zero.
+func startAttemptSpan(ctx context.Context, attempt int) (context.Context, trace.Span) {
+	ctx, span := tracing.Tracer().Start(ctx, "upstream attempt", trace.WithSpanKind(trace.SpanKindClient))
+	if attempt > 0 {
+		span.SetAttributes(semconv.HTTPRequestResendCount(attempt))
+	}
+	return ctx, span
+}
+
+// endAttemptSpan records the outcome of an attempt.
+func endAttemptSpan(span trace.Span, resp *http.Response, err error) {
+	if resp != nil {
+		if req := resp.Request; req != nil {
+			span.SetName(req.Method)
+			span.SetAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.URLFull(req.URL.Redacted()),
+			)
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			span.SetAttributes(semconv.ErrorTypeKey.String(strconv.Itoa(resp.StatusCode)))
+		}
+	}
+	if err != nil {
+		span.SetAttributes(semconv.ErrorType(err))
+	}
+	tracing.EndSpan(span, err)
+}
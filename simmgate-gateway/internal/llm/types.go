@@ -2,6 +2,7 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -11,13 +12,71 @@ const (
 	RoleSystem    = "system"
 	RoleUser      = "user"
 	RoleAssistant = "assistant"
+	RoleTool      = "tool"
 )
 
+const ToolTypeFunction = "function"
+
+// ChatMessage is one conversation turn. Content holds plain-string content;
+// Parts holds array-form (multimodal) content and takes precedence when
+// non-nil. See content.go for the JSON encoding.
 type ChatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role    string        `json:"role"`
+	Content string        `json:"content"`
+	Parts   []ContentPart `json:"-"`
+	Name    string        `json:"name,omitempty"`
+
+	// ToolCalls is set on assistant messages that invoke tools.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID links a role "tool" message to the call it answers.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// Tool is a function the model may call (OpenAI "tools" entry).
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// ToolCall is a completed tool invocation in an assistant message.
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolCallDelta is a streamed fragment of a tool call. The first fragment
+// for an Index carries ID, Type and Function.Name; later ones only append
+// to Function.Arguments.
+type ToolCallDelta struct {
+	Index    int               `json:"index"`
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Function FunctionCallDelta `json:"function"`
+}
+
+type FunctionCallDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
 }
 
+// MaxPayloadBytes caps one encoded chat request in every transport: HTTP
+// body, WebSocket frame, gRPC message and batch line. It is the text limit
+// plus room for inline base64 images and audio.
+const MaxPayloadBytes = 24 * 1024 * 1024
+
 type ChatRequest struct {
 	Model       string        `json:"model"`
 	Messages    []ChatMessage `json:"messages"`
@@ -26,6 +85,55 @@ type ChatRequest struct {
 	MaxTokens   int           `json:"max_tokens,omitempty"`
 	Stop        []string      `json:"stop,omitempty"`
 	Stream      bool          `json:"stream,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	Tools []Tool `json:"tools,omitempty"`
+	// ToolChoice is "none", "auto", "required" or an object naming a function.
+	ToolChoice        json.RawMessage `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+
+	// N is the number of choices to generate (default 1).
+	N           int  `json:"n,omitempty"`
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs *int `json:"top_logprobs,omitempty"`
+
+	// Extra holds top-level fields the gateway has no typed field for
+	// (seed, presence_penalty, logit_bias, user, ...). They are forwarded
+	// to the provider subject to Config.ExtraFieldsAllow/Deny.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// ResponseFormat mirrors OpenAI's response_format request field.
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// WantsJSON reports whether the response must be a JSON document.
+func (f *ResponseFormat) WantsJSON() bool {
+	return f != nil && (f.Type == ResponseFormatJSONObject || f.Type == ResponseFormatJSONSchema)
+}
+
+// StreamOptions mirrors OpenAI's stream_options request field.
+type StreamOptions struct {
+	// IncludeUsage asks for a final chunk carrying token usage.
+	IncludeUsage bool `json:"include_usage,omitempty"`
 }
 
 func (r *ChatRequest) Validate() error {
@@ -38,12 +146,62 @@ func (r *ChatRequest) Validate() error {
 	}
 
 	for i, m := range r.Messages {
-		if m.Role != RoleSystem && m.Role != RoleUser && m.Role != RoleAssistant {
+		switch m.Role {
+		case RoleSystem, RoleUser:
+		case RoleAssistant:
+			for j, tc := range m.ToolCalls {
+				if tc.ID == "" || tc.Function.Name == "" {
+					return fmt.Errorf("messages[%d].tool_calls[%d] requires id and function.name", i, j)
+				}
+			}
+		case RoleTool:
+			if m.ToolCallID == "" {
+				return fmt.Errorf("tool_call_id is required for messages[%d]", i)
+			}
+		default:
 			return fmt.Errorf("invalid role %q in messages[%d]", m.Role, i)
 		}
-		if m.Content == "" && m.Role != RoleSystem {
+		if !m.HasContent() && m.Role != RoleSystem && len(m.ToolCalls) == 0 {
 			return fmt.Errorf("content is required for messages[%d]", i)
 		}
+		for j, p := range m.Parts {
+			if err := p.validate(); err != nil {
+				return fmt.Errorf("messages[%d].content[%d]: %w", i, j, err)
+			}
+		}
+	}
+
+	for i, t := range r.Tools {
+		if t.Type != ToolTypeFunction {
+			return fmt.Errorf("tools[%d]: unsupported type %q", i, t.Type)
+		}
+		if t.Function.Name == "" {
+			return fmt.Errorf("tools[%d]: function.name is required", i)
+		}
+	}
+
+	if rf := r.ResponseFormat; rf != nil {
+		switch rf.Type {
+		case ResponseFormatText, ResponseFormatJSONObject:
+		case ResponseFormatJSONSchema:
+			if rf.JSONSchema == nil || rf.JSONSchema.Name == "" || len(rf.JSONSchema.Schema) == 0 {
+				return errors.New("response_format.json_schema requires name and schema")
+			}
+		default:
+			return fmt.Errorf("unsupported response_format type %q", rf.Type)
+		}
+	}
+
+	if r.N < 0 || r.N > maxChoices {
+		return fmt.Errorf("n must be between 1 and %d", maxChoices)
+	}
+	if r.TopLogprobs != nil {
+		if !r.Logprobs {
+			return errors.New("top_logprobs requires logprobs to be true")
+		}
+		if *r.TopLogprobs < 0 || *r.TopLogprobs > maxTopLogprobs {
+			return fmt.Errorf("top_logprobs must be between 0 and %d", maxTopLogprobs)
+		}
 	}
 
 	if r.Temperature < 0 || r.Temperature > 2 {
@@ -56,10 +214,36 @@ func (r *ChatRequest) Validate() error {
 	return nil
 }
 
+const (
+	maxChoices     = 128
+	maxTopLogprobs = 20
+)
+
 type ChatChoice struct {
 	Index        int         `json:"index"`
 	Message      ChatMessage `json:"message"`
 	FinishReason string      `json:"finish_reason,omitempty"`
+	Logprobs     *Logprobs   `json:"logprobs,omitempty"`
+}
+
+// Logprobs carries per-token log probabilities for a choice (or, when
+// streaming, for the tokens of one delta).
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+	Refusal []TokenLogprob `json:"refusal,omitempty"`
+}
+
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
 }
 
 type Usage struct {
@@ -76,10 +260,22 @@ type ChatResponse struct {
 	Usage   *Usage       `json:"usage,omitempty"`
 }
 
+// StreamChunk is one choice delta from a streamed completion.
+// ID, Created and Model are copied from the provider chunk so the handler
+// can emit spec-complete chat.completion.chunk objects. A chunk with Usage
+// set carries no choice and is only sent when include_usage was requested.
 type StreamChunk struct {
-	Index        int    `json:"index"`
-	Delta        string `json:"delta"`
-	FinishReason string `json:"finish_reason,omitempty"`
+	ID           string    `json:"id,omitempty"`
+	Created      time.Time `json:"created,omitempty"`
+	Model        string    `json:"model,omitempty"`
+	Index        int       `json:"index"`
+	Role         string    `json:"role,omitempty"`
+	Delta        string    `json:"delta"`
+	FinishReason string    `json:"finish_reason,omitempty"`
+	Usage        *Usage    `json:"usage,omitempty"`
+
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
+	Logprobs  *Logprobs       `json:"logprobs,omitempty"`
 }
 
 type StreamResult struct {
@@ -90,4 +286,5 @@ type StreamResult struct {
 type Client interface {
 	ChatCompletion(ctx context.Context, req *ChatRequest) (*ChatResponse, error)
 	ChatCompletionStream(ctx context.Context, req *ChatRequest) (<-chan StreamResult, error)
+	Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error)
 }
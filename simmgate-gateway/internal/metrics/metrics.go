@@ -1,14 +1,47 @@
 package metrics
 
 import (
+	"context"
 	"net/http"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
+	"github.com/go-chi/chi/v5"
+	chimw "github.com/go-chi/chi/v5/middleware"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Token directions for TokensTotal.
+const (
+	TokensInput  = "input"
+	TokensOutput = "output"
+)
+
+// Cache lookup results for CacheLookupsTotal.
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheError = "error"
+)
+
+// Audit record outcomes for AuditRecordsTotal.
+const (
+	AuditWritten = "written"
+	AuditDropped = "dropped"
+	AuditFailed  = "failed"
+)
+
+// ModelOther is the model label of models the gateway does not know, so
+// clients cannot create series by naming arbitrary models.
+const ModelOther = "other"
+
+// unmatchedRoute labels requests that matched no route, so unknown paths
+// cannot grow the path label.
+const unmatchedRoute = "unmatched"
+
 var (
 	// Counter: how many times we served from exact cache.
 	ExactHitsTotal = prometheus.NewCounter(
@@ -18,7 +51,8 @@ var (
 		},
 	)
 
-	// Histogram: gateway HTTP latency in seconds.
+	// Histogram: gateway HTTP latency in seconds. path is the chi route
+	// pattern, not the raw URL.
 	GatewayLatencySeconds = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "gateway_latency_seconds",
@@ -27,6 +61,93 @@ var (
 		},
 		[]string{"path", "method", "status_code"},
 	)
+
+	// Gauge: requests being served, by transport (http, grpc).
+	InFlightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_in_flight_requests",
+			Help: "Requests currently being served.",
+		},
+		[]string{"transport"},
+	)
+
+	// Counter: cache lookups by tier and result (hit, miss, error).
+	CacheLookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_lookups_total",
+			Help: "Cache lookups by tier and result.",
+		},
+		[]string{"tier", "result"},
+	)
+
+	// Counter: provider calls by outcome. status is the upstream HTTP
+	// status of failed calls, or ok, timeout, canceled or error.
+	UpstreamRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_requests_total",
+			Help: "Upstream LLM requests by provider, model and status.",
+		},
+		[]string{"provider", "model", "status"},
+	)
+
+	// Counter: upstream attempts that were retried; reason is the HTTP
+	// status or "network".
+	UpstreamRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_retries_total",
+			Help: "Upstream LLM attempts that were retried, by reason.",
+		},
+		[]string{"provider", "reason"},
+	)
+
+	// Counter: tokens reported by the provider, by direction (input, output).
+	TokensTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "llm_tokens_total",
+			Help: "Tokens consumed by upstream LLM requests.",
+		},
+		[]string{"provider", "model", "direction"},
+	)
+
+	// Histogram: wait for the first chunk of a stream.
+	TimeToFirstTokenSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "stream_time_to_first_token_seconds",
+			Help:    "Time from the upstream stream request to its first chunk.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+		},
+		[]string{"model"},
+	)
+
+	// Histogram: gap between consecutive chunks of a stream.
+	InterTokenLatencySeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "stream_inter_token_latency_seconds",
+			Help:    "Time between consecutive stream chunks.",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 5},
+		},
+		[]string{"model"},
+	)
+
+	// Histogram: whole streams, by outcome (completed or the abort reason).
+	StreamDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "stream_duration_seconds",
+			Help:    "Duration of streamed completions.",
+			Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+		},
+		[]string{"model", "outcome"},
+	)
+
+	// Counter: audit records by sink and outcome: written, dropped (queue
+	// full) or failed (sink error).
+	AuditRecordsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "audit_records_total",
+			Help: "Audit records by sink and outcome.",
+		},
+		[]string{"sink", "result"},
+	)
 )
 
 // Register is called once in main() to register metrics.
@@ -34,18 +155,77 @@ func Register() {
 	prometheus.MustRegister(
 		ExactHitsTotal,
 		GatewayLatencySeconds,
+		InFlightRequests,
+		CacheLookupsTotal,
+		UpstreamRequestsTotal,
+		UpstreamRetriesTotal,
+		TokensTotal,
+		TimeToFirstTokenSeconds,
+		InterTokenLatencySeconds,
+		StreamDurationSeconds,
+		AuditRecordsTotal,
 	)
 }
 
-// Handler exposes the /metrics endpoint for Prometheus to scrape.
+// Handler exposes the /metrics endpoint for Prometheus to scrape. Exemplars
+// are only sent in the OpenMetrics format, which scrapers negotiate.
 func Handler() http.Handler {
-	return promhttp.Handler()
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+}
+
+// exemplar returns the exemplar labels of the request in ctx: its request
+// ID and, when traced, its trace ID. The request ID comes from the client,
+// so it is left out when it is not valid UTF-8 or would take the labels
+// past prometheus.ExemplarMaxRunes, which makes client_golang panic.
+func exemplar(ctx context.Context) prometheus.Labels {
+	labels := prometheus.Labels{}
+	runes := 0
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		labels["trace_id"] = sc.TraceID().String()
+		runes += utf8.RuneCountInString("trace_id") + utf8.RuneCountInString(labels["trace_id"])
+	}
+	if id := chimw.GetReqID(ctx); id != "" && utf8.ValidString(id) &&
+		runes+utf8.RuneCountInString("request_id")+utf8.RuneCountInString(id) <= prometheus.ExemplarMaxRunes {
+		labels["request_id"] = id
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// Observe records v on o with the exemplar of the request in ctx.
+func Observe(ctx context.Context, o prometheus.Observer, v float64) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok {
+		if labels := exemplar(ctx); labels != nil {
+			eo.ObserveWithExemplar(v, labels)
+			return
+		}
+	}
+	o.Observe(v)
 }
 
-// Middleware measures gateway latency for each HTTP request.
+// Add adds v to c with the exemplar of the request in ctx.
+func Add(ctx context.Context, c prometheus.Counter, v float64) {
+	if ea, ok := c.(prometheus.ExemplarAdder); ok {
+		if labels := exemplar(ctx); labels != nil {
+			ea.AddWithExemplar(v, labels)
+			return
+		}
+	}
+	c.Add(v)
+}
+
+// Middleware measures gateway latency and in-flight requests. It must run
+// after the request ID middleware so exemplars can carry the ID.
 func Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		inFlight := InFlightRequests.WithLabelValues("http")
+		inFlight.Inc()
+		defer inFlight.Dec()
 
 		// capture status code
 		rec := &statusRecorder{
@@ -57,13 +237,17 @@ func Middleware(next http.Handler) http.Handler {
 
 		duration := time.Since(start).Seconds()
 
-		path := r.URL.Path
+		// The route pattern is complete once routing has finished.
+		path := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			if pattern := rctx.RoutePattern(); pattern != "" {
+				path = pattern
+			}
+		}
 		method := r.Method
 		status := strconv.Itoa(rec.statusCode)
 
-		GatewayLatencySeconds.
-			WithLabelValues(path, method, status).
-			Observe(duration)
+		Observe(r.Context(), GatewayLatencySeconds.WithLabelValues(path, method, status), duration)
 	})
 }
 
@@ -76,3 +260,8 @@ func (r *statusRecorder) WriteHeader(code int) {
 	r.statusCode = code
 	r.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap lets http.ResponseController reach Flush and the write deadline.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	chimw "github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMiddlewareLabelsRoutePatternWithExemplar(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	GatewayLatencySeconds.Reset()
+	reg.MustRegister(GatewayLatencySeconds)
+
+	r := chi.NewRouter()
+	r.Use(chimw.RequestID)
+	r.Use(Middleware)
+	r.Get("/v1/batches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	for _, path := range []string{"/v1/batches/a", "/v1/batches/b", "/nowhere"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Request-Id", "req-"+path)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	got := map[string]*dto.Histogram{}
+	for _, m := range families[0].GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "path" {
+				got[l.GetValue()] = m.GetHistogram()
+			}
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("path labels = %v, want the route pattern and %q", keys(got), unmatchedRoute)
+	}
+	h, ok := got["/v1/batches/{id}"]
+	if !ok {
+		t.Fatalf("no series for the route pattern: %v", keys(got))
+	}
+	if h.GetSampleCount() != 2 {
+		t.Errorf("route samples = %d, want 2", h.GetSampleCount())
+	}
+	if _, ok := got[unmatchedRoute]; !ok {
+		t.Errorf("no %q series: %v", unmatchedRoute, keys(got))
+	}
+
+	var exemplarIDs []string
+	for _, b := range h.GetBucket() {
+		if ex := b.GetExemplar(); ex != nil {
+			for _, l := range ex.GetLabel() {
+				if l.GetName() == "request_id" {
+					exemplarIDs = append(exemplarIDs, l.GetValue())
+				}
+			}
+		}
+	}
+	if len(exemplarIDs) == 0 || exemplarIDs[0] != "req-/v1/batches/b" {
+		t.Errorf("exemplar request ids = %v, want the latest request", exemplarIDs)
+	}
+}
+
+func TestMiddlewareSkipsOversizedRequestID(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	GatewayLatencySeconds.Reset()
+	reg.MustRegister(GatewayLatencySeconds)
+
+	r := chi.NewRouter()
+	r.Use(chimw.RequestID)
+	r.Use(Middleware)
+	r.Get("/v1/models", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, id := range []string{strings.Repeat("x", 200), "bad-\xff-id"} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		req.Header.Set("X-Request-Id", id)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request id %q: status %d", id, rr.Code)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	h := families[0].GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 2 {
+		t.Fatalf("samples = %d, want 2", h.GetSampleCount())
+	}
+	for _, b := range h.GetBucket() {
+		if ex := b.GetExemplar(); ex != nil {
+			t.Fatalf("unexpected exemplar %v", ex.GetLabel())
+		}
+	}
+}
+
+func keys(m map[string]*dto.Histogram) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainPollInterval is how often Wait checks the in-flight counts.
+const drainPollInterval = 50 * time.Millisecond
+
+// ErrDrainExpired is the context cause, from Drain.Bind, once the shutdown
+// drain period is over.
+var ErrDrainExpired = errors.New("shutdown drain period expired")
+
+// Drain tracks in-flight requests and streams for a graceful shutdown.
+// Start refuses new work; Expire tells streams still running to end with a
+// terminal error. A nil *Drain tracks nothing and never expires.
+type Drain struct {
+	requests atomic.Int64
+	streams  atomic.Int64
+	draining atomic.Bool
+
+	expireOnce sync.Once
+	expired    chan struct{}
+}
+
+func NewDrain() *Drain {
+	return &Drain{expired: make(chan struct{})}
+}
+
+// Middleware counts requests in flight and answers new ones with 503 once
+// draining, asking the client to reconnect elsewhere.
+func (d *Drain) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.Draining() {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "1")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"error":{"message":"server is shutting down","type":"server_error","param":null,"code":"server_shutting_down"}}`))
+			return
+		}
+		d.requests.Add(1)
+		defer d.requests.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TrackRequest counts a request that does not go through Middleware, such
+// as a WebSocket frame, until the returned function is called.
+func (d *Drain) TrackRequest() func() {
+	if d == nil {
+		return func() {}
+	}
+	d.requests.Add(1)
+	return func() { d.requests.Add(-1) }
+}
+
+// TrackStream counts a stream until the returned function is called.
+// Streams on connections that outlive a request, such as WebSocket frames,
+// are only counted here.
+func (d *Drain) TrackStream() func() {
+	if d == nil {
+		return func() {}
+	}
+	d.streams.Add(1)
+	return func() { d.streams.Add(-1) }
+}
+
+// Start begins draining.
+func (d *Drain) Start() {
+	if d != nil {
+		d.draining.Store(true)
+	}
+}
+
+// Draining reports whether Start was called.
+func (d *Drain) Draining() bool {
+	return d != nil && d.draining.Load()
+}
+
+// InFlight returns the requests and streams still running.
+func (d *Drain) InFlight() (requests, streams int64) {
+	if d == nil {
+		return 0, 0
+	}
+	return d.requests.Load(), d.streams.Load()
+}
+
+// Wait blocks until nothing is in flight or ctx is done.
+func (d *Drain) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if requests, streams := d.InFlight(); requests == 0 && streams == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Expire ends the drain period: Expired is closed and bound contexts are
+// cancelled.
+func (d *Drain) Expire() {
+	if d != nil {
+		d.expireOnce.Do(func() { close(d.expired) })
+	}
+}
+
+// Expired is closed once the drain period is over; streams select on it to
+// end with a terminal error event.
+func (d *Drain) Expired() <-chan struct{} {
+	if d == nil {
+		return nil
+	}
+	return d.expired
+}
+
+// Bind returns ctx cancelled with ErrDrainExpired when the drain period
+// ends, for code that waits on a context rather than a channel.
+func (d *Drain) Bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if expired := d.Expired(); expired != nil {
+		go func() {
+			select {
+			case <-expired:
+				cancel(ErrDrainExpired)
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, func() { cancel(nil) }
+}
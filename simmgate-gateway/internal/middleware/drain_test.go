@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainRefusesNewRequests(t *testing.T) {
+	d := NewDrain()
+	h := d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("before drain: got %d", rr.Code)
+	}
+
+	d.Start()
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Connection") != "close" {
+		t.Fatalf("while draining: got %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestDrainWait(t *testing.T) {
+	d := NewDrain()
+	release := make(chan struct{})
+	h := d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	done := d.TrackStream()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if requests, streams := d.InFlight(); requests == 1 && streams == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request and stream were not counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*drainPollInterval)
+	defer cancel()
+	if err := d.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait with work in flight: %v", err)
+	}
+
+	close(release)
+	done()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.Wait(ctx); err != nil {
+		t.Fatalf("Wait after work finished: %v", err)
+	}
+}
+
+func TestDrainBind(t *testing.T) {
+	d := NewDrain()
+	ctx, cancel := d.Bind(context.Background())
+	defer cancel()
+
+	d.Expire()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("bound context not cancelled on Expire")
+	}
+	if !errors.Is(context.Cause(ctx), ErrDrainExpired) {
+		t.Fatalf("cause = %v", context.Cause(ctx))
+	}
+	d.Expire() // idempotent
+
+	var nilDrain *Drain
+	ctx, cancel = nilDrain.Bind(context.Background())
+	defer cancel()
+	if ctx.Err() != nil || nilDrain.Expired() != nil {
+		t.Fatal("nil Drain must never expire")
+	}
+	nilDrain.TrackStream()()
+}
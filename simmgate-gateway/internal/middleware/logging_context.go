@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	chimw "github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"simmgate-gateway/pkg/logging/logging"
@@ -29,6 +30,11 @@ func LoggingContext(baseLogger *zap.Logger) func(next http.Handler) http.Handler
 				reqLogger = reqLogger.With(zap.String("request_id", reqID))
 			}
 
+			// Trace ID, to find the request's spans from its logs
+			if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+				reqLogger = reqLogger.With(zap.String("trace_id", sc.TraceID().String()))
+			}
+
 			// Real IP from chi's RealIP middleware (or RemoteAddr fallback)
 			remoteIP := r.RemoteAddr
 			if remoteIP != "" {
@@ -25,7 +25,7 @@ func Recoverer() func(http.Handler) http.Handler {
 
 					w.Header().Set("Content-Type", "application/json")
 					w.WriteHeader(http.StatusInternalServerError)
-					_, _ = w.Write([]byte(`{"error":"internal_server_error"}`))
+					_, _ = w.Write([]byte(`{"error":{"message":"internal server error","type":"server_error","param":null,"code":"internal_server_error"}}`))
 				}
 			}()
 
@@ -2,7 +2,9 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"sync"
 	"time"
 
 	"simmgate-gateway/pkg/logging/logging"
@@ -10,35 +12,198 @@ import (
 	"go.uber.org/zap"
 )
 
-// Timeout cancels the request context after d and returns 504 if still running.
+// streamWriteGrace is added to the stream write deadline so a terminal
+// event can still be written after StreamTotal expires.
+const streamWriteGrace = 5 * time.Second
 
-// Timeout cancels the request context after d and returns 504 if still running.
-func Timeout(d time.Duration) func(http.Handler) http.Handler {
+// ErrStreamTimeout is the request context cause once a stream has run for
+// longer than Timeouts.StreamTotal.
+var ErrStreamTimeout = errors.New("stream exceeded its maximum duration")
+
+// Timeouts configures request deadlines. A zero value disables that limit.
+type Timeouts struct {
+	// Request bounds non-streaming requests.
+	Request time.Duration
+	// StreamFirstByte bounds the wait for the first upstream chunk and
+	// StreamIdle the gap between later chunks. Streaming handlers enforce
+	// both themselves, see StartStream.
+	StreamFirstByte time.Duration
+	StreamIdle      time.Duration
+	// StreamTotal bounds a whole stream.
+	StreamTotal time.Duration
+}
+
+// StreamLimits are the stream timeouts. FirstByte and Idle are enforced by
+// the handler; Total is enforced here and reported for handlers that keep
+// generating after the client has gone.
+type StreamLimits struct {
+	FirstByte time.Duration
+	Idle      time.Duration
+	Total     time.Duration
+}
+
+type (
+	timeoutKey      struct{}
+	streamLimitsKey struct{}
+)
+
+// WithStreamLimits sets the limits StartStream reports for requests that do
+// not go through Timeout, such as WebSocket frames. The caller enforces
+// Total, cancelling the context with ErrStreamTimeout.
+func WithStreamLimits(ctx context.Context, l StreamLimits) context.Context {
+	return context.WithValue(ctx, streamLimitsKey{}, l)
+}
+
+// Timeout applies t.Request to the request context. The handler runs on the
+// request goroutine and writes through a guarded ResponseWriter: once the
+// deadline passes its writes are discarded, and a 504 is sent after it
+// returns if nothing was written yet, so the two never interleave.
+// Streaming handlers call StartStream to switch to the stream limits.
+func Timeout(t Timeouts) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx, cancel := context.WithTimeout(r.Context(), d)
-			defer cancel()
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
 
-			r = r.WithContext(ctx)
+			tw := &timeoutWriter{w: w, cfg: t, cancel: cancel}
+			tw.arm(t.Request, context.DeadlineExceeded)
 
-			done := make(chan struct{})
-			go func() {
-				next.ServeHTTP(w, r)
-				close(done)
-			}()
+			next.ServeHTTP(tw, r.WithContext(context.WithValue(ctx, timeoutKey{}, tw)))
 
-			select {
-			case <-done:
+			tw.mu.Lock()
+			tw.disarm()
+			timedOut, wrote := tw.timedOut, tw.wroteHeader
+			tw.mu.Unlock()
 
+			if !timedOut {
 				return
-			case <-ctx.Done():
-				// context timeout/cancelled
-				logger := logging.L(ctx)
-				logger.Warn("request timeout", zap.Duration("timeout", d))
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusGatewayTimeout)
-				_, _ = w.Write([]byte(`{"error":"gateway_timeout"}`))
 			}
+			logging.L(ctx).Warn("request timeout", zap.Duration("timeout", t.Request))
+			if wrote {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			_, _ = w.Write([]byte(`{"error":{"message":"request timed out","type":"timeout_error","param":null,"code":"gateway_timeout"}}`))
 		})
 	}
 }
+
+// StartStream replaces the request deadline with the stream limits: the
+// context is now cancelled with ErrStreamTimeout after StreamTotal, and the
+// server write deadline is moved to match. It returns false if the request
+// has already timed out. Outside Timeout it returns the limits set with
+// WithStreamLimits, if any, and true.
+func StartStream(ctx context.Context) (StreamLimits, bool) {
+	tw, ok := ctx.Value(timeoutKey{}).(*timeoutWriter)
+	if !ok {
+		limits, _ := ctx.Value(streamLimitsKey{}).(StreamLimits)
+		return limits, true
+	}
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return StreamLimits{}, false
+	}
+	tw.disarm()
+	tw.streaming = true
+	tw.armLocked(tw.cfg.StreamTotal, ErrStreamTimeout)
+
+	var deadline time.Time
+	if tw.cfg.StreamTotal > 0 {
+		deadline = time.Now().Add(tw.cfg.StreamTotal + streamWriteGrace)
+	}
+	if err := http.NewResponseController(tw.w).SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logging.L(ctx).Warn("stream write deadline not set", zap.Error(err))
+	}
+
+	return StreamLimits{
+		FirstByte: tw.cfg.StreamFirstByte,
+		Idle:      tw.cfg.StreamIdle,
+		Total:     tw.cfg.StreamTotal,
+	}, true
+}
+
+// timeoutWriter serialises writes and drops them once a non-streaming
+// request has timed out. A streaming handler keeps writing after
+// StreamTotal so it can end the stream with an error event.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	cfg    Timeouts
+	cancel context.CancelCauseFunc
+
+	mu          sync.Mutex
+	timer       *time.Timer
+	gen         int // invalidates a timer that fired while being replaced
+	wroteHeader bool
+	timedOut    bool
+	streaming   bool
+}
+
+func (tw *timeoutWriter) arm(d time.Duration, cause error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.armLocked(d, cause)
+}
+
+func (tw *timeoutWriter) armLocked(d time.Duration, cause error) {
+	if d <= 0 {
+		return
+	}
+	gen := tw.gen
+	tw.timer = time.AfterFunc(d, func() { tw.expire(gen, cause) })
+}
+
+func (tw *timeoutWriter) disarm() {
+	tw.gen++
+	if tw.timer != nil {
+		tw.timer.Stop()
+		tw.timer = nil
+	}
+}
+
+func (tw *timeoutWriter) expire(gen int, cause error) {
+	tw.mu.Lock()
+	if gen != tw.gen {
+		tw.mu.Unlock()
+		return
+	}
+	if !tw.streaming {
+		tw.timedOut = true
+	}
+	tw.mu.Unlock()
+	tw.cancel(cause)
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.w.Header() }
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.w.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.wroteHeader = true
+	return tw.w.Write(p)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.wroteHeader = true
+	_ = http.NewResponseController(tw.w).Flush()
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutNonStream(t *testing.T) {
+	var writeErr error
+	h := Timeout(Timeouts{Request: 10 * time.Millisecond})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusBadGateway)
+		_, writeErr = w.Write([]byte("late"))
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+
+	if rr.Code != http.StatusGatewayTimeout || !strings.Contains(rr.Body.String(), "gateway_timeout") {
+		t.Fatalf("expected a single 504, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !errors.Is(writeErr, http.ErrHandlerTimeout) {
+		t.Fatalf("expected the late write to be rejected, got %v", writeErr)
+	}
+}
+
+func TestTimeoutFastHandlerUntouched(t *testing.T) {
+	h := Timeout(Timeouts{Request: time.Second})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+		t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestStartStreamReplacesRequestDeadline(t *testing.T) {
+	var cause error
+	var limits StreamLimits
+	h := Timeout(Timeouts{
+		Request:         10 * time.Millisecond,
+		StreamFirstByte: time.Second,
+		StreamIdle:      2 * time.Second,
+		StreamTotal:     50 * time.Millisecond,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		if limits, ok = StartStream(r.Context()); !ok {
+			t.Errorf("StartStream reported an expired request")
+			return
+		}
+		_, _ = w.Write([]byte("data: a\n\n"))
+
+		// Outlive the request timeout; only the stream total applies now.
+		time.Sleep(20 * time.Millisecond)
+		if r.Context().Err() != nil {
+			t.Errorf("stream cancelled by the request timeout")
+		}
+
+		<-r.Context().Done()
+		cause = context.Cause(r.Context())
+		_, _ = w.Write([]byte("data: end\n\n"))
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+
+	if limits != (StreamLimits{FirstByte: time.Second, Idle: 2 * time.Second, Total: 50 * time.Millisecond}) {
+		t.Fatalf("unexpected limits %+v", limits)
+	}
+	if !errors.Is(cause, ErrStreamTimeout) {
+		t.Fatalf("expected ErrStreamTimeout cause, got %v", cause)
+	}
+	if rr.Body.String() != "data: a\n\ndata: end\n\n" {
+		t.Fatalf("expected the handler to end its own stream, got %q", rr.Body.String())
+	}
+}
+
+func TestStartStreamAfterTimeout(t *testing.T) {
+	h := Timeout(Timeouts{Request: 5 * time.Millisecond})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		if _, ok := StartStream(r.Context()); ok {
+			t.Errorf("expected StartStream to fail after the request timed out")
+		}
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rr.Code)
+	}
+}
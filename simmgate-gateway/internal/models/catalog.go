@@ -0,0 +1,18 @@
+package models
+
+// defaultCatalog is metadata for common models whose provider list endpoint
+// does not report it. Override or extend it through Config.Catalog.
+var defaultCatalog = []Model{
+	{ID: "gpt-4o", OwnedBy: "openai", ContextWindow: 128000, MaxOutputTokens: 16384,
+		Pricing: &Pricing{InputPer1M: 2.50, OutputPer1M: 10.00}},
+	{ID: "gpt-4o-mini", OwnedBy: "openai", ContextWindow: 128000, MaxOutputTokens: 16384,
+		Pricing: &Pricing{InputPer1M: 0.15, OutputPer1M: 0.60}},
+	{ID: "gpt-4.1", OwnedBy: "openai", ContextWindow: 1047576, MaxOutputTokens: 32768,
+		Pricing: &Pricing{InputPer1M: 2.00, OutputPer1M: 8.00}},
+	{ID: "gpt-4.1-mini", OwnedBy: "openai", ContextWindow: 1047576, MaxOutputTokens: 32768,
+		Pricing: &Pricing{InputPer1M: 0.40, OutputPer1M: 1.60}},
+	{ID: "text-embedding-3-small", OwnedBy: "openai", ContextWindow: 8191,
+		Pricing: &Pricing{InputPer1M: 0.02}},
+	{ID: "text-embedding-3-large", OwnedBy: "openai", ContextWindow: 8191,
+		Pricing: &Pricing{InputPer1M: 0.13}},
+}
@@ -0,0 +1,323 @@
+// Package models keeps the catalogue of models reachable through the
+// gateway: provider model lists (cached), a static catalogue with metadata
+// such as context window and pricing, aliases, and per-tenant allow lists.
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/metrics"
+)
+
+const (
+	defaultRefreshInterval = 10 * time.Minute
+	// listTimeout bounds one provider list call; it runs detached from the
+	// request that triggered it.
+	listTimeout = 10 * time.Second
+	// failureBackoff is how long a failed list call waits before the next
+	// attempt, if shorter than the refresh interval.
+	failureBackoff = 30 * time.Second
+)
+
+// Pricing is USD per one million tokens.
+type Pricing struct {
+	InputPer1M  float64 `json:"input_per_1m"`
+	OutputPer1M float64 `json:"output_per_1m,omitempty"`
+}
+
+// Cost returns the USD cost of a request with the given token counts.
+func (p *Pricing) Cost(inputTokens, outputTokens int) float64 {
+	return (float64(inputTokens)*p.InputPer1M + float64(outputTokens)*p.OutputPer1M) / 1e6
+}
+
+// Model is an OpenAI model object plus gateway metadata.
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+
+	Provider        string   `json:"provider,omitempty"`
+	ContextWindow   int      `json:"context_window,omitempty"`
+	MaxOutputTokens int      `json:"max_output_tokens,omitempty"`
+	Pricing         *Pricing `json:"pricing,omitempty"`
+	AliasFor        string   `json:"alias_for,omitempty"`
+}
+
+// Config is loaded from MODELS_CONFIG_FILE (JSON). Catalog entries override
+// the built-in defaults by ID.
+type Config struct {
+	Catalog []Model             `json:"catalog"`
+	Aliases map[string]string   `json:"aliases"` // alias -> target model ID
+	Tenants map[string][]string `json:"tenants"` // tenant -> allowed model IDs
+
+	// RefreshInterval is how long provider lists are cached; it is set
+	// from MODELS_REFRESH_INTERVAL rather than the file.
+	RefreshInterval time.Duration `json:"-"`
+}
+
+// LoadConfig reads a JSON config file. An empty path yields an empty config.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("models: read config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("models: parse config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Provider is an upstream whose model list is merged into the registry.
+// Lister may be nil when the provider has no list endpoint.
+type Provider struct {
+	Name   string
+	Lister llm.ModelLister
+}
+
+type providerState struct {
+	models []llm.ModelInfo
+	ids    map[string]bool
+	// listed is set once the provider answered; models is then served,
+	// stale if need be, while later refreshes run.
+	listed      bool
+	nextRefresh time.Time
+	// refreshing is closed when the running refresh ends.
+	refreshing chan struct{}
+}
+
+// Registry merges provider lists, the static catalogue and aliases.
+type Registry struct {
+	catalog  map[string]Model
+	aliases  map[string]string
+	tenants  map[string]map[string]bool
+	refresh  time.Duration
+	provider []Provider
+	logger   *zap.Logger
+
+	mu    sync.Mutex
+	state map[string]providerState
+}
+
+func NewRegistry(cfg Config, providers []Provider, logger *zap.Logger) *Registry {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaultRefreshInterval
+	}
+
+	catalog := make(map[string]Model, len(defaultCatalog)+len(cfg.Catalog))
+	for _, m := range defaultCatalog {
+		catalog[m.ID] = m
+	}
+	for _, m := range cfg.Catalog {
+		catalog[m.ID] = m
+	}
+
+	tenants := make(map[string]map[string]bool, len(cfg.Tenants))
+	for tenant, ids := range cfg.Tenants {
+		set := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			set[id] = true
+		}
+		tenants[tenant] = set
+	}
+
+	return &Registry{
+		catalog:  catalog,
+		aliases:  cfg.Aliases,
+		tenants:  tenants,
+		refresh:  cfg.RefreshInterval,
+		provider: providers,
+		logger:   logger.Named("models"),
+		state:    make(map[string]providerState),
+	}
+}
+
+// Resolve maps an alias to its target model ID. It is safe on a nil
+// Registry, which resolves nothing.
+func (r *Registry) Resolve(model string) string {
+	if r == nil {
+		return model
+	}
+	if target, ok := r.aliases[model]; ok && target != "" {
+		return target
+	}
+	return model
+}
+
+// Pricing returns the catalogue pricing of model, following aliases, or nil
+// when it has none. It is safe on a nil Registry.
+func (r *Registry) Pricing(model string) *Pricing {
+	if r == nil {
+		return nil
+	}
+	return r.catalog[r.Resolve(model)].Pricing
+}
+
+// MetricLabel returns model when it is in the catalogue, an alias or a
+// provider list already fetched, and metrics.ModelOther otherwise, so
+// metrics only carry models the gateway knows. It never refreshes provider
+// lists and is safe on a nil Registry.
+func (r *Registry) MetricLabel(model string) string {
+	if r == nil || model == "" {
+		return metrics.ModelOther
+	}
+	if _, ok := r.catalog[model]; ok {
+		return model
+	}
+	if _, ok := r.aliases[model]; ok {
+		return model
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, st := range r.state {
+		if st.ids[model] {
+			return model
+		}
+	}
+	return metrics.ModelOther
+}
+
+// List returns the models visible to tenant, sorted by ID. Tenants without
+// an allow list see everything. Provider lists are enriched with catalogue
+// metadata; catalogue-only entries stand in for providers without a list
+// endpoint or whose list could not be fetched.
+func (r *Registry) List(ctx context.Context, tenant string) []Model {
+	merged := make(map[string]Model)
+
+	var unlisted []string
+	for _, p := range r.provider {
+		infos, ok := r.providerModels(ctx, p)
+		if !ok {
+			unlisted = append(unlisted, p.Name)
+			continue
+		}
+		for _, info := range infos {
+			m := r.catalog[info.ID]
+			m.ID = info.ID
+			m.Created = info.Created
+			m.OwnedBy = info.OwnedBy
+			m.Provider = p.Name
+			merged[m.ID] = m
+		}
+	}
+
+	for _, name := range unlisted {
+		for id, m := range r.catalog {
+			if _, ok := merged[id]; !ok {
+				m.Provider = name
+				merged[id] = m
+			}
+		}
+	}
+
+	for alias, target := range r.aliases {
+		m, ok := merged[target]
+		if !ok {
+			m = Model{OwnedBy: "simmgate"}
+		}
+		m.ID = alias
+		m.AliasFor = target
+		merged[alias] = m
+	}
+
+	allowed, restricted := r.tenants[tenant]
+
+	out := make([]Model, 0, len(merged))
+	for _, m := range merged {
+		if restricted && !allowed[m.ID] && !(m.AliasFor != "" && allowed[m.AliasFor]) {
+			continue
+		}
+		m.Object = "model"
+		if m.OwnedBy == "" {
+			m.OwnedBy = "system"
+		}
+		out = append(out, m)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// providerModels returns the cached list for p and whether the provider
+// ever answered. A stale list is served while it is refreshed in the
+// background; without one, the caller waits for the refresh or its ctx.
+func (r *Registry) providerModels(ctx context.Context, p Provider) ([]llm.ModelInfo, bool) {
+	if p.Lister == nil {
+		return nil, false
+	}
+
+	r.mu.Lock()
+	st := r.state[p.Name]
+	if time.Now().Before(st.nextRefresh) {
+		r.mu.Unlock()
+		return st.models, st.listed
+	}
+	if st.refreshing == nil {
+		st.refreshing = make(chan struct{})
+		r.state[p.Name] = st
+		go r.refreshProvider(p, st.refreshing)
+	}
+	done := st.refreshing
+	r.mu.Unlock()
+
+	if st.listed {
+		return st.models, true
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st = r.state[p.Name]
+	return st.models, st.listed
+}
+
+// refreshProvider fetches the list of p with its own timeout, so a caller
+// that gives up does not fail the refresh for everyone. On failure the
+// previous list is kept.
+func (r *Registry) refreshProvider(p Provider, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+	defer cancel()
+	models, err := p.Lister.ListModels(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.state[p.Name]
+	if err != nil {
+		r.logger.Warn("provider model list refresh failed",
+			zap.String("provider", p.Name),
+			zap.Error(err),
+		)
+		// Back off instead of hammering the provider.
+		st.nextRefresh = time.Now().Add(min(failureBackoff, r.refresh))
+	} else {
+		st.models, st.listed = models, true
+		st.ids = make(map[string]bool, len(models))
+		for _, m := range models {
+			st.ids[m.ID] = true
+		}
+		st.nextRefresh = time.Now().Add(r.refresh)
+	}
+	st.refreshing = nil
+	r.state[p.Name] = st
+	close(done)
+}
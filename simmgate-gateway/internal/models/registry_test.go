@@ -0,0 +1,162 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"simmgate-gateway/internal/llm"
+	"simmgate-gateway/internal/metrics"
+)
+
+type fakeLister struct {
+	calls  atomic.Int32
+	models []llm.ModelInfo
+	err    error
+	// release, when set, holds each call until it is closed.
+	release chan struct{}
+}
+
+func (f *fakeLister) ListModels(ctx context.Context) ([]llm.ModelInfo, error) {
+	f.calls.Add(1)
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return f.models, f.err
+}
+
+func TestRegistryList(t *testing.T) {
+	lister := &fakeLister{models: []llm.ModelInfo{
+		{ID: "gpt-4o", Created: 1715367049, OwnedBy: "system"},
+		{ID: "custom-ft", Created: 1700000000, OwnedBy: "org-1"},
+	}}
+
+	r := NewRegistry(Config{
+		Catalog: []Model{{ID: "local-llama", OwnedBy: "self", ContextWindow: 8192}},
+		Aliases: map[string]string{"default": "gpt-4o"},
+		Tenants: map[string][]string{"team-a": {"gpt-4o"}},
+	}, []Provider{{Name: "openai", Lister: lister}}, nil)
+
+	all := r.List(context.Background(), "anon")
+	byID := make(map[string]Model, len(all))
+	for _, m := range all {
+		byID[m.ID] = m
+	}
+
+	gpt, ok := byID["gpt-4o"]
+	if !ok || gpt.Provider != "openai" || gpt.Created != 1715367049 || gpt.ContextWindow != 128000 || gpt.Pricing == nil {
+		t.Fatalf("provider entry not merged with catalogue metadata: %#v", gpt)
+	}
+	if m, ok := byID["local-llama"]; ok {
+		t.Fatalf("catalogue-only entry listed although the provider answered: %#v", m)
+	}
+	if m, ok := byID["custom-ft"]; !ok || m.OwnedBy != "org-1" {
+		t.Fatalf("provider-only entry missing: %#v", m)
+	}
+	if m, ok := byID["default"]; !ok || m.AliasFor != "gpt-4o" || m.ContextWindow != 128000 {
+		t.Fatalf("alias entry missing: %#v", m)
+	}
+
+	restricted := r.List(context.Background(), "team-a")
+	if len(restricted) != 2 || restricted[0].ID != "default" || restricted[1].ID != "gpt-4o" {
+		t.Fatalf("unexpected tenant list: %#v", restricted)
+	}
+
+	if n := lister.calls.Load(); n != 1 {
+		t.Fatalf("expected provider list to be cached, got %d calls", n)
+	}
+
+	if got := r.Resolve("default"); got != "gpt-4o" {
+		t.Fatalf("Resolve(default) = %q", got)
+	}
+	var nilRegistry *Registry
+	if got := nilRegistry.Resolve("default"); got != "default" {
+		t.Fatalf("nil registry must not resolve aliases, got %q", got)
+	}
+}
+
+func TestRegistryMetricLabel(t *testing.T) {
+	lister := &fakeLister{models: []llm.ModelInfo{{ID: "custom-ft"}}}
+	r := NewRegistry(Config{
+		Catalog: []Model{{ID: "local-llama"}},
+		Aliases: map[string]string{"default": "gpt-4o"},
+	}, []Provider{{Name: "openai", Lister: lister}}, nil)
+
+	// Provider models are only known once their list has been fetched.
+	if got := r.MetricLabel("custom-ft"); got != metrics.ModelOther {
+		t.Fatalf("MetricLabel before listing = %q", got)
+	}
+	r.List(context.Background(), "anon")
+
+	for model, want := range map[string]string{
+		"gpt-4o":       "gpt-4o",
+		"local-llama":  "local-llama",
+		"default":      "default",
+		"custom-ft":    "custom-ft",
+		"made-up-1234": metrics.ModelOther,
+		"":             metrics.ModelOther,
+	} {
+		if got := r.MetricLabel(model); got != want {
+			t.Errorf("MetricLabel(%q) = %q, want %q", model, got, want)
+		}
+	}
+	var nilRegistry *Registry
+	if got := nilRegistry.MetricLabel("gpt-4o"); got != metrics.ModelOther {
+		t.Fatalf("nil registry MetricLabel = %q", got)
+	}
+}
+
+func TestRegistryListFallsBackToCatalogue(t *testing.T) {
+	cfg := Config{Catalog: []Model{{ID: "local-llama", OwnedBy: "self", ContextWindow: 8192}}}
+
+	for name, p := range map[string]Provider{
+		"no lister":   {Name: "local"},
+		"list failed": {Name: "local", Lister: &fakeLister{err: errors.New("404")}},
+	} {
+		r := NewRegistry(cfg, []Provider{p}, nil)
+		var found bool
+		for _, m := range r.List(context.Background(), "") {
+			if m.ID == "local-llama" {
+				found = m.Provider == "local" && m.ContextWindow == 8192
+			}
+		}
+		if !found {
+			t.Errorf("%s: catalogue entry missing", name)
+		}
+	}
+}
+
+func TestRegistryRefreshIsDetached(t *testing.T) {
+	lister := &fakeLister{
+		models:  []llm.ModelInfo{{ID: "custom-ft"}},
+		release: make(chan struct{}),
+	}
+	r := NewRegistry(Config{RefreshInterval: time.Hour}, []Provider{{Name: "p", Lister: lister}}, nil)
+
+	// A caller that gives up gets the catalogue and does not fail the fetch.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	for _, m := range r.List(ctx, "") {
+		if m.ID == "custom-ft" {
+			t.Fatalf("provider entry listed before the provider answered")
+		}
+	}
+
+	close(lister.release)
+	var found bool
+	for _, m := range r.List(context.Background(), "") {
+		found = found || m.ID == "custom-ft"
+	}
+	if !found {
+		t.Fatalf("provider list missing after the refresh finished")
+	}
+	if n := lister.calls.Load(); n != 1 {
+		t.Fatalf("expected one shared list call, got %d", n)
+	}
+}
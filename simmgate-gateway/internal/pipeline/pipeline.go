@@ -0,0 +1,214 @@
+// Package pipeline runs a chat request through an ordered list of stages
+// around the upstream call. Stages are how cache tiers, policy checks and
+// post-processors plug into every endpoint that serves chat completions,
+// streaming or not.
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"simmgate-gateway/internal/llm"
+)
+
+// Exchange is one request on its way through the pipeline.
+type Exchange struct {
+	Request   *llm.ChatRequest
+	UserID    string
+	VersionID string
+	Start     time.Time
+	// Stream is set for stream requests. Their chunks go straight to the
+	// client, so Response stays nil.
+	Stream bool
+
+	// Response is the completion. A Before hook that sets it answers the
+	// request without calling the upstream or the stages after it; this
+	// only applies to non-stream exchanges.
+	Response *llm.ChatResponse
+	// Err is the outcome of the call, for After hooks.
+	Err error
+	// AbortReason is why a stream ended early (idle_timeout,
+	// upstream_error, ...); empty for streams that completed. Errors after
+	// the first chunk are sent in-band and do not set Err.
+	AbortReason string
+
+	// Cacheable is cleared for responses that must not be stored, such as
+	// ones that failed structured-output validation.
+	Cacheable bool
+	// CacheTier names the stage that answered the request, if any.
+	CacheTier string
+	// UpstreamLatency is the time spent in the upstream call.
+	UpstreamLatency time.Duration
+	// Usage is the token usage a stream reported, if any; non-stream
+	// exchanges have it on Response.
+	Usage *llm.Usage
+
+	// CollectOutput is set by a Before hook that needs the text of a
+	// stream; the stream then appends each delta, see Output.
+	CollectOutput bool
+
+	output map[int]*strings.Builder
+	values map[string]interface{}
+}
+
+// NewExchange starts an exchange for req; stream callers set Stream.
+func NewExchange(req *llm.ChatRequest, userID, versionID string, start time.Time) *Exchange {
+	return &Exchange{
+		Request:   req,
+		UserID:    userID,
+		VersionID: versionID,
+		Start:     start,
+		Cacheable: true,
+	}
+}
+
+// Set stores per-request state for a stage; stages are shared between
+// requests and must not keep it themselves.
+func (e *Exchange) Set(key string, v interface{}) {
+	if e.values == nil {
+		e.values = make(map[string]interface{})
+	}
+	e.values[key] = v
+}
+
+// Get returns a value stored with Set.
+func (e *Exchange) Get(key string) (interface{}, bool) {
+	v, ok := e.values[key]
+	return v, ok
+}
+
+// AppendOutput adds streamed text to the choice at index.
+func (e *Exchange) AppendOutput(index int, text string) {
+	if e.output == nil {
+		e.output = make(map[int]*strings.Builder)
+	}
+	b, ok := e.output[index]
+	if !ok {
+		b = &strings.Builder{}
+		e.output[index] = b
+	}
+	b.WriteString(text)
+}
+
+// Output returns the streamed text of each choice, in index order.
+func (e *Exchange) Output() []string {
+	if len(e.output) == 0 {
+		return nil
+	}
+	indexes := make([]int, 0, len(e.output))
+	for i := range e.output {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	out := make([]string, len(indexes))
+	for i, index := range indexes {
+		out[i] = e.output[index].String()
+	}
+	return out
+}
+
+// Stage hooks into the pipeline. Before hooks run in order before the
+// upstream call; After hooks run in reverse order once it returned, for
+// every stage whose Before ran, and see its outcome in Exchange.Err.
+type Stage interface {
+	Before(ctx context.Context, ex *Exchange) error
+	After(ctx context.Context, ex *Exchange) error
+}
+
+// Funcs adapts a pair of functions to a Stage; either may be nil.
+type Funcs struct {
+	BeforeFunc func(ctx context.Context, ex *Exchange) error
+	AfterFunc  func(ctx context.Context, ex *Exchange) error
+}
+
+func (f Funcs) Before(ctx context.Context, ex *Exchange) error {
+	if f.BeforeFunc == nil {
+		return nil
+	}
+	return f.BeforeFunc(ctx, ex)
+}
+
+func (f Funcs) After(ctx context.Context, ex *Exchange) error {
+	if f.AfterFunc == nil {
+		return nil
+	}
+	return f.AfterFunc(ctx, ex)
+}
+
+// Call is the step the stages wrap: the upstream request, or for streams
+// the whole stream.
+type Call func(ctx context.Context, ex *Exchange) error
+
+// Pipeline is an ordered list of stages.
+type Pipeline struct {
+	stages []Stage
+}
+
+func New(stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages}
+}
+
+// Run passes ex through the stages and call. A Before error stops the
+// request and is returned as is. An After error replaces a successful
+// non-stream outcome, so post-processors can reject a response; a stream
+// has already been sent by then.
+func (p *Pipeline) Run(ctx context.Context, ex *Exchange, call Call) error {
+	var entered int
+	if p != nil {
+		for _, s := range p.stages {
+			entered++
+			if err := s.Before(ctx, ex); err != nil {
+				ex.Err = err
+				break
+			}
+			if ex.Response != nil && !ex.Stream {
+				break
+			}
+		}
+	}
+
+	if ex.Err == nil && (ex.Response == nil || ex.Stream) {
+		ex.Err = call(ctx, ex)
+	}
+
+	for i := entered - 1; i >= 0; i-- {
+		if err := p.stages[i].After(ctx, ex); err != nil && ex.Err == nil && !ex.Stream {
+			ex.Err = err
+		}
+	}
+	return ex.Err
+}
+
+// Registry maps stage names to stages, so the order can come from
+// configuration.
+type Registry map[string]Stage
+
+// Build returns a pipeline of the named stages, in order.
+func (r Registry) Build(names []string) (*Pipeline, error) {
+	stages := make([]Stage, 0, len(names))
+	for _, name := range names {
+		s, ok := r[name]
+		if !ok {
+			return nil, fmt.Errorf("pipeline: unknown stage %q", name)
+		}
+		stages = append(stages, s)
+	}
+	return New(stages...), nil
+}
+
+// RejectError is returned by a stage to refuse a request with an HTTP
+// status and an OpenAI-style error body.
+type RejectError struct {
+	Status  int
+	Type    string
+	Code    string
+	Param   string
+	Message string
+}
+
+func (e *RejectError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"simmgate-gateway/internal/llm"
+)
+
+// recorder returns a stage that appends "<name>.before" and "<name>.after"
+// to calls.
+func recorder(name string, calls *[]string) Funcs {
+	return Funcs{
+		BeforeFunc: func(context.Context, *Exchange) error {
+			*calls = append(*calls, name+".before")
+			return nil
+		},
+		AfterFunc: func(context.Context, *Exchange) error {
+			*calls = append(*calls, name+".after")
+			return nil
+		},
+	}
+}
+
+func newTestExchange() *Exchange {
+	return NewExchange(&llm.ChatRequest{Model: "m"}, "u", "v1", time.Now())
+}
+
+func TestRunOrder(t *testing.T) {
+	var calls []string
+	p := New(recorder("a", &calls), recorder("b", &calls))
+
+	err := p.Run(context.Background(), newTestExchange(), func(context.Context, *Exchange) error {
+		calls = append(calls, "call")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []string{"a.before", "b.before", "call", "b.after", "a.after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestRunShortCircuit(t *testing.T) {
+	var calls []string
+	answer := Funcs{BeforeFunc: func(_ context.Context, ex *Exchange) error {
+		calls = append(calls, "cache.before")
+		ex.Response = &llm.ChatResponse{Model: "cached"}
+		return nil
+	}}
+	p := New(recorder("a", &calls), answer, recorder("b", &calls))
+
+	ex := newTestExchange()
+	err := p.Run(context.Background(), ex, func(context.Context, *Exchange) error {
+		t.Fatal("call must not run when a stage answered")
+		return nil
+	})
+	if err != nil || ex.Response.Model != "cached" {
+		t.Fatalf("run: %v, %v", err, ex.Response)
+	}
+	want := []string{"a.before", "cache.before", "a.after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	denied := errors.New("denied")
+
+	var calls []string
+	reject := Funcs{BeforeFunc: func(context.Context, *Exchange) error { return denied }}
+	p := New(recorder("a", &calls), reject, recorder("b", &calls))
+	if err := p.Run(context.Background(), newTestExchange(), func(context.Context, *Exchange) error {
+		t.Fatal("call must not run after a Before error")
+		return nil
+	}); !errors.Is(err, denied) {
+		t.Fatalf("expected Before error, got %v", err)
+	}
+	if want := []string{"a.before", "a.after"}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+
+	post := New(Funcs{AfterFunc: func(context.Context, *Exchange) error { return denied }})
+	if err := post.Run(context.Background(), newTestExchange(), func(context.Context, *Exchange) error { return nil }); !errors.Is(err, denied) {
+		t.Fatalf("expected After error to replace success, got %v", err)
+	}
+
+	ex := newTestExchange()
+	ex.Stream = true
+	if err := post.Run(context.Background(), ex, func(context.Context, *Exchange) error { return nil }); err != nil {
+		t.Fatalf("After errors must not fail a stream that was already sent, got %v", err)
+	}
+}
+
+func TestRegistryBuild(t *testing.T) {
+	var calls []string
+	r := Registry{"a": recorder("a", &calls), "b": recorder("b", &calls)}
+
+	p, err := r.Build([]string{"b", "a"})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	_ = p.Run(context.Background(), newTestExchange(), func(context.Context, *Exchange) error { return nil })
+	if want := []string{"b.before", "a.before", "a.after", "b.after"}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+
+	if _, err := r.Build([]string{"a", "missing"}); err == nil {
+		t.Fatal("expected an error for an unknown stage")
+	}
+}
@@ -0,0 +1,99 @@
+package resume
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// readBatch caps the events returned by one XREAD.
+const readBatch = 256
+
+// RedisStore keeps each stream in a Redis stream, so a client can resume
+// on any gateway instance. Event seq n is entry 0-n; Finish adds an entry
+// with an "end" field under an auto-generated ID, which sorts after them.
+// Keys (<prefix>:stream:<key>) expire Retention after the last change.
+type RedisStore struct {
+	client    *redis.Client
+	prefix    string
+	retention time.Duration
+}
+
+func NewRedisStore(client *redis.Client, prefix string, retention time.Duration) *RedisStore {
+	if retention <= 0 {
+		retention = defaultRetention
+	}
+	return &RedisStore{client: client, prefix: prefix, retention: retention}
+}
+
+func (s *RedisStore) key(key string) string {
+	k := "stream:" + key
+	if s.prefix != "" {
+		k = s.prefix + ":" + k
+	}
+	return k
+}
+
+func (s *RedisStore) Append(ctx context.Context, key string, ev Event) error {
+	return s.add(ctx, key, "0-"+strconv.FormatInt(ev.Seq, 10), "d", ev.Data)
+}
+
+func (s *RedisStore) Finish(ctx context.Context, key string) error {
+	return s.add(ctx, key, "*", "end", "1")
+}
+
+func (s *RedisStore) add(ctx context.Context, key, id string, values ...interface{}) error {
+	pipe := s.client.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{Stream: s.key(key), ID: id, Values: values})
+	pipe.Expire(ctx, s.key(key), s.retention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis stream append failed: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisStore) Read(ctx context.Context, key string, after int64, wait time.Duration) ([]Event, bool, error) {
+	block := wait
+	if block <= 0 {
+		block = -1 // XREAD without BLOCK; BLOCK 0 would wait forever
+	}
+
+	res, err := s.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{s.key(key), "0-" + strconv.FormatInt(after, 10)},
+		Count:   readBatch,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		n, err := s.client.Exists(ctx, s.key(key)).Result()
+		if err != nil {
+			return nil, false, fmt.Errorf("redis stream read failed: %w", err)
+		}
+		if n == 0 {
+			return nil, false, ErrNotFound
+		}
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("redis stream read failed: %w", err)
+	}
+
+	var events []Event
+	for _, stream := range res {
+		for _, msg := range stream.Messages {
+			if _, ok := msg.Values["end"]; ok {
+				return events, true, nil
+			}
+			seq, err := strconv.ParseInt(strings.TrimPrefix(msg.ID, "0-"), 10, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("redis stream entry %s: unexpected id", msg.ID)
+			}
+			data, _ := msg.Values["d"].(string)
+			events = append(events, Event{Seq: seq, Data: []byte(data)})
+		}
+	}
+	return events, false, nil
+}
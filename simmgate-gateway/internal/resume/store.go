@@ -0,0 +1,194 @@
+// Package resume buffers the SSE events of streams so a client that lost
+// its connection can reconnect with Last-Event-ID and receive the rest of
+// the generation, even if it finished while the client was away.
+package resume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRetention = 5 * time.Minute
+
+var ErrNotFound = errors.New("resume: stream not found")
+
+// Event is one buffered SSE event block, including its id line.
+type Event struct {
+	Seq  int64
+	Data []byte
+}
+
+// Store buffers stream events. Streams are identified by Key, so one
+// caller cannot resume another's stream.
+type Store interface {
+	// Append adds ev to the stream; sequence numbers start at 1 and grow
+	// by one.
+	Append(ctx context.Context, key string, ev Event) error
+	// Finish marks the stream complete after its last event.
+	Finish(ctx context.Context, key string) error
+	// Read returns the events after seq after, waiting up to wait for one
+	// to arrive. done reports that the stream finished and nothing follows
+	// the returned events. Unknown or expired streams return ErrNotFound.
+	Read(ctx context.Context, key string, after int64, wait time.Duration) (events []Event, done bool, err error)
+}
+
+// Key scopes a generation to the caller that started it.
+func Key(userID, generationID string) string {
+	return userID + ":" + generationID
+}
+
+// EventID is the SSE id of event seq of a generation.
+func EventID(generationID string, seq int64) string {
+	return generationID + ":" + strconv.FormatInt(seq, 10)
+}
+
+// ParseEventID splits a Last-Event-ID value produced by EventID.
+func ParseEventID(id string) (generationID string, seq int64, err error) {
+	i := strings.LastIndexByte(id, ':')
+	if i <= 0 {
+		return "", 0, fmt.Errorf("malformed event id %q", id)
+	}
+	seq, err = strconv.ParseInt(id[i+1:], 10, 64)
+	if err != nil || seq < 0 {
+		return "", 0, fmt.Errorf("malformed event id %q", id)
+	}
+	return id[:i], seq, nil
+}
+
+type memoryStream struct {
+	events  []Event
+	done    bool
+	updated time.Time
+	// changed is closed and replaced whenever the stream changes.
+	changed chan struct{}
+}
+
+// MemoryStore keeps streams in process memory, so a client can only resume
+// on the instance that served it. Streams are dropped Retention after their
+// last change.
+type MemoryStore struct {
+	retention time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*memoryStream
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewMemoryStore(retention time.Duration) *MemoryStore {
+	if retention <= 0 {
+		retention = defaultRetention
+	}
+	s := &MemoryStore{
+		retention: retention,
+		streams:   make(map[string]*memoryStream),
+		stop:      make(chan struct{}),
+	}
+	go s.cleanup()
+	return s
+}
+
+func (s *MemoryStore) Append(_ context.Context, key string, ev Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.streams[key]
+	if !ok {
+		st = &memoryStream{changed: make(chan struct{})}
+		s.streams[key] = st
+	}
+	ev.Data = append([]byte(nil), ev.Data...)
+	st.events = append(st.events, ev)
+	s.touch(st)
+	return nil
+}
+
+func (s *MemoryStore) Finish(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.streams[key]
+	if !ok {
+		return ErrNotFound
+	}
+	st.done = true
+	s.touch(st)
+	return nil
+}
+
+func (s *MemoryStore) Read(ctx context.Context, key string, after int64, wait time.Duration) ([]Event, bool, error) {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		s.mu.Lock()
+		st, ok := s.streams[key]
+		if !ok {
+			s.mu.Unlock()
+			return nil, false, ErrNotFound
+		}
+		var events []Event
+		for _, ev := range st.events {
+			if ev.Seq > after {
+				events = append(events, ev)
+			}
+		}
+		done, changed := st.done, st.changed
+		s.mu.Unlock()
+
+		if len(events) > 0 || done || timeout == nil {
+			return events, done, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil, false, nil
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// Close stops the cleanup goroutine.
+func (s *MemoryStore) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// touch wakes readers; s.mu must be held.
+func (s *MemoryStore) touch(st *memoryStream) {
+	st.updated = time.Now()
+	close(st.changed)
+	st.changed = make(chan struct{})
+}
+
+func (s *MemoryStore) cleanup() {
+	ticker := time.NewTicker(s.retention / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-s.retention)
+			s.mu.Lock()
+			for key, st := range s.streams {
+				if st.updated.Before(cutoff) {
+					delete(s.streams, key)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
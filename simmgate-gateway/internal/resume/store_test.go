@@ -0,0 +1,68 @@
+package resume
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreReadFollowsStream(t *testing.T) {
+	s := NewMemoryStore(time.Minute)
+	defer s.Close()
+	ctx := context.Background()
+
+	if _, _, err := s.Read(ctx, "u:gen", 0, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	for seq := int64(1); seq <= 2; seq++ {
+		if err := s.Append(ctx, "u:gen", Event{Seq: seq, Data: []byte{byte('0' + seq)}}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	events, done, err := s.Read(ctx, "u:gen", 1, 0)
+	if err != nil || done || len(events) != 1 || string(events[0].Data) != "2" {
+		t.Fatalf("unexpected read: %v %v %v", events, done, err)
+	}
+
+	// A waiting reader wakes up for new events and for Finish.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = s.Append(ctx, "u:gen", Event{Seq: 3, Data: []byte("3")})
+		_ = s.Finish(ctx, "u:gen")
+	}()
+	events, _, err = s.Read(ctx, "u:gen", 2, time.Second)
+	if err != nil || len(events) != 1 || events[0].Seq != 3 {
+		t.Fatalf("expected seq 3, got %v %v", events, err)
+	}
+	events, done, err = s.Read(ctx, "u:gen", 3, time.Second)
+	if err != nil || !done || len(events) != 0 {
+		t.Fatalf("expected finished stream, got %v %v %v", events, done, err)
+	}
+}
+
+func TestMemoryStoreReadTimesOut(t *testing.T) {
+	s := NewMemoryStore(time.Minute)
+	defer s.Close()
+	ctx := context.Background()
+
+	_ = s.Append(ctx, "u:gen", Event{Seq: 1, Data: []byte("1")})
+	events, done, err := s.Read(ctx, "u:gen", 1, 10*time.Millisecond)
+	if err != nil || done || len(events) != 0 {
+		t.Fatalf("expected an empty read after the wait, got %v %v %v", events, done, err)
+	}
+}
+
+func TestParseEventID(t *testing.T) {
+	gen, seq, err := ParseEventID(EventID("gen_abc", 42))
+	if err != nil || gen != "gen_abc" || seq != 42 {
+		t.Fatalf("round trip failed: %q %d %v", gen, seq, err)
+	}
+	for _, bad := range []string{"", "gen_abc", ":3", "gen_abc:x", "gen_abc:-1"} {
+		if _, _, err := ParseEventID(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
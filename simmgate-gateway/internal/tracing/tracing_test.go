@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a provider that records ended spans in memory.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	return sr
+}
+
+func TestMiddlewareContinuesTraceAndNamesRoute(t *testing.T) {
+	sr := recordSpans(t)
+
+	var inner trace.SpanContext
+	r := chi.NewRouter()
+	r.Use(Middleware)
+	r.Get("/v1/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		inner = trace.SpanContextFromContext(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/v1/items/42", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("spans = %d, want 1", len(spans))
+	}
+	span := spans[0]
+	if got := span.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("trace id = %s, want %s", got, traceID)
+	}
+	if got := span.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("parent span id = %s", got)
+	}
+	if span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("kind = %v, want server", span.SpanKind())
+	}
+	if got, want := span.Name(), "GET /v1/items/{id}"; got != want {
+		t.Errorf("name = %q, want %q", got, want)
+	}
+	if inner.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("handler context does not carry the server span")
+	}
+
+	attrs := map[string]interface{}{}
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	if attrs[string(semconv.HTTPRouteKey)] != "/v1/items/{id}" {
+		t.Errorf("http.route = %v", attrs[string(semconv.HTTPRouteKey)])
+	}
+	if attrs[string(semconv.HTTPResponseStatusCodeKey)] != int64(http.StatusTeapot) {
+		t.Errorf("status code = %v", attrs[string(semconv.HTTPResponseStatusCodeKey)])
+	}
+}
+
+func TestInjectWritesTraceparent(t *testing.T) {
+	recordSpans(t)
+
+	ctx, span := Tracer().Start(context.Background(), "outer")
+	defer span.End()
+
+	h := http.Header{}
+	Inject(ctx, h)
+	want := "00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"
+	if got := h.Get("traceparent"); got != want {
+		t.Errorf("traceparent = %q, want %q", got, want)
+	}
+}
+
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+
+	if _, err := Setup(context.Background(), Config{Exporter: "zipkin"}); err == nil {
+		t.Fatal("expected an error for an unknown exporter")
+	}
+}
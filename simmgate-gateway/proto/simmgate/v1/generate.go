@@ -0,0 +1,4 @@
+// Package simmgatev1 holds the generated code of the gateway's gRPC API.
+package simmgatev1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chat.proto